@@ -9,36 +9,71 @@ import (
 
 // Auth & OAuth helpers moved to api_auth.go
 
-func (a *api) routes(mux *http.ServeMux) {
+// router is the part of *http.ServeMux that routes needs; tests record the patterns with it.
+type router interface {
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
+func (a *api) routes(mux router) {
 	// Auth endpoints
-	mux.HandleFunc("POST /api/auth/register", a.withRateLimit("auth", 20, time.Minute, a.handleRegister))
-	mux.HandleFunc("POST /api/auth/login", a.withRateLimit("auth", 30, time.Minute, a.handleLogin))
-	mux.HandleFunc("POST /api/auth/logout", a.handleLogout)
+	mux.HandleFunc("POST /api/auth/register", a.withOriginCheck(a.withRateLimit("auth", 20, time.Minute, a.handleRegister)))
+	mux.HandleFunc("POST /api/auth/login", a.withOriginCheck(a.withRateLimit("auth", 30, time.Minute, a.handleLogin)))
+	mux.HandleFunc("POST /api/auth/logout", a.withOriginCheck(a.handleLogout))
 	mux.HandleFunc("GET /api/auth/me", a.handleMe)
 	mux.HandleFunc("GET /api/auth/providers", a.handleAuthProviders)
 	mux.HandleFunc("GET /api/auth/oauth/github/start", a.handleGithubStart)
 	mux.HandleFunc("GET /api/auth/oauth/github/callback", a.handleGithubCallback)
 	mux.HandleFunc("GET /api/auth/oauth/google/start", a.handleGoogleStart)
 	mux.HandleFunc("GET /api/auth/oauth/google/callback", a.handleGoogleCallback)
+	mux.HandleFunc("GET /api/auth/oidc/{provider}/start", a.handleOIDCStart)
+	mux.HandleFunc("GET /api/auth/oidc/{provider}/callback", a.handleOIDCCallback)
 
 	// Profile / self-update
 	mux.HandleFunc("PATCH /api/me", a.requireAuth(a.handleUpdateMe))
+	mux.HandleFunc("GET /api/me/identities", a.requireAuth(a.handleMyIdentities))
+	mux.HandleFunc("GET /api/me/identities/{provider}/link", a.requireAuth(a.handleLinkIdentityStart))
+	mux.HandleFunc("DELETE /api/me/identities/{provider}", a.requireAuth(a.handleUnlinkIdentity))
+	mux.HandleFunc("GET /api/me/security-events", a.requireAuth(a.handleMySecurityEvents))
+	mux.HandleFunc("PUT /api/me/org", a.requireAuth(a.handleSetActiveOrg))
+	mux.HandleFunc("GET /api/me/events", a.requireAuth(a.handleMyEvents))
+
+	// Organizations (tenants) and their members
+	mux.HandleFunc("GET /api/orgs", a.requireAuth(a.handleListOrgs))
+	mux.HandleFunc("POST /api/orgs", a.requireAuth(a.handleCreateOrg))
+	mux.HandleFunc("GET /api/orgs/{id}", a.requireAuth(a.handleGetOrg))
+	mux.HandleFunc("PATCH /api/orgs/{id}", a.requireAuth(a.handleUpdateOrg))
+	mux.HandleFunc("DELETE /api/orgs/{id}", a.requireAuth(a.changesAccess(a.handleDeleteOrg)))
+	mux.HandleFunc("GET /api/orgs/{id}/members", a.requireAuth(a.handleOrgMembers))
+	mux.HandleFunc("POST /api/orgs/{id}/members", a.requireAuth(a.changesAccess(a.handleAddOrgMember)))
+	mux.HandleFunc("PATCH /api/orgs/{id}/members/{uid}", a.requireAuth(a.changesAccess(a.handleUpdateOrgMember)))
+	mux.HandleFunc("DELETE /api/orgs/{id}/members/{uid}", a.requireAuth(a.changesAccess(a.handleRemoveOrgMember)))
 
 	// Dev password reset (magic link in logs)
-	mux.HandleFunc("POST /api/auth/reset", a.withRateLimit("auth_reset", 10, time.Minute, a.handleResetRequest))
-	mux.HandleFunc("POST /api/auth/reset/confirm", a.withRateLimit("auth_reset", 20, time.Minute, a.handleResetConfirm))
-	mux.HandleFunc("POST /api/auth/verify/confirm", a.withRateLimit("auth_verify", 20, time.Minute, a.handleVerifyConfirm))
+	mux.HandleFunc("POST /api/auth/reset", a.withOriginCheck(a.withRateLimit("auth_reset", 10, time.Minute, a.handleResetRequest)))
+	mux.HandleFunc("POST /api/auth/reset/confirm", a.withOriginCheck(a.withRateLimit("auth_reset", 20, time.Minute, a.handleResetConfirm)))
+	mux.HandleFunc("POST /api/auth/verify/confirm", a.withOriginCheck(a.withRateLimit("auth_verify", 20, time.Minute, a.handleVerifyConfirm)))
 
 	mux.HandleFunc("GET /api/health", a.handleHealth)
+	mux.HandleFunc("POST /api/csp-report", a.withRateLimit("csp", 120, time.Minute, a.handleCSPReport))
 	mux.HandleFunc("GET /api/boards", a.handleListBoards)
-	mux.HandleFunc("POST /api/boards", a.requireAuth(a.handleCreateBoard))
+	mux.HandleFunc("POST /api/boards", a.requireAuth(a.changesAccess(a.handleCreateBoard)))
 	mux.HandleFunc("GET /api/boards/{id}", a.requireAuth(a.handleGetBoard))
+	mux.HandleFunc("GET /api/boards/{id}/presence", a.requireAuth(a.handleBoardPresence))
+	mux.HandleFunc("GET /api/boards/{id}/ws", a.requireAuth(a.handleBoardWS))
 	mux.HandleFunc("GET /api/boards/{id}/full", a.requireAuth(a.handleGetBoardFull))
 	mux.HandleFunc("GET /api/boards/{id}/events", a.requireAuth(a.handleBoardEvents))
+	mux.HandleFunc("GET /api/boards/{id}/changes", a.requireAuth(a.handleBoardChanges))
+	mux.HandleFunc("POST /api/boards/{id}/changes", a.requireAuth(a.handleSyncPush))
 	mux.HandleFunc("GET /api/boards/{id}/members", a.requireAuth(a.handleBoardMembers))
+	mux.HandleFunc("GET /api/boards/{id}/access", a.requireAuth(a.handleBoardAccess))
+	mux.HandleFunc("POST /api/boards/{id}/members", a.requireAuth(a.changesAccess(a.handleAddBoardMember)))
+	mux.HandleFunc("PATCH /api/boards/{id}/members/{uid}", a.requireAuth(a.changesAccess(a.handleUpdateBoardMember)))
+	mux.HandleFunc("DELETE /api/boards/{id}/members/{uid}", a.requireAuth(a.changesAccess(a.handleRemoveBoardMember)))
+	mux.HandleFunc("POST /api/boards/{id}/transfer", a.requireAuth(a.changesAccess(a.handleTransferBoard)))
+	mux.HandleFunc("PUT /api/boards/{id}/project", a.requireAuth(a.changesAccess(a.handleSetBoardProject)))
 	mux.HandleFunc("PATCH /api/boards/{id}", a.requireAuth(a.handleUpdateBoard))
 	mux.HandleFunc("POST /api/boards/{id}/move", a.requireAuth(a.handleMoveBoard))
-	mux.HandleFunc("DELETE /api/boards/{id}", a.requireAuth(a.handleDeleteBoard))
+	mux.HandleFunc("DELETE /api/boards/{id}", a.requireAuth(a.changesAccess(a.handleDeleteBoard)))
 
 	mux.HandleFunc("GET /api/boards/{id}/lists", a.requireAuth(a.handleListsByBoard))
 	mux.HandleFunc("POST /api/boards/{id}/lists", a.requireAuth(a.handleCreateList))
@@ -51,6 +86,10 @@ func (a *api) routes(mux *http.ServeMux) {
 	mux.HandleFunc("PATCH /api/cards/{id}", a.requireAuth(a.handleUpdateCard))
 	mux.HandleFunc("DELETE /api/cards/{id}", a.requireAuth(a.handleDeleteCard))
 	mux.HandleFunc("POST /api/cards/{id}/move", a.requireAuth(a.handleMoveCard))
+	mux.HandleFunc("PUT /api/cards/{id}/editing", a.requireAuth(a.handleCardEditing))
+	mux.HandleFunc("DELETE /api/cards/{id}/editing", a.requireAuth(a.handleCardEditing))
+	mux.HandleFunc("GET /api/cards/{id}/doc", a.requireAuth(a.handleCardDoc))
+	mux.HandleFunc("POST /api/cards/{id}/doc", a.requireAuth(a.handleCardDocOp))
 
 	mux.HandleFunc("GET /api/cards/{id}/comments", a.requireAuth(a.handleCommentsByCard))
 	mux.HandleFunc("POST /api/cards/{id}/comments", a.requireAuth(a.handleAddComment))
@@ -63,39 +102,74 @@ func (a *api) routes(mux *http.ServeMux) {
 	mux.HandleFunc("GET /share/{token}", a.handlePublicSharePage)
 	mux.HandleFunc("GET /api/public/share/{token}", a.handlePublicShareData)
 
+	// Invitations (links and email invites to boards, projects, groups)
+	mux.HandleFunc("POST /api/invites", a.requireAuth(a.withRateLimit("invites", 60, time.Hour, a.handleCreateInvite)))
+	mux.HandleFunc("GET /api/invites", a.requireAuth(a.handleListInvites))
+	mux.HandleFunc("DELETE /api/invites/{id}", a.requireAuth(a.handleRevokeInvite))
+	mux.HandleFunc("GET /api/join/{token}", a.withRateLimit("join", 60, time.Minute, a.handleInvitePreview))
+	mux.HandleFunc("POST /api/join/{token}", a.requireAuth(a.changesAccess(a.withRateLimit("join", 60, time.Minute, a.handleAcceptInvite))))
+
 	// Groups and board visibility
 	mux.HandleFunc("POST /api/groups", a.requireAuth(a.handleCreateGroupSelf))
 	mux.HandleFunc("GET /api/my/groups", a.requireAuth(a.handleMyGroups))
 	// Self-managed groups (creators/admins)
 	mux.HandleFunc("GET /api/groups/{id}/users", a.requireAuth(a.handleSelfGroupUsers))
 	mux.HandleFunc("GET /api/groups/{id}/users/search", a.requireAuth(a.handleSelfSearchUsers))
-	mux.HandleFunc("POST /api/groups/{id}/users", a.requireAuth(a.handleSelfAddUserToGroup))
-	mux.HandleFunc("DELETE /api/groups/{id}/users/{uid}", a.requireAuth(a.handleSelfRemoveUserFromGroup))
+	mux.HandleFunc("POST /api/groups/{id}/users", a.requireAuth(a.changesAccess(a.handleSelfAddUserToGroup)))
+	mux.HandleFunc("DELETE /api/groups/{id}/users/{uid}", a.requireAuth(a.changesAccess(a.handleSelfRemoveUserFromGroup)))
 	// Self leave from a group (any member can leave)
-	mux.HandleFunc("POST /api/groups/{id}/leave", a.requireAuth(a.handleSelfLeaveGroup))
-	mux.HandleFunc("DELETE /api/groups/{id}", a.requireAuth(a.handleSelfDeleteGroup))
+	mux.HandleFunc("POST /api/groups/{id}/leave", a.requireAuth(a.changesAccess(a.handleSelfLeaveGroup)))
+	mux.HandleFunc("DELETE /api/groups/{id}", a.requireAuth(a.changesAccess(a.handleSelfDeleteGroup)))
 	mux.HandleFunc("GET /api/boards/{id}/groups", a.requireAuth(a.handleBoardGroups))
-	mux.HandleFunc("POST /api/boards/{id}/groups", a.requireAuth(a.handleBoardGroupAdd))
-	mux.HandleFunc("DELETE /api/boards/{id}/groups/{gid}", a.requireAuth(a.handleBoardGroupRemove))
+	mux.HandleFunc("POST /api/boards/{id}/groups", a.requireAuth(a.changesAccess(a.handleBoardGroupAdd)))
+	mux.HandleFunc("DELETE /api/boards/{id}/groups/{gid}", a.requireAuth(a.changesAccess(a.handleBoardGroupRemove)))
 
 	// Admin: groups CRUD and membership
 	mux.HandleFunc("GET /api/admin/groups", a.requireAdmin(a.handleAdminListGroups))
 	mux.HandleFunc("POST /api/admin/groups", a.requireAdmin(a.handleAdminCreateGroup))
-	mux.HandleFunc("DELETE /api/admin/groups/{id}", a.requireAdmin(a.handleAdminDeleteGroup))
+	mux.HandleFunc("DELETE /api/admin/groups/{id}", a.requireAdmin(a.changesAccess(a.handleAdminDeleteGroup)))
 	mux.HandleFunc("GET /api/admin/groups/{id}/users", a.requireAdmin(a.handleAdminGroupUsers))
-	mux.HandleFunc("POST /api/admin/groups/{id}/users", a.requireAdmin(a.handleAdminAddUserToGroup))
-	mux.HandleFunc("DELETE /api/admin/groups/{id}/users/{uid}", a.requireAdmin(a.handleAdminRemoveUserFromGroup))
+	mux.HandleFunc("POST /api/admin/groups/{id}/users", a.requireAdmin(a.changesAccess(a.handleAdminAddUserToGroup)))
+	mux.HandleFunc("DELETE /api/admin/groups/{id}/users/{uid}", a.requireAdmin(a.changesAccess(a.handleAdminRemoveUserFromGroup)))
 	mux.HandleFunc("GET /api/admin/users", a.requireAdmin(a.handleAdminListUsers))
-	mux.HandleFunc("PATCH /api/admin/users/{id}", a.requireAdmin(a.handleAdminUpdateUser))
-	mux.HandleFunc("DELETE /api/admin/users/{id}", a.requireAdmin(a.handleAdminDeleteUser))
+	mux.HandleFunc("PATCH /api/admin/users/{id}", a.requireAdmin(a.changesAccess(a.handleAdminUpdateUser)))
+	mux.HandleFunc("DELETE /api/admin/users/{id}", a.requireAdmin(a.changesAccess(a.handleAdminDeleteUser)))
 	mux.HandleFunc("GET /api/admin/system", a.requireAdmin(a.handleAdminSystemStatus))
+	mux.HandleFunc("POST /api/admin/projects/migrate-default", a.requireAdmin(a.changesAccess(a.handleAdminMigrateDefaultProjects)))
+	mux.HandleFunc("GET /api/admin/security-events", a.requireAdmin(a.handleAdminSecurityEvents))
+
+	// SCIM 2.0 provisioning (bearer token, see SCIM_TOKEN)
+	mux.HandleFunc("GET /scim/v2/ServiceProviderConfig", a.requireSCIM(a.handleSCIMServiceProviderConfig))
+	mux.HandleFunc("GET /scim/v2/ResourceTypes", a.requireSCIM(a.handleSCIMResourceTypes))
+	mux.HandleFunc("GET /scim/v2/Users", a.requireSCIM(a.handleSCIMListUsers))
+	mux.HandleFunc("POST /scim/v2/Users", a.requireSCIM(a.handleSCIMCreateUser))
+	mux.HandleFunc("GET /scim/v2/Users/{id}", a.requireSCIM(a.handleSCIMGetUser))
+	mux.HandleFunc("PUT /scim/v2/Users/{id}", a.requireSCIM(a.changesAccess(a.handleSCIMReplaceUser)))
+	mux.HandleFunc("PATCH /scim/v2/Users/{id}", a.requireSCIM(a.changesAccess(a.handleSCIMPatchUser)))
+	mux.HandleFunc("DELETE /scim/v2/Users/{id}", a.requireSCIM(a.changesAccess(a.handleSCIMDeleteUser)))
+	mux.HandleFunc("GET /scim/v2/Groups", a.requireSCIM(a.handleSCIMListGroups))
+	mux.HandleFunc("POST /scim/v2/Groups", a.requireSCIM(a.changesAccess(a.handleSCIMCreateGroup)))
+	mux.HandleFunc("GET /scim/v2/Groups/{id}", a.requireSCIM(a.handleSCIMGetGroup))
+	mux.HandleFunc("PUT /scim/v2/Groups/{id}", a.requireSCIM(a.changesAccess(a.handleSCIMReplaceGroup)))
+	mux.HandleFunc("PATCH /scim/v2/Groups/{id}", a.requireSCIM(a.changesAccess(a.handleSCIMPatchGroup)))
+	mux.HandleFunc("DELETE /scim/v2/Groups/{id}", a.requireSCIM(a.changesAccess(a.handleSCIMDeleteGroup)))
 
 	// Projects
 	mux.HandleFunc("GET /api/projects", a.requireAuth(a.handleListProjects))
 	mux.HandleFunc("POST /api/projects", a.requireAuth(a.handleCreateProject))
+	mux.HandleFunc("GET /api/projects/{id}", a.requireAuth(a.handleGetProject))
+	mux.HandleFunc("PATCH /api/projects/{id}", a.requireAuth(a.handleUpdateProject))
+	mux.HandleFunc("DELETE /api/projects/{id}", a.requireAuth(a.changesAccess(a.handleDeleteProject)))
+	mux.HandleFunc("POST /api/projects/{id}/transfer", a.requireAuth(a.changesAccess(a.handleTransferProject)))
+	mux.HandleFunc("GET /api/projects/{id}/boards", a.requireAuth(a.handleProjectBoards))
 	mux.HandleFunc("GET /api/projects/{id}/members", a.requireAuth(a.handleProjectMembers))
-	mux.HandleFunc("POST /api/projects/{id}/members", a.requireAuth(a.handleAddProjectMember))
-	mux.HandleFunc("DELETE /api/projects/{id}/members/{uid}", a.requireAuth(a.handleRemoveProjectMember))
+	mux.HandleFunc("POST /api/projects/{id}/members", a.requireAuth(a.changesAccess(a.handleAddProjectMember)))
+	mux.HandleFunc("PATCH /api/projects/{id}/members/{uid}", a.requireAuth(a.changesAccess(a.handleUpdateProjectMember)))
+	mux.HandleFunc("DELETE /api/projects/{id}/members/{uid}", a.requireAuth(a.changesAccess(a.handleRemoveProjectMember)))
+	mux.HandleFunc("GET /api/projects/{id}/groups", a.requireAuth(a.handleProjectGroups))
+	mux.HandleFunc("POST /api/projects/{id}/groups", a.requireAuth(a.changesAccess(a.handleSetProjectGroup)))
+	mux.HandleFunc("DELETE /api/projects/{id}/groups/{gid}", a.requireAuth(a.changesAccess(a.handleRemoveProjectGroup)))
+	mux.HandleFunc("GET /api/projects/{id}/access", a.requireAuth(a.handleProjectAccess))
 }
 
 // Handlers implementation moved into separate files under server/:
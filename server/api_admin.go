@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func (a *api) handleAdminListGroups(w http.ResponseWriter, r *http.Request) {
@@ -24,7 +25,7 @@ func (a *api) handleAdminCreateGroup(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	g, err := a.store.CreateGroup(r.Context(), strings.TrimSpace(req.Name))
+	g, err := a.store.CreateGroup(r.Context(), a.store.DefaultOrgID(), strings.TrimSpace(req.Name))
 	if err != nil {
 		a.log.Error("admin create group", "err", err)
 		writeError(w, 400, "cannot create group")
@@ -39,6 +40,12 @@ func (a *api) handleAdminDeleteGroup(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	members, err := a.store.GroupUsers(r.Context(), id)
+	if err != nil {
+		a.log.Error("admin delete group", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
 	if err := a.store.DeleteGroup(r.Context(), id); err != nil {
 		if err == ErrNotFound {
 			writeError(w, 404, "not found")
@@ -49,6 +56,9 @@ func (a *api) handleAdminDeleteGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	for _, m := range members {
+		a.notifyUser(m.ID, "group.deleted", "group", map[string]any{"group_id": id})
+	}
 }
 
 func (a *api) handleAdminGroupUsers(w http.ResponseWriter, r *http.Request) {
@@ -85,6 +95,7 @@ func (a *api) handleAdminAddUserToGroup(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.notifyUser(req.UserID, "group.member_added", "group", map[string]any{"group_id": id})
 }
 
 func (a *api) handleAdminRemoveUserFromGroup(w http.ResponseWriter, r *http.Request) {
@@ -104,6 +115,7 @@ func (a *api) handleAdminRemoveUserFromGroup(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.notifyUser(uid, "group.member_removed", "group", map[string]any{"group_id": id})
 }
 
 func (a *api) handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
@@ -114,7 +126,7 @@ func (a *api) handleAdminListUsers(w http.ResponseWriter, r *http.Request) {
 			limit = n
 		}
 	}
-	items, err := a.store.ListUsers(r.Context(), q, limit)
+	items, err := a.store.ListUsers(r.Context(), q, 0, limit)
 	if err != nil {
 		a.log.Error("admin list users", "err", err)
 		writeError(w, 500, "internal error")
@@ -137,6 +149,9 @@ func (a *api) handleAdminUpdateUser(w http.ResponseWriter, r *http.Request) {
 		IsAdmin       *bool   `json:"is_admin"`
 		EmailVerified *bool   `json:"email_verified"`
 		Password      *string `json:"password"`
+		// guest flag and expiry are set together; an empty expiry means no expiry
+		IsGuest        *bool      `json:"is_guest"`
+		GuestExpiresAt *time.Time `json:"guest_expires_at"`
 	}
 	if err := readJSON(w, r, &req); err != nil {
 		writeError(w, 400, "invalid payload")
@@ -163,11 +178,38 @@ func (a *api) handleAdminUpdateUser(w http.ResponseWriter, r *http.Request) {
 		}
 		req.Password = &v
 	}
+	before, err := a.store.UserByID(r.Context(), id)
+	if err != nil {
+		if err == ErrNotFound {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("admin update user", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
 	if err := a.store.AdminUpdateUser(r.Context(), id, req.Name, req.Email, req.IsAdmin, req.EmailVerified, req.Password, nil); err != nil {
 		a.log.Error("admin update user", "err", err)
 		writeError(w, 400, "cannot update user")
 		return
 	}
+	if req.IsGuest != nil {
+		if err := a.store.SetUserGuest(r.Context(), id, *req.IsGuest, req.GuestExpiresAt); err != nil {
+			a.log.Error("admin update user", "err", err)
+			writeError(w, 500, "internal error")
+			return
+		}
+	}
+	var by int64
+	if me, err := a.currentUser(r); err == nil {
+		by = me.ID
+	}
+	if req.IsAdmin != nil && *req.IsAdmin != before.IsAdmin {
+		a.securityEvent(r, id, secAdminRoleChange, map[string]any{"is_admin": *req.IsAdmin, "by": by})
+	}
+	if req.Password != nil && *req.Password != "" {
+		a.securityEvent(r, id, secPasswordChange, map[string]any{"via": "admin", "by": by})
+	}
 	writeJSON(w, 200, map[string]any{"ok": true})
 }
 
@@ -175,14 +217,27 @@ func (a *api) handleAdminUpdateUser(w http.ResponseWriter, r *http.Request) {
 // Returns basic system capabilities/config flags for admin Settings UI
 func (a *api) handleAdminSystemStatus(w http.ResponseWriter, r *http.Request) {
 	smtpConfigured := getenv("SMTP_HOST", "") != "" && getenv("SMTP_PORT", "") != "" && getenv("SMTP_FROM", "") != ""
+	oidc := []map[string]string{}
+	for _, p := range a.oidc {
+		oidc = append(oidc, map[string]string{"id": p.ID, "name": p.Name, "issuer": p.Issuer})
+	}
 	writeJSON(w, 200, map[string]any{
 		"oauth": map[string]bool{
 			"github": a.githubEnabled(),
 			"google": a.googleEnabled(),
 		},
+		"oidc": oidc,
+		"ldap": map[string]bool{
+			"configured": a.ldap != nil,
+		},
+		"scim": map[string]bool{
+			"configured": getenv("SCIM_TOKEN", "") != "",
+		},
 		"smtp": map[string]bool{
 			"configured": smtpConfigured,
 		},
+		"projects_required": projectsRequired(),
+		"events":            a.bus.Stats(),
 	})
 }
 
@@ -210,3 +265,16 @@ func (a *api) handleAdminDeleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
 }
+
+// POST /api/admin/projects/migrate-default
+// Runs the Default Project migration on demand (it also runs at startup with PROJECTS_REQUIRED=true).
+func (a *api) handleAdminMigrateDefaultProjects(w http.ResponseWriter, r *http.Request) {
+	projects, boards, orphans, err := a.store.MigrateDefaultProjects(r.Context())
+	if err != nil {
+		a.log.Error("migrate default projects", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	a.log.Info("default projects", "created", projects, "boards_moved", boards, "boards_without_owner", orphans)
+	writeJSON(w, 200, map[string]any{"projects_created": projects, "boards_moved": boards, "boards_without_owner": orphans})
+}
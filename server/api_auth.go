@@ -47,9 +47,45 @@ func (a *api) readStateCookie(r *http.Request) (string, error) {
 	return c.Value, nil
 }
 
+// clearStateCookie removes the used state cookie to prevent stale state causing loops
+func (a *api) clearStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "oauth_state",
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   a.secureCookie(),
+		SameSite: a.sameSite(),
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+	})
+}
+
+// oauthRedirectURI builds the callback URL for a provider. A configured URL is used
+// as-is unless its host differs from the request host: the request host wins to
+// avoid cookie domain mismatch loops.
+func (a *api) oauthRedirectURI(r *http.Request, configured, callbackPath string) string {
+	scheme := "http"
+	if r.Header.Get("X-Forwarded-Proto") == "https" || r.TLS != nil {
+		scheme = "https"
+	}
+	fallback := scheme + "://" + r.Host + callbackPath
+	if configured == "" {
+		return fallback
+	}
+	if u, err := url.Parse(configured); err == nil && !strings.EqualFold(u.Host, r.Host) {
+		a.log.Info("oauth redirect host adjusted to request host", "from", u.Host, "to", r.Host)
+		return fallback
+	}
+	return configured
+}
+
 // Auth handlers
 func (a *api) handleRegister(w http.ResponseWriter, r *http.Request) {
-	var req struct{ Email, Password, Name string }
+	var req struct {
+		Email, Password, Name string
+		Invite                string `json:"invite"` // invitation link token the user came from
+	}
 	if err := readJSON(w, r, &req); err != nil || strings.TrimSpace(req.Email) == "" || strings.TrimSpace(req.Password) == "" {
 		writeError(w, 400, "invalid payload")
 		return
@@ -65,12 +101,33 @@ func (a *api) handleRegister(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 500, "internal error")
 		return
 	}
+	guest, guestUntil, err := a.guestInvites(r.Context(), strings.TrimSpace(req.Email), strings.TrimSpace(req.Invite))
+	if err != nil {
+		a.log.Error("register", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
 	u, err := a.store.CreateUser(r.Context(), req.Email, string(hashBytes), strings.TrimSpace(req.Name))
 	if err != nil {
 		a.log.Error("register", "err", err)
 		writeError(w, 400, "cannot create user")
 		return
 	}
+	// accounts created through a guest invitation are guests
+	if guest {
+		if err := a.store.SetUserGuest(r.Context(), u.ID, true, guestUntil); err != nil {
+			a.log.Error("register", "err", err)
+			writeError(w, 500, "internal error")
+			return
+		}
+		u.IsGuest, u.GuestExpiresAt = true, guestUntil
+		if guestUntil != nil {
+			// lets every instance schedule the re-check of open streams at the expiry
+			a.bus.AccessChanged()
+		}
+	}
+	// Pending email invitations wait for the first sign-in (loginSucceeded): only then is
+	// the address verified.
 	// Email verification: generate token and log magic-link (dev)
 	b := make([]byte, 24)
 	_, _ = rand.Read(b)
@@ -91,15 +148,23 @@ func (a *api) handleLogin(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	u, err := a.store.Authenticate(r.Context(), req.Email, req.Password)
+	login := strings.TrimSpace(req.Email)
+	if !a.checkLoginThrottle(w, r, login) {
+		return
+	}
+	u, err := a.authenticate(r.Context(), login, req.Password)
 	if err != nil {
 		if strings.Contains(strings.ToLower(err.Error()), "email_not_verified") {
 			writeError(w, 403, "email not verified")
 			return
 		}
+		a.loginFailed(r, login)
 		writeError(w, 401, "invalid credentials")
 		return
 	}
+	if err := a.store.ClearLoginFailures(r.Context(), login); err != nil {
+		a.log.Error("clear login failures", "err", err)
+	}
 	token, exp, err := a.store.CreateSession(r.Context(), u.ID, a.sessionTTL())
 	if err != nil {
 		a.log.Error("create session", "err", err)
@@ -107,6 +172,7 @@ func (a *api) handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	a.setSessionCookie(w, token, exp)
+	a.loginSucceeded(r, u, "password")
 	// Ensure sample content for first-time users
 	go a.ensureSampleContent(context.Background(), u.ID, r)
 	writeJSON(w, 200, map[string]any{"ok": true, "user": u})
@@ -114,6 +180,9 @@ func (a *api) handleLogin(w http.ResponseWriter, r *http.Request) {
 
 func (a *api) handleLogout(w http.ResponseWriter, r *http.Request) {
 	if c, err := r.Cookie(a.sessionCookieName()); err == nil && c.Value != "" {
+		if u, err := a.currentUser(r); err == nil {
+			a.securityEvent(r, u.ID, secSessionRevoke, map[string]any{"reason": "logout"})
+		}
 		_ = a.store.DeleteSession(r.Context(), c.Value)
 	}
 	a.clearSessionCookie(w)
@@ -127,7 +196,17 @@ func (a *api) handleMe(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, 200, map[string]any{"user": nil})
 		return
 	}
-	writeJSON(w, 200, map[string]any{"user": u})
+	resp := map[string]any{"user": u, "csrf_token": a.sessionCSRFToken(r), "projects_required": projectsRequired(), "org": nil}
+	// the active organization and the ones the user can switch to
+	if org, err := a.activeOrg(r.Context(), r, u); err == nil {
+		resp["org"] = org
+	} else if !errors.Is(err, errNotOrgMember) {
+		a.log.Error("active org", "err", err)
+	}
+	if orgs, err := a.store.ListOrgs(r.Context(), u.ID, false); err == nil {
+		resp["orgs"] = orgs
+	}
+	writeJSON(w, 200, resp)
 }
 
 // POST /api/auth/verify/confirm {token}
@@ -163,6 +242,9 @@ func (a *api) handleAuthProviders(w http.ResponseWriter, r *http.Request) {
 	if a.googleEnabled() {
 		providers = append(providers, map[string]string{"id": "google", "name": "Google"})
 	}
+	for _, p := range a.oidc {
+		providers = append(providers, map[string]string{"id": p.ID, "name": p.Name, "type": "oidc", "start_url": "/api/auth/oidc/" + p.ID + "/start"})
+	}
 	writeJSON(w, 200, map[string]any{"providers": providers})
 }
 
@@ -172,29 +254,12 @@ func (a *api) handleGithubStart(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 404, "provider not configured")
 		return
 	}
-	// generate state
-	b := make([]byte, 16)
-	_, _ = rand.Read(b)
-	state := base64RawURL(b)
-	a.setStateCookie(w, state)
+	a.redirectToProvider(w, r, "github", randomToken(16))
+}
+
+func (a *api) githubAuthURL(r *http.Request, state string) string {
 	clientID := getenv("OAUTH_GITHUB_CLIENT_ID", "")
-	// Prefer current request's host to avoid cookie domain mismatch loops
-	scheme := "http"
-	if r.Header.Get("X-Forwarded-Proto") == "https" || r.TLS != nil {
-		scheme = "https"
-	}
-	ruEnv := getenv("OAUTH_GITHUB_REDIRECT_URL", "")
-	redirectURI := ruEnv
-	if redirectURI == "" {
-		redirectURI = scheme + "://" + r.Host + "/api/auth/oauth/github/callback"
-	} else {
-		if u2, err := url.Parse(redirectURI); err == nil {
-			if !strings.EqualFold(u2.Host, r.Host) {
-				a.log.Info("oauth redirect host adjusted to request host", "from", u2.Host, "to", r.Host)
-				redirectURI = scheme + "://" + r.Host + "/api/auth/oauth/github/callback"
-			}
-		}
-	}
+	redirectURI := a.oauthRedirectURI(r, getenv("OAUTH_GITHUB_REDIRECT_URL", ""), "/api/auth/oauth/github/callback")
 	u, _ := url.Parse("https://github.com/login/oauth/authorize")
 	q := u.Query()
 	q.Set("client_id", clientID)
@@ -202,7 +267,7 @@ func (a *api) handleGithubStart(w http.ResponseWriter, r *http.Request) {
 	q.Set("scope", "read:user user:email")
 	q.Set("state", state)
 	u.RawQuery = q.Encode()
-	http.Redirect(w, r, u.String(), http.StatusFound)
+	return u.String()
 }
 
 // GET /api/auth/oauth/github/callback
@@ -222,17 +287,7 @@ func (a *api) handleGithubCallback(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "state mismatch")
 		return
 	}
-	// Clear used state cookie to prevent stale state causing loops
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_state",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   a.secureCookie(),
-		SameSite: a.sameSite(),
-		Expires:  time.Unix(0, 0),
-		MaxAge:   -1,
-	})
+	a.clearStateCookie(w)
 	token, err := a.githubExchangeToken(r.Context(), code)
 	if err != nil {
 		a.log.Error("oauth token", "err", err)
@@ -252,23 +307,7 @@ func (a *api) handleGithubCallback(w http.ResponseWriter, r *http.Request) {
 	if name == "" {
 		name = gh.Login
 	}
-	u, err := a.store.EnsureOAuthUser(r.Context(), "github", gh.ID, email, name)
-	if err != nil {
-		a.log.Error("ensure oauth user", "err", err)
-		writeError(w, 500, "internal error")
-		return
-	}
-	tok, exp, err := a.store.CreateSession(r.Context(), u.ID, a.sessionTTL())
-	if err != nil {
-		a.log.Error("create session", "err", err)
-		writeError(w, 500, "internal error")
-		return
-	}
-	a.setSessionCookie(w, tok, exp)
-	// Ensure sample content for first-time users
-	go a.ensureSampleContent(context.Background(), u.ID, r)
-	// Redirect to home after successful OAuth login
-	http.Redirect(w, r, "/", http.StatusFound)
+	a.completeOAuth(w, r, st, "github", gh.ID, email, name)
 }
 
 // --- Google OAuth ---
@@ -278,30 +317,12 @@ func (a *api) handleGoogleStart(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 404, "provider not configured")
 		return
 	}
-	// state
-	b := make([]byte, 16)
-	_, _ = rand.Read(b)
-	state := base64RawURL(b)
-	a.setStateCookie(w, state)
+	a.redirectToProvider(w, r, "google", randomToken(16))
+}
 
+func (a *api) googleAuthURL(r *http.Request, state string) string {
 	clientID := getenv("OAUTH_GOOGLE_CLIENT_ID", "")
-	// Build redirect URI, prefer request host to avoid domain mismatches
-	scheme := "http"
-	if r.Header.Get("X-Forwarded-Proto") == "https" || r.TLS != nil {
-		scheme = "https"
-	}
-	ruEnv := getenv("OAUTH_GOOGLE_REDIRECT_URL", "")
-	redirectURI := ruEnv
-	if redirectURI == "" {
-		redirectURI = scheme + "://" + r.Host + "/api/auth/oauth/google/callback"
-	} else {
-		if u2, err := url.Parse(redirectURI); err == nil {
-			if !strings.EqualFold(u2.Host, r.Host) {
-				a.log.Info("oauth redirect host adjusted to request host", "from", u2.Host, "to", r.Host)
-				redirectURI = scheme + "://" + r.Host + "/api/auth/oauth/google/callback"
-			}
-		}
-	}
+	redirectURI := a.googleRedirectURI(r)
 	u, _ := url.Parse("https://accounts.google.com/o/oauth2/v2/auth")
 	q := u.Query()
 	q.Set("client_id", clientID)
@@ -311,7 +332,7 @@ func (a *api) handleGoogleStart(w http.ResponseWriter, r *http.Request) {
 	q.Set("state", state)
 	// Optional UX tweaks: force consent only if needed; we skip access_type/offline
 	u.RawQuery = q.Encode()
-	http.Redirect(w, r, u.String(), http.StatusFound)
+	return u.String()
 }
 
 // GET /api/auth/oauth/google/callback
@@ -331,17 +352,7 @@ func (a *api) handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "state mismatch")
 		return
 	}
-	// Clear used state cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "oauth_state",
-		Value:    "",
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   a.secureCookie(),
-		SameSite: a.sameSite(),
-		Expires:  time.Unix(0, 0),
-		MaxAge:   -1,
-	})
+	a.clearStateCookie(w)
 	token, err := a.googleExchangeToken(r.Context(), code, r)
 	if err != nil {
 		a.log.Error("oauth token", "err", err)
@@ -363,29 +374,22 @@ func (a *api) handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
 	if name == "" {
 		name = email
 	}
-	u, err := a.store.EnsureOAuthUser(r.Context(), "google", gu.Sub, email, name)
-	if err != nil {
-		a.log.Error("ensure oauth user", "err", err)
-		writeError(w, 500, "internal error")
-		return
-	}
-	tok, exp, err := a.store.CreateSession(r.Context(), u.ID, a.sessionTTL())
-	if err != nil {
-		a.log.Error("create session", "err", err)
-		writeError(w, 500, "internal error")
-		return
-	}
-	a.setSessionCookie(w, tok, exp)
-	// Ensure sample content for first-time users
-	go a.ensureSampleContent(context.Background(), u.ID, r)
-	http.Redirect(w, r, "/", http.StatusFound)
+	a.completeOAuth(w, r, st, "google", gu.Sub, email, name)
 }
 
 // ensureSampleContent creates a sample board with lists and cards for users with no boards yet.
 // It is safe to call multiple times; it only acts when the user has zero own boards.
 func (a *api) ensureSampleContent(ctx context.Context, userID int64, r *http.Request) {
 	// Quick check: if user already has boards, skip
-	boards, err := a.store.ListBoards(ctx, userID, "mine")
+	u, err := a.store.UserByID(ctx, userID)
+	if err != nil || u.IsGuest {
+		return
+	}
+	org, err := a.activeOrg(ctx, nil, &u)
+	if err != nil {
+		return
+	}
+	boards, err := a.store.ListBoards(ctx, userID, org.ID, "mine")
 	if err != nil || len(boards) > 0 {
 		return
 	}
@@ -424,10 +428,15 @@ func (a *api) ensureSampleContent(ctx context.Context, userID int64, r *http.Req
 		}
 	}
 	// Create the board and content
-	b, err := a.store.CreateBoard(ctx, userID, sm.board)
+	b, err := a.store.CreateBoard(ctx, org.ID, userID, sm.board)
 	if err != nil {
 		return
 	}
+	if projectsRequired() {
+		if p, err := a.store.DefaultProject(ctx, org.ID, userID); err == nil {
+			_ = a.store.SetBoardProject(ctx, b.ID, p.ID)
+		}
+	}
 	for i, lt := range sm.lists {
 		l, err := a.store.CreateList(ctx, b.ID, lt)
 		if err != nil {
@@ -449,17 +458,13 @@ type googleUser struct {
 	Picture       string `json:"picture"`
 }
 
+func (a *api) googleRedirectURI(r *http.Request) string {
+	return a.oauthRedirectURI(r, getenv("OAUTH_GOOGLE_REDIRECT_URL", ""), "/api/auth/oauth/google/callback")
+}
+
 func (a *api) googleExchangeToken(ctx context.Context, code string, r *http.Request) (string, error) {
-	// Build redirect URI same as in start
-	scheme := "http"
-	if r.Header.Get("X-Forwarded-Proto") == "https" || r.TLS != nil {
-		scheme = "https"
-	}
-	ru := getenv("OAUTH_GOOGLE_REDIRECT_URL", "")
-	redirectURI := ru
-	if redirectURI == "" {
-		redirectURI = scheme + "://" + r.Host + "/api/auth/oauth/google/callback"
-	}
+	// Redirect URI must match the one sent in start
+	redirectURI := a.googleRedirectURI(r)
 	data := url.Values{}
 	data.Set("client_id", getenv("OAUTH_GOOGLE_CLIENT_ID", ""))
 	data.Set("client_secret", getenv("OAUTH_GOOGLE_CLIENT_SECRET", ""))
@@ -636,6 +641,11 @@ func (a *api) handleResetConfirm(w http.ResponseWriter, r *http.Request) {
 			writeError(w, 500, "internal error")
 			return
 		}
+		// the owner proved control of the mailbox: lift any lockout
+		_ = a.store.ClearLoginFailures(r.Context(), email)
+		if u, err := a.store.userByEmail(r.Context(), email); err == nil {
+			a.securityEvent(r, u.ID, secPasswordChange, map[string]any{"via": "reset"})
+		}
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
 }
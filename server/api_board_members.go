@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Direct board members (board_members). Maintainers invite, re-role and remove members
+// up to their own role; Owner is never granted this way, only handed over via transfer.
+
+// parseBoardMemberRole validates a role for board_members: Viewer..Maintainer.
+func parseBoardMemberRole(v *int, def Role) (Role, bool) {
+	if v == nil {
+		return def, true
+	}
+	if *v < int(RoleViewer) || *v > int(RoleMaintainer) {
+		return RoleNone, false
+	}
+	return Role(*v), true
+}
+
+func (a *api) publishMembersChanged(boardID, userID int64) {
+	a.bus.Publish(Event{Type: "board.members_changed", Entity: "board", BoardID: boardID, Payload: map[string]any{"id": boardID, "user_id": userID}})
+}
+
+// POST /api/boards/{id}/members {user_id | email, role?}
+func (a *api) handleAddBoardMember(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	me, ok := a.authorize(w, r, ActBoardMembers, boardResource(id))
+	if !ok || denyGuest(w, me) {
+		return
+	}
+	var req struct {
+		UserID int64  `json:"user_id"`
+		Email  string `json:"email"`
+		Role   *int   `json:"role"` // 0 Viewer, 1 Member (default), 2 Maintainer
+	}
+	if err := readJSON(w, r, &req); err != nil || (req.UserID == 0 && strings.TrimSpace(req.Email) == "") {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	role, ok := parseBoardMemberRole(req.Role, RoleMember)
+	if !ok {
+		writeError(w, 400, "invalid role")
+		return
+	}
+	if role > a.effectiveRole(r.Context(), me, boardResource(id)) {
+		writeError(w, 403, "cannot grant a role above your own")
+		return
+	}
+	var target User
+	if req.UserID != 0 {
+		target, err = a.store.UserByID(r.Context(), req.UserID)
+	} else {
+		target, err = a.store.userByEmail(r.Context(), strings.TrimSpace(req.Email))
+	}
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "user not found")
+		return
+	}
+	if err != nil {
+		a.log.Error("add board member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if !a.requireOrgMember(w, r, "board", id, target.ID) {
+		return
+	}
+	if cur, err := a.store.BoardRole(r.Context(), target.ID, id); err == nil && cur == RoleOwner {
+		writeError(w, 409, "user already owns the board")
+		return
+	}
+	if err := a.store.AddBoardMember(r.Context(), id, target.ID, role, me.ID); err != nil {
+		a.log.Error("add board member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true, "user_id": target.ID, "role": role})
+	a.publishMembersChanged(id, target.ID)
+}
+
+// PATCH /api/boards/{id}/members/{uid} {role}
+func (a *api) handleUpdateBoardMember(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	uid, err := parseID(r.PathValue("uid"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	me, ok := a.authorize(w, r, ActBoardMembers, boardResource(id))
+	if !ok {
+		return
+	}
+	var req struct {
+		Role *int `json:"role"`
+	}
+	if err := readJSON(w, r, &req); err != nil || req.Role == nil {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	role, ok := parseBoardMemberRole(req.Role, RoleMember)
+	if !ok {
+		writeError(w, 400, "invalid role")
+		return
+	}
+	myRole := a.effectiveRole(r.Context(), me, boardResource(id))
+	cur, err := a.store.DirectBoardRole(r.Context(), id, uid)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "not a board member")
+		return
+	}
+	if err != nil {
+		a.log.Error("update board member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if role > myRole || cur > myRole {
+		writeError(w, 403, "cannot manage a role above your own")
+		return
+	}
+	if err := a.store.SetBoardMemberRole(r.Context(), id, uid, role); err != nil {
+		a.log.Error("update board member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+	a.publishMembersChanged(id, uid)
+}
+
+// DELETE /api/boards/{id}/members/{uid}
+// Any direct member may remove themselves (leave the board).
+func (a *api) handleRemoveBoardMember(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	uid, err := parseID(r.PathValue("uid"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	if me.ID != uid {
+		if _, ok := a.authorize(w, r, ActBoardMembers, boardResource(id)); !ok {
+			return
+		}
+		cur, err := a.store.DirectBoardRole(r.Context(), id, uid)
+		if err == nil && cur > a.effectiveRole(r.Context(), me, boardResource(id)) {
+			writeError(w, 403, "cannot manage a role above your own")
+			return
+		}
+	}
+	switch err := a.store.RemoveBoardMember(r.Context(), id, uid); {
+	case err == nil:
+		writeJSON(w, 200, map[string]any{"ok": true})
+		a.publishMembersChanged(id, uid)
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not a board member")
+	default:
+		a.log.Error("remove board member", "err", err)
+		writeError(w, 500, "internal error")
+	}
+}
+
+// POST /api/boards/{id}/transfer {user_id}
+// Hands created_by over to a user who already has access to the board.
+func (a *api) handleTransferBoard(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	me, ok := a.authorize(w, r, ActBoardTransfer, boardResource(id))
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	if err := readJSON(w, r, &req); err != nil || req.UserID == 0 {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if has, err := a.store.CanAccessBoard(r.Context(), req.UserID, id); err != nil || !has {
+		if err != nil {
+			a.log.Error("transfer board", "err", err)
+		}
+		writeError(w, 400, "new owner must be a board member")
+		return
+	}
+	if err := a.store.TransferBoardOwnership(r.Context(), id, req.UserID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("transfer board", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	a.log.Info("board ownership transferred", "board_id", id, "from", me.ID, "to", req.UserID)
+	writeJSON(w, 200, map[string]any{"ok": true})
+	a.bus.Publish(Event{Type: "board.updated", Entity: "board", BoardID: id, Payload: map[string]any{"id": id, "created_by": req.UserID}})
+	a.publishMembersChanged(id, req.UserID)
+}
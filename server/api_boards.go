@@ -16,7 +16,11 @@ func (a *api) handleListBoards(w http.ResponseWriter, r *http.Request) {
 	if scope == "" {
 		scope = "mine"
 	}
-	items, err := a.store.ListBoards(r.Context(), u.ID, scope)
+	org, ok := a.requireOrg(w, r, u)
+	if !ok {
+		return
+	}
+	items, err := a.store.ListBoards(r.Context(), u.ID, org.ID, scope)
 	if err != nil {
 		a.log.Error("list boards", "err", err)
 		writeError(w, 500, "internal error")
@@ -42,17 +46,52 @@ func (a *api) handleCreateBoard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	b, err := a.store.CreateBoard(r.Context(), u.ID, req.Title)
+	if req.ProjectID == 0 && projectsRequired() {
+		writeError(w, 400, "project required")
+		return
+	}
+	// the board lives in its project's organization, otherwise in the active one
+	var orgID int64
+	if req.ProjectID == 0 {
+		org, ok := a.requireOrg(w, r, u)
+		if !ok {
+			return
+		}
+		orgID = org.ID
+	} else {
+		switch ok, err := a.Can(r.Context(), u, ActProjectCreateBoard, projectResource(req.ProjectID)); {
+		case errors.Is(err, ErrNotFound):
+			writeError(w, 404, "project not found")
+			return
+		case err != nil:
+			a.log.Error("create board", "err", err)
+			writeError(w, 500, "internal error")
+			return
+		case !ok:
+			writeError(w, 403, "forbidden")
+			return
+		}
+		var err error
+		if orgID, err = a.store.OrgOf(r.Context(), "project", req.ProjectID); err != nil {
+			a.log.Error("create board", "err", err)
+			writeError(w, 500, "internal error")
+			return
+		}
+	}
+	b, err := a.store.CreateBoard(r.Context(), orgID, u.ID, req.Title)
 	if err != nil {
 		a.log.Error("create board", "err", err)
 		writeError(w, 500, "internal error")
 		return
 	}
 	if req.ProjectID != 0 {
-		if ok, _ := a.store.CanAccessProject(r.Context(), req.ProjectID, u.ID); ok {
-			_ = a.store.SetBoardProject(r.Context(), b.ID, req.ProjectID)
+		if err := a.store.SetBoardProject(r.Context(), b.ID, req.ProjectID); err != nil {
+			a.log.Error("create board", "err", err)
+		} else {
+			b.ProjectID = &req.ProjectID
 		}
 	}
+	w.Header().Set("ETag", etag(b.Version))
 	writeJSON(w, 201, b)
 }
 
@@ -62,17 +101,7 @@ func (a *api) handleGetBoard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	ok, e := a.store.CanAccessBoard(r.Context(), u.ID, id)
-	if e != nil {
-		a.log.Error("access check", "err", e)
-	}
-	if !ok {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActBoardView, boardResource(id)); !ok {
 		return
 	}
 	b, err := a.store.GetBoard(r.Context(), id)
@@ -85,6 +114,7 @@ func (a *api) handleGetBoard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 500, "internal error")
 		return
 	}
+	w.Header().Set("ETag", etag(b.Version))
 	writeJSON(w, 200, b)
 }
 
@@ -94,46 +124,37 @@ func (a *api) handleUpdateBoard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	if own, e := a.store.IsBoardOwner(r.Context(), id, u.ID); e != nil || !own {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActBoardUpdate, boardResource(id)); !ok {
 		return
 	}
 	var req struct {
-		Title *string `json:"title"`
-		Color *string `json:"color"`
+		Title   *string `json:"title"`
+		Color   *string `json:"color"`
+		Version *int64  `json:"version"`
 	}
 	if err := readJSON(w, r, &req); err != nil {
 		writeError(w, 400, "invalid payload")
 		return
 	}
 	if req.Title != nil {
-		title := strings.TrimSpace(*req.Title)
-		if title == "" {
+		*req.Title = strings.TrimSpace(*req.Title)
+		if *req.Title == "" {
 			writeError(w, 400, "title cannot be empty")
 			return
 		}
-		if err := a.store.UpdateBoard(r.Context(), id, title); err != nil {
-			if errors.Is(err, ErrNotFound) {
-				writeError(w, 404, "not found")
-				return
-			}
-			a.log.Error("update board", "err", err)
-			writeError(w, 500, "internal error")
-			return
-		}
 	}
-	if req.Color != nil {
-		if _, err := a.store.db.ExecContext(r.Context(), `update boards set color=$1 where id=$2`, *req.Color, id); err != nil {
-			a.log.Error("update board color", "err", err)
-		}
+	ifVersion, ok := ifMatch(w, r, req.Version)
+	if !ok {
+		return
 	}
-	writeJSON(w, 200, map[string]any{"ok": true})
-	a.bus.Publish(Event{Type: "board.updated", Entity: "board", BoardID: id, Payload: map[string]any{"id": id}})
+	version, err := a.store.UpdateBoard(r.Context(), id, ifVersion, req.Title, req.Color)
+	if err != nil {
+		a.versionedWriteFailed(w, r, "board", id, err)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	writeJSON(w, 200, map[string]any{"ok": true, "version": version})
+	a.bus.Publish(Event{Type: "board.updated", Entity: "board", BoardID: id, Payload: map[string]any{"id": id, "version": version}})
 }
 
 func (a *api) handleDeleteBoard(w http.ResponseWriter, r *http.Request) {
@@ -142,13 +163,7 @@ func (a *api) handleDeleteBoard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	if own, e := a.store.IsBoardOwner(r.Context(), id, u.ID); e != nil || !own {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActBoardDelete, boardResource(id)); !ok {
 		return
 	}
 	if err := a.store.DeleteBoard(r.Context(), id); err != nil {
@@ -161,6 +176,8 @@ func (a *api) handleDeleteBoard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	// its streams are closed with access.revoked once access is checked again (changesAccess)
+	a.bus.Publish(Event{Type: "board.deleted", Entity: "board", BoardID: id, Payload: map[string]any{"id": id}})
 }
 
 func (a *api) handleMoveBoard(w http.ResponseWriter, r *http.Request) {
@@ -169,33 +186,29 @@ func (a *api) handleMoveBoard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	if own, e := a.store.IsBoardOwner(r.Context(), id, u.ID); e != nil || !own {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActBoardReorder, boardResource(id)); !ok {
 		return
 	}
 	var req struct {
-		NewIndex int `json:"new_index"`
+		NewIndex int    `json:"new_index"`
+		Version  *int64 `json:"version"`
 	}
 	if err := readJSON(w, r, &req); err != nil {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	if err := a.store.MoveBoard(r.Context(), id, req.NewIndex); err != nil {
-		if errors.Is(err, ErrNotFound) {
-			writeError(w, 404, "not found")
-			return
-		}
-		a.log.Error("move board", "err", err)
-		writeError(w, 500, "internal error")
+	ifVersion, ok := ifMatch(w, r, req.Version)
+	if !ok {
 		return
 	}
-	writeJSON(w, 200, map[string]any{"ok": true})
-	a.bus.Publish(Event{Type: "board.moved", Entity: "board", BoardID: id, Payload: map[string]any{"id": id, "new_index": req.NewIndex}})
+	version, err := a.store.MoveBoard(r.Context(), id, req.NewIndex, ifVersion)
+	if err != nil {
+		a.versionedWriteFailed(w, r, "board", id, err)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	writeJSON(w, 200, map[string]any{"ok": true, "version": version})
+	a.bus.Publish(Event{Type: "board.moved", Entity: "board", BoardID: id, Payload: map[string]any{"id": id, "new_index": req.NewIndex, "version": version}})
 }
 
 func (a *api) handleBoardEvents(w http.ResponseWriter, r *http.Request) {
@@ -204,17 +217,11 @@ func (a *api) handleBoardEvents(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	if u, errU := a.currentUser(r); errU == nil {
-		ok, e := a.store.CanAccessBoard(r.Context(), u.ID, id)
-		if e != nil {
-			a.log.Error("access check", "err", e)
-		}
-		if !ok {
-			writeError(w, 403, "forbidden")
-			return
-		}
+	u, ok := a.authorize(w, r, ActBoardView, boardResource(id))
+	if !ok {
+		return
 	}
-	a.bus.ServeSSE(w, r, id)
+	a.bus.ServeSSE(w, r, id, u)
 }
 
 func (a *api) handleGetBoardFull(w http.ResponseWriter, r *http.Request) {
@@ -223,15 +230,17 @@ func (a *api) handleGetBoardFull(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	if u, errU := a.currentUser(r); errU == nil {
-		ok, e := a.store.CanAccessBoard(r.Context(), u.ID, id)
-		if e != nil {
-			a.log.Error("access check", "err", e)
-		}
-		if !ok {
-			writeError(w, 403, "forbidden")
-			return
-		}
+	u, ok := a.authorize(w, r, ActBoardView, boardResource(id))
+	if !ok {
+		return
+	}
+	// sync_cursor is taken before anything is read: GET /changes from it returns
+	// whatever this snapshot misses
+	cursor, err := a.store.SyncCursor(r.Context())
+	if err != nil {
+		a.log.Error("sync cursor", "err", err)
+		writeError(w, 500, "internal error")
+		return
 	}
 	board, err := a.store.GetBoard(r.Context(), id)
 	if err != nil {
@@ -243,13 +252,22 @@ func (a *api) handleGetBoardFull(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 500, "internal error")
 		return
 	}
+	// last_event_id is read before the lists and cards, so the client resumes SSE from a point
+	// no later than the snapshot and never misses an event published while it loads
+	lastEvent, err := a.store.LastEventID(r.Context(), id)
+	if err != nil {
+		a.log.Error("last event id", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
 	lists, err := a.store.ListsByBoard(r.Context(), id)
 	if err != nil {
 		a.log.Error("lists by board", "err", err)
 		writeError(w, 500, "internal error")
 		return
 	}
-	out := map[string]any{"board": board, "lists": lists, "cards": map[int64][]Card{}}
+	// my_role lets the UI go read-only for viewers; the server enforces it regardless
+	out := map[string]any{"last_event_id": lastEvent, "sync_cursor": cursor, "board": board, "lists": lists, "cards": map[int64][]Card{}, "my_role": a.effectiveRole(r.Context(), u, boardResource(id)).String()}
 	cardsMap := out["cards"].(map[int64][]Card)
 	for _, l := range lists {
 		cards, err := a.store.CardsByList(r.Context(), l.ID)
@@ -270,17 +288,8 @@ func (a *api) handleBoardMembers(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	ok, e := a.store.CanAccessBoard(r.Context(), u.ID, id)
-	if e != nil {
-		a.log.Error("access check", "err", e)
-	}
+	u, ok := a.authorize(w, r, ActBoardView, boardResource(id))
 	if !ok {
-		writeError(w, 403, "forbidden")
 		return
 	}
 	users, e2 := a.store.BoardMembers(r.Context(), id)
@@ -291,7 +300,95 @@ func (a *api) handleBoardMembers(w http.ResponseWriter, r *http.Request) {
 	}
 	if len(users) == 0 && u != nil {
 		// ensure at least board requester can assign to self
-		users = []User{*u}
+		users = []Member{{User: *u, Role: a.effectiveRole(r.Context(), u, boardResource(id))}}
 	}
 	writeJSON(w, 200, users)
 }
+
+// GET /api/boards/{id}/access?user_id=
+// Effective role on the board and every grant behind it (owner, direct, group, project, project_group).
+func (a *api) handleBoardAccess(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	me, ok := a.authorize(w, r, ActBoardView, boardResource(id))
+	if !ok {
+		return
+	}
+	uid, err := accessUserID(r, me)
+	if err != nil {
+		writeError(w, 400, "bad user_id")
+		return
+	}
+	role, sources, err := a.store.BoardAccess(r.Context(), uid, id)
+	if err != nil {
+		a.log.Error("board access", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	out := map[string]any{"user_id": uid, "role": role.String(), "sources": sources}
+	if uid == me.ID && me.IsAdmin {
+		out["admin"] = true // site admins pass every check regardless of sources
+	}
+	writeJSON(w, 200, out)
+}
+
+// PUT /api/boards/{id}/project {project_id}
+// Moves a board into another project (project.create_board there) or out of any
+// project with project_id 0. Needs Owner on the board since it changes who has access.
+func (a *api) handleSetBoardProject(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	u, ok := a.authorize(w, r, ActBoardProject, boardResource(id))
+	if !ok {
+		return
+	}
+	var req struct {
+		ProjectID *int64 `json:"project_id"`
+	}
+	if err := readJSON(w, r, &req); err != nil || req.ProjectID == nil {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if *req.ProjectID == 0 && projectsRequired() {
+		writeError(w, 400, "project required")
+		return
+	}
+	if *req.ProjectID != 0 {
+		switch ok, err := a.Can(r.Context(), u, ActProjectCreateBoard, projectResource(*req.ProjectID)); {
+		case errors.Is(err, ErrNotFound):
+			writeError(w, 404, "project not found")
+			return
+		case err != nil:
+			a.log.Error("set board project", "err", err)
+			writeError(w, 500, "internal error")
+			return
+		case !ok:
+			writeError(w, 403, "forbidden")
+			return
+		}
+		if !a.sameOrg(w, r, "board", id, "project", *req.ProjectID) {
+			return
+		}
+	}
+	if err := a.store.SetBoardProject(r.Context(), id, *req.ProjectID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("set board project", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	var pid any
+	if *req.ProjectID != 0 {
+		pid = *req.ProjectID
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+	a.bus.Publish(Event{Type: "board.updated", Entity: "board", BoardID: id, Payload: map[string]any{"id": id, "project_id": pid}})
+}
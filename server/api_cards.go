@@ -13,21 +13,9 @@ func (a *api) handleCardsByList(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
+	if _, ok := a.authorize(w, r, ActBoardView, listResource(id)); !ok {
 		return
 	}
-	if bid, e := a.store.BoardIDByList(r.Context(), id); e == nil {
-		ok, e2 := a.store.CanAccessBoard(r.Context(), u.ID, bid)
-		if e2 != nil {
-			a.log.Error("access check", "err", e2)
-		}
-		if !ok {
-			writeError(w, 403, "forbidden")
-			return
-		}
-	}
 	items, err := a.store.CardsByList(r.Context(), id)
 	if err != nil {
 		a.log.Error("cards by list", "err", err)
@@ -43,6 +31,10 @@ func (a *api) handleCreateCard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	u, ok := a.authorize(w, r, ActCardCreate, listResource(id))
+	if !ok {
+		return
+	}
 	var req struct {
 		Title           string `json:"title"`
 		Description     string `json:"description"`
@@ -62,11 +54,14 @@ func (a *api) handleCreateCard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 500, "internal error")
 		return
 	}
-	// apply parent if provided
+	// apply parent if provided and it is a card the user can edit
 	if req.ParentID != nil {
-		_ = a.store.UpdateCard(r.Context(), c.ID, nil, nil, nil, nil, nil, nil, req.ParentID)
-		c.ParentID = req.ParentID
+		if ok, _ := a.Can(r.Context(), u, ActCardUpdate, cardResource(*req.ParentID)); ok {
+			_ = a.store.UpdateCard(r.Context(), c.ID, nil, nil, nil, nil, nil, nil, req.ParentID)
+			c.ParentID = req.ParentID
+		}
 	}
+	w.Header().Set("ETag", etag(c.Version))
 	writeJSON(w, 201, c)
 	if bid, e := a.store.BoardIDByList(r.Context(), c.ListID); e == nil {
 		a.bus.Publish(Event{Type: "card.created", Entity: "card", BoardID: bid, ListID: &c.ListID, Payload: c})
@@ -79,6 +74,10 @@ func (a *api) handleUpdateCard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	u, ok := a.authorize(w, r, ActCardUpdate, cardResource(id))
+	if !ok {
+		return
+	}
 	var due *time.Time
 	var req struct {
 		Title           *string `json:"title"`
@@ -89,11 +88,16 @@ func (a *api) handleUpdateCard(w http.ResponseWriter, r *http.Request) {
 		DescriptionIsMD *bool   `json:"description_is_md"`
 		AssigneeID      *int64  `json:"assignee_id"`
 		ParentID        *int64  `json:"parent_id"`
+		Version         *int64  `json:"version"`
 	}
 	if err := readJSON(w, r, &req); err != nil {
 		writeError(w, 400, "invalid payload")
 		return
 	}
+	ifVersion, ok := ifMatch(w, r, req.Version)
+	if !ok {
+		return
+	}
 	if req.DueAt != nil && *req.DueAt != "" {
 		if t, e := time.Parse(time.RFC3339, *req.DueAt); e == nil {
 			due = &t
@@ -130,13 +134,17 @@ func (a *api) handleUpdateCard(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// If parent change requested, validate and ensure list alignment
+	var parentList int64
 	if req.ParentID != nil {
 		if *req.ParentID == id {
 			writeError(w, 400, "cannot set parent to self")
 			return
 		}
+		// the card follows its parent's list, possibly onto another board
+		if _, ok := a.authorize(w, r, ActCardUpdate, cardResource(*req.ParentID)); !ok {
+			return
+		}
 		// Ensure parent exists and not descendant of id
-		var parentList int64
 		if err := a.store.db.QueryRowContext(r.Context(), `select list_id from cards where id=$1`, *req.ParentID).Scan(&parentList); err != nil {
 			if errors.Is(err, ErrNotFound) || errors.Is(err, sql.ErrNoRows) {
 				writeError(w, 404, "parent not found")
@@ -150,32 +158,29 @@ func (a *api) handleUpdateCard(w http.ResponseWriter, r *http.Request) {
 			writeError(w, 400, "cannot set parent to descendant")
 			return
 		}
-		// Align list with parent list if differs (move subtree)
-		if _, curList, e := a.store.BoardAndListByCard(r.Context(), id); e == nil && curList != parentList {
-			_ = a.store.MoveCard(r.Context(), id, parentList, 1<<30)
-		}
 	}
 
-	if err := a.store.UpdateCard(r.Context(), id, req.Title, req.Description, req.Pos, due, req.DescriptionIsMD, req.AssigneeID, req.ParentID); err != nil {
-		if errors.Is(err, ErrNotFound) {
-			writeError(w, 404, "not found")
-			return
-		}
-		a.log.Error("update card", "err", err)
-		writeError(w, 500, "internal error")
+	// the version check and every change are one transaction; the description is replaced
+	// through the collaborative document, so editors that have the card open get it as an
+	// operation
+	version, docOp, docRev, err := a.store.PatchCard(r.Context(), id, ifVersion, u.ID, CardPatch{
+		Title: req.Title, Description: req.Description, Pos: req.Pos, DueAt: due, DescriptionIsMD: req.DescriptionIsMD,
+		AssigneeID: req.AssigneeID, ParentID: req.ParentID, ParentList: parentList, Color: req.Color,
+	})
+	if err != nil {
+		a.versionedWriteFailed(w, r, "card", id, err)
 		return
 	}
-	if req.Color != nil {
-		if _, err := a.store.db.ExecContext(r.Context(), `update cards set color=$1 where id=$2`, *req.Color, id); err != nil {
-			a.log.Error("update card color", "err", err)
-		}
-	}
-	writeJSON(w, 200, map[string]any{"ok": true})
+	w.Header().Set("ETag", etag(version))
+	writeJSON(w, 200, map[string]any{"ok": true, "version": version})
 	if bid, _, e := a.store.BoardAndListByCard(r.Context(), id); e == nil {
+		if docOp != nil {
+			a.bus.Publish(Event{Type: "card.doc_op", Entity: "card", BoardID: bid, Payload: map[string]any{"card_id": id, "rev": docRev, "op": docOp, "user_id": u.ID}})
+		}
 		if req.AssigneeID != nil {
-			a.bus.Publish(Event{Type: "card.assignee_changed", Entity: "card", BoardID: bid, Payload: map[string]any{"id": id, "assignee_id": req.AssigneeID}})
+			a.bus.Publish(Event{Type: "card.assignee_changed", Entity: "card", BoardID: bid, Payload: map[string]any{"id": id, "assignee_id": req.AssigneeID, "version": version}})
 		} else {
-			a.bus.Publish(Event{Type: "card.updated", Entity: "card", BoardID: bid, Payload: map[string]any{"id": id}})
+			a.bus.Publish(Event{Type: "card.updated", Entity: "card", BoardID: bid, Payload: map[string]any{"id": id, "version": version}})
 		}
 	}
 }
@@ -186,6 +191,11 @@ func (a *api) handleDeleteCard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	if _, ok := a.authorize(w, r, ActCardDelete, cardResource(id)); !ok {
+		return
+	}
+	// resolve the board before the row is gone, for the event below
+	bid, _, _ := a.store.BoardAndListByCard(r.Context(), id)
 	res, err := a.store.db.ExecContext(r.Context(), `delete from cards where id=$1`, id)
 	if err != nil {
 		a.log.Error("delete card", "err", err)
@@ -197,7 +207,7 @@ func (a *api) handleDeleteCard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
-	if bid, _, e := a.store.BoardAndListByCard(r.Context(), id); e == nil {
+	if bid != 0 {
 		a.bus.Publish(Event{Type: "card.deleted", Entity: "card", BoardID: bid, Payload: map[string]any{"id": id}})
 	}
 }
@@ -208,26 +218,38 @@ func (a *api) handleMoveCard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	if _, ok := a.authorize(w, r, ActCardMove, cardResource(id)); !ok {
+		return
+	}
 	var req struct {
-		TargetListID int64 `json:"target_list_id"`
-		NewIndex     int   `json:"new_index"`
+		TargetListID int64  `json:"target_list_id"`
+		NewIndex     int    `json:"new_index"`
+		Version      *int64 `json:"version"`
 	}
 	if err := readJSON(w, r, &req); err != nil {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	if err := a.store.MoveCard(r.Context(), id, req.TargetListID, req.NewIndex); err != nil {
-		if errors.Is(err, ErrNotFound) {
-			writeError(w, 404, "not found")
-			return
-		}
-		a.log.Error("move card", "err", err)
-		writeError(w, 500, "internal error")
+	// the target list may be on another board
+	if _, ok := a.authorize(w, r, ActCardCreate, listResource(req.TargetListID)); !ok {
 		return
 	}
-	writeJSON(w, 200, map[string]any{"ok": true})
+	if !a.sameOrg(w, r, "card", id, "list", req.TargetListID) {
+		return
+	}
+	ifVersion, ok := ifMatch(w, r, req.Version)
+	if !ok {
+		return
+	}
+	version, err := a.store.MoveCard(r.Context(), id, req.TargetListID, req.NewIndex, ifVersion)
+	if err != nil {
+		a.versionedWriteFailed(w, r, "card", id, err)
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	writeJSON(w, 200, map[string]any{"ok": true, "version": version})
 	if bid, _, e := a.store.BoardAndListByCard(r.Context(), id); e == nil {
-		a.bus.Publish(Event{Type: "card.moved", Entity: "card", BoardID: bid, Payload: map[string]any{"id": id, "target_list_id": req.TargetListID, "new_index": req.NewIndex}})
+		a.bus.Publish(Event{Type: "card.moved", Entity: "card", BoardID: bid, Payload: map[string]any{"id": id, "target_list_id": req.TargetListID, "new_index": req.NewIndex, "version": version}})
 	}
 }
 
@@ -239,17 +261,7 @@ func (a *api) handleCreateOrGetShare(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	ok, err := a.store.CanAccessCard(r.Context(), u.ID, cardID)
-	if err != nil {
-		a.log.Error("share access check", "err", err)
-	}
-	if !ok {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActCardShare, cardResource(cardID)); !ok {
 		return
 	}
 	token, err := a.store.GetOrCreateCardShare(r.Context(), cardID)
@@ -8,9 +8,8 @@ func (a *api) handleAddComment(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	me, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
+	me, ok := a.authorize(w, r, ActCommentCreate, cardResource(id))
+	if !ok {
 		return
 	}
 	var req struct {
@@ -20,14 +19,6 @@ func (a *api) handleAddComment(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	// Verify access to the card via board membership (reuse helper)
-	if ok, errAcc := a.store.CanAccessCard(r.Context(), me.ID, id); errAcc != nil || !ok {
-		if errAcc != nil {
-			a.log.Error("add comment access", "err", errAcc)
-		}
-		writeError(w, 403, "forbidden")
-		return
-	}
 	uid := me.ID
 	c, err := a.store.AddComment(r.Context(), id, req.Body, &uid)
 	if err != nil {
@@ -47,21 +38,9 @@ func (a *api) handleCommentsByCard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
+	if _, ok := a.authorize(w, r, ActBoardView, cardResource(id)); !ok {
 		return
 	}
-	if bid, _, e := a.store.BoardAndListByCard(r.Context(), id); e == nil {
-		ok, e2 := a.store.CanAccessBoard(r.Context(), u.ID, bid)
-		if e2 != nil {
-			a.log.Error("access check", "err", e2)
-		}
-		if !ok {
-			writeError(w, 403, "forbidden")
-			return
-		}
-	}
 	items, err := a.store.CommentsByCard(r.Context(), id)
 	if err != nil {
 		a.log.Error("comments by card", "err", err)
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"io"
 	"log/slog"
 	"mime"
+	"net"
 	"net/http"
 	"net/mail"
 	"net/smtp"
@@ -27,10 +29,27 @@ type api struct {
 	// dev email verification tokens (in-memory)
 	evMu  sync.Mutex
 	evTok map[string]verifyReq
+	// generic OpenID Connect providers and their in-flight authorization requests
+	oidc      []*oidcProvider
+	oidcMu    sync.Mutex
+	oidcFlows map[string]oidcFlow
+	// optional LDAP / Active Directory auth backend
+	ldap *ldapBackend
+	// pending "link another provider" round trips started from the profile
+	linkMu      sync.Mutex
+	linkIntents map[string]linkIntent
 }
 
 func newAPI(store *Store, log *slog.Logger) *api {
-	return &api{store: store, log: log, bus: NewEventBus(), rl: map[string]*rateBucket{}, prTok: map[string]resetReq{}, evTok: map[string]verifyReq{}}
+	a := &api{store: store, log: log, bus: NewEventBus(store, log), rl: map[string]*rateBucket{}, prTok: map[string]resetReq{}, evTok: map[string]verifyReq{}, oidcFlows: map[string]oidcFlow{}, linkIntents: map[string]linkIntent{}}
+	providers, errs := loadOIDCProviders()
+	for _, err := range errs {
+		log.Error("oidc config", "err", err)
+	}
+	a.oidc = providers
+	a.ldap = loadLDAPBackend()
+	a.bus.CheckAccessWith(store.CanAccessBoard, store.NextGuestExpiry)
+	return a
 }
 
 type rateBucket struct {
@@ -246,25 +265,35 @@ func (a *api) clearSessionCookie(w http.ResponseWriter) {
 	})
 }
 
+// currentUser resolves the session from the cookie or, for API clients, from an
+// "Authorization: Bearer <session token>" header.
 func (a *api) currentUser(r *http.Request) (*User, error) {
-	c, err := r.Cookie(a.sessionCookieName())
-	if err != nil || c.Value == "" {
+	token := ""
+	if c, err := r.Cookie(a.sessionCookieName()); err == nil {
+		token = c.Value
+	} else if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(v)
+	}
+	if token == "" {
 		return nil, ErrNotFound
 	}
-	u, err := a.store.UserBySession(r.Context(), c.Value)
+	u, err := a.store.UserBySession(r.Context(), token)
 	if err != nil {
 		return nil, err
 	}
 	return &u, nil
 }
 
-// requireAuth wraps a handler and enforces a valid session
+// requireAuth wraps a handler and enforces a valid session (and CSRF checks for mutations)
 func (a *api) requireAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if _, err := a.currentUser(r); err != nil {
 			writeError(w, 401, "unauthorized")
 			return
 		}
+		if !a.checkCSRF(w, r) {
+			return
+		}
 		next(w, r)
 	}
 }
@@ -281,6 +310,9 @@ func (a *api) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
 			writeError(w, 403, "forbidden")
 			return
 		}
+		if !a.checkCSRF(w, r) {
+			return
+		}
 		next(w, r)
 	}
 }
@@ -307,3 +339,21 @@ func (w *statusWriter) Flush() {
 		f.Flush()
 	}
 }
+
+// FlushError and Unwrap let http.ResponseController reach the connection (event
+// streams set write deadlines and need to know when a flush fails)
+func (w *statusWriter) FlushError() error {
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// Implement http.Hijacker for WebSocket upgrades; they are logged as 101
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
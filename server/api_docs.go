@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Collaborative description editing. Editors load GET /api/cards/{id}/doc (text + rev)
+// and send their changes as ot.js operations on the revision they have; the server
+// transforms each against what was applied since, gives it the next revision and
+// broadcasts it as card.doc_op. Editors apply the others' operations in revision order
+// and recognise their own by client_id, which doubles as the acknowledgement.
+
+// GET /api/cards/{id}/doc[?since=rev]
+func (a *api) handleCardDoc(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActBoardView, cardResource(id)); !ok {
+		return
+	}
+	since := int64(-1)
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			writeError(w, 400, "bad since")
+			return
+		}
+	}
+	doc, err := a.store.CardDoc(r.Context(), id, since)
+	if err != nil {
+		a.writeDocError(w, "card doc", err)
+		return
+	}
+	writeJSON(w, 200, doc)
+}
+
+// POST /api/cards/{id}/doc {rev, op, client_id}
+func (a *api) handleCardDocOp(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	u, ok := a.authorize(w, r, ActCardUpdate, cardResource(id))
+	if !ok {
+		return
+	}
+	var req struct {
+		Rev      *int64 `json:"rev"`
+		Op       textOp `json:"op"`
+		ClientID string `json:"client_id"`
+	}
+	if err := readJSON(w, r, &req); err != nil || req.Rev == nil || *req.Rev < 0 || len(req.ClientID) > 64 {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	boardID, _, err := a.store.BoardAndListByCard(r.Context(), id)
+	if err != nil {
+		a.writeDocError(w, "card doc op", err)
+		return
+	}
+	op, rev, err := a.store.ApplyCardDocOp(r.Context(), id, u.ID, req.ClientID, *req.Rev, req.Op)
+	if err != nil {
+		a.writeDocError(w, "card doc op", err)
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true, "rev": rev})
+	a.bus.Publish(Event{Type: "card.doc_op", Entity: "card", BoardID: boardID, Payload: map[string]any{"card_id": id, "rev": rev, "op": op, "user_id": u.ID, "client_id": req.ClientID}})
+}
+
+func (a *api) writeDocError(w http.ResponseWriter, what string, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+	case errors.Is(err, ErrDocStale):
+		writeError(w, 409, err.Error())
+	case errors.Is(err, errOpLength):
+		writeError(w, 400, err.Error())
+	default:
+		a.log.Error(what, "err", err)
+		writeError(w, 500, "internal error")
+	}
+}
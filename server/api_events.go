@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// GET /api/me/events[?board=1,2][&types=card.*,comment.created]
+// One SSE stream with the events of every board the current user can access.
+func (a *api) handleMyEvents(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	q := r.URL.Query()
+	var boards map[int64]bool
+	if v := q.Get("board"); v != "" {
+		boards = map[int64]bool{}
+		for _, s := range strings.Split(v, ",") {
+			id, err := parseID(strings.TrimSpace(s))
+			if err != nil {
+				writeError(w, 400, "bad board")
+				return
+			}
+			boards[id] = true
+		}
+	}
+	var types []string
+	if v := q.Get("types"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				types = append(types, s)
+			}
+		}
+	}
+	sub, cancel, ok := a.bus.SubscribeUser(r.Context(), u.ID, boards, func(ctx context.Context) (map[int64]bool, error) {
+		return a.store.AccessibleBoards(ctx, u.ID)
+	})
+	if !ok {
+		writeError(w, 429, "too many event streams")
+		return
+	}
+	defer cancel()
+	a.bus.ServeUserSSE(w, r, sub, func(ctx context.Context, boardID int64) (bool, error) {
+		return a.store.CanAccessBoard(ctx, u.ID, boardID)
+	}, types)
+}
+
+// notifyUser sends the user a personal event about their group or project membership.
+func (a *api) notifyUser(userID int64, typ, entity string, payload map[string]any) {
+	payload["user_id"] = userID
+	a.bus.PublishUser(userID, Event{Type: typ, Entity: entity, Payload: payload})
+}
+
+// changesAccess wraps handlers that change who can access which boards (memberships,
+// groups, projects, users, new boards): once one succeeds, user event streams check
+// access again.
+func (a *api) changesAccess(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: 200}
+		next(sw, r)
+		if sw.status < 300 {
+			a.bus.AccessChanged()
+		}
+	}
+}
@@ -20,7 +20,14 @@ func (a *api) handleCreateGroupSelf(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	g, e := a.store.CreateGroupOwned(r.Context(), u.ID, strings.TrimSpace(req.Name))
+	if denyGuest(w, u) {
+		return
+	}
+	org, ok := a.requireOrg(w, r, u)
+	if !ok {
+		return
+	}
+	g, e := a.store.CreateGroupOwned(r.Context(), org.ID, u.ID, strings.TrimSpace(req.Name))
 	if e != nil {
 		a.log.Error("create group self", "err", e)
 		writeError(w, 400, "cannot create group")
@@ -35,7 +42,15 @@ func (a *api) handleMyGroups(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 401, "unauthorized")
 		return
 	}
-	groups, err := a.store.MyGroups(r.Context(), u.ID)
+	if u.IsGuest {
+		writeJSON(w, 200, []Group{})
+		return
+	}
+	org, ok := a.requireOrg(w, r, u)
+	if !ok {
+		return
+	}
+	groups, err := a.store.MyGroups(r.Context(), u.ID, org.ID)
 	if err != nil {
 		a.log.Error("my groups", "err", err)
 		writeError(w, 500, "internal error")
@@ -91,12 +106,16 @@ func (a *api) handleSelfAddUserToGroup(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
+	if !a.requireOrgMember(w, r, "group", gid, req.UserID) {
+		return
+	}
 	if err := a.store.AddUserToGroupSelf(r.Context(), gid, req.UserID); err != nil {
 		a.log.Error("self add user to group", "err", err)
 		writeError(w, 500, "internal error")
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.notifyUser(req.UserID, "group.member_added", "group", map[string]any{"group_id": gid})
 }
 
 func (a *api) handleSelfSearchUsers(w http.ResponseWriter, r *http.Request) {
@@ -105,6 +124,9 @@ func (a *api) handleSelfSearchUsers(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 401, "unauthorized")
 		return
 	}
+	if denyGuest(w, u) {
+		return
+	}
 	gid, e := parseID(r.PathValue("id"))
 	if e != nil {
 		writeError(w, 400, "bad id")
@@ -121,7 +143,13 @@ func (a *api) handleSelfSearchUsers(w http.ResponseWriter, r *http.Request) {
 			limit = n
 		}
 	}
-	items, e2 := a.store.ListUsers(r.Context(), q, limit)
+	orgID, e2 := a.store.OrgOf(r.Context(), "group", gid)
+	if e2 != nil {
+		a.log.Error("self search users", "err", e2)
+		writeError(w, 500, "internal error")
+		return
+	}
+	items, e2 := a.store.ListUsers(r.Context(), q, orgID, limit)
 	if e2 != nil {
 		a.log.Error("self search users", "err", e2)
 		writeError(w, 500, "internal error")
@@ -156,6 +184,7 @@ func (a *api) handleSelfRemoveUserFromGroup(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.notifyUser(uid, "group.member_removed", "group", map[string]any{"group_id": gid})
 }
 
 func (a *api) handleSelfDeleteGroup(w http.ResponseWriter, r *http.Request) {
@@ -169,6 +198,12 @@ func (a *api) handleSelfDeleteGroup(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	members, err := a.store.GroupUsers(r.Context(), gid)
+	if err != nil {
+		a.log.Error("self delete group", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
 	if err := a.store.DeleteGroupIfAdmin(r.Context(), gid, u.ID); err != nil {
 		if err.Error() == "forbidden" {
 			writeError(w, 403, "forbidden")
@@ -179,6 +214,9 @@ func (a *api) handleSelfDeleteGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	for _, m := range members {
+		a.notifyUser(m.ID, "group.deleted", "group", map[string]any{"group_id": gid})
+	}
 }
 
 func (a *api) handleSelfLeaveGroup(w http.ResponseWriter, r *http.Request) {
@@ -198,6 +236,7 @@ func (a *api) handleSelfLeaveGroup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.notifyUser(u.ID, "group.member_removed", "group", map[string]any{"group_id": gid})
 }
 
 func (a *api) handleBoardGroups(w http.ResponseWriter, r *http.Request) {
@@ -206,13 +245,7 @@ func (a *api) handleBoardGroups(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	if own, e := a.store.IsBoardOwner(r.Context(), id, u.ID); e != nil || !own {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActBoardShare, boardResource(id)); !ok {
 		return
 	}
 	groups, err := a.store.BoardGroups(r.Context(), id)
@@ -225,16 +258,14 @@ func (a *api) handleBoardGroups(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *api) handleBoardGroupAdd(w http.ResponseWriter, r *http.Request) {
-	u, err := a.currentUser(r)
-	if err != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
 	id, err := parseID(r.PathValue("id"))
 	if err != nil {
 		writeError(w, 400, "bad id")
 		return
 	}
+	if _, ok := a.authorize(w, r, ActBoardShare, boardResource(id)); !ok {
+		return
+	}
 	var req struct {
 		GroupID int64 `json:"group_id"`
 	}
@@ -242,14 +273,7 @@ func (a *api) handleBoardGroupAdd(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	own, err := a.store.IsBoardOwner(r.Context(), id, u.ID)
-	if err != nil {
-		a.log.Error("check owner", "err", err)
-		writeError(w, 500, "internal error")
-		return
-	}
-	if !own {
-		writeError(w, 403, "forbidden")
+	if !a.sameOrg(w, r, "board", id, "group", req.GroupID) {
 		return
 	}
 	if err := a.store.AddBoardToGroup(r.Context(), id, req.GroupID); err != nil {
@@ -258,32 +282,21 @@ func (a *api) handleBoardGroupAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.bus.Publish(Event{Type: "board.members_changed", Entity: "board", BoardID: id, Payload: map[string]any{"id": id, "group_id": req.GroupID}})
 }
 
 func (a *api) handleBoardGroupRemove(w http.ResponseWriter, r *http.Request) {
-	u, err := a.currentUser(r)
-	if err != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
 	id, err := parseID(r.PathValue("id"))
 	if err != nil {
 		writeError(w, 400, "bad id")
 		return
 	}
-	gid, err := parseID(r.PathValue("gid"))
-	if err != nil {
-		writeError(w, 400, "bad id")
+	if _, ok := a.authorize(w, r, ActBoardShare, boardResource(id)); !ok {
 		return
 	}
-	own, err := a.store.IsBoardOwner(r.Context(), id, u.ID)
+	gid, err := parseID(r.PathValue("gid"))
 	if err != nil {
-		a.log.Error("check owner", "err", err)
-		writeError(w, 500, "internal error")
-		return
-	}
-	if !own {
-		writeError(w, 403, "forbidden")
+		writeError(w, 400, "bad id")
 		return
 	}
 	if err := a.store.RemoveBoardFromGroup(r.Context(), id, gid); err != nil {
@@ -292,4 +305,5 @@ func (a *api) handleBoardGroupRemove(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.bus.Publish(Event{Type: "board.members_changed", Entity: "board", BoardID: id, Payload: map[string]any{"id": id, "group_id": gid}})
 }
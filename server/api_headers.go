@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// securityHeaders holds the hardening headers added to every response.
+// SECURITY_HEADERS=false turns the middleware off, CSP_MODE picks enforce (default),
+// report-only or off for the Content-Security-Policy itself.
+type securityHeaders struct {
+	csp        string
+	reportOnly bool
+	hsts       string
+	static     map[string]string
+}
+
+// inlineScriptRe matches inline <script> blocks; scripts with src= are skipped by the caller.
+var inlineScriptRe = regexp.MustCompile(`(?is)<script([^>]*)>(.*?)</script>`)
+
+// inlineScriptHashes returns CSP hash sources for the inline scripts of the HTML
+// pages in dir. Pages are static, so hashing once at startup is enough; restart
+// the server after editing an inline script.
+func inlineScriptHashes(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range inlineScriptRe.FindAllSubmatch(b, -1) {
+			if strings.Contains(strings.ToLower(string(m[1])), "src=") || len(m[2]) == 0 {
+				continue
+			}
+			sum := sha256.Sum256(m[2])
+			seen["'sha256-"+base64.StdEncoding.EncodeToString(sum[:])+"'"] = true
+		}
+	}
+	out := make([]string, 0, len(seen))
+	for h := range seen {
+		out = append(out, h)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func loadSecurityHeaders(log *slog.Logger, webDir string) *securityHeaders {
+	if getenv("SECURITY_HEADERS", "true") == "false" {
+		return nil
+	}
+	frameAncestors := getenv("CSP_FRAME_ANCESTORS", "'none'")
+	h := &securityHeaders{static: map[string]string{
+		"X-Content-Type-Options":     "nosniff",
+		"Referrer-Policy":            getenv("REFERRER_POLICY", "strict-origin-when-cross-origin"),
+		"Permissions-Policy":         "camera=(), microphone=(), geolocation=(), payment=(), usb=(), interest-cohort=()",
+		"Cross-Origin-Opener-Policy": "same-origin",
+	}}
+	if frameAncestors == "'none'" {
+		h.static["X-Frame-Options"] = "DENY"
+	}
+	if getenv("COOKIE_SECURE", "false") == "true" {
+		maxAge := 31536000
+		if d, err := time.ParseDuration(getenv("HSTS_MAX_AGE", "")); err == nil && d >= 0 {
+			maxAge = int(d.Seconds())
+		}
+		h.hsts = "max-age=" + strconv.Itoa(maxAge)
+	}
+
+	mode := getenv("CSP_MODE", "enforce")
+	if mode == "off" {
+		return h
+	}
+	h.reportOnly = mode == "report-only"
+	hashes, err := inlineScriptHashes(webDir)
+	if err != nil {
+		log.Error("csp: hash inline scripts", "err", err)
+	}
+	scriptSrc := append([]string{"'self'"}, hashes...)
+	h.csp = strings.Join([]string{
+		"default-src 'self'",
+		"script-src " + strings.Join(scriptSrc, " "),
+		// style attributes are used throughout the markup and set from JS
+		"style-src 'self' 'unsafe-inline'",
+		"img-src 'self' data: https:",
+		"font-src 'self' data:",
+		"connect-src 'self'",
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+		"frame-ancestors " + frameAncestors,
+		"report-uri /api/csp-report",
+		"report-to csp",
+	}, "; ")
+	log.Info("security headers", "csp_mode", mode, "inline_scripts", len(hashes), "hsts", h.hsts != "")
+	return h
+}
+
+// withSecurityHeaders sets the configured hardening headers before calling next.
+func withSecurityHeaders(h *securityHeaders, next http.Handler) http.Handler {
+	if h == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hd := w.Header()
+		for k, v := range h.static {
+			hd.Set(k, v)
+		}
+		if h.hsts != "" {
+			hd.Set("Strict-Transport-Security", h.hsts)
+		}
+		if h.csp != "" {
+			hd.Set("Reporting-Endpoints", `csp="/api/csp-report"`)
+			if h.reportOnly {
+				hd.Set("Content-Security-Policy-Report-Only", h.csp)
+			} else {
+				hd.Set("Content-Security-Policy", h.csp)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// POST /api/csp-report
+// Collects violation reports in both the legacy report-uri format
+// ({"csp-report": {...}}) and the Reporting API format ([{"type": "csp-violation", "body": {...}}]).
+func (a *api) handleCSPReport(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	var reports []map[string]any
+	var legacy struct {
+		Report map[string]any `json:"csp-report"`
+	}
+	var batch []struct {
+		Type string         `json:"type"`
+		Body map[string]any `json:"body"`
+	}
+	if json.Unmarshal(raw, &legacy) == nil && legacy.Report != nil {
+		reports = append(reports, legacy.Report)
+	} else if json.Unmarshal(raw, &batch) == nil {
+		for _, b := range batch {
+			if b.Type == "csp-violation" && b.Body != nil {
+				reports = append(reports, b.Body)
+			}
+		}
+	}
+	for i, rep := range reports {
+		if i == 10 {
+			break
+		}
+		line := rep["line-number"]
+		if line == nil {
+			line = rep["lineNumber"]
+		}
+		a.log.Info("csp violation",
+			"document", firstString(rep, "document-uri", "documentURL"),
+			"directive", firstString(rep, "violated-directive", "effectiveDirective"),
+			"blocked", firstString(rep, "blocked-uri", "blockedURL"),
+			"source", firstString(rep, "source-file", "sourceFile"),
+			"line", line, "sample", firstString(rep, "script-sample", "sample"),
+			"disposition", rep["disposition"])
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// firstString returns the first non-empty string among the given keys.
+func firstString(m map[string]any, keys ...string) string {
+	for _, k := range keys {
+		if s, ok := m[k].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
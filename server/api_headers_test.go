@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// inlineHandler matches an on* attribute inside a tag, in HTML files and in markup
+// built by scripts.
+var inlineHandler = regexp.MustCompile(`(?i)<[a-z][^<>]*\son[a-z]+\s*=`)
+
+// TestNoInlineHandlers keeps web/ working under the default CSP (script-src 'self'),
+// which blocks inline event handlers.
+func TestNoInlineHandlers(t *testing.T) {
+	if !inlineHandler.MatchString(`<button class="x" onclick="f(1)">`) || inlineHandler.MatchString(`<button data-on="x">`) {
+		t.Fatal("pattern is broken")
+	}
+	err := filepath.WalkDir("../web", func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if ext := filepath.Ext(path); ext != ".html" && ext != ".js" {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for i, line := range strings.Split(string(b), "\n") {
+			if m := inlineHandler.FindString(line); m != "" {
+				t.Errorf("%s:%d: inline handler %q", path, i+1, m)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
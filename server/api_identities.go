@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// linkIntent marks an OAuth round trip started from the profile to attach a
+// provider to the signed-in user instead of logging in. Keyed by state.
+type linkIntent struct {
+	UserID    int64
+	Provider  string
+	ExpiresAt time.Time
+}
+
+func (a *api) putLinkIntent(state string, li linkIntent) {
+	a.linkMu.Lock()
+	defer a.linkMu.Unlock()
+	now := time.Now()
+	for k, v := range a.linkIntents {
+		if now.After(v.ExpiresAt) {
+			delete(a.linkIntents, k)
+		}
+	}
+	a.linkIntents[state] = li
+}
+
+func (a *api) takeLinkIntent(state string) (linkIntent, bool) {
+	a.linkMu.Lock()
+	defer a.linkMu.Unlock()
+	li, ok := a.linkIntents[state]
+	if !ok {
+		return linkIntent{}, false
+	}
+	delete(a.linkIntents, state)
+	if time.Now().After(li.ExpiresAt) {
+		return linkIntent{}, false
+	}
+	return li, true
+}
+
+// oauthAutoLink reports whether an unknown provider identity may be attached to an
+// existing account just because the emails match (OAUTH_AUTO_LINK_EMAIL, default on).
+func (a *api) oauthAutoLink() bool { return getenv("OAUTH_AUTO_LINK_EMAIL", "true") != "false" }
+
+// providerName returns the display name of a login provider and whether it is
+// currently configured. LDAP is listed but cannot be linked through a redirect.
+func (a *api) providerName(id string) (string, bool) {
+	switch id {
+	case "github":
+		return "GitHub", a.githubEnabled()
+	case "google":
+		return "Google", a.googleEnabled()
+	case "ldap":
+		return "LDAP", a.ldap != nil
+	}
+	if p := a.oidcProviderByID(id); p != nil {
+		return p.Name, true
+	}
+	return id, false
+}
+
+// redirectToProvider stores state in the oauth_state cookie and sends the browser
+// to the provider's consent page.
+func (a *api) redirectToProvider(w http.ResponseWriter, r *http.Request, provider, state string) {
+	var authURL string
+	switch provider {
+	case "github":
+		authURL = a.githubAuthURL(r, state)
+	case "google":
+		authURL = a.googleAuthURL(r, state)
+	default:
+		p := a.oidcProviderByID(provider)
+		if p == nil {
+			writeError(w, 404, "provider not configured")
+			return
+		}
+		var err error
+		if authURL, err = a.oidcAuthURL(r, p, state); err != nil {
+			a.log.Error("oidc discovery", "provider", p.ID, "err", err)
+			writeError(w, 502, "oauth error")
+			return
+		}
+	}
+	a.setStateCookie(w, state)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// completeOAuth finishes a verified provider callback: it links the identity when
+// the round trip was started from the profile, otherwise logs the user in.
+func (a *api) completeOAuth(w http.ResponseWriter, r *http.Request, state, provider, subject, email, name string) {
+	ctx := r.Context()
+	if li, ok := a.takeLinkIntent(state); ok {
+		me, err := a.currentUser(r)
+		if err != nil || me.ID != li.UserID || li.Provider != provider {
+			writeError(w, 400, "link session mismatch")
+			return
+		}
+		switch err := a.store.LinkIdentity(ctx, me.ID, provider, subject, email); {
+		case err == nil:
+			a.log.Info("identity linked", "user_id", me.ID, "provider", provider)
+			a.securityEvent(r, me.ID, secIdentityLink, map[string]any{"provider": provider, "email": email})
+			http.Redirect(w, r, "/web/profile.html#identities", http.StatusFound)
+		case errors.Is(err, ErrIdentityTaken):
+			http.Redirect(w, r, "/web/profile.html#link_error=taken", http.StatusFound)
+		case errors.Is(err, ErrProviderLinked):
+			http.Redirect(w, r, "/web/profile.html#link_error=already_linked", http.StatusFound)
+		default:
+			a.log.Error("link identity", "err", err)
+			writeError(w, 500, "internal error")
+		}
+		return
+	}
+	u, err := a.store.EnsureOAuthUser(ctx, provider, subject, email, name, a.oauthAutoLink())
+	if errors.Is(err, ErrEmailTaken) {
+		// the owner has to sign in another way and link this provider from the profile
+		http.Redirect(w, r, "/web/login.html#oauth_error=email_taken", http.StatusFound)
+		return
+	}
+	if err != nil {
+		a.log.Error("ensure oauth user", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if !u.IsActive {
+		writeError(w, 403, "account disabled")
+		return
+	}
+	tok, exp, err := a.store.CreateSession(ctx, u.ID, a.sessionTTL())
+	if err != nil {
+		a.log.Error("create session", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	a.setSessionCookie(w, tok, exp)
+	a.loginSucceeded(r, u, provider)
+	// Ensure sample content for first-time users
+	go a.ensureSampleContent(context.Background(), u.ID, r)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// GET /api/me/identities
+// Linked identities, whether a local password is set, and providers that can still be linked.
+func (a *api) handleMyIdentities(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	ids, err := a.store.UserIdentities(r.Context(), me.ID)
+	if err != nil {
+		a.log.Error("list identities", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	hasPassword, err := a.store.UserHasPassword(r.Context(), me.ID)
+	if err != nil {
+		a.log.Error("list identities", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	linked := map[string]bool{}
+	items := make([]map[string]any, 0, len(ids))
+	for _, id := range ids {
+		linked[id.Provider] = true
+		name, _ := a.providerName(id.Provider)
+		items = append(items, map[string]any{"provider": id.Provider, "name": name, "email": id.Email, "created_at": id.CreatedAt})
+	}
+	candidates := []string{"github", "google"}
+	for _, p := range a.oidc {
+		candidates = append(candidates, p.ID)
+	}
+	linkable := []map[string]string{}
+	for _, id := range candidates {
+		if name, ok := a.providerName(id); ok && !linked[id] {
+			linkable = append(linkable, map[string]string{"id": id, "name": name, "link_url": "/api/me/identities/" + id + "/link"})
+		}
+	}
+	writeJSON(w, 200, map[string]any{
+		"identities":   items,
+		"has_password": hasPassword,
+		"linkable":     linkable,
+		"auto_link":    a.oauthAutoLink(),
+	})
+}
+
+// GET /api/me/identities/{provider}/link
+// Starts an OAuth round trip that attaches the provider to the current user, even
+// when the provider reports a different email.
+func (a *api) handleLinkIdentityStart(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	provider := r.PathValue("provider")
+	if _, ok := a.providerName(provider); !ok || provider == "ldap" {
+		writeError(w, 404, "provider not configured")
+		return
+	}
+	state := randomToken(16)
+	a.putLinkIntent(state, linkIntent{UserID: me.ID, Provider: provider, ExpiresAt: time.Now().Add(10 * time.Minute)})
+	a.redirectToProvider(w, r, provider, state)
+}
+
+// DELETE /api/me/identities/{provider}
+func (a *api) handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	provider := r.PathValue("provider")
+	switch err := a.store.UnlinkIdentity(r.Context(), me.ID, provider); {
+	case err == nil:
+		a.log.Info("identity unlinked", "user_id", me.ID, "provider", provider)
+		a.securityEvent(r, me.ID, secIdentityUnlink, map[string]any{"provider": provider})
+		writeJSON(w, 200, map[string]any{"ok": true})
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+	case errors.Is(err, ErrLastLoginMethod):
+		writeError(w, 409, "cannot remove the last login method")
+	default:
+		a.log.Error("unlink identity", "err", err)
+		writeError(w, 500, "internal error")
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Invitations to boards, projects and groups. A link invite is reusable until it
+// expires or is revoked; an email invite is single-use and is also accepted
+// automatically when an account with that address registers or signs in.
+
+// inviteTTL is the default lifetime of a new invite (INVITE_TTL, default 7 days).
+func inviteTTL() time.Duration {
+	if d, err := time.ParseDuration(getenv("INVITE_TTL", "168h")); err == nil && d > 0 {
+		return d
+	}
+	return 7 * 24 * time.Hour
+}
+
+// baseURL is the scheme and host the request came in on, for links in emails.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.Header.Get("X-Forwarded-Proto") == "https" || r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func inviteURL(r *http.Request, token string) string {
+	return baseURL(r) + "/#invite=" + token
+}
+
+// inviteRoleRange returns the roles an invite of the given kind may grant, capped by
+// what the inviting user holds: group invites use user_groups roles (1 member, 2 admin),
+// boards and projects go up to Maintainer. ok is false when u can't invite at all.
+func (a *api) inviteRoleRange(ctx context.Context, u *User, kind string, targetID int64) (lo, hi int, ok bool, err error) {
+	switch kind {
+	case "board":
+		if ok, err = a.Can(ctx, u, ActBoardMembers, boardResource(targetID)); !ok || err != nil {
+			return 0, 0, false, err
+		}
+		return int(RoleViewer), int(min(a.effectiveRole(ctx, u, boardResource(targetID)), RoleMaintainer)), true, nil
+	case "project":
+		if ok, err = a.Can(ctx, u, ActProjectManageMembers, projectResource(targetID)); !ok || err != nil {
+			return 0, 0, false, err
+		}
+		return int(RoleViewer), int(RoleMaintainer), true, nil
+	case "group":
+		if _, err = a.store.InviteTargetName(ctx, kind, targetID); err != nil {
+			return 0, 0, false, err
+		}
+		if !u.IsAdmin {
+			if ok, err = a.store.IsGroupAdmin(ctx, targetID, u.ID); !ok || err != nil {
+				return 0, 0, false, err
+			}
+		}
+		return 1, 2, true, nil
+	}
+	return 0, 0, false, errors.New("invalid invite kind")
+}
+
+// errGuestInvite: guests can only accept board invitations.
+var errGuestInvite = errors.New("guests can only join boards")
+
+// guestInvites reports whether an account registering with email (and optionally the
+// invitation link token it came from) must be a guest: when any of those pending invites
+// is a guest invite. The expiry is the latest guest expiry, nil if any has none.
+func (a *api) guestInvites(ctx context.Context, email, token string) (bool, *time.Time, error) {
+	invs, err := a.store.PendingInvitesForEmail(ctx, email)
+	if err != nil {
+		return false, nil, err
+	}
+	if token != "" {
+		if inv, err := a.store.InviteByToken(ctx, token); err == nil {
+			invs = append(invs, inv)
+		}
+	}
+	guest, unlimited := false, false
+	var until *time.Time
+	for _, inv := range invs {
+		if !inv.Guest {
+			continue
+		}
+		guest = true
+		switch {
+		case inv.GuestExpiresAt == nil:
+			unlimited = true
+		case until == nil || inv.GuestExpiresAt.After(*until):
+			until = inv.GuestExpiresAt
+		}
+	}
+	if unlimited {
+		until = nil
+	}
+	return guest, until, nil
+}
+
+// applyInvite grants the invited role to u, never lowering a role the user already has.
+func (a *api) applyInvite(ctx context.Context, inv Invite, u User) error {
+	if u.IsGuest && inv.Kind != "board" {
+		return errGuestInvite
+	}
+	var by int64
+	if inv.CreatedBy != nil {
+		by = *inv.CreatedBy
+	}
+	// accepting an invitation makes the user a member of the target's organization
+	orgID, err := a.store.OrgOf(ctx, inv.Kind, inv.TargetID)
+	if err != nil {
+		return err
+	}
+	if err := a.store.JoinOrg(ctx, orgID, u.ID, OrgRoleMember); err != nil {
+		return err
+	}
+	switch inv.Kind {
+	case "board":
+		cur, err := a.store.BoardRole(ctx, u.ID, inv.TargetID)
+		if err != nil {
+			return err
+		}
+		if cur >= Role(inv.Role) {
+			return nil
+		}
+		if err := a.store.AddBoardMember(ctx, inv.TargetID, u.ID, Role(inv.Role), by); err != nil {
+			return err
+		}
+		a.publishMembersChanged(inv.TargetID, u.ID)
+		return nil
+	case "project":
+		cur, err := a.store.ProjectRole(ctx, u.ID, inv.TargetID)
+		if err != nil {
+			return err
+		}
+		if cur >= Role(inv.Role) {
+			return nil
+		}
+		return a.store.AddProjectMember(ctx, inv.TargetID, u.ID, &inv.Role)
+	case "group":
+		return a.store.AddUserToGroupRole(ctx, inv.TargetID, u.ID, inv.Role)
+	}
+	return errors.New("invalid invite kind")
+}
+
+// acceptPendingInvites accepts the email invitations addressed to u. Errors are
+// logged only: a stale invite must not break registration or login.
+func (a *api) acceptPendingInvites(ctx context.Context, u User) {
+	invs, err := a.store.PendingInvitesForEmail(ctx, u.Email)
+	if err != nil {
+		a.log.Error("pending invites", "err", err)
+		return
+	}
+	for _, inv := range invs {
+		if err := a.applyInvite(ctx, inv, u); err != nil {
+			a.log.Error("accept invite", "invite_id", inv.ID, "err", err)
+			continue
+		}
+		if err := a.store.UseInvite(ctx, inv.ID, u.ID); err != nil {
+			a.log.Error("accept invite", "invite_id", inv.ID, "err", err)
+			continue
+		}
+		a.log.Info("invite accepted", "invite_id", inv.ID, "user_id", u.ID, "kind", inv.Kind, "target_id", inv.TargetID)
+	}
+}
+
+func (a *api) sendInviteEmail(inv Invite, link string, inviter *User, target string) {
+	until := inv.ExpiresAt.UTC().Format("2006-01-02 15:04 UTC")
+	subject := "Приглашение в Trellolite"
+	body := "Здравствуйте,\n\n" + inviter.Name + " приглашает вас в «" + target + "».\n\nПринять приглашение:\n" + link +
+		"\n\nЕсли у вас ещё нет аккаунта, зарегистрируйтесь с этим адресом — приглашение будет принято автоматически.\nСсылка действует до " + until + "."
+	if inviter.Lang == "en" {
+		subject = "Invitation to Trellolite"
+		body = "Hello,\n\n" + inviter.Name + " invited you to \"" + target + "\".\n\nAccept the invitation:\n" + link +
+			"\n\nIf you don't have an account yet, sign up with this address and the invitation is accepted automatically.\nThe link is valid until " + until + "."
+	}
+	if err := a.sendEmail(inv.Email, subject, body); err != nil {
+		a.log.Error("send invite email", "err", err)
+	}
+	a.log.Info("invite link (dev)", "email", inv.Email, "url", link)
+}
+
+// POST /api/invites {kind, target_id, role?, email?, expires_in_hours?}
+func (a *api) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	var req struct {
+		Kind           string     `json:"kind"`
+		TargetID       int64      `json:"target_id"`
+		Role           *int       `json:"role"`
+		Email          string     `json:"email"`
+		ExpiresInHours int        `json:"expires_in_hours"`
+		Guest          bool       `json:"guest"`
+		GuestExpiresAt *time.Time `json:"guest_expires_at"`
+	}
+	if denyGuest(w, me) {
+		return
+	}
+	if err := readJSON(w, r, &req); err != nil || inviteTargetColumn(req.Kind) == "" || req.TargetID == 0 {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if req.Guest && req.Kind != "board" {
+		writeError(w, 400, "guests can only be invited to boards")
+		return
+	}
+	if !req.Guest {
+		req.GuestExpiresAt = nil
+	} else if req.GuestExpiresAt != nil && !req.GuestExpiresAt.After(time.Now()) {
+		writeError(w, 400, "guest expiry must be in the future")
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			writeError(w, 400, "invalid email")
+			return
+		}
+		email = addr.Address
+	}
+	lo, hi, ok, err := a.inviteRoleRange(r.Context(), me, req.Kind, req.TargetID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+		return
+	case err != nil:
+		a.log.Error("create invite", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	case !ok:
+		writeError(w, 403, "forbidden")
+		return
+	}
+	role := int(RoleMember) // also "member" in user_groups
+	if req.Role != nil {
+		role = *req.Role
+	}
+	if role < lo || role > hi {
+		writeError(w, 400, "invalid role")
+		return
+	}
+	ttl := inviteTTL()
+	if req.ExpiresInHours > 0 {
+		ttl = time.Duration(min(req.ExpiresInHours, 24*30)) * time.Hour
+	}
+	inv, err := a.store.CreateInvite(r.Context(), Invite{
+		Token: randomToken(24), Kind: req.Kind, TargetID: req.TargetID, Role: role,
+		Email: email, CreatedBy: &me.ID, ExpiresAt: time.Now().Add(ttl),
+		Guest: req.Guest, GuestExpiresAt: req.GuestExpiresAt,
+	})
+	if err != nil {
+		a.log.Error("create invite", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if inv.Email != "" {
+		target, _ := a.store.InviteTargetName(r.Context(), inv.Kind, inv.TargetID)
+		go a.sendInviteEmail(inv, inviteURL(r, inv.Token), me, target)
+	}
+	writeJSON(w, 201, map[string]any{"invite": inv, "url": inviteURL(r, inv.Token)})
+}
+
+// GET /api/invites?kind=board&target_id=1
+func (a *api) handleListInvites(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	targetID, err := strconv.ParseInt(r.URL.Query().Get("target_id"), 10, 64)
+	if err != nil || inviteTargetColumn(kind) == "" {
+		writeError(w, 400, "kind and target_id required")
+		return
+	}
+	_, _, ok, err := a.inviteRoleRange(r.Context(), me, kind, targetID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+		return
+	case err != nil:
+		a.log.Error("list invites", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	case !ok:
+		writeError(w, 403, "forbidden")
+		return
+	}
+	items, err := a.store.ListInvites(r.Context(), kind, targetID)
+	if err != nil {
+		a.log.Error("list invites", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	out := make([]map[string]any, 0, len(items))
+	for _, inv := range items {
+		out = append(out, map[string]any{"invite": inv, "url": inviteURL(r, inv.Token)})
+	}
+	writeJSON(w, 200, out)
+}
+
+// DELETE /api/invites/{id}
+// The creator or anyone who may invite to the target can revoke.
+func (a *api) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	inv, err := a.store.InviteByID(r.Context(), id)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "not found")
+		return
+	}
+	if err != nil {
+		a.log.Error("revoke invite", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if inv.CreatedBy == nil || *inv.CreatedBy != me.ID {
+		if _, _, ok, err := a.inviteRoleRange(r.Context(), me, inv.Kind, inv.TargetID); err != nil || !ok {
+			writeError(w, 403, "forbidden")
+			return
+		}
+	}
+	if err := a.store.DeleteInvite(r.Context(), id); err != nil && !errors.Is(err, ErrNotFound) {
+		a.log.Error("revoke invite", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// GET /api/join/{token}
+// Public preview of an invitation for the landing page.
+func (a *api) handleInvitePreview(w http.ResponseWriter, r *http.Request) {
+	inv, err := a.store.InviteByToken(r.Context(), r.PathValue("token"))
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "invite not found or expired")
+		return
+	}
+	if err != nil {
+		a.log.Error("invite preview", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	target, err := a.store.InviteTargetName(r.Context(), inv.Kind, inv.TargetID)
+	if err != nil {
+		writeError(w, 404, "invite not found or expired")
+		return
+	}
+	writeJSON(w, 200, map[string]any{
+		"kind": inv.Kind, "target_id": inv.TargetID, "target_name": target, "role": inv.Role,
+		"invited_by": inv.CreatedByName, "expires_at": inv.ExpiresAt, "email": inv.Email != "",
+	})
+}
+
+// POST /api/join/{token}
+func (a *api) handleAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	inv, err := a.store.InviteByToken(r.Context(), r.PathValue("token"))
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "invite not found or expired")
+		return
+	}
+	if err != nil {
+		a.log.Error("accept invite", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if err := a.applyInvite(r.Context(), inv, *me); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, 404, "invite not found or expired")
+			return
+		}
+		if errors.Is(err, errGuestInvite) {
+			writeError(w, 403, "not available to guests")
+			return
+		}
+		a.log.Error("accept invite", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if err := a.store.UseInvite(r.Context(), inv.ID, me.ID); err != nil {
+		a.log.Error("accept invite", "err", err)
+	}
+	a.log.Info("invite accepted", "invite_id", inv.ID, "user_id", me.ID, "kind", inv.Kind, "target_id", inv.TargetID)
+	writeJSON(w, 200, map[string]any{"ok": true, "kind": inv.Kind, "target_id": inv.TargetID})
+	switch inv.Kind {
+	case "board":
+		a.publishMembersChanged(inv.TargetID, me.ID)
+	case "project", "group":
+		a.notifyUser(me.ID, inv.Kind+".member_added", inv.Kind, map[string]any{inv.Kind + "_id": inv.TargetID, "role": inv.Role})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ldapDirectory is the subset of an LDAP connection used by the auth backend.
+// *ldapConn implements it; a local stand-in can be plugged in via ldapBackend.dial.
+type ldapDirectory interface {
+	Bind(dn, password string) error
+	Search(base string, scope int, filter string, attrs []string, sizeLimit int) ([]ldapEntry, error)
+	Close() error
+}
+
+type ldapConfig struct {
+	URL          string
+	StartTLS     bool
+	TLS          *tls.Config
+	Timeout      time.Duration
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // {login} is replaced with the escaped login
+	AttrUID      string
+	AttrEmail    string
+	AttrName     string
+	AttrGroups   string
+	GroupBaseDN  string // optional: search groups instead of reading AttrGroups
+	GroupFilter  string // {dn} is replaced with the escaped user DN
+	GroupMap     map[string]string
+	AdminGroups  []string
+	// LocalFallback controls local password logins while LDAP is enabled:
+	// "admins" (default, break-glass for is_admin users), "all" or "none".
+	LocalFallback string
+}
+
+type ldapBackend struct {
+	cfg  ldapConfig
+	dial func() (ldapDirectory, error)
+}
+
+// ldapIdentity is the directory view of a user after a successful bind.
+type ldapIdentity struct {
+	DN     string
+	UID    string
+	Email  string
+	Name   string
+	Groups []string // normalized group DNs
+}
+
+var errLDAPUserNotFound = errors.New("ldap: user not found")
+
+// loadLDAPBackend builds the backend from LDAP_* env vars; nil when LDAP_URL is unset.
+func loadLDAPBackend() *ldapBackend {
+	rawURL := getenv("LDAP_URL", "")
+	if rawURL == "" {
+		return nil
+	}
+	timeout := 10 * time.Second
+	if d, err := time.ParseDuration(getenv("LDAP_TIMEOUT", "")); err == nil && d > 0 {
+		timeout = d
+	}
+	cfg := ldapConfig{
+		URL:           rawURL,
+		StartTLS:      getenv("LDAP_START_TLS", "false") == "true",
+		TLS:           &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: getenv("LDAP_TLS_INSECURE_SKIP_VERIFY", "false") == "true"},
+		Timeout:       timeout,
+		BindDN:        getenv("LDAP_BIND_DN", ""),
+		BindPassword:  getenv("LDAP_BIND_PASSWORD", ""),
+		BaseDN:        getenv("LDAP_BASE_DN", ""),
+		UserFilter:    getenv("LDAP_USER_FILTER", "(&(objectClass=person)(|(uid={login})(mail={login})))"),
+		AttrUID:       getenv("LDAP_ATTR_UID", "entryUUID"),
+		AttrEmail:     getenv("LDAP_ATTR_EMAIL", "mail"),
+		AttrName:      getenv("LDAP_ATTR_NAME", "cn"),
+		AttrGroups:    getenv("LDAP_ATTR_GROUPS", "memberOf"),
+		GroupBaseDN:   getenv("LDAP_GROUP_BASE_DN", ""),
+		GroupFilter:   getenv("LDAP_GROUP_FILTER", "(|(member={dn})(uniqueMember={dn}))"),
+		GroupMap:      map[string]string{},
+		LocalFallback: strings.ToLower(getenv("LDAP_LOCAL_FALLBACK", "admins")),
+	}
+	// LDAP_GROUP_MAP="cn=devs,ou=groups,dc=example,dc=org=>Developers;cn=ops,ou=groups,dc=example,dc=org=>Ops"
+	for _, item := range strings.Split(getenv("LDAP_GROUP_MAP", ""), ";") {
+		dn, name, ok := strings.Cut(item, "=>")
+		if !ok || strings.TrimSpace(dn) == "" || strings.TrimSpace(name) == "" {
+			continue
+		}
+		cfg.GroupMap[normalizeDN(dn)] = strings.TrimSpace(name)
+	}
+	for _, dn := range strings.Split(getenv("LDAP_ADMIN_GROUPS", ""), ";") {
+		if strings.TrimSpace(dn) != "" {
+			cfg.AdminGroups = append(cfg.AdminGroups, normalizeDN(dn))
+		}
+	}
+	b := &ldapBackend{cfg: cfg}
+	b.dial = func() (ldapDirectory, error) {
+		return dialLDAP(cfg.URL, cfg.StartTLS, cfg.TLS, cfg.Timeout)
+	}
+	return b
+}
+
+// normalizeDN lowercases a DN and trims spaces around RDNs for comparisons.
+func normalizeDN(dn string) string {
+	parts := strings.Split(strings.TrimSpace(dn), ",")
+	for i, p := range parts {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		parts[i] = strings.ToLower(strings.TrimSpace(k)) + "=" + strings.ToLower(strings.TrimSpace(v))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Authenticate looks the user up with the service account, then binds as the user.
+func (b *ldapBackend) Authenticate(login, password string) (*ldapIdentity, error) {
+	login = strings.TrimSpace(login)
+	if login == "" || password == "" {
+		return nil, errLDAPInvalidCredentials
+	}
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if b.cfg.BindDN != "" {
+		if err := conn.Bind(b.cfg.BindDN, b.cfg.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	attrs := []string{b.cfg.AttrUID, b.cfg.AttrEmail, b.cfg.AttrName, b.cfg.AttrGroups}
+	filter := strings.ReplaceAll(b.cfg.UserFilter, "{login}", ldapEscapeFilter(login))
+	entries, err := conn.Search(b.cfg.BaseDN, ldapScopeSubtree, filter, attrs, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, errLDAPUserNotFound
+	}
+	if len(entries) > 1 {
+		return nil, errors.New("ldap: login matches several entries")
+	}
+	e := entries[0]
+	if err := conn.Bind(e.DN, password); err != nil {
+		return nil, err
+	}
+	id := &ldapIdentity{DN: e.DN, UID: e.first(b.cfg.AttrUID), Email: strings.TrimSpace(e.first(b.cfg.AttrEmail)), Name: strings.TrimSpace(e.first(b.cfg.AttrName))}
+	if id.UID == "" {
+		id.UID = normalizeDN(e.DN)
+	} else if !utf8.ValidString(id.UID) {
+		// binary identifiers such as AD objectGUID
+		id.UID = hex.EncodeToString([]byte(id.UID))
+	}
+	if b.cfg.GroupBaseDN != "" {
+		// group lookups may not be permitted for the user; use the service account again
+		if b.cfg.BindDN != "" {
+			if err := conn.Bind(b.cfg.BindDN, b.cfg.BindPassword); err != nil {
+				return nil, err
+			}
+		}
+		gf := strings.ReplaceAll(b.cfg.GroupFilter, "{dn}", ldapEscapeFilter(e.DN))
+		groups, err := conn.Search(b.cfg.GroupBaseDN, ldapScopeSubtree, gf, []string{"cn"}, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			id.Groups = append(id.Groups, normalizeDN(g.DN))
+		}
+	} else {
+		for _, g := range e.Attrs[strings.ToLower(b.cfg.AttrGroups)] {
+			id.Groups = append(id.Groups, normalizeDN(g))
+		}
+	}
+	return id, nil
+}
+
+// authenticate checks email/login and password against LDAP (when configured)
+// and the local users table, honoring LDAP_LOCAL_FALLBACK.
+func (a *api) authenticate(ctx context.Context, login, password string) (User, error) {
+	if a.ldap == nil {
+		return a.store.Authenticate(ctx, login, password)
+	}
+	id, err := a.ldap.Authenticate(login, password)
+	if err == nil {
+		return a.provisionLDAPUser(ctx, id)
+	}
+	if !errors.Is(err, errLDAPUserNotFound) && !errors.Is(err, errLDAPInvalidCredentials) {
+		a.log.Error("ldap auth", "err", err)
+	}
+	u, lerr := a.store.Authenticate(ctx, login, password)
+	if lerr != nil {
+		return User{}, lerr
+	}
+	if !a.ldap.localLoginAllowed(u) {
+		return User{}, ErrNotFound
+	}
+	if a.ldap.cfg.LocalFallback != "all" {
+		a.log.Info("ldap: local break-glass login", "user_id", u.ID)
+	}
+	return u, nil
+}
+
+// localLoginAllowed applies LDAP_LOCAL_FALLBACK to a user whose local password matched:
+// "all" lets everyone in, "none" nobody, anything else (default "admins") only site admins.
+func (b *ldapBackend) localLoginAllowed(u User) bool {
+	switch b.cfg.LocalFallback {
+	case "all":
+		return true
+	case "none":
+		return false
+	}
+	return u.IsAdmin
+}
+
+// provisionLDAPUser creates or updates the local user for a directory identity
+// and syncs mapped group memberships and the admin flag.
+func (a *api) provisionLDAPUser(ctx context.Context, id *ldapIdentity) (User, error) {
+	email := id.Email
+	if email == "" {
+		sum := sha256.Sum256([]byte(id.UID))
+		email = "ldap-" + hex.EncodeToString(sum[:8]) + "@users.noreply.local"
+	}
+	name := id.Name
+	if name == "" {
+		name = email
+	}
+	// the directory is operator-controlled, so its addresses are always trusted for linking
+	u, err := a.store.EnsureOAuthUser(ctx, "ldap", id.UID, email, name, true)
+	if err != nil {
+		return User{}, err
+	}
+	if !u.IsActive {
+		return User{}, errors.New("user_inactive")
+	}
+	var newName, newEmail *string
+	if u.Name != name {
+		newName = &name
+	}
+	if !strings.EqualFold(u.Email, email) {
+		newEmail = &email
+	}
+	var isAdmin *bool
+	if len(a.ldap.cfg.AdminGroups) > 0 {
+		v := false
+		for _, g := range a.ldap.cfg.AdminGroups {
+			if containsString(id.Groups, g) {
+				v = true
+			}
+		}
+		if v != u.IsAdmin {
+			isAdmin = &v
+		}
+	}
+	if newName != nil || newEmail != nil || isAdmin != nil {
+		if err := a.store.AdminUpdateUser(ctx, u.ID, newName, newEmail, isAdmin, nil, nil, nil); err != nil {
+			// e.g. the directory email is already taken by another local account
+			a.log.Error("ldap: update user", "user_id", u.ID, "err", err)
+		} else {
+			if newName != nil {
+				u.Name = name
+			}
+			if newEmail != nil {
+				u.Email = email
+			}
+			if isAdmin != nil {
+				u.IsAdmin = *isAdmin
+				a.logUserSecurityEvent(ctx, u.ID, secAdminRoleChange, map[string]any{"is_admin": *isAdmin, "by": "ldap"})
+			}
+		}
+	}
+	if len(a.ldap.cfg.GroupMap) > 0 {
+		managed := make([]string, 0, len(a.ldap.cfg.GroupMap))
+		var member []string
+		for dn, g := range a.ldap.cfg.GroupMap {
+			managed = append(managed, g)
+			if containsString(id.Groups, dn) {
+				member = append(member, g)
+			}
+		}
+		if err := a.store.SyncManagedGroups(ctx, a.envOrgID("LDAP_ORG_ID"), u.ID, managed, member); err != nil {
+			a.log.Error("ldap: sync groups", "user_id", u.ID, "err", err)
+		} else {
+			a.bus.AccessChanged()
+		}
+	}
+	return u, nil
+}
@@ -11,17 +11,7 @@ func (a *api) handleListsByBoard(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
-	u, errU := a.currentUser(r)
-	if errU != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
-	ok, e := a.store.CanAccessBoard(r.Context(), u.ID, id)
-	if e != nil {
-		a.log.Error("access check", "err", e)
-	}
-	if !ok {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActBoardView, boardResource(id)); !ok {
 		return
 	}
 	items, err := a.store.ListsByBoard(r.Context(), id)
@@ -39,6 +29,9 @@ func (a *api) handleCreateList(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	if _, ok := a.authorize(w, r, ActListCreate, boardResource(id)); !ok {
+		return
+	}
 	var req struct {
 		Title string `json:"title"`
 	}
@@ -55,6 +48,7 @@ func (a *api) handleCreateList(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 500, "internal error")
 		return
 	}
+	w.Header().Set("ETag", etag(l.Version))
 	writeJSON(w, 201, l)
 	a.bus.Publish(Event{Type: "list.created", Entity: "list", BoardID: l.BoardID, ListID: &l.ID, Payload: l})
 }
@@ -65,33 +59,33 @@ func (a *api) handleUpdateList(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	if _, ok := a.authorize(w, r, ActListUpdate, listResource(id)); !ok {
+		return
+	}
 	var req struct {
-		Title *string `json:"title"`
-		Pos   *int64  `json:"pos"`
-		Color *string `json:"color"`
+		Title   *string `json:"title"`
+		Pos     *int64  `json:"pos"`
+		Color   *string `json:"color"`
+		Version *int64  `json:"version"`
 	}
 	if err := readJSON(w, r, &req); err != nil {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	if err := a.store.UpdateList(r.Context(), id, req.Title, req.Pos); err != nil {
-		if errors.Is(err, ErrNotFound) {
-			writeError(w, 404, "not found")
-			return
-		}
-		a.log.Error("update list", "err", err)
-		writeError(w, 500, "internal error")
+	ifVersion, ok := ifMatch(w, r, req.Version)
+	if !ok {
 		return
 	}
-	if req.Color != nil {
-		if _, err := a.store.db.ExecContext(r.Context(), `update lists set color=$1 where id=$2`, *req.Color, id); err != nil {
-			a.log.Error("update list color", "err", err)
-		}
+	version, err := a.store.UpdateList(r.Context(), id, ifVersion, req.Title, req.Pos, req.Color)
+	if err != nil {
+		a.versionedWriteFailed(w, r, "list", id, err)
+		return
 	}
-	writeJSON(w, 200, map[string]any{"ok": true})
+	w.Header().Set("ETag", etag(version))
+	writeJSON(w, 200, map[string]any{"ok": true, "version": version})
 	if bid, e := a.store.BoardIDByList(r.Context(), id); e == nil {
 		aID := id
-		a.bus.Publish(Event{Type: "list.updated", Entity: "list", BoardID: bid, ListID: &aID, Payload: map[string]any{"id": id}})
+		a.bus.Publish(Event{Type: "list.updated", Entity: "list", BoardID: bid, ListID: &aID, Payload: map[string]any{"id": id, "version": version}})
 	}
 }
 
@@ -101,6 +95,11 @@ func (a *api) handleDeleteList(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	if _, ok := a.authorize(w, r, ActListDelete, listResource(id)); !ok {
+		return
+	}
+	// resolve the board before the row is gone, for the event below
+	bid, _ := a.store.BoardIDByList(r.Context(), id)
 	if err := a.store.DeleteList(r.Context(), id); err != nil {
 		if errors.Is(err, ErrNotFound) {
 			writeError(w, 404, "not found")
@@ -111,7 +110,7 @@ func (a *api) handleDeleteList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
-	if bid, e := a.store.BoardIDByList(r.Context(), id); e == nil {
+	if bid != 0 {
 		aID := id
 		a.bus.Publish(Event{Type: "list.deleted", Entity: "list", BoardID: bid, ListID: &aID, Payload: map[string]any{"id": id}})
 	}
@@ -123,30 +122,44 @@ func (a *api) handleMoveList(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "bad id")
 		return
 	}
+	if _, ok := a.authorize(w, r, ActListMove, listResource(id)); !ok {
+		return
+	}
 	var req struct {
-		NewIndex      int   `json:"new_index"`
-		TargetBoardID int64 `json:"target_board_id"`
+		NewIndex      int    `json:"new_index"`
+		TargetBoardID int64  `json:"target_board_id"`
+		Version       *int64 `json:"version"`
 	}
 	if err := readJSON(w, r, &req); err != nil {
 		writeError(w, 400, "invalid payload")
 		return
 	}
+	if req.TargetBoardID != 0 {
+		// moving to another board adds a list there
+		if _, ok := a.authorize(w, r, ActListCreate, boardResource(req.TargetBoardID)); !ok {
+			return
+		}
+		if !a.sameOrg(w, r, "list", id, "board", req.TargetBoardID) {
+			return
+		}
+	}
+	ifVersion, ok := ifMatch(w, r, req.Version)
+	if !ok {
+		return
+	}
 	var srcBid int64
 	if bid, e := a.store.BoardIDByList(r.Context(), id); e == nil {
 		srcBid = bid
 	}
-	if err := a.store.MoveList(r.Context(), id, req.TargetBoardID, req.NewIndex); err != nil {
-		if errors.Is(err, ErrNotFound) {
-			writeError(w, 404, "not found")
-			return
-		}
-		a.log.Error("move list", "err", err)
-		writeError(w, 500, "internal error")
+	version, err := a.store.MoveList(r.Context(), id, req.TargetBoardID, req.NewIndex, ifVersion)
+	if err != nil {
+		a.versionedWriteFailed(w, r, "list", id, err)
 		return
 	}
-	writeJSON(w, 200, map[string]any{"ok": true})
+	w.Header().Set("ETag", etag(version))
+	writeJSON(w, 200, map[string]any{"ok": true, "version": version})
 	if dstBid, e := a.store.BoardIDByList(r.Context(), id); e == nil {
-		a.bus.Publish(Event{Type: "list.moved", Entity: "list", BoardID: dstBid, ListID: &id, Payload: map[string]any{"id": id, "new_index": req.NewIndex}})
+		a.bus.Publish(Event{Type: "list.moved", Entity: "list", BoardID: dstBid, ListID: &id, Payload: map[string]any{"id": id, "new_index": req.NewIndex, "version": version}})
 		if srcBid != 0 && srcBid != dstBid {
 			a.bus.Publish(Event{Type: "list.deleted", Entity: "list", BoardID: srcBid, ListID: &id, Payload: map[string]any{"id": id}})
 		}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oidcFlow is the server-side half of an in-flight authorization request,
+// keyed by the state value that also lives in the oauth_state cookie.
+type oidcFlow struct {
+	Provider  string
+	Nonce     string
+	Verifier  string
+	Redirect  string
+	ExpiresAt time.Time
+}
+
+func (a *api) putOIDCFlow(state string, f oidcFlow) {
+	a.oidcMu.Lock()
+	defer a.oidcMu.Unlock()
+	now := time.Now()
+	for k, v := range a.oidcFlows {
+		if now.After(v.ExpiresAt) {
+			delete(a.oidcFlows, k)
+		}
+	}
+	a.oidcFlows[state] = f
+}
+
+func (a *api) takeOIDCFlow(state string) (oidcFlow, bool) {
+	a.oidcMu.Lock()
+	defer a.oidcMu.Unlock()
+	f, ok := a.oidcFlows[state]
+	if !ok {
+		return oidcFlow{}, false
+	}
+	delete(a.oidcFlows, state)
+	if time.Now().After(f.ExpiresAt) {
+		return oidcFlow{}, false
+	}
+	return f, true
+}
+
+func (a *api) oidcProviderByID(id string) *oidcProvider {
+	for _, p := range a.oidc {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64RawURL(b)
+}
+
+// GET /api/auth/oidc/{provider}/start
+func (a *api) handleOIDCStart(w http.ResponseWriter, r *http.Request) {
+	p := a.oidcProviderByID(r.PathValue("provider"))
+	if p == nil {
+		writeError(w, 404, "provider not configured")
+		return
+	}
+	a.redirectToProvider(w, r, p.ID, randomToken(16))
+}
+
+// oidcAuthURL registers the server side of the flow under state and returns the
+// provider's authorization URL.
+func (a *api) oidcAuthURL(r *http.Request, p *oidcProvider, state string) (string, error) {
+	flow := oidcFlow{
+		Provider:  p.ID,
+		Nonce:     randomToken(16),
+		Verifier:  randomToken(32),
+		Redirect:  a.oauthRedirectURI(r, p.RedirectURL, "/api/auth/oidc/"+p.ID+"/callback"),
+		ExpiresAt: time.Now().Add(5 * time.Minute),
+	}
+	authURL, err := p.authCodeURL(r.Context(), flow.Redirect, state, flow.Nonce, flow.Verifier)
+	if err != nil {
+		return "", err
+	}
+	a.putOIDCFlow(state, flow)
+	return authURL, nil
+}
+
+// GET /api/auth/oidc/{provider}/callback
+func (a *api) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := a.oidcProviderByID(r.PathValue("provider"))
+	if p == nil {
+		writeError(w, 404, "provider not configured")
+		return
+	}
+	qs := r.URL.Query()
+	if e := qs.Get("error"); e != "" {
+		a.log.Info("oidc provider error", "provider", p.ID, "error", e, "desc", qs.Get("error_description"))
+		http.Redirect(w, r, "/web/login.html", http.StatusFound)
+		return
+	}
+	code := qs.Get("code")
+	st := qs.Get("state")
+	if code == "" || st == "" {
+		writeError(w, 400, "bad oauth response")
+		return
+	}
+	if have, err := a.readStateCookie(r); err != nil || have == "" || have != st {
+		writeError(w, 400, "state mismatch")
+		return
+	}
+	a.clearStateCookie(w)
+	flow, ok := a.takeOIDCFlow(st)
+	if !ok || flow.Provider != p.ID {
+		writeError(w, 400, "state mismatch")
+		return
+	}
+	rawID, access, err := p.exchange(r.Context(), code, flow.Redirect, flow.Verifier)
+	if err != nil {
+		a.log.Error("oidc token", "provider", p.ID, "err", err)
+		writeError(w, 502, "oauth error")
+		return
+	}
+	claims, err := p.verifyIDToken(r.Context(), rawID, flow.Nonce)
+	if err != nil {
+		a.log.Error("oidc id_token", "provider", p.ID, "err", err)
+		writeError(w, 401, "invalid id token")
+		return
+	}
+	if claims.Email == "" || claims.Name == "" {
+		if err := p.userinfo(r.Context(), access, claims); err != nil {
+			a.log.Info("oidc userinfo", "provider", p.ID, "err", err)
+		}
+	}
+	email := strings.TrimSpace(claims.Email)
+	// Only trust the address for account linking when the IdP vouches for it.
+	if email == "" || !(claims.emailVerified() || p.TrustEmail) {
+		sum := sha256.Sum256([]byte(claims.Subject))
+		email = "oidc-" + p.ID + "-" + hex.EncodeToString(sum[:8]) + "@users.noreply.local"
+	}
+	name := strings.TrimSpace(claims.Name)
+	if name == "" {
+		name = claims.PreferredUsername
+	}
+	if name == "" {
+		name = email
+	}
+	a.completeOAuth(w, r, st, p.ID, claims.Subject, email, name)
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Organizations (tenants). Every request works in an active organization: the X-Org-ID
+// header, else the org cookie set by PUT /api/me/org, else the user's first organization.
+// Listings and new boards, projects and groups use it; boards and projects addressed by
+// id are checked through roles, which only count for members of their organization.
+
+const orgCookieName = "trellolite_org"
+
+var errNotOrgMember = errors.New("not a member of this organization")
+
+// orgAutoJoin is what happens to a user without any organization (ORG_AUTO_JOIN):
+// "default" joins the default organization, "personal" creates their own, "none" leaves
+// them without one until they are invited.
+func orgAutoJoin() string {
+	switch v := strings.ToLower(getenv("ORG_AUTO_JOIN", "default")); v {
+	case "personal", "none":
+		return v
+	}
+	return "default"
+}
+
+// orgCreateAllowed reports whether u may create organizations (ORG_CREATE=all|admin; never guests).
+func orgCreateAllowed(u *User) bool {
+	return u.IsAdmin || (!u.IsGuest && getenv("ORG_CREATE", "all") != "admin")
+}
+
+// envOrgID returns the organization named by env var name (SCIM_ORG_ID, LDAP_ORG_ID) for
+// the groups SCIM and LDAP manage, the default organization when it is unset. main checks
+// the value at startup.
+func (a *api) envOrgID(name string) int64 {
+	if id, err := strconv.ParseInt(getenv(name, ""), 10, 64); err == nil {
+		return id
+	}
+	return a.store.DefaultOrgID()
+}
+
+// orgRoleOf returns u's role in the organization; instance admins act as owners.
+// ErrNotFound when the organization doesn't exist or u isn't a member.
+func (a *api) orgRoleOf(ctx context.Context, u *User, orgID int64) (int, error) {
+	if u.IsAdmin {
+		if _, err := a.store.GetOrg(ctx, orgID); err != nil {
+			return 0, err
+		}
+		return OrgRoleOwner, nil
+	}
+	return a.store.OrgRole(ctx, orgID, u.ID)
+}
+
+// selectOrg returns organization id if u may work in it.
+func (a *api) selectOrg(ctx context.Context, u *User, id int64) (Org, error) {
+	o, err := a.store.GetOrg(ctx, id)
+	if err != nil {
+		return Org{}, err
+	}
+	role, err := a.store.OrgRole(ctx, id, u.ID)
+	switch {
+	case err == nil:
+		o.Role = role
+	case errors.Is(err, ErrNotFound) && u.IsAdmin:
+	case errors.Is(err, ErrNotFound):
+		return Org{}, errNotOrgMember
+	default:
+		return Org{}, err
+	}
+	return o, nil
+}
+
+// activeOrg resolves the organization the request works in, see the top of this file.
+// r may be nil (background work), then only the user's memberships count.
+func (a *api) activeOrg(ctx context.Context, r *http.Request, u *User) (Org, error) {
+	if r != nil {
+		if v := strings.TrimSpace(r.Header.Get("X-Org-ID")); v != "" {
+			id, err := parseID(v)
+			if err != nil {
+				return Org{}, errNotOrgMember
+			}
+			o, err := a.selectOrg(ctx, u, id)
+			if errors.Is(err, ErrNotFound) {
+				return Org{}, errNotOrgMember
+			}
+			return o, err
+		}
+		if c, err := r.Cookie(orgCookieName); err == nil {
+			if id, err := parseID(c.Value); err == nil {
+				// a stale cookie (left or deleted organization) falls through
+				if o, err := a.selectOrg(ctx, u, id); err == nil {
+					return o, nil
+				}
+			}
+		}
+	}
+	orgs, err := a.store.ListOrgs(ctx, u.ID, false)
+	if err != nil {
+		return Org{}, err
+	}
+	if len(orgs) > 0 {
+		return orgs[0], nil
+	}
+	// guests only reach organizations through invitations
+	if u.IsGuest {
+		return Org{}, errNotOrgMember
+	}
+	switch orgAutoJoin() {
+	case "personal":
+		name := strings.TrimSpace(u.Name)
+		if name == "" {
+			name = u.Email
+		}
+		if name == "" {
+			name = "Workspace"
+		}
+		return a.store.CreateOrg(ctx, name, u.ID)
+	case "none":
+		return Org{}, errNotOrgMember
+	}
+	if err := a.store.JoinOrg(ctx, a.store.DefaultOrgID(), u.ID, OrgRoleMember); err != nil {
+		return Org{}, err
+	}
+	o, err := a.store.GetOrg(ctx, a.store.DefaultOrgID())
+	o.Role = OrgRoleMember
+	return o, err
+}
+
+// requireOrg is the handler-side wrapper around activeOrg: it answers 403/500 itself.
+func (a *api) requireOrg(w http.ResponseWriter, r *http.Request, u *User) (Org, bool) {
+	o, err := a.activeOrg(r.Context(), r, u)
+	switch {
+	case errors.Is(err, errNotOrgMember):
+		writeError(w, 403, "not a member of this organization")
+		return Org{}, false
+	case err != nil:
+		a.log.Error("active org", "err", err)
+		writeError(w, 500, "internal error")
+		return Org{}, false
+	}
+	return o, true
+}
+
+// sameOrg answers 400 unless the two entities (kind, id) belong to the same organization.
+func (a *api) sameOrg(w http.ResponseWriter, r *http.Request, kindA string, idA int64, kindB string, idB int64) bool {
+	orgA, err := a.store.OrgOf(r.Context(), kindA, idA)
+	if err == nil {
+		var orgB int64
+		orgB, err = a.store.OrgOf(r.Context(), kindB, idB)
+		if err == nil && orgA != orgB {
+			writeError(w, 400, kindB+" belongs to another organization")
+			return false
+		}
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+		return false
+	case err != nil:
+		a.log.Error("org check", "err", err)
+		writeError(w, 500, "internal error")
+		return false
+	}
+	return true
+}
+
+// pathOrg parses {id} and returns it with u's role there; it answers 400/404/500 itself.
+func (a *api) pathOrg(w http.ResponseWriter, r *http.Request, u *User) (int64, int, bool) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return 0, 0, false
+	}
+	role, err := a.orgRoleOf(r.Context(), u, id)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "not found")
+		return 0, 0, false
+	}
+	if err != nil {
+		a.log.Error("org role", "err", err)
+		writeError(w, 500, "internal error")
+		return 0, 0, false
+	}
+	return id, role, true
+}
+
+// GET /api/orgs[?all=1] — the user's organizations; instance admins may list all.
+func (a *api) handleListOrgs(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	all := u.IsAdmin && r.URL.Query().Get("all") == "1"
+	orgs, err := a.store.ListOrgs(r.Context(), u.ID, all)
+	if err != nil {
+		a.log.Error("list orgs", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, orgs)
+}
+
+// POST /api/orgs {name}
+func (a *api) handleCreateOrg(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	if !orgCreateAllowed(u) {
+		writeError(w, 403, "forbidden")
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(w, r, &req); err != nil || strings.TrimSpace(req.Name) == "" {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	o, err := a.store.CreateOrg(r.Context(), strings.TrimSpace(req.Name), u.ID)
+	if err != nil {
+		a.log.Error("create org", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	a.log.Info("org created", "org_id", o.ID, "by", u.ID)
+	writeJSON(w, 201, o)
+}
+
+// GET /api/orgs/{id}
+func (a *api) handleGetOrg(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, role, ok := a.pathOrg(w, r, u)
+	if !ok {
+		return
+	}
+	o, err := a.store.GetOrg(r.Context(), id)
+	if err != nil {
+		a.log.Error("get org", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	o.Role = role
+	writeJSON(w, 200, o)
+}
+
+// PATCH /api/orgs/{id} {name} — org admins
+func (a *api) handleUpdateOrg(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, role, ok := a.pathOrg(w, r, u)
+	if !ok {
+		return
+	}
+	if role < OrgRoleAdmin {
+		writeError(w, 403, "forbidden")
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := readJSON(w, r, &req); err != nil || strings.TrimSpace(req.Name) == "" {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if err := a.store.RenameOrg(r.Context(), id, strings.TrimSpace(req.Name)); err != nil {
+		a.log.Error("rename org", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// DELETE /api/orgs/{id} — org owners; deletes all boards, projects and groups of the
+// organization. The default organization can't be deleted.
+func (a *api) handleDeleteOrg(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, role, ok := a.pathOrg(w, r, u)
+	if !ok {
+		return
+	}
+	if role < OrgRoleOwner {
+		writeError(w, 403, "forbidden")
+		return
+	}
+	if id == a.store.DefaultOrgID() {
+		writeError(w, 400, "the default organization cannot be deleted")
+		return
+	}
+	if err := a.store.DeleteOrg(r.Context(), id); err != nil {
+		a.log.Error("delete org", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	a.log.Info("org deleted", "org_id", id, "by", u.ID)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// GET /api/orgs/{id}/members — any member
+func (a *api) handleOrgMembers(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, _, ok := a.pathOrg(w, r, u)
+	if !ok {
+		return
+	}
+	items, err := a.store.OrgMembers(r.Context(), id)
+	if err != nil {
+		a.log.Error("org members", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, items)
+}
+
+// parseOrgRole validates an org role that a manager with role mine may grant:
+// admins grant member/admin, owners also owner.
+func parseOrgRole(v *int, def, mine int) (int, bool) {
+	if v == nil {
+		return def, true
+	}
+	if *v < OrgRoleMember || *v > OrgRoleOwner || *v > mine {
+		return 0, false
+	}
+	return *v, true
+}
+
+// POST /api/orgs/{id}/members {user_id | email, role?} — org admins
+func (a *api) handleAddOrgMember(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, mine, ok := a.pathOrg(w, r, u)
+	if !ok {
+		return
+	}
+	if mine < OrgRoleAdmin {
+		writeError(w, 403, "forbidden")
+		return
+	}
+	var req struct {
+		UserID int64  `json:"user_id"`
+		Email  string `json:"email"`
+		Role   *int   `json:"role"`
+	}
+	if err := readJSON(w, r, &req); err != nil || (req.UserID == 0 && strings.TrimSpace(req.Email) == "") {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	role, ok := parseOrgRole(req.Role, OrgRoleMember, mine)
+	if !ok {
+		writeError(w, 400, "invalid role")
+		return
+	}
+	var target User
+	if req.UserID != 0 {
+		target, err = a.store.UserByID(r.Context(), req.UserID)
+	} else {
+		target, err = a.store.userByEmail(r.Context(), strings.TrimSpace(req.Email))
+	}
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "user not found")
+		return
+	}
+	if err != nil {
+		a.log.Error("add org member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if _, err := a.store.OrgRole(r.Context(), id, target.ID); err == nil {
+		writeError(w, 409, "already a member")
+		return
+	}
+	if err := a.store.JoinOrg(r.Context(), id, target.ID, role); err != nil {
+		a.log.Error("add org member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true, "user_id": target.ID, "role": role})
+}
+
+// PATCH /api/orgs/{id}/members/{uid} {role} — org admins, up to their own role
+func (a *api) handleUpdateOrgMember(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, mine, ok := a.pathOrg(w, r, u)
+	if !ok {
+		return
+	}
+	uid, err := parseID(r.PathValue("uid"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if mine < OrgRoleAdmin {
+		writeError(w, 403, "forbidden")
+		return
+	}
+	var req struct {
+		Role *int `json:"role"`
+	}
+	if err := readJSON(w, r, &req); err != nil || req.Role == nil {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	role, ok := parseOrgRole(req.Role, OrgRoleMember, mine)
+	if !ok {
+		writeError(w, 400, "invalid role")
+		return
+	}
+	cur, err := a.store.OrgRole(r.Context(), id, uid)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "not a member")
+		return
+	}
+	if err != nil {
+		a.log.Error("update org member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if cur > mine {
+		writeError(w, 403, "cannot manage a role above your own")
+		return
+	}
+	if !a.keepsOrgOwner(w, r, id, cur, role) {
+		return
+	}
+	if err := a.store.SetOrgMemberRole(r.Context(), id, uid, role); err != nil {
+		a.log.Error("update org member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// DELETE /api/orgs/{id}/members/{uid} — org admins; any member may leave.
+func (a *api) handleRemoveOrgMember(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	id, mine, ok := a.pathOrg(w, r, u)
+	if !ok {
+		return
+	}
+	uid, err := parseID(r.PathValue("uid"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	cur, err := a.store.OrgRole(r.Context(), id, uid)
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, 404, "not a member")
+		return
+	}
+	if err != nil {
+		a.log.Error("remove org member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if uid != u.ID && (mine < OrgRoleAdmin || cur > mine) {
+		writeError(w, 403, "forbidden")
+		return
+	}
+	if !a.keepsOrgOwner(w, r, id, cur, 0) {
+		return
+	}
+	if err := a.store.RemoveOrgMember(r.Context(), id, uid); err != nil {
+		a.log.Error("remove org member", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// keepsOrgOwner answers 409 when changing a member from role cur to next would leave
+// the organization without an owner.
+func (a *api) keepsOrgOwner(w http.ResponseWriter, r *http.Request, orgID int64, cur, next int) bool {
+	if cur < OrgRoleOwner || next >= OrgRoleOwner {
+		return true
+	}
+	n, err := a.store.OrgOwners(r.Context(), orgID)
+	if err != nil {
+		a.log.Error("org owners", "err", err)
+		writeError(w, 500, "internal error")
+		return false
+	}
+	if n <= 1 {
+		writeError(w, 409, "the organization needs another owner first")
+		return false
+	}
+	return true
+}
+
+// PUT /api/me/org {org_id} — selects the active organization (cookie).
+func (a *api) handleSetActiveOrg(w http.ResponseWriter, r *http.Request) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	var req struct {
+		OrgID int64 `json:"org_id"`
+	}
+	if err := readJSON(w, r, &req); err != nil || req.OrgID == 0 {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	o, err := a.selectOrg(r.Context(), u, req.OrgID)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+		return
+	case errors.Is(err, errNotOrgMember):
+		writeError(w, 403, "not a member of this organization")
+		return
+	case err != nil:
+		a.log.Error("set active org", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     orgCookieName,
+		Value:    strconv.FormatInt(o.ID, 10),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   a.secureCookie(),
+		SameSite: a.sameSite(),
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+	})
+	writeJSON(w, 200, o)
+}
+
+// requireOrgMember answers 404 "user not found" unless userID is a member of the
+// organization of entity kind/id: members are only added from within the organization,
+// everybody else joins through an invitation.
+func (a *api) requireOrgMember(w http.ResponseWriter, r *http.Request, kind string, id, userID int64) bool {
+	orgID, err := a.store.OrgOf(r.Context(), kind, id)
+	if err == nil {
+		_, err = a.store.OrgRole(r.Context(), orgID, userID)
+	}
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "user not found")
+		return false
+	case err != nil:
+		a.log.Error("org member check", "err", err)
+		writeError(w, 500, "internal error")
+		return false
+	}
+	return true
+}
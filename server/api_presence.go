@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// GET /api/boards/{id}/presence
+// Who has the board open (an SSE or WebSocket stream) and which card each of them is editing.
+func (a *api) handleBoardPresence(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActBoardView, boardResource(id)); !ok {
+		return
+	}
+	writeJSON(w, 200, a.bus.Presence(id))
+}
+
+// PUT /api/cards/{id}/editing marks the card as being edited by the current user,
+// DELETE clears it. Clients repeat the PUT while the editor is open; the mark lapses
+// a minute after the last one.
+func (a *api) handleCardEditing(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	editing := r.Method == http.MethodPut
+	act := ActBoardView // stopping is always allowed
+	if editing {
+		act = ActCardUpdate
+	}
+	u, ok := a.authorize(w, r, act, cardResource(id))
+	if !ok {
+		return
+	}
+	boardID, _, err := a.store.BoardAndListByCard(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("card editing", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	a.bus.SetEditing(boardID, id, u, editing)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
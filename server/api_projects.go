@@ -1,17 +1,32 @@
 package main
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// projectsRequired reports PROJECTS_REQUIRED: every board must belong to a project,
+// so access is expressed through project roles. Orphan boards are moved into their
+// owners' default projects at startup (see Store.MigrateDefaultProjects).
+func projectsRequired() bool { return getenv("PROJECTS_REQUIRED", "false") == "true" }
+
 func (a *api) handleListProjects(w http.ResponseWriter, r *http.Request) {
 	u, err := a.currentUser(r)
 	if err != nil {
 		writeError(w, 401, "unauthorized")
 		return
 	}
-	items, e := a.store.ListProjects(r.Context(), u.ID)
+	if u.IsGuest {
+		writeJSON(w, 200, []Project{})
+		return
+	}
+	org, ok := a.requireOrg(w, r, u)
+	if !ok {
+		return
+	}
+	items, e := a.store.ListProjects(r.Context(), u.ID, org.ID)
 	if e != nil {
 		a.log.Error("list projects", "err", e)
 		writeError(w, 500, "internal error")
@@ -33,7 +48,14 @@ func (a *api) handleCreateProject(w http.ResponseWriter, r *http.Request) {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	p, e := a.store.CreateProject(r.Context(), u.ID, strings.TrimSpace(req.Name))
+	if denyGuest(w, u) {
+		return
+	}
+	org, ok := a.requireOrg(w, r, u)
+	if !ok {
+		return
+	}
+	p, e := a.store.CreateProject(r.Context(), org.ID, u.ID, strings.TrimSpace(req.Name))
 	if e != nil {
 		a.log.Error("create project", "err", e)
 		writeError(w, 500, "internal error")
@@ -43,18 +65,12 @@ func (a *api) handleCreateProject(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *api) handleProjectMembers(w http.ResponseWriter, r *http.Request) {
-	u, err := a.currentUser(r)
-	if err != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
 	id, e := parseID(r.PathValue("id"))
 	if e != nil {
 		writeError(w, 400, "bad id")
 		return
 	}
-	if ok, e := a.store.CanAccessProject(r.Context(), id, u.ID); e != nil || !ok {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActProjectView, projectResource(id)); !ok {
 		return
 	}
 	items, e2 := a.store.ProjectMembers(r.Context(), id)
@@ -67,42 +83,43 @@ func (a *api) handleProjectMembers(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *api) handleAddProjectMember(w http.ResponseWriter, r *http.Request) {
-	u, err := a.currentUser(r)
-	if err != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
 	id, e := parseID(r.PathValue("id"))
 	if e != nil {
 		writeError(w, 400, "bad id")
 		return
 	}
-	if own, e := a.store.IsProjectOwner(r.Context(), id, u.ID); e != nil || !own {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActProjectManageMembers, projectResource(id)); !ok {
 		return
 	}
 	var req struct {
 		UserID int64 `json:"user_id"`
-		Role   int   `json:"role"`
+		Role   *int  `json:"role"` // 0 Viewer, 1 Member, 2 Maintainer (default), 3 Owner
 	}
 	if e := readJSON(w, r, &req); e != nil || req.UserID == 0 {
 		writeError(w, 400, "invalid payload")
 		return
 	}
-	if e := a.store.AddProjectMember(r.Context(), id, req.UserID, req.Role); e != nil {
+	role := int(RoleMaintainer)
+	if req.Role != nil {
+		if *req.Role < int(RoleViewer) || *req.Role > int(RoleOwner) {
+			writeError(w, 400, "invalid role")
+			return
+		}
+		role = *req.Role
+	}
+	if !a.requireOrgMember(w, r, "project", id, req.UserID) {
+		return
+	}
+	if e := a.store.AddProjectMember(r.Context(), id, req.UserID, &role); e != nil {
 		a.log.Error("add proj member", "err", e)
 		writeError(w, 500, "internal error")
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.notifyUser(req.UserID, "project.member_added", "project", map[string]any{"project_id": id, "role": role})
 }
 
 func (a *api) handleRemoveProjectMember(w http.ResponseWriter, r *http.Request) {
-	u, err := a.currentUser(r)
-	if err != nil {
-		writeError(w, 401, "unauthorized")
-		return
-	}
 	id, e := parseID(r.PathValue("id"))
 	if e != nil {
 		writeError(w, 400, "bad id")
@@ -113,8 +130,7 @@ func (a *api) handleRemoveProjectMember(w http.ResponseWriter, r *http.Request)
 		writeError(w, 400, "bad id")
 		return
 	}
-	if own, e := a.store.IsProjectOwner(r.Context(), id, u.ID); e != nil || !own {
-		writeError(w, 403, "forbidden")
+	if _, ok := a.authorize(w, r, ActProjectManageMembers, projectResource(id)); !ok {
 		return
 	}
 	if e := a.store.RemoveProjectMember(r.Context(), id, uid); e != nil {
@@ -123,4 +139,328 @@ func (a *api) handleRemoveProjectMember(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	writeJSON(w, 200, map[string]any{"ok": true})
+	a.notifyUser(uid, "project.member_removed", "project", map[string]any{"project_id": id})
+}
+
+// GET /api/projects/{id}/groups
+func (a *api) handleProjectGroups(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActProjectView, projectResource(id)); !ok {
+		return
+	}
+	items, e := a.store.ProjectGroups(r.Context(), id)
+	if e != nil {
+		a.log.Error("project groups", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, items)
+}
+
+// POST /api/projects/{id}/groups {group_id, role?}
+// Members of the group inherit role (0 Viewer, 1 Member by default, 2 Maintainer) on the
+// project and all of its boards; posting again changes the role.
+func (a *api) handleSetProjectGroup(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActProjectManageMembers, projectResource(id)); !ok {
+		return
+	}
+	var req struct {
+		GroupID int64 `json:"group_id"`
+		Role    *int  `json:"role"`
+	}
+	if e := readJSON(w, r, &req); e != nil || req.GroupID == 0 {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	role := RoleMember
+	if req.Role != nil {
+		if *req.Role < int(RoleViewer) || *req.Role > int(RoleMaintainer) {
+			writeError(w, 400, "invalid role")
+			return
+		}
+		role = Role(*req.Role)
+	}
+	if !a.sameOrg(w, r, "project", id, "group", req.GroupID) {
+		return
+	}
+	switch e := a.store.SetProjectGroup(r.Context(), id, req.GroupID, role); {
+	case e == nil:
+		writeJSON(w, 200, map[string]any{"ok": true})
+	case errors.Is(e, ErrNotFound):
+		writeError(w, 404, "group not found")
+	default:
+		a.log.Error("set project group", "err", e)
+		writeError(w, 500, "internal error")
+	}
+}
+
+// DELETE /api/projects/{id}/groups/{gid}
+func (a *api) handleRemoveProjectGroup(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	gid, e := parseID(r.PathValue("gid"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActProjectManageMembers, projectResource(id)); !ok {
+		return
+	}
+	switch e := a.store.RemoveProjectGroup(r.Context(), id, gid); {
+	case e == nil:
+		writeJSON(w, 200, map[string]any{"ok": true})
+	case errors.Is(e, ErrNotFound):
+		writeError(w, 404, "not found")
+	default:
+		a.log.Error("remove project group", "err", e)
+		writeError(w, 500, "internal error")
+	}
+}
+
+// accessUserID is the ?user_id= of the access endpoints, defaulting to the caller.
+func accessUserID(r *http.Request, me *User) (int64, error) {
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		return strconv.ParseInt(v, 10, 64)
+	}
+	return me.ID, nil
+}
+
+// GET /api/projects/{id}/access?user_id=
+// Effective role in the project and where it comes from (owner, direct, group).
+func (a *api) handleProjectAccess(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	me, ok := a.authorize(w, r, ActProjectView, projectResource(id))
+	if !ok {
+		return
+	}
+	uid, e := accessUserID(r, me)
+	if e != nil {
+		writeError(w, 400, "bad user_id")
+		return
+	}
+	role, sources, e := a.store.ProjectAccess(r.Context(), uid, id)
+	if e != nil {
+		a.log.Error("project access", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"user_id": uid, "role": role.String(), "sources": sources})
+}
+
+// GET /api/projects/{id}
+func (a *api) handleGetProject(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	u, ok := a.authorize(w, r, ActProjectView, projectResource(id))
+	if !ok {
+		return
+	}
+	p, e := a.store.GetProject(r.Context(), id)
+	if e != nil {
+		if errors.Is(e, ErrNotFound) {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("get project", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"project": p, "my_role": a.effectiveRole(r.Context(), u, projectResource(id)).String()})
+}
+
+// PATCH /api/projects/{id} {name}
+func (a *api) handleUpdateProject(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActProjectUpdate, projectResource(id)); !ok {
+		return
+	}
+	var req struct {
+		Name *string `json:"name"`
+	}
+	if e := readJSON(w, r, &req); e != nil {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			writeError(w, 400, "name cannot be empty")
+			return
+		}
+		if e := a.store.RenameProject(r.Context(), id, name); e != nil {
+			if errors.Is(e, ErrNotFound) {
+				writeError(w, 404, "not found")
+				return
+			}
+			a.log.Error("rename project", "err", e)
+			writeError(w, 500, "internal error")
+			return
+		}
+	}
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// DELETE /api/projects/{id}
+// Boards of the project are not deleted: they are detached and stay with their owners.
+func (a *api) handleDeleteProject(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActProjectDelete, projectResource(id)); !ok {
+		return
+	}
+	boards, e := a.store.ProjectBoards(r.Context(), id, "")
+	if e != nil {
+		a.log.Error("delete project", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	members, e := a.store.ProjectMembers(r.Context(), id)
+	if e != nil {
+		a.log.Error("delete project", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	if e := a.store.DeleteProject(r.Context(), id); e != nil {
+		if errors.Is(e, ErrNotFound) {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("delete project", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, map[string]any{"ok": true, "detached_boards": len(boards)})
+	for _, b := range boards {
+		a.bus.Publish(Event{Type: "board.updated", Entity: "board", BoardID: b.ID, Payload: map[string]any{"id": b.ID, "project_id": nil}})
+	}
+	for _, m := range members {
+		a.notifyUser(m.ID, "project.deleted", "project", map[string]any{"project_id": id})
+	}
+}
+
+// PATCH /api/projects/{id}/members/{uid} {role}
+func (a *api) handleUpdateProjectMember(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	uid, e := parseID(r.PathValue("uid"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActProjectManageMembers, projectResource(id)); !ok {
+		return
+	}
+	var req struct {
+		Role *int `json:"role"` // 0 Viewer, 1 Member, 2 Maintainer, 3 Owner
+	}
+	if e := readJSON(w, r, &req); e != nil || req.Role == nil {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if *req.Role < int(RoleViewer) || *req.Role > int(RoleOwner) {
+		writeError(w, 400, "invalid role")
+		return
+	}
+	switch e := a.store.SetProjectMemberRole(r.Context(), id, uid, Role(*req.Role)); {
+	case e == nil:
+		writeJSON(w, 200, map[string]any{"ok": true})
+		a.notifyUser(uid, "project.member_updated", "project", map[string]any{"project_id": id, "role": *req.Role})
+	case errors.Is(e, ErrNotFound):
+		writeError(w, 404, "not a project member")
+	default:
+		a.log.Error("update proj member", "err", e)
+		writeError(w, 500, "internal error")
+	}
+}
+
+// POST /api/projects/{id}/transfer {user_id}
+// Hands owner_user_id over to a user who already has a role in the project.
+func (a *api) handleTransferProject(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	me, ok := a.authorize(w, r, ActProjectTransfer, projectResource(id))
+	if !ok {
+		return
+	}
+	var req struct {
+		UserID int64 `json:"user_id"`
+	}
+	if e := readJSON(w, r, &req); e != nil || req.UserID == 0 {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if role, e := a.store.ProjectRole(r.Context(), req.UserID, id); e != nil || role < RoleViewer {
+		if e != nil {
+			a.log.Error("transfer project", "err", e)
+		}
+		writeError(w, 400, "new owner must be a project member")
+		return
+	}
+	if e := a.store.TransferProjectOwnership(r.Context(), id, req.UserID); e != nil {
+		if errors.Is(e, ErrNotFound) {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("transfer project", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	a.log.Info("project ownership transferred", "project_id", id, "from", me.ID, "to", req.UserID)
+	writeJSON(w, 200, map[string]any{"ok": true})
+}
+
+// GET /api/projects/{id}/boards?sort=pos|title|created
+func (a *api) handleProjectBoards(w http.ResponseWriter, r *http.Request) {
+	id, e := parseID(r.PathValue("id"))
+	if e != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActProjectView, projectResource(id)); !ok {
+		return
+	}
+	sort := r.URL.Query().Get("sort")
+	if _, ok := projectBoardOrder[sort]; !ok {
+		writeError(w, 400, "sort must be pos, title or created")
+		return
+	}
+	items, e := a.store.ProjectBoards(r.Context(), id, sort)
+	if e != nil {
+		a.log.Error("project boards", "err", e)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, items)
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// routeActions lists every route with the action its handler authorizes against the board,
+// list, card or project in {id}. Routes that are not bound to one of those (auth, profile,
+// orgs, groups, invites, admin, SCIM, public shares) map to "": they have checks of their own.
+// A new route has to be added here.
+var routeActions = map[string]Action{
+	"POST /api/auth/register":                   "",
+	"POST /api/auth/login":                      "",
+	"POST /api/auth/logout":                     "",
+	"GET /api/auth/me":                          "",
+	"GET /api/auth/providers":                   "",
+	"GET /api/auth/oauth/github/start":          "",
+	"GET /api/auth/oauth/github/callback":       "",
+	"GET /api/auth/oauth/google/start":          "",
+	"GET /api/auth/oauth/google/callback":       "",
+	"GET /api/auth/oidc/{provider}/start":       "",
+	"GET /api/auth/oidc/{provider}/callback":    "",
+	"PATCH /api/me":                             "",
+	"GET /api/me/identities":                    "",
+	"GET /api/me/identities/{provider}/link":    "",
+	"DELETE /api/me/identities/{provider}":      "",
+	"GET /api/me/security-events":               "",
+	"PUT /api/me/org":                           "",
+	"GET /api/me/events":                        "",
+	"GET /api/orgs":                             "",
+	"POST /api/orgs":                            "",
+	"GET /api/orgs/{id}":                        "",
+	"PATCH /api/orgs/{id}":                      "",
+	"DELETE /api/orgs/{id}":                     "",
+	"GET /api/orgs/{id}/members":                "",
+	"POST /api/orgs/{id}/members":               "",
+	"PATCH /api/orgs/{id}/members/{uid}":        "",
+	"DELETE /api/orgs/{id}/members/{uid}":       "",
+	"POST /api/auth/reset":                      "",
+	"POST /api/auth/reset/confirm":              "",
+	"POST /api/auth/verify/confirm":             "",
+	"GET /api/health":                           "",
+	"POST /api/csp-report":                      "",
+	"GET /api/boards":                           "",
+	"POST /api/boards":                          "", // the project comes in the body
+	"GET /api/boards/{id}":                      ActBoardView,
+	"GET /api/boards/{id}/presence":             ActBoardView,
+	"GET /api/boards/{id}/ws":                   ActBoardView,
+	"GET /api/boards/{id}/full":                 ActBoardView,
+	"GET /api/boards/{id}/events":               ActBoardView,
+	"GET /api/boards/{id}/changes":              ActBoardView,
+	"POST /api/boards/{id}/changes":             ActBoardView, // each change is checked on its own
+	"GET /api/boards/{id}/members":              ActBoardView,
+	"GET /api/boards/{id}/access":               ActBoardView,
+	"POST /api/boards/{id}/members":             ActBoardMembers,
+	"PATCH /api/boards/{id}/members/{uid}":      ActBoardMembers,
+	"DELETE /api/boards/{id}/members/{uid}":     ActBoardMembers,
+	"POST /api/boards/{id}/transfer":            ActBoardTransfer,
+	"PUT /api/boards/{id}/project":              ActBoardProject,
+	"PATCH /api/boards/{id}":                    ActBoardUpdate,
+	"POST /api/boards/{id}/move":                ActBoardReorder,
+	"DELETE /api/boards/{id}":                   ActBoardDelete,
+	"GET /api/boards/{id}/lists":                ActBoardView,
+	"POST /api/boards/{id}/lists":               ActListCreate,
+	"PATCH /api/lists/{id}":                     ActListUpdate,
+	"POST /api/lists/{id}/move":                 ActListMove,
+	"DELETE /api/lists/{id}":                    ActListDelete,
+	"GET /api/lists/{id}/cards":                 ActBoardView,
+	"POST /api/lists/{id}/cards":                ActCardCreate,
+	"PATCH /api/cards/{id}":                     ActCardUpdate,
+	"DELETE /api/cards/{id}":                    ActCardDelete,
+	"POST /api/cards/{id}/move":                 ActCardMove,
+	"PUT /api/cards/{id}/editing":               ActCardUpdate,
+	"DELETE /api/cards/{id}/editing":            ActBoardView,
+	"GET /api/cards/{id}/doc":                   ActBoardView,
+	"POST /api/cards/{id}/doc":                  ActCardUpdate,
+	"GET /api/cards/{id}/comments":              ActBoardView,
+	"POST /api/cards/{id}/comments":             ActCommentCreate,
+	"POST /api/cards/{id}/share":                ActCardShare,
+	"GET /api/cards/{id}/share":                 ActCardShare,
+	"GET /share/{token}":                        "",
+	"GET /api/public/share/{token}":             "",
+	"POST /api/invites":                         "",
+	"GET /api/invites":                          "",
+	"DELETE /api/invites/{id}":                  "",
+	"GET /api/join/{token}":                     "",
+	"POST /api/join/{token}":                    "",
+	"POST /api/groups":                          "",
+	"GET /api/my/groups":                        "",
+	"GET /api/groups/{id}/users":                "",
+	"GET /api/groups/{id}/users/search":         "",
+	"POST /api/groups/{id}/users":               "",
+	"DELETE /api/groups/{id}/users/{uid}":       "",
+	"POST /api/groups/{id}/leave":               "",
+	"DELETE /api/groups/{id}":                   "",
+	"GET /api/boards/{id}/groups":               ActBoardShare,
+	"POST /api/boards/{id}/groups":              ActBoardShare,
+	"DELETE /api/boards/{id}/groups/{gid}":      ActBoardShare,
+	"GET /api/admin/groups":                     "",
+	"POST /api/admin/groups":                    "",
+	"DELETE /api/admin/groups/{id}":             "",
+	"GET /api/admin/groups/{id}/users":          "",
+	"POST /api/admin/groups/{id}/users":         "",
+	"DELETE /api/admin/groups/{id}/users/{uid}": "",
+	"GET /api/admin/users":                      "",
+	"PATCH /api/admin/users/{id}":               "",
+	"DELETE /api/admin/users/{id}":              "",
+	"GET /api/admin/system":                     "",
+	"POST /api/admin/projects/migrate-default":  "",
+	"GET /api/admin/security-events":            "",
+	"GET /scim/v2/ServiceProviderConfig":        "",
+	"GET /scim/v2/ResourceTypes":                "",
+	"GET /scim/v2/Users":                        "",
+	"POST /scim/v2/Users":                       "",
+	"GET /scim/v2/Users/{id}":                   "",
+	"PUT /scim/v2/Users/{id}":                   "",
+	"PATCH /scim/v2/Users/{id}":                 "",
+	"DELETE /scim/v2/Users/{id}":                "",
+	"GET /scim/v2/Groups":                       "",
+	"POST /scim/v2/Groups":                      "",
+	"GET /scim/v2/Groups/{id}":                  "",
+	"PUT /scim/v2/Groups/{id}":                  "",
+	"PATCH /scim/v2/Groups/{id}":                "",
+	"DELETE /scim/v2/Groups/{id}":               "",
+	"GET /api/projects":                         "",
+	"POST /api/projects":                        "",
+	"GET /api/projects/{id}":                    ActProjectView,
+	"PATCH /api/projects/{id}":                  ActProjectUpdate,
+	"DELETE /api/projects/{id}":                 ActProjectDelete,
+	"POST /api/projects/{id}/transfer":          ActProjectTransfer,
+	"GET /api/projects/{id}/boards":             ActProjectView,
+	"GET /api/projects/{id}/members":            ActProjectView,
+	"POST /api/projects/{id}/members":           ActProjectManageMembers,
+	"PATCH /api/projects/{id}/members/{uid}":    ActProjectManageMembers,
+	"DELETE /api/projects/{id}/members/{uid}":   ActProjectManageMembers,
+	"GET /api/projects/{id}/groups":             ActProjectView,
+	"POST /api/projects/{id}/groups":            ActProjectManageMembers,
+	"DELETE /api/projects/{id}/groups/{gid}":    ActProjectManageMembers,
+	"GET /api/projects/{id}/access":             ActProjectView,
+}
+
+type routeRecorder []string
+
+func (r *routeRecorder) HandleFunc(pattern string, _ func(http.ResponseWriter, *http.Request)) {
+	*r = append(*r, pattern)
+}
+
+func TestRouteTable(t *testing.T) {
+	var rec routeRecorder
+	(&api{}).routes(&rec)
+	seen := map[string]bool{}
+	for _, pattern := range rec {
+		seen[pattern] = true
+		if _, ok := routeActions[pattern]; !ok {
+			t.Errorf("%s is not in routeActions", pattern)
+		}
+	}
+	for pattern, act := range routeActions {
+		if !seen[pattern] {
+			t.Errorf("%s in routeActions is not registered", pattern)
+		}
+		if _, ok := wantMinRole[act]; act != "" && !ok {
+			t.Errorf("%s: unknown action %s", pattern, act)
+		}
+	}
+}
+
+// TestRouteAuthorization calls every board-, list-, card- and project-bound route as a
+// user holding each role and expects 403 exactly when the role is below the action's.
+// Each call gets a fresh board so that a delete or transfer does not leak into the next.
+func TestRouteAuthorization(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	a := newAPI(s, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	mux := http.NewServeMux()
+	a.routes(mux)
+
+	creator := testUser(t, s, "routes-creator", OrgRoleMember)
+	target := testUser(t, s, "routes-target", OrgRoleMember)
+	users := map[Role]User{}
+	tokens := map[Role]string{}
+	for _, role := range allRoles {
+		u := testUser(t, s, "routes-"+role.String(), OrgRoleMember)
+		token, _, err := s.CreateSession(ctx, u.ID, time.Hour)
+		must(t, err)
+		users[role], tokens[role] = u, token
+	}
+
+	for pattern, act := range routeActions {
+		if act == "" {
+			continue
+		}
+		method, path, _ := strings.Cut(pattern, " ")
+		for _, role := range allRoles {
+			p, err := s.CreateProject(ctx, s.defaultOrg, creator.ID, "routes project")
+			must(t, err)
+			b, err := s.CreateBoard(ctx, s.defaultOrg, creator.ID, "routes board")
+			must(t, err)
+			must(t, s.SetBoardProject(ctx, b.ID, p.ID))
+			l, err := s.CreateList(ctx, b.ID, "list")
+			must(t, err)
+			c, err := s.CreateCard(ctx, l.ID, "card", "", false)
+			must(t, err)
+			if role != RoleNone {
+				must(t, s.AddBoardMember(ctx, b.ID, users[role].ID, role, creator.ID))
+				r := int(role)
+				must(t, s.AddProjectMember(ctx, p.ID, users[role].ID, &r))
+			}
+
+			var id int64
+			switch {
+			case strings.HasPrefix(path, "/api/boards/"):
+				id = b.ID
+			case strings.HasPrefix(path, "/api/lists/"):
+				id = l.ID
+			case strings.HasPrefix(path, "/api/cards/"):
+				id = c.ID
+			case strings.HasPrefix(path, "/api/projects/"):
+				id = p.ID
+			default:
+				t.Fatalf("%s: no resource for %s", pattern, act)
+			}
+			url := strings.NewReplacer("{id}", fmt.Sprint(id), "{uid}", fmt.Sprint(target.ID), "{gid}", fmt.Sprint(target.ID)).Replace(path)
+
+			reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if strings.HasSuffix(path, "/events") {
+				reqCtx, cancel = context.WithTimeout(ctx, 100*time.Millisecond) // streams run until the client leaves
+			}
+			req := httptest.NewRequest(method, url, strings.NewReader("{}")).WithContext(reqCtx)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+tokens[role])
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			cancel()
+
+			if denied, want := w.Code == http.StatusForbidden, role < wantMinRole[act]; denied != want {
+				t.Errorf("%s as %s (%s): %d %s", pattern, role, act, w.Code, strings.TrimSpace(w.Body.String()))
+			}
+		}
+	}
+}
@@ -0,0 +1,1236 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SCIM 2.0 (RFC 7643/7644) provisioning endpoints under /scim/v2. Users map onto
+// accounts (userName is the login email), Groups onto admin-managed groups.
+
+const (
+	scimUserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimGroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimMaxResults  = 200
+)
+
+// requireSCIM authenticates provisioning requests with the SCIM_TOKEN bearer token.
+// The endpoints answer 404 while no token is configured.
+func (a *api) requireSCIM(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := getenv("SCIM_TOKEN", "")
+		if token == "" {
+			writeSCIMError(w, 404, "", "SCIM provisioning is disabled")
+			return
+		}
+		scheme, got, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			writeSCIMError(w, 401, "", "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/scim+json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]any{"schemas": []string{scimErrorSchema}, "status": strconv.Itoa(status), "detail": detail}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(w, status, body)
+}
+
+// readSCIM decodes a SCIM payload. Unlike readJSON it tolerates unknown attributes:
+// identity providers send many that we do not map.
+func readSCIM(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, r.Body)
+	return nil
+}
+
+func scimBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.Header.Get("X-Forwarded-Proto") == "https" || r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/scim/v2"
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// scimBool accepts both JSON booleans and the "True"/"False" strings some IdPs send.
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case bool:
+		*b = scimBool(t)
+	case string:
+		p, err := strconv.ParseBool(t)
+		if err != nil {
+			return err
+		}
+		*b = scimBool(p)
+	default:
+		return fmt.Errorf("not a boolean: %s", data)
+	}
+	return nil
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted"`
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+}
+
+type scimEmail struct {
+	Value   string   `json:"value"`
+	Primary scimBool `json:"primary"`
+}
+
+type scimUserInput struct {
+	ExternalID  *string     `json:"externalId"`
+	UserName    string      `json:"userName"`
+	DisplayName string      `json:"displayName"`
+	Name        *scimName   `json:"name"`
+	Emails      []scimEmail `json:"emails"`
+	Active      *scimBool   `json:"active"`
+	Password    string      `json:"password"`
+}
+
+// email picks the login email: userName when it is an address, else the primary email.
+func (in scimUserInput) email() string {
+	if u := strings.TrimSpace(in.UserName); strings.Contains(u, "@") {
+		return u
+	}
+	return primaryEmail(in.Emails)
+}
+
+func (in scimUserInput) displayName() string {
+	if in.Name != nil && strings.TrimSpace(in.Name.Formatted) != "" {
+		return strings.TrimSpace(in.Name.Formatted)
+	}
+	if v := strings.TrimSpace(in.DisplayName); v != "" {
+		return v
+	}
+	if in.Name != nil {
+		return strings.TrimSpace(in.Name.GivenName + " " + in.Name.FamilyName)
+	}
+	return ""
+}
+
+func primaryEmail(emails []scimEmail) string {
+	for _, e := range emails {
+		if e.Primary && strings.TrimSpace(e.Value) != "" {
+			return strings.TrimSpace(e.Value)
+		}
+	}
+	for _, e := range emails {
+		if strings.TrimSpace(e.Value) != "" {
+			return strings.TrimSpace(e.Value)
+		}
+	}
+	return ""
+}
+
+type scimMember struct {
+	Value string `json:"value"`
+}
+
+type scimGroupInput struct {
+	ExternalID  *string      `json:"externalId"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+}
+
+type scimPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Operations []scimPatchOp `json:"Operations"`
+}
+
+// --- filtering ---
+
+// parseSCIMFilter parses the subset of RFC 7644 filters identity providers send in
+// practice: "attr op value" terms joined with "and". Value filters on multi-valued
+// attributes are reduced to the sub-attribute, e.g. emails[type eq "work"].value.
+func parseSCIMFilter(f string) ([]ScimCond, error) {
+	toks, err := scimTokens(f)
+	if err != nil {
+		return nil, err
+	}
+	var out []ScimCond
+	for i := 0; i < len(toks); {
+		if len(out) > 0 {
+			if !strings.EqualFold(toks[i], "and") {
+				return nil, fmt.Errorf("only 'and' is supported between terms, got %q", toks[i])
+			}
+			i++
+			if i >= len(toks) {
+				return nil, errors.New("dangling 'and'")
+			}
+		}
+		attr := toks[i]
+		i++
+		if open := strings.IndexByte(attr, '['); open >= 0 && strings.HasSuffix(attr, "]") {
+			// attr[sub op value] is a complete term on attr.sub
+			inner, err := parseSCIMFilter(attr[open+1 : len(attr)-1])
+			if err != nil || len(inner) != 1 {
+				return nil, fmt.Errorf("unsupported value filter %q", attr)
+			}
+			c := inner[0]
+			c.Attr = scimAttr(attr[:open]) + "." + c.Attr
+			out = append(out, c)
+			continue
+		}
+		if i >= len(toks) {
+			return nil, fmt.Errorf("missing operator after %q", attr)
+		}
+		c := ScimCond{Attr: scimAttr(attr), Op: strings.ToLower(toks[i])}
+		i++
+		if c.Op != "pr" {
+			if i >= len(toks) {
+				return nil, fmt.Errorf("missing value for %q", attr)
+			}
+			v := toks[i]
+			i++
+			if strings.HasPrefix(v, `"`) {
+				if err := json.Unmarshal([]byte(v), &c.Value); err != nil {
+					return nil, fmt.Errorf("bad string literal %s", v)
+				}
+			} else {
+				c.Value = strings.ToLower(v)
+			}
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// scimTokens splits a filter into words and quoted strings. Brackets are kept
+// inside the attribute token they belong to.
+func scimTokens(f string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(f); {
+		switch c := f[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			return nil, errors.New("grouping is not supported")
+		case c == '"':
+			j := i + 1
+			for j < len(f) && f[j] != '"' {
+				if f[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(f) {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, f[i:j+1])
+			i = j + 1
+		default:
+			j, depth, quoted := i, 0, false
+			for j < len(f) && (quoted || depth > 0 || (f[j] != ' ' && f[j] != '\t')) {
+				switch {
+				case quoted && f[j] == '\\':
+					j++
+				case f[j] == '"':
+					quoted = !quoted
+				case !quoted && f[j] == '[':
+					depth++
+				case !quoted && f[j] == ']':
+					depth--
+				}
+				j++
+			}
+			if depth != 0 || quoted {
+				return nil, errors.New("unbalanced brackets")
+			}
+			toks = append(toks, f[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// scimAttr lowercases an attribute path, drops a schema URN prefix and reduces
+// value filters like emails[type eq "work"].value to emails.value.
+func scimAttr(p string) string {
+	p = strings.TrimSpace(p)
+	if open := strings.IndexByte(p, '['); open >= 0 {
+		if close := strings.LastIndexByte(p, ']'); close > open {
+			p = p[:open] + p[close+1:]
+		}
+	}
+	p = strings.ToLower(p)
+	if strings.HasPrefix(p, "urn:") {
+		p = p[strings.LastIndexByte(p, ':')+1:]
+	}
+	return p
+}
+
+// scimPage reads startIndex (1-based) and count, returning the SQL offset and limit.
+func scimPage(r *http.Request) (start, count int) {
+	start, count = 1, 100
+	if v, err := strconv.Atoi(r.URL.Query().Get("startIndex")); err == nil && v > 1 {
+		start = v
+	}
+	if v, err := strconv.Atoi(r.URL.Query().Get("count")); err == nil && v >= 0 {
+		count = v
+	}
+	if count > scimMaxResults {
+		count = scimMaxResults
+	}
+	return start, count
+}
+
+func scimList(start, total int, items []map[string]any) map[string]any {
+	return map[string]any{
+		"schemas":      []string{scimListSchema},
+		"totalResults": total,
+		"startIndex":   start,
+		"itemsPerPage": len(items),
+		"Resources":    items,
+	}
+}
+
+// --- users ---
+
+func (a *api) scimUserResource(r *http.Request, su ScimUser) map[string]any {
+	id := strconv.FormatInt(su.ID, 10)
+	res := map[string]any{
+		"schemas":     []string{scimUserSchema},
+		"id":          id,
+		"userName":    su.Email,
+		"displayName": su.Name,
+		"name":        map[string]string{"formatted": su.Name},
+		"emails":      []map[string]any{{"value": su.Email, "primary": true, "type": "work"}},
+		"active":      su.IsActive,
+		"meta": map[string]any{
+			"resourceType": "User",
+			"created":      su.CreatedAt.UTC().Format(time.RFC3339),
+			"location":     scimBaseURL(r) + "/Users/" + id,
+		},
+	}
+	if su.ExternalID != "" {
+		res["externalId"] = su.ExternalID
+	}
+	return res
+}
+
+func (a *api) writeSCIMUser(w http.ResponseWriter, r *http.Request, status int, id int64) {
+	su, err := a.store.ScimUserByID(r.Context(), id)
+	if err != nil {
+		a.log.Error("scim load user", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	res := a.scimUserResource(r, su)
+	if status == 201 {
+		w.Header().Set("Location", res["meta"].(map[string]any)["location"].(string))
+	}
+	writeSCIM(w, status, res)
+}
+
+// scimUserID resolves the {id} path value to an existing user, answering 404 otherwise.
+func (a *api) scimUserID(w http.ResponseWriter, r *http.Request) (ScimUser, bool) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeSCIMError(w, 404, "", "user not found")
+		return ScimUser{}, false
+	}
+	su, err := a.store.ScimUserByID(r.Context(), id)
+	if err != nil {
+		if err == ErrNotFound {
+			writeSCIMError(w, 404, "", "user not found")
+		} else {
+			a.log.Error("scim get user", "err", err)
+			writeSCIMError(w, 500, "", "internal error")
+		}
+		return ScimUser{}, false
+	}
+	return su, true
+}
+
+// emailTaken reports whether another user already uses email.
+func (a *api) emailTaken(ctx context.Context, email string, selfID int64) (bool, error) {
+	u, err := a.store.userByEmail(ctx, email)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return u.ID != selfID, nil
+}
+
+// GET /scim/v2/Users
+func (a *api) handleSCIMListUsers(w http.ResponseWriter, r *http.Request) {
+	conds, err := parseSCIMFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		writeSCIMError(w, 400, "invalidFilter", err.Error())
+		return
+	}
+	start, count := scimPage(r)
+	items, total, err := a.store.ScimUsers(r.Context(), conds, start-1, count)
+	if errors.Is(err, ErrInvalidFilter) {
+		writeSCIMError(w, 400, "invalidFilter", err.Error())
+		return
+	}
+	if err != nil {
+		a.log.Error("scim list users", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	out := make([]map[string]any, 0, len(items))
+	for _, su := range items {
+		out = append(out, a.scimUserResource(r, su))
+	}
+	writeSCIM(w, 200, scimList(start, total, out))
+}
+
+// GET /scim/v2/Users/{id}
+func (a *api) handleSCIMGetUser(w http.ResponseWriter, r *http.Request) {
+	su, ok := a.scimUserID(w, r)
+	if !ok {
+		return
+	}
+	writeSCIM(w, 200, a.scimUserResource(r, su))
+}
+
+// POST /scim/v2/Users
+func (a *api) handleSCIMCreateUser(w http.ResponseWriter, r *http.Request) {
+	var in scimUserInput
+	if err := readSCIM(w, r, &in); err != nil {
+		writeSCIMError(w, 400, "invalidSyntax", "invalid payload")
+		return
+	}
+	email := in.email()
+	if email == "" {
+		writeSCIMError(w, 400, "invalidValue", "userName or emails must contain an email address")
+		return
+	}
+	ctx := r.Context()
+	if taken, err := a.emailTaken(ctx, email, 0); err != nil {
+		a.log.Error("scim create user", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	} else if taken {
+		writeSCIMError(w, 409, "uniqueness", "user already exists")
+		return
+	}
+	hash := ""
+	if in.Password != "" {
+		b, err := bcrypt.GenerateFromPassword([]byte(in.Password), bcrypt.DefaultCost)
+		if err != nil {
+			a.log.Error("scim hash password", "err", err)
+			writeSCIMError(w, 500, "", "internal error")
+			return
+		}
+		hash = string(b)
+	}
+	u, err := a.store.CreateUser(ctx, email, hash, in.displayName())
+	if err != nil {
+		if isUniqueViolation(err) {
+			writeSCIMError(w, 409, "uniqueness", "user already exists")
+			return
+		}
+		a.log.Error("scim create user", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	// the identity provider vouches for the address
+	verified := true
+	err = a.store.AdminUpdateUser(ctx, u.ID, nil, nil, nil, &verified, nil, nil)
+	if err == nil && in.Active != nil && !bool(*in.Active) {
+		err = a.store.SetUserActive(ctx, u.ID, false)
+	}
+	if err == nil && in.ExternalID != nil {
+		err = a.store.SetUserExternalID(ctx, u.ID, *in.ExternalID)
+	}
+	if err != nil {
+		a.log.Error("scim create user", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	a.log.Info("scim user created", "user_id", u.ID, "email", email)
+	a.writeSCIMUser(w, r, 201, u.ID)
+}
+
+// PUT /scim/v2/Users/{id}
+func (a *api) handleSCIMReplaceUser(w http.ResponseWriter, r *http.Request) {
+	su, ok := a.scimUserID(w, r)
+	if !ok {
+		return
+	}
+	var in scimUserInput
+	if err := readSCIM(w, r, &in); err != nil {
+		writeSCIMError(w, 400, "invalidSyntax", "invalid payload")
+		return
+	}
+	email := in.email()
+	if email == "" {
+		writeSCIMError(w, 400, "invalidValue", "userName or emails must contain an email address")
+		return
+	}
+	name := in.displayName()
+	var active *bool
+	if in.Active != nil {
+		v := bool(*in.Active)
+		active = &v
+	}
+	ext := ""
+	if in.ExternalID != nil {
+		ext = *in.ExternalID
+	}
+	var password *string
+	if in.Password != "" {
+		password = &in.Password
+	}
+	a.applySCIMUser(w, r, su.ID, &name, &email, active, &ext, password)
+}
+
+// PATCH /scim/v2/Users/{id}
+func (a *api) handleSCIMPatchUser(w http.ResponseWriter, r *http.Request) {
+	su, ok := a.scimUserID(w, r)
+	if !ok {
+		return
+	}
+	var req scimPatchRequest
+	if err := readSCIM(w, r, &req); err != nil || len(req.Operations) == 0 {
+		writeSCIMError(w, 400, "invalidSyntax", "invalid payload")
+		return
+	}
+	p, err := parseSCIMUserPatch(req.Operations, su.Name)
+	if err != nil {
+		writeSCIMError(w, 400, err.scimType, err.detail)
+		return
+	}
+	a.applySCIMUser(w, r, su.ID, p.name, p.email, p.active, p.ext, p.password)
+}
+
+// scimPatchError is a PATCH the client got wrong, answered with 400 and scimType.
+type scimPatchError struct {
+	scimType, detail string
+}
+
+func (e *scimPatchError) Error() string { return e.detail }
+
+// scimUserPatch is what a user PATCH changes; nil fields stay as they are.
+type scimUserPatch struct {
+	name, email, ext, password *string
+	active                     *bool
+}
+
+// parseSCIMUserPatch applies the operations of a user PATCH in order. We keep a single
+// display name: a given or family name alone is completed from curName.
+func parseSCIMUserPatch(ops []scimPatchOp, curName string) (scimUserPatch, *scimPatchError) {
+	var (
+		p             scimUserPatch
+		given, family *string
+	)
+	str := func(raw json.RawMessage) (*string, error) {
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		v = strings.TrimSpace(v)
+		return &v, nil
+	}
+	var apply func(op, path string, raw json.RawMessage) error
+	apply = func(op, path string, raw json.RawMessage) error {
+		if op == "remove" {
+			switch path {
+			case "externalid":
+				empty := ""
+				p.ext = &empty
+			case "active":
+				off := false
+				p.active = &off
+			}
+			return nil
+		}
+		var err error
+		switch path {
+		case "":
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return err
+			}
+			for k, v := range m {
+				if err := apply(op, scimAttr(k), v); err != nil {
+					return err
+				}
+			}
+		case "active":
+			var b scimBool
+			if err = json.Unmarshal(raw, &b); err == nil {
+				v := bool(b)
+				p.active = &v
+			}
+		case "username":
+			var v *string
+			if v, err = str(raw); err == nil && strings.Contains(*v, "@") {
+				p.email = v
+			}
+		case "emails":
+			var list []scimEmail
+			if err = json.Unmarshal(raw, &list); err == nil {
+				if v := primaryEmail(list); v != "" {
+					p.email = &v
+				}
+			}
+		case "emails.value":
+			p.email, err = str(raw)
+		case "displayname", "name.formatted":
+			p.name, err = str(raw)
+		case "name":
+			var n scimName
+			if err = json.Unmarshal(raw, &n); err == nil {
+				if n.Formatted != "" {
+					p.name = &n.Formatted
+				}
+				if n.GivenName != "" {
+					given = &n.GivenName
+				}
+				if n.FamilyName != "" {
+					family = &n.FamilyName
+				}
+			}
+		case "name.givenname":
+			given, err = str(raw)
+		case "name.familyname":
+			family, err = str(raw)
+		case "externalid":
+			p.ext, err = str(raw)
+		case "password":
+			p.password, err = str(raw)
+		}
+		// attributes we do not store (title, phoneNumbers, extensions...) are ignored
+		return err
+	}
+	for _, op := range ops {
+		kind := strings.ToLower(op.Op)
+		if kind != "add" && kind != "replace" && kind != "remove" {
+			return p, &scimPatchError{"invalidSyntax", "unsupported op " + op.Op}
+		}
+		if err := apply(kind, scimAttr(op.Path), op.Value); err != nil {
+			return p, &scimPatchError{"invalidValue", "invalid value for " + op.Path}
+		}
+	}
+	if p.name == nil && (given != nil || family != nil) {
+		cur := strings.Fields(curName)
+		g, f := "", ""
+		if len(cur) > 0 {
+			g, f = cur[0], strings.Join(cur[1:], " ")
+		}
+		if given != nil {
+			g = *given
+		}
+		if family != nil {
+			f = *family
+		}
+		v := strings.TrimSpace(g + " " + f)
+		p.name = &v
+	}
+	if p.email != nil && *p.email == "" {
+		p.email = nil
+	}
+	return p, nil
+}
+
+// applySCIMUser writes the changed user fields (nil = unchanged) and responds with the resource.
+func (a *api) applySCIMUser(w http.ResponseWriter, r *http.Request, id int64, name, email *string, active *bool, ext, password *string) {
+	ctx := r.Context()
+	if email != nil {
+		if taken, err := a.emailTaken(ctx, *email, id); err != nil {
+			a.log.Error("scim update user", "err", err)
+			writeSCIMError(w, 500, "", "internal error")
+			return
+		} else if taken {
+			writeSCIMError(w, 409, "uniqueness", "email already in use")
+			return
+		}
+	}
+	err := a.store.AdminUpdateUser(ctx, id, name, email, nil, nil, password, nil)
+	if err == nil && active != nil {
+		err = a.store.SetUserActive(ctx, id, *active)
+	}
+	if err == nil && ext != nil {
+		err = a.store.SetUserExternalID(ctx, id, *ext)
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			writeSCIMError(w, 409, "uniqueness", "email already in use")
+			return
+		}
+		a.log.Error("scim update user", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	if active != nil && !*active {
+		a.log.Info("scim user deactivated", "user_id", id)
+		a.logUserSecurityEvent(ctx, id, secSessionRevoke, map[string]any{"reason": "deactivated", "by": "scim"})
+	}
+	if password != nil && *password != "" {
+		a.logUserSecurityEvent(ctx, id, secPasswordChange, map[string]any{"via": "scim"})
+	}
+	a.writeSCIMUser(w, r, 200, id)
+}
+
+// DELETE /scim/v2/Users/{id}
+func (a *api) handleSCIMDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeSCIMError(w, 404, "", "user not found")
+		return
+	}
+	if err := a.store.DeleteUser(r.Context(), id); err != nil {
+		if err == ErrNotFound {
+			writeSCIMError(w, 404, "", "user not found")
+			return
+		}
+		a.log.Error("scim delete user", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	a.log.Info("scim user deleted", "user_id", id)
+	w.WriteHeader(204)
+}
+
+// --- groups ---
+
+func (a *api) scimGroupResource(r *http.Request, sg ScimGroup, withMembers bool) (map[string]any, error) {
+	id := strconv.FormatInt(sg.ID, 10)
+	res := map[string]any{
+		"schemas":     []string{scimGroupSchema},
+		"id":          id,
+		"displayName": sg.Name,
+		"meta": map[string]any{
+			"resourceType": "Group",
+			"created":      sg.CreatedAt.UTC().Format(time.RFC3339),
+			"location":     scimBaseURL(r) + "/Groups/" + id,
+		},
+	}
+	if sg.ExternalID != "" {
+		res["externalId"] = sg.ExternalID
+	}
+	if withMembers {
+		users, err := a.store.GroupUsers(r.Context(), sg.ID)
+		if err != nil {
+			return nil, err
+		}
+		members := make([]map[string]string, 0, len(users))
+		for _, u := range users {
+			uid := strconv.FormatInt(u.ID, 10)
+			members = append(members, map[string]string{"value": uid, "display": u.Email, "$ref": scimBaseURL(r) + "/Users/" + uid})
+		}
+		res["members"] = members
+	}
+	return res, nil
+}
+
+// scimWantMembers honours excludedAttributes=members, which IdPs use to keep large groups cheap.
+func scimWantMembers(r *http.Request) bool {
+	for _, attr := range strings.Split(r.URL.Query().Get("excludedAttributes"), ",") {
+		if scimAttr(attr) == "members" {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *api) writeSCIMGroup(w http.ResponseWriter, r *http.Request, status int, id int64) {
+	sg, err := a.store.ScimGroupByID(r.Context(), a.envOrgID("SCIM_ORG_ID"), id)
+	var res map[string]any
+	if err == nil {
+		res, err = a.scimGroupResource(r, sg, scimWantMembers(r))
+	}
+	if err != nil {
+		a.log.Error("scim load group", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	if status == 201 {
+		w.Header().Set("Location", res["meta"].(map[string]any)["location"].(string))
+	}
+	writeSCIM(w, status, res)
+}
+
+func (a *api) scimGroupID(w http.ResponseWriter, r *http.Request) (ScimGroup, bool) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeSCIMError(w, 404, "", "group not found")
+		return ScimGroup{}, false
+	}
+	sg, err := a.store.ScimGroupByID(r.Context(), a.envOrgID("SCIM_ORG_ID"), id)
+	if err != nil {
+		if err == ErrNotFound {
+			writeSCIMError(w, 404, "", "group not found")
+		} else {
+			a.log.Error("scim get group", "err", err)
+			writeSCIMError(w, 500, "", "internal error")
+		}
+		return ScimGroup{}, false
+	}
+	return sg, true
+}
+
+// scimMemberIDs validates member references, which must be ids of existing users.
+func (a *api) scimMemberIDs(ctx context.Context, members []scimMember) ([]int64, error) {
+	ids := make([]int64, 0, len(members))
+	for _, m := range members {
+		id, err := parseID(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("unknown member %q", m.Value)
+		}
+		if _, err := a.store.ScimUserByID(ctx, id); err != nil {
+			if err == ErrNotFound {
+				return nil, fmt.Errorf("unknown member %q", m.Value)
+			}
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// setGroupMembers makes the group's membership exactly ids.
+func (a *api) setGroupMembers(ctx context.Context, groupID int64, ids []int64) error {
+	current, err := a.store.GroupUsers(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	want := map[int64]bool{}
+	for _, id := range ids {
+		want[id] = true
+	}
+	for _, u := range current {
+		if want[u.ID] {
+			delete(want, u.ID)
+			continue
+		}
+		if err := a.store.RemoveUserFromGroup(ctx, groupID, u.ID); err != nil {
+			return err
+		}
+	}
+	for id := range want {
+		if err := a.store.AddUserToGroup(ctx, groupID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GET /scim/v2/Groups
+func (a *api) handleSCIMListGroups(w http.ResponseWriter, r *http.Request) {
+	conds, err := parseSCIMFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		writeSCIMError(w, 400, "invalidFilter", err.Error())
+		return
+	}
+	start, count := scimPage(r)
+	items, total, err := a.store.ScimGroups(r.Context(), a.envOrgID("SCIM_ORG_ID"), conds, start-1, count)
+	if errors.Is(err, ErrInvalidFilter) {
+		writeSCIMError(w, 400, "invalidFilter", err.Error())
+		return
+	}
+	if err != nil {
+		a.log.Error("scim list groups", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	withMembers := scimWantMembers(r)
+	out := make([]map[string]any, 0, len(items))
+	for _, sg := range items {
+		res, err := a.scimGroupResource(r, sg, withMembers)
+		if err != nil {
+			a.log.Error("scim list groups", "err", err)
+			writeSCIMError(w, 500, "", "internal error")
+			return
+		}
+		out = append(out, res)
+	}
+	writeSCIM(w, 200, scimList(start, total, out))
+}
+
+// GET /scim/v2/Groups/{id}
+func (a *api) handleSCIMGetGroup(w http.ResponseWriter, r *http.Request) {
+	sg, ok := a.scimGroupID(w, r)
+	if !ok {
+		return
+	}
+	a.writeSCIMGroup(w, r, 200, sg.ID)
+}
+
+// POST /scim/v2/Groups
+func (a *api) handleSCIMCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var in scimGroupInput
+	if err := readSCIM(w, r, &in); err != nil {
+		writeSCIMError(w, 400, "invalidSyntax", "invalid payload")
+		return
+	}
+	name := strings.TrimSpace(in.DisplayName)
+	if name == "" {
+		writeSCIMError(w, 400, "invalidValue", "displayName is required")
+		return
+	}
+	ctx := r.Context()
+	ids, err := a.scimMemberIDs(ctx, in.Members)
+	if err != nil {
+		writeSCIMError(w, 400, "invalidValue", err.Error())
+		return
+	}
+	g, err := a.store.CreateGroup(ctx, a.envOrgID("SCIM_ORG_ID"), name)
+	if err != nil {
+		if isUniqueViolation(err) {
+			writeSCIMError(w, 409, "uniqueness", "group already exists")
+			return
+		}
+		a.log.Error("scim create group", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	for _, uid := range ids {
+		if err = a.store.AddUserToGroup(ctx, g.ID, uid); err != nil {
+			break
+		}
+	}
+	if err == nil && in.ExternalID != nil {
+		err = a.store.SetGroupExternalID(ctx, g.ID, *in.ExternalID)
+	}
+	if err != nil {
+		a.log.Error("scim create group", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	a.log.Info("scim group created", "group_id", g.ID, "name", name)
+	a.writeSCIMGroup(w, r, 201, g.ID)
+}
+
+// PUT /scim/v2/Groups/{id}
+func (a *api) handleSCIMReplaceGroup(w http.ResponseWriter, r *http.Request) {
+	sg, ok := a.scimGroupID(w, r)
+	if !ok {
+		return
+	}
+	var in scimGroupInput
+	if err := readSCIM(w, r, &in); err != nil {
+		writeSCIMError(w, 400, "invalidSyntax", "invalid payload")
+		return
+	}
+	name := strings.TrimSpace(in.DisplayName)
+	if name == "" {
+		writeSCIMError(w, 400, "invalidValue", "displayName is required")
+		return
+	}
+	ctx := r.Context()
+	ids, err := a.scimMemberIDs(ctx, in.Members)
+	if err != nil {
+		writeSCIMError(w, 400, "invalidValue", err.Error())
+		return
+	}
+	ext := ""
+	if in.ExternalID != nil {
+		ext = *in.ExternalID
+	}
+	err = a.store.RenameGroup(ctx, sg.ID, name)
+	if err == nil {
+		err = a.setGroupMembers(ctx, sg.ID, ids)
+	}
+	if err == nil {
+		err = a.store.SetGroupExternalID(ctx, sg.ID, ext)
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			writeSCIMError(w, 409, "uniqueness", "group name already in use")
+			return
+		}
+		a.log.Error("scim replace group", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	a.writeSCIMGroup(w, r, 200, sg.ID)
+}
+
+// PATCH /scim/v2/Groups/{id}
+// Supports add/replace/remove on members (including members[value eq "id"]),
+// displayName and externalId, with or without a path. The operations run on the group
+// as loaded; nothing is written unless they all apply.
+func (a *api) handleSCIMPatchGroup(w http.ResponseWriter, r *http.Request) {
+	sg, ok := a.scimGroupID(w, r)
+	if !ok {
+		return
+	}
+	var req scimPatchRequest
+	if err := readSCIM(w, r, &req); err != nil || len(req.Operations) == 0 {
+		writeSCIMError(w, 400, "invalidSyntax", "invalid payload")
+		return
+	}
+	ctx := r.Context()
+	users, err := a.store.GroupUsers(ctx, sg.ID)
+	if err != nil {
+		a.log.Error("scim patch group", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	before := scimGroupPatch{name: sg.Name, externalID: sg.ExternalID}
+	for _, u := range users {
+		before.members = append(before.members, strconv.FormatInt(u.ID, 10))
+	}
+	after := before
+	after.members = append([]string(nil), before.members...)
+	if err := after.apply(req.Operations); err != nil {
+		writeSCIMError(w, 400, err.scimType, err.detail)
+		return
+	}
+
+	// members added are checked before anything is written; the others are ours already
+	var added []scimMember
+	for _, v := range scimMembersMissing(after.members, before.members) {
+		added = append(added, scimMember{Value: v})
+	}
+	addIDs, err := a.scimMemberIDs(ctx, added)
+	if err != nil {
+		writeSCIMError(w, 400, "invalidValue", err.Error())
+		return
+	}
+	if after.name != before.name {
+		err = a.store.RenameGroup(ctx, sg.ID, after.name)
+	}
+	if err == nil && after.externalID != before.externalID {
+		err = a.store.SetGroupExternalID(ctx, sg.ID, after.externalID)
+	}
+	for _, v := range scimMembersMissing(before.members, after.members) {
+		if err == nil {
+			id, _ := parseID(v)
+			err = a.store.RemoveUserFromGroup(ctx, sg.ID, id)
+		}
+	}
+	for _, id := range addIDs {
+		if err == nil {
+			err = a.store.AddUserToGroup(ctx, sg.ID, id)
+		}
+	}
+	if err != nil {
+		if isUniqueViolation(err) {
+			writeSCIMError(w, 409, "uniqueness", "group name already in use")
+			return
+		}
+		a.log.Error("scim patch group", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	a.writeSCIMGroup(w, r, 200, sg.ID)
+}
+
+// scimGroupPatch is the part of a group a PATCH works on. Members are their values
+// (user ids), unchecked until the result is written.
+type scimGroupPatch struct {
+	name, externalID string
+	members          []string
+}
+
+// scimMemberValue normalizes a member value so that "042" and "42" are the same user.
+func scimMemberValue(v string) string {
+	if id, err := parseID(strings.TrimSpace(v)); err == nil {
+		return strconv.FormatInt(id, 10)
+	}
+	return strings.TrimSpace(v)
+}
+
+// scimMembersMissing returns the values of a that are not in b, each once.
+func scimMembersMissing(a, b []string) []string {
+	seen := map[string]bool{}
+	for _, v := range b {
+		seen[v] = true
+	}
+	var out []string
+	for _, v := range a {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// apply runs the operations of a group PATCH in order.
+func (g *scimGroupPatch) apply(ops []scimPatchOp) *scimPatchError {
+	invalid := func(format string, args ...any) *scimPatchError {
+		return &scimPatchError{"invalidValue", fmt.Sprintf(format, args...)}
+	}
+	members := func(op string, raw json.RawMessage) *scimPatchError {
+		var list []scimMember
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &list); err != nil {
+				return invalid("%v", err)
+			}
+		}
+		values := make([]string, 0, len(list))
+		for _, m := range list {
+			values = append(values, scimMemberValue(m.Value))
+		}
+		switch {
+		case op == "remove" && len(raw) == 0:
+			g.members = nil
+		case op == "remove":
+			g.members = scimMembersMissing(g.members, values)
+		case op == "replace":
+			g.members = scimMembersMissing(values, nil)
+		default:
+			g.members = append(g.members, scimMembersMissing(values, g.members)...)
+		}
+		return nil
+	}
+	var apply func(op, path string, raw json.RawMessage) *scimPatchError
+	apply = func(op, path string, raw json.RawMessage) *scimPatchError {
+		if strings.HasPrefix(path, "members[") {
+			// members[value eq "42"] addresses a single member; only removal makes sense
+			conds, err := parseSCIMFilter(path)
+			if err != nil || len(conds) != 1 || conds[0].Attr != "members.value" || conds[0].Op != "eq" || op != "remove" {
+				return invalid("unsupported path %q", path)
+			}
+			if _, err := parseID(conds[0].Value); err != nil {
+				return invalid("unknown member %q", conds[0].Value)
+			}
+			g.members = scimMembersMissing(g.members, []string{scimMemberValue(conds[0].Value)})
+			return nil
+		}
+		switch scimAttr(path) {
+		case "":
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return invalid("%v", err)
+			}
+			for k, v := range m {
+				if err := apply(op, k, v); err != nil {
+					return err
+				}
+			}
+		case "members":
+			return members(op, raw)
+		case "displayname":
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil || strings.TrimSpace(v) == "" || op == "remove" {
+				return invalid("displayName must be a non-empty string")
+			}
+			g.name = strings.TrimSpace(v)
+		case "externalid":
+			var v string
+			if op != "remove" {
+				if err := json.Unmarshal(raw, &v); err != nil {
+					return invalid("%v", err)
+				}
+			}
+			g.externalID = v
+		}
+		return nil
+	}
+	for _, op := range ops {
+		kind := strings.ToLower(op.Op)
+		if kind != "add" && kind != "replace" && kind != "remove" {
+			return &scimPatchError{"invalidSyntax", "unsupported op " + op.Op}
+		}
+		if err := apply(kind, strings.TrimSpace(op.Path), op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DELETE /scim/v2/Groups/{id}
+func (a *api) handleSCIMDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	sg, ok := a.scimGroupID(w, r)
+	if !ok {
+		return
+	}
+	if err := a.store.DeleteGroup(r.Context(), sg.ID); err != nil {
+		if err == ErrNotFound {
+			writeSCIMError(w, 404, "", "group not found")
+			return
+		}
+		a.log.Error("scim delete group", "err", err)
+		writeSCIMError(w, 500, "", "internal error")
+		return
+	}
+	a.log.Info("scim group deleted", "group_id", sg.ID)
+	w.WriteHeader(204)
+}
+
+// --- discovery ---
+
+// GET /scim/v2/ServiceProviderConfig
+func (a *api) handleSCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	writeSCIM(w, 200, map[string]any{
+		"schemas":        []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": scimMaxResults},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "Static token configured via SCIM_TOKEN",
+			"primary":     true,
+		}},
+		"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": scimBaseURL(r) + "/ServiceProviderConfig"},
+	})
+}
+
+// GET /scim/v2/ResourceTypes
+func (a *api) handleSCIMResourceTypes(w http.ResponseWriter, r *http.Request) {
+	base := scimBaseURL(r)
+	rt := func(name, endpoint, schema string) map[string]any {
+		return map[string]any{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       name,
+			"name":     name,
+			"endpoint": endpoint,
+			"schema":   schema,
+			"meta":     map[string]string{"resourceType": "ResourceType", "location": base + "/ResourceTypes/" + name},
+		}
+	}
+	writeSCIM(w, 200, scimList(1, 2, []map[string]any{
+		rt("User", "/Users", scimUserSchema),
+		rt("Group", "/Groups", scimGroupSchema),
+	}))
+}
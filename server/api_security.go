@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Security event types.
+const (
+	secLoginSuccess    = "login_success"
+	secLoginFailure    = "login_failure"
+	secLoginLocked     = "login_locked"
+	secLoginNewDevice  = "login_new_device"
+	secPasswordChange  = "password_change"
+	secSessionRevoke   = "session_revoke"
+	secAdminRoleChange = "admin_role_change"
+	secIdentityLink    = "identity_link"
+	secIdentityUnlink  = "identity_unlink"
+)
+
+// clientIP returns the caller's address. X-Forwarded-For is honoured only with
+// TRUST_PROXY=true, since clients can set it freely otherwise.
+func clientIP(r *http.Request) string {
+	if getenv("TRUST_PROXY", "false") == "true" {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// securityEvent records an event for userID (0 = unknown account) with the
+// request's IP and user agent. Failures are logged, never surfaced to the client.
+func (a *api) securityEvent(r *http.Request, userID int64, typ string, details map[string]any) {
+	ua := r.UserAgent()
+	if len(ua) > 300 {
+		ua = ua[:300]
+	}
+	e := SecurityEvent{Type: typ, IP: clientIP(r), UserAgent: ua, Details: details}
+	if userID != 0 {
+		e.UserID = &userID
+	}
+	if err := a.store.AddSecurityEvent(r.Context(), e); err != nil {
+		a.log.Error("security event", "type", typ, "err", err)
+	}
+}
+
+// loginPolicy controls per-account brute-force protection:
+// LOGIN_DELAY_AFTER failures (default 3) start a doubling delay between attempts,
+// LOGIN_MAX_FAILURES (default 10) lock the login for LOGIN_LOCKOUT (default 15m).
+// The counter restarts after LOGIN_LOCKOUT without failures.
+type loginPolicy struct {
+	DelayAfter  int
+	MaxFailures int
+	LockFor     time.Duration
+}
+
+func (a *api) loginPolicy() loginPolicy {
+	p := loginPolicy{DelayAfter: 3, MaxFailures: 10, LockFor: 15 * time.Minute}
+	if n, err := strconv.Atoi(getenv("LOGIN_DELAY_AFTER", "")); err == nil && n >= 0 {
+		p.DelayAfter = n
+	}
+	if n, err := strconv.Atoi(getenv("LOGIN_MAX_FAILURES", "")); err == nil && n >= 0 {
+		p.MaxFailures = n
+	}
+	if d, err := time.ParseDuration(getenv("LOGIN_LOCKOUT", "")); err == nil && d > 0 {
+		p.LockFor = d
+	}
+	return p
+}
+
+// retryAfter is how long the login has to wait before the next attempt: the rest of
+// a lockout, or a delay that doubles with each failure past DelayAfter (max 1m).
+func (p loginPolicy) retryAfter(la LoginAttempts, now time.Time) time.Duration {
+	if now.Before(la.LockedUntil) {
+		return la.LockedUntil.Sub(now)
+	}
+	if p.DelayAfter <= 0 || la.Failures < p.DelayAfter {
+		return 0
+	}
+	n := min(la.Failures-p.DelayAfter, 6)
+	delay := min(time.Second<<n, time.Minute)
+	if wait := la.LastFailureAt.Add(delay).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// checkLoginThrottle answers 429 with Retry-After when login must wait. It returns false in that case.
+func (a *api) checkLoginThrottle(w http.ResponseWriter, r *http.Request, login string) bool {
+	la, err := a.store.LoginAttempts(r.Context(), login)
+	if err != nil {
+		a.log.Error("login attempts", "err", err)
+		return true
+	}
+	if wait := a.loginPolicy().retryAfter(la, time.Now()); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, 429, "too many failed attempts, try again later")
+		return false
+	}
+	return true
+}
+
+// loginFailed counts a failed password login and logs it, plus a lockout event
+// when this failure reached the limit.
+func (a *api) loginFailed(r *http.Request, login string) {
+	p := a.loginPolicy()
+	la, err := a.store.RecordLoginFailure(r.Context(), login, p.MaxFailures, p.LockFor, p.LockFor)
+	if err != nil {
+		a.log.Error("record login failure", "err", err)
+	}
+	var uid int64
+	if u, err := a.store.userByEmail(r.Context(), login); err == nil {
+		uid = u.ID
+	}
+	details := map[string]any{"login": login, "failures": la.Failures}
+	a.securityEvent(r, uid, secLoginFailure, details)
+	if p.MaxFailures > 0 && la.Failures == p.MaxFailures {
+		a.log.Info("login locked", "login", login, "until", la.LockedUntil)
+		a.securityEvent(r, uid, secLoginLocked, map[string]any{"login": login, "locked_until": la.LockedUntil})
+	}
+}
+
+// loginSucceeded logs a successful login by method (password, ldap, github, ...) and
+// emails the user when it comes from an IP/device combination not seen before.
+func (a *api) loginSucceeded(r *http.Request, u User, method string) {
+	ip, ua := clientIP(r), r.UserAgent()
+	if len(ua) > 300 {
+		ua = ua[:300]
+	}
+	first, known, err := a.store.KnownLoginSource(r.Context(), u.ID, ip, ua)
+	if err != nil {
+		a.log.Error("login source", "err", err)
+	}
+	a.securityEvent(r, u.ID, secLoginSuccess, map[string]any{"method": method})
+	// the only place email invites are accepted: the address is verified by now (password
+	// sign-in requires it, OAuth/OIDC/LDAP vouch for it)
+	a.acceptPendingInvites(r.Context(), u)
+	if err != nil || first || known {
+		return
+	}
+	a.securityEvent(r, u.ID, secLoginNewDevice, map[string]any{"method": method})
+	go a.sendNewDeviceEmail(u, ip, ua, time.Now())
+}
+
+func (a *api) sendNewDeviceEmail(u User, ip, ua string, at time.Time) {
+	if strings.HasSuffix(u.Email, ".local") || strings.Contains(u.Email, "@users.noreply.") {
+		return // synthetic address, nobody to tell
+	}
+	when := at.UTC().Format("2006-01-02 15:04 UTC")
+	subject := "Новый вход в аккаунт — Trellolite"
+	body := "Здравствуйте,\n\nВ ваш аккаунт выполнен вход с нового устройства или адреса.\n\nВремя: " + when + "\nIP: " + ip + "\nУстройство: " + ua +
+		"\n\nЕсли это были не вы, смените пароль и проверьте способы входа в профиле."
+	if u.Lang == "en" {
+		subject = "New sign-in to your account — Trellolite"
+		body = "Hello,\n\nYour account was just signed in to from a new device or address.\n\nTime: " + when + "\nIP: " + ip + "\nDevice: " + ua +
+			"\n\nIf this wasn't you, change your password and review the sign-in methods in your profile."
+	}
+	_ = a.sendEmail(u.Email, subject, body)
+}
+
+// logUserSecurityEvent records an event that is not tied to an HTTP request (LDAP sync, SCIM...).
+func (a *api) logUserSecurityEvent(ctx context.Context, userID int64, typ string, details map[string]any) {
+	if err := a.store.AddSecurityEvent(ctx, SecurityEvent{UserID: &userID, Type: typ, Details: details}); err != nil {
+		a.log.Error("security event", "type", typ, "err", err)
+	}
+}
+
+// GET /api/me/security-events?limit=
+func (a *api) handleMySecurityEvents(w http.ResponseWriter, r *http.Request) {
+	me, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	items, err := a.store.SecurityEvents(r.Context(), &me.ID, r.URL.Query().Get("type"), limit)
+	if err != nil {
+		a.log.Error("security events", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, items)
+}
+
+// GET /api/admin/security-events?user_id=&type=&limit=
+func (a *api) handleAdminSecurityEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var userID *int64
+	if v := q.Get("user_id"); v != "" {
+		id, err := parseID(v)
+		if err != nil {
+			writeError(w, 400, "bad user_id")
+			return
+		}
+		userID = &id
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	items, err := a.store.SecurityEvents(r.Context(), userID, q.Get("type"), limit)
+	if err != nil {
+		a.log.Error("admin security events", "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	writeJSON(w, 200, items)
+}
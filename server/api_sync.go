@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Delta sync for clients working offline. A client keeps the board from
+// GET /api/boards/{id}/full (sync_cursor) up to date with GET /api/boards/{id}/changes,
+// queues its edits while offline and pushes them in one batch when back online; each
+// operation runs through the REST handler of the matching socket command (wsCommands),
+// so version checks report conflicts exactly as for a PATCH.
+
+// syncPushMax is the most operations one push may carry.
+const syncPushMax = 100
+
+// syncTombstoneTTL is how long deletions are kept for sync (SYNC_TOMBSTONE_TTL, default
+// 30 days); a client that hasn't synced for longer reloads the board.
+func syncTombstoneTTL() time.Duration {
+	if d, err := time.ParseDuration(getenv("SYNC_TOMBSTONE_TTL", "720h")); err == nil && d > 0 {
+		return d
+	}
+	return 30 * 24 * time.Hour
+}
+
+// GET /api/boards/{id}/changes?since=cursor
+func (a *api) handleBoardChanges(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	if _, ok := a.authorize(w, r, ActBoardView, boardResource(id)); !ok {
+		return
+	}
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+			writeError(w, 400, "bad since")
+			return
+		}
+	}
+	if err := a.store.PruneTombstones(r.Context(), id, syncTombstoneTTL()); err != nil {
+		a.log.Error("prune tombstones", "board_id", id, "err", err)
+	}
+	changes, err := a.store.BoardChanges(r.Context(), id, since)
+	switch {
+	case err == nil:
+		writeJSON(w, 200, changes)
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+	case errors.Is(err, ErrCursorExpired):
+		writeError(w, 410, err.Error())
+	default:
+		a.log.Error("board changes", "err", err)
+		writeError(w, 500, "internal error")
+	}
+}
+
+// syncOp is a queued offline operation: a socket command (see wsCommands) with an id
+// for retries. Creates may name their row with ref; later operations of the batch then
+// use the ref as target or as a *_id field of the body.
+type syncOp struct {
+	ID     string          `json:"id"`
+	Ref    string          `json:"ref"`
+	Type   string          `json:"type"`
+	Target json.RawMessage `json:"target"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// syncResult is what one pushed operation got, as its REST request would have.
+type syncResult struct {
+	ID     string          `json:"id,omitempty"`
+	Ref    string          `json:"ref,omitempty"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// POST /api/boards/{id}/changes {ops:[{id, ref?, type, target, body}]}
+// Operations run in order; a failed one doesn't stop the batch, but the operations
+// referring to its ref fail with 424.
+func (a *api) handleSyncPush(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	u, ok := a.authorize(w, r, ActBoardView, boardResource(id))
+	if !ok {
+		return
+	}
+	var req struct {
+		Ops []syncOp `json:"ops"`
+	}
+	if err := readJSON(w, r, &req); err != nil {
+		writeError(w, 400, "invalid payload")
+		return
+	}
+	if len(req.Ops) > syncPushMax {
+		writeError(w, 400, "too many operations")
+		return
+	}
+	for _, op := range req.Ops {
+		if _, ok := wsCommands[op.Type]; !ok || len(op.ID) > 64 || len(op.Ref) > 64 {
+			writeError(w, 400, "invalid operation")
+			return
+		}
+	}
+	if err := a.store.PruneSyncOps(r.Context(), u.ID); err != nil {
+		a.log.Error("prune sync ops", "err", err)
+	}
+
+	refs := map[string]int64{} // ref → id of the created row, 0 when the create failed
+	results := make([]syncResult, 0, len(req.Ops))
+	conflicts := 0
+	for _, op := range req.Ops {
+		res := a.runSyncOp(r, u.ID, id, op, refs)
+		if res.Status == http.StatusConflict {
+			conflicts++
+		}
+		if op.Ref != "" {
+			var created struct {
+				ID int64 `json:"id"`
+			}
+			if res.Status < 300 {
+				_ = json.Unmarshal(res.Body, &created)
+			}
+			refs[op.Ref] = created.ID
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, 200, map[string]any{"ok": true, "results": results, "conflicts": conflicts})
+}
+
+// runSyncOp runs one pushed operation, or answers with the result of an earlier push
+// of the same id.
+func (a *api) runSyncOp(r *http.Request, userID, boardID int64, op syncOp, refs map[string]int64) syncResult {
+	res := syncResult{ID: op.ID, Ref: op.Ref}
+	target, body, ok := resolveSyncRefs(op, boardID, refs)
+	if !ok {
+		res.Status, res.Body = http.StatusFailedDependency, json.RawMessage(`{"ok":false,"error":"depends on a failed operation"}`)
+		return res
+	}
+	if op.ID != "" {
+		claimed, status, stored, err := a.store.ClaimSyncOp(r.Context(), userID, op.ID)
+		switch {
+		case err != nil:
+			a.log.Error("claim sync op", "err", err)
+			res.Status, res.Body = 500, json.RawMessage(`{"ok":false,"error":"internal error"}`)
+			return res
+		case !claimed && status == 0:
+			res.Status, res.Body = http.StatusConflict, json.RawMessage(`{"ok":false,"error":"operation in progress"}`)
+			return res
+		case !claimed:
+			res.Status = status
+			if len(stored) > 0 {
+				res.Body = stored
+			}
+			return res
+		}
+	}
+	f := a.runWSCommand(r.Context(), r, wsCommand{Type: op.Type, Target: target, Body: body})
+	res.Status, res.Body = f.Status, f.Body
+	if op.ID != "" {
+		stored := []byte(res.Body)
+		if stored == nil {
+			stored = []byte{}
+		}
+		if res.Status >= 500 {
+			stored = nil // not applied: may be retried
+		}
+		// even when the client is gone: otherwise the claim blocks retries until it goes stale
+		if err := a.store.FinishSyncOp(context.WithoutCancel(r.Context()), userID, op.ID, res.Status, stored); err != nil {
+			a.log.Error("finish sync op", "err", err)
+		}
+	}
+	return res
+}
+
+// resolveSyncRefs turns refs of earlier creates into ids, in the target and in the
+// body's *_id fields. A missing target means the board (list.create). ok is false when
+// a ref names a create that failed.
+func resolveSyncRefs(op syncOp, boardID int64, refs map[string]int64) (target int64, body json.RawMessage, ok bool) {
+	resolve := func(raw json.RawMessage) (json.RawMessage, bool) {
+		var ref string
+		if json.Unmarshal(raw, &ref) != nil {
+			return raw, true // not a ref
+		}
+		id, known := refs[ref]
+		if !known {
+			return raw, true // left for the handler to reject
+		}
+		return json.RawMessage(strconv.FormatInt(id, 10)), id != 0
+	}
+	switch t := op.Target; {
+	case len(t) == 0 || string(t) == "null":
+		target = boardID
+	default:
+		raw, ok := resolve(t)
+		if !ok {
+			return 0, nil, false
+		}
+		if json.Unmarshal(raw, &target) != nil {
+			target = 0 // bad target: the handler answers 400 bad id
+		}
+	}
+	body = op.Body
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(op.Body, &fields) == nil && fields != nil {
+		changed := false
+		for k, v := range fields {
+			if !strings.HasSuffix(k, "_id") {
+				continue
+			}
+			raw, ok := resolve(v)
+			if !ok {
+				return 0, nil, false
+			}
+			if string(raw) != string(v) {
+				fields[k], changed = raw, true
+			}
+		}
+		if changed {
+			body, _ = json.Marshal(fields)
+		}
+	}
+	return target, body, true
+}
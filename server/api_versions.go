@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Optimistic concurrency: boards, lists, cards and comments carry a version that every
+// write bumps. A client makes a write conditional by sending the version it last saw,
+// either as If-Match (the ETag we returned, "7") or as "version" in the JSON body; a
+// stale one gets 409 with the current state to merge from. Unconditional writes still work.
+
+func etag(version int64) string { return `"` + strconv.FormatInt(version, 10) + `"` }
+
+// ifMatch returns the version a write is conditioned on, 0 for none: If-Match wins over
+// the body's version. A malformed header is answered with 400 and ok false.
+func ifMatch(w http.ResponseWriter, r *http.Request, bodyVersion *int64) (int64, bool) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" || h == "*" {
+		if bodyVersion != nil {
+			return *bodyVersion, true
+		}
+		return 0, true
+	}
+	v, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(h, "W/"), `"`), 10, 64)
+	if err != nil || v <= 0 {
+		writeError(w, 400, "bad If-Match")
+		return 0, false
+	}
+	return v, true
+}
+
+// versionedWriteFailed answers a failed version bump or versioned write: 404, 409 with
+// the current state, or 500.
+func (a *api) versionedWriteFailed(w http.ResponseWriter, r *http.Request, kind string, id int64, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+	case errors.Is(err, ErrVersionConflict):
+		a.writeConflict(w, r, kind, id)
+	default:
+		a.log.Error("versioned write", "kind", kind, "id", id, "err", err)
+		writeError(w, 500, "internal error")
+	}
+}
+
+// writeConflict answers 409 with the entity as it is now, for the client to merge and retry.
+func (a *api) writeConflict(w http.ResponseWriter, r *http.Request, kind string, id int64) {
+	var current any
+	var version int64
+	var err error
+	switch kind {
+	case "board":
+		var b Board
+		b, err = a.store.GetBoard(r.Context(), id)
+		current, version = b, b.Version
+	case "list":
+		var l List
+		l, err = a.store.GetList(r.Context(), id)
+		current, version = l, l.Version
+	case "card":
+		var c Card
+		c, err = a.store.GetCard(r.Context(), id)
+		current, version = c, c.Version
+	default:
+		err = errors.New("no current state for " + kind)
+	}
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, 404, "not found")
+			return
+		}
+		a.log.Error("version conflict", "kind", kind, "id", id, "err", err)
+		writeError(w, 500, "internal error")
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	writeJSON(w, 409, map[string]any{"ok": false, "error": "version conflict", "current": current})
+}
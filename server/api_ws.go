@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Board WebSocket: one connection carries the board's events (like SSE) and the
+// client's commands. Messages are JSON text frames.
+//
+//	server → client  {"type":"event","id":42,"event":{...}}   same events and ids as SSE
+//	                 {"type":"resync","board_id":7}            reload the board
+//	                 {"type":"reply","seq":3,"status":200,"body":{...}}
+//	client → server  {"type":"card.move","seq":3,"target":15,"body":{"target_list_id":4,"new_index":0}}
+//	                 {"type":"presence","seq":4}
+
+// wsFrame is a server → client message.
+type wsFrame struct {
+	Type    string          `json:"type"`
+	ID      int64           `json:"id,omitempty"`
+	Event   json.RawMessage `json:"event,omitempty"`
+	BoardID int64           `json:"board_id,omitempty"`
+	Seq     int64           `json:"seq,omitempty"`
+	Status  int             `json:"status,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+}
+
+// wsCommand is a client → server message; seq is echoed in the reply.
+type wsCommand struct {
+	Type   string          `json:"type"`
+	Seq    int64           `json:"seq"`
+	Target int64           `json:"target"` // card or list id, as in the REST path
+	Body   json.RawMessage `json:"body"`
+}
+
+// wsCommands map socket commands onto the REST handlers, so a command gets exactly the
+// validation, access checks and events of the matching HTTP request.
+var wsCommands = map[string]struct {
+	method  string
+	handler func(*api, http.ResponseWriter, *http.Request)
+}{
+	"card.create":    {http.MethodPost, (*api).handleCreateCard}, // target: list id
+	"card.update":    {http.MethodPatch, (*api).handleUpdateCard},
+	"card.move":      {http.MethodPost, (*api).handleMoveCard},
+	"card.editing":   {http.MethodPut, (*api).handleCardEditing},
+	"card.stopped":   {http.MethodDelete, (*api).handleCardEditing},
+	"card.doc_op":    {http.MethodPost, (*api).handleCardDocOp},
+	"card.delete":    {http.MethodDelete, (*api).handleDeleteCard},
+	"list.create":    {http.MethodPost, (*api).handleCreateList}, // target: board id
+	"list.update":    {http.MethodPatch, (*api).handleUpdateList},
+	"list.move":      {http.MethodPost, (*api).handleMoveList},
+	"list.delete":    {http.MethodDelete, (*api).handleDeleteList},
+	"comment.create": {http.MethodPost, (*api).handleAddComment}, // target: card id
+}
+
+// presence pings are broadcast to the board, so each connection gets at most one per interval
+const wsPresenceInterval = 5 * time.Second
+
+// GET /api/boards/{id}/ws
+func (a *api) handleBoardWS(w http.ResponseWriter, r *http.Request) {
+	id, err := parseID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, 400, "bad id")
+		return
+	}
+	u, ok := a.authorize(w, r, ActBoardView, boardResource(id))
+	if !ok {
+		return
+	}
+	// browsers send cookies on cross-site WebSocket handshakes and there is no CORS for
+	// them, so a cookie session needs a same-site (or trusted) Origin, like mutations do
+	if !bearerOnly(r, a.sessionCookieName()) && !originAllowed(r) {
+		writeError(w, 403, "cross-origin request rejected")
+		return
+	}
+	conn, err := wsUpgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	sub, unsubscribe := a.bus.Subscribe(id, u)
+	defer unsubscribe()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	send := func(f wsFrame) {
+		data, _ := json.Marshal(f)
+		if err := conn.WriteText(data); err != nil {
+			cancel() // too slow or gone
+		}
+	}
+	stream := &boardStream{bus: a.bus, boardID: id,
+		emit:   func(msg LoggedEvent) { send(wsFrame{Type: "event", ID: msg.ID, Event: msg.Data}) },
+		resync: func() { send(wsFrame{Type: "resync", BoardID: id}) }}
+	if last, resume := lastEventID(r); resume {
+		stream.last = last
+		stream.catchUp(ctx)
+	}
+
+	// commands are read and answered one at a time on their own goroutine, so a client
+	// can't queue up more work than it waits for; events are written from this one
+	go func() {
+		defer cancel()
+		var lastPresence time.Time
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var cmd wsCommand
+			if op != wsOpText || json.Unmarshal(data, &cmd) != nil {
+				send(wsFrame{Type: "reply", Status: 400, Body: json.RawMessage(`{"ok":false,"error":"invalid command"}`)})
+				continue
+			}
+			if cmd.Type == "presence" {
+				if time.Since(lastPresence) >= wsPresenceInterval {
+					lastPresence = time.Now()
+					a.bus.PublishEphemeral(Event{Type: "presence.ping", Entity: "user", BoardID: id, Payload: map[string]any{"user_id": u.ID, "name": u.Name}})
+				}
+				send(wsFrame{Type: "reply", Seq: cmd.Seq, Status: 200, Body: json.RawMessage(`{"ok":true}`)})
+				continue
+			}
+			send(a.safeWSCommand(ctx, r, cmd))
+		}
+	}()
+
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			conn.Close(wsCloseGoingAway, "")
+			return
+		case <-ticker.C:
+			if err := conn.Ping(); err != nil {
+				cancel()
+			}
+		case <-sub.kicked:
+			cancel()
+		case <-sub.revoked:
+			ev := accessRevokedEvent(id, u.ID)
+			send(wsFrame{Type: "event", Event: ev.Data})
+			conn.Close(wsClosePolicy, "access revoked")
+			return
+		case msg, ok := <-sub.ch:
+			if !ok {
+				cancel()
+				continue
+			}
+			stream.handle(ctx, msg)
+			if sub.drained(len(sub.ch) == 0) {
+				stream.handle(ctx, LoggedEvent{Resync: true})
+			}
+		}
+	}
+}
+
+// safeWSCommand is runWSCommand on the command goroutine, which has no net/http
+// recovery around it: a panicking handler answers 500 instead of taking the process down.
+func (a *api) safeWSCommand(ctx context.Context, upgrade *http.Request, cmd wsCommand) (f wsFrame) {
+	defer func() {
+		if v := recover(); v != nil {
+			a.log.Error("ws command panic", "type", cmd.Type, "panic", v, "stack", string(debug.Stack()))
+			f = wsFrame{Type: "reply", Seq: cmd.Seq, Status: 500, Body: json.RawMessage(`{"ok":false,"error":"internal error"}`)}
+		}
+	}()
+	return a.runWSCommand(ctx, upgrade, cmd)
+}
+
+// runWSCommand runs a command through its REST handler as the user who opened the
+// socket (or pushed the batch, see api_sync.go): the request carries the handshake's
+// cookies and Authorization, so the session is checked again for every command.
+func (a *api) runWSCommand(ctx context.Context, upgrade *http.Request, cmd wsCommand) wsFrame {
+	c, ok := wsCommands[cmd.Type]
+	if !ok {
+		return wsFrame{Type: "reply", Seq: cmd.Seq, Status: 400, Body: json.RawMessage(`{"ok":false,"error":"unknown command"}`)}
+	}
+	body := []byte(cmd.Body)
+	if len(body) == 0 {
+		body = []byte("{}")
+	}
+	req, err := http.NewRequestWithContext(ctx, c.method, upgrade.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		return wsFrame{Type: "reply", Seq: cmd.Seq, Status: 500}
+	}
+	for _, h := range []string{"Cookie", "Authorization", "X-Org-ID", "Accept-Language", "User-Agent", "X-Forwarded-For"} {
+		if v := upgrade.Header.Values(h); len(v) > 0 {
+			req.Header[h] = v
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = upgrade.RemoteAddr
+	req.SetPathValue("id", strconv.FormatInt(cmd.Target, 10))
+	rec := &wsRecorder{header: http.Header{}, status: 200}
+	c.handler(a, rec, req)
+	f := wsFrame{Type: "reply", Seq: cmd.Seq, Status: rec.status}
+	if rec.body.Len() > 0 {
+		f.Body = rec.body.Bytes()
+	}
+	return f
+}
+
+// wsRecorder captures a handler's response for a command reply.
+type wsRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *wsRecorder) Header() http.Header         { return w.header }
+func (w *wsRecorder) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *wsRecorder) WriteHeader(code int)        { w.status = code }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Role is a user's effective role on a board or project (ROADMAP: Owner/Maintainer/Member/Viewer).
+// Values match project_members.role.
+type Role int
+
+const (
+	RoleNone       Role = -1
+	RoleViewer     Role = 0
+	RoleMember     Role = 1
+	RoleMaintainer Role = 2
+	RoleOwner      Role = 3
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleMember:
+		return "member"
+	case RoleMaintainer:
+		return "maintainer"
+	case RoleOwner:
+		return "owner"
+	}
+	return "none"
+}
+
+// Action is something a user does to a board, list, card or project.
+type Action string
+
+const (
+	ActBoardView     Action = "board.view"
+	ActBoardUpdate   Action = "board.update"
+	ActBoardReorder  Action = "board.reorder"
+	ActBoardShare    Action = "board.share"
+	ActBoardDelete   Action = "board.delete"
+	ActBoardMembers  Action = "board.manage_members"
+	ActBoardTransfer Action = "board.transfer"
+	ActBoardProject  Action = "board.set_project"
+
+	ActListCreate Action = "list.create"
+	ActListUpdate Action = "list.update"
+	ActListMove   Action = "list.move"
+	ActListDelete Action = "list.delete"
+
+	ActCardCreate Action = "card.create"
+	ActCardUpdate Action = "card.update"
+	ActCardMove   Action = "card.move"
+	ActCardDelete Action = "card.delete"
+	ActCardShare  Action = "card.share"
+
+	ActCommentCreate Action = "comment.create"
+
+	ActProjectView          Action = "project.view"
+	ActProjectUpdate        Action = "project.update"
+	ActProjectCreateBoard   Action = "project.create_board"
+	ActProjectManageMembers Action = "project.manage_members"
+	ActProjectTransfer      Action = "project.transfer"
+	ActProjectDelete        Action = "project.delete"
+)
+
+// permissions is the permission matrix: the minimum role needed for each action.
+// Viewers are read-only; site admins (users.is_admin) pass every check.
+var permissions = map[Action]Role{
+	ActBoardView:     RoleViewer,
+	ActBoardUpdate:   RoleMaintainer,
+	ActBoardReorder:  RoleOwner,
+	ActBoardShare:    RoleOwner,
+	ActBoardDelete:   RoleOwner,
+	ActBoardMembers:  RoleMaintainer,
+	ActBoardTransfer: RoleOwner,
+	ActBoardProject:  RoleOwner,
+
+	ActListCreate: RoleMember,
+	ActListUpdate: RoleMember,
+	ActListMove:   RoleMember,
+	ActListDelete: RoleMaintainer,
+
+	ActCardCreate: RoleMember,
+	ActCardUpdate: RoleMember,
+	ActCardMove:   RoleMember,
+	ActCardDelete: RoleMember,
+	ActCardShare:  RoleMember,
+
+	ActCommentCreate: RoleMember,
+
+	ActProjectView:          RoleViewer,
+	ActProjectUpdate:        RoleMaintainer,
+	ActProjectCreateBoard:   RoleMember,
+	ActProjectManageMembers: RoleOwner,
+	ActProjectTransfer:      RoleOwner,
+	ActProjectDelete:        RoleOwner,
+}
+
+// Resource identifies what an action applies to. Lists and cards resolve to their board.
+type Resource struct {
+	Kind string // board, list, card, project
+	ID   int64
+}
+
+func boardResource(id int64) Resource   { return Resource{Kind: "board", ID: id} }
+func listResource(id int64) Resource    { return Resource{Kind: "list", ID: id} }
+func cardResource(id int64) Resource    { return Resource{Kind: "card", ID: id} }
+func projectResource(id int64) Resource { return Resource{Kind: "project", ID: id} }
+
+// RoleOn returns the user's effective role on a resource, or ErrNotFound when it doesn't exist.
+func (a *api) RoleOn(ctx context.Context, u *User, res Resource) (Role, error) {
+	switch res.Kind {
+	case "project":
+		return a.store.ProjectRole(ctx, u.ID, res.ID)
+	case "board":
+		return a.store.BoardRole(ctx, u.ID, res.ID)
+	case "list":
+		bid, err := a.store.BoardIDByList(ctx, res.ID)
+		if err != nil {
+			return RoleNone, err
+		}
+		return a.store.BoardRole(ctx, u.ID, bid)
+	case "card":
+		bid, _, err := a.store.BoardAndListByCard(ctx, res.ID)
+		if err != nil {
+			return RoleNone, err
+		}
+		return a.store.BoardRole(ctx, u.ID, bid)
+	}
+	return RoleNone, errors.New("authz: unknown resource kind " + res.Kind)
+}
+
+// effectiveRole is the role the UI should assume: admins act as owners.
+func (a *api) effectiveRole(ctx context.Context, u *User, res Resource) Role {
+	if u.IsAdmin {
+		return RoleOwner
+	}
+	role, err := a.RoleOn(ctx, u, res)
+	if err != nil {
+		return RoleNone
+	}
+	return role
+}
+
+// allows reports whether role is enough for act by the permission matrix. Unknown
+// actions are denied.
+func allows(role Role, act Action) bool {
+	need, ok := permissions[act]
+	return ok && role >= need
+}
+
+// Can reports whether u may perform act on res. Unknown actions are denied.
+func (a *api) Can(ctx context.Context, u *User, act Action, res Resource) (bool, error) {
+	if _, ok := permissions[act]; !ok || u == nil {
+		return false, nil
+	}
+	if u.IsAdmin {
+		// still report missing resources as such
+		if _, err := a.RoleOn(ctx, u, res); errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+		return true, nil
+	}
+	role, err := a.RoleOn(ctx, u, res)
+	if err != nil {
+		return false, err
+	}
+	return allows(role, act), nil
+}
+
+// denyGuest answers 403 for guest accounts, which can't use directory-wide features
+// (user search, creating projects, groups, organizations or invitations).
+func denyGuest(w http.ResponseWriter, u *User) bool {
+	if u.IsGuest {
+		writeError(w, 403, "not available to guests")
+		return true
+	}
+	return false
+}
+
+// authorize is the handler-side wrapper around Can: it answers 401/403/404/500 itself
+// and returns the current user only when the action is allowed.
+func (a *api) authorize(w http.ResponseWriter, r *http.Request, act Action, res Resource) (*User, bool) {
+	u, err := a.currentUser(r)
+	if err != nil {
+		writeError(w, 401, "unauthorized")
+		return nil, false
+	}
+	ok, err := a.Can(r.Context(), u, act, res)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, 404, "not found")
+		return nil, false
+	case err != nil:
+		a.log.Error("access check", "action", act, "err", err)
+		writeError(w, 500, "internal error")
+		return nil, false
+	case !ok:
+		writeError(w, 403, "forbidden")
+		return nil, false
+	}
+	return u, true
+}
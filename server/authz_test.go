@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+var allRoles = []Role{RoleNone, RoleViewer, RoleMember, RoleMaintainer, RoleOwner}
+
+// The matrix spelled out once more: changing a permission has to change this table too.
+var wantMinRole = map[Action]Role{
+	ActBoardView:     RoleViewer,
+	ActBoardUpdate:   RoleMaintainer,
+	ActBoardReorder:  RoleOwner,
+	ActBoardShare:    RoleOwner,
+	ActBoardDelete:   RoleOwner,
+	ActBoardMembers:  RoleMaintainer,
+	ActBoardTransfer: RoleOwner,
+	ActBoardProject:  RoleOwner,
+
+	ActListCreate: RoleMember,
+	ActListUpdate: RoleMember,
+	ActListMove:   RoleMember,
+	ActListDelete: RoleMaintainer,
+
+	ActCardCreate: RoleMember,
+	ActCardUpdate: RoleMember,
+	ActCardMove:   RoleMember,
+	ActCardDelete: RoleMember,
+	ActCardShare:  RoleMember,
+
+	ActCommentCreate: RoleMember,
+
+	ActProjectView:          RoleViewer,
+	ActProjectUpdate:        RoleMaintainer,
+	ActProjectCreateBoard:   RoleMember,
+	ActProjectManageMembers: RoleOwner,
+	ActProjectTransfer:      RoleOwner,
+	ActProjectDelete:        RoleOwner,
+}
+
+func TestPermissionMatrix(t *testing.T) {
+	if len(permissions) != len(wantMinRole) {
+		t.Fatalf("%d actions in the matrix, %d in the test", len(permissions), len(wantMinRole))
+	}
+	for act, need := range wantMinRole {
+		for _, role := range allRoles {
+			if got, want := allows(role, act), role >= need; got != want {
+				t.Errorf("%s as %s: allowed %v, want %v", act, role, got, want)
+			}
+		}
+	}
+	for _, role := range allRoles {
+		if allows(role, "board.unknown") {
+			t.Errorf("unknown action allowed for %s", role)
+		}
+	}
+	// viewers are read-only
+	for act := range permissions {
+		if allows(RoleViewer, act) && act != ActBoardView && act != ActProjectView {
+			t.Errorf("viewer may %s", act)
+		}
+	}
+}
+
+func TestCanWithoutUser(t *testing.T) {
+	a := &api{}
+	if ok, err := a.Can(context.Background(), nil, ActBoardView, boardResource(1)); ok || err != nil {
+		t.Fatalf("nil user: %v %v", ok, err)
+	}
+	if ok, err := a.Can(context.Background(), &User{IsAdmin: true}, "board.unknown", boardResource(1)); ok || err != nil {
+		t.Fatalf("unknown action: %v %v", ok, err)
+	}
+}
+
+// testStore opens the database named by TEST_DATABASE_URL and migrates it; tests that need
+// Postgres are skipped without it.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	s := NewStore(db)
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testUser creates a user with a unique email, a member of the default organization
+// with orgRole unless orgRole is 0.
+func testUser(t *testing.T, s *Store, name string, orgRole int) User {
+	t.Helper()
+	ctx := context.Background()
+	u, err := s.CreateUser(ctx, fmt.Sprintf("%s-%d@authz.test", name, time.Now().UnixNano()), "x", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orgRole != 0 {
+		if err := s.JoinOrg(ctx, s.defaultOrg, u.ID, orgRole); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return u
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestGrants covers every source of a role in boardGrants and projectGrants, and RoleOn /
+// Can on boards, lists, cards and projects.
+func TestGrants(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	a := &api{store: s, log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	owner := testUser(t, s, "owner", OrgRoleMember)
+	orgAdmin := testUser(t, s, "orgadmin", OrgRoleAdmin)
+	direct := testUser(t, s, "direct", OrgRoleMember)
+	groupMember := testUser(t, s, "groupmember", OrgRoleMember)
+	groupAdmin := testUser(t, s, "groupadmin", OrgRoleMember)
+	projOwner := testUser(t, s, "projowner", OrgRoleMember)
+	projMember := testUser(t, s, "projmember", OrgRoleMember)
+	projDefault := testUser(t, s, "projdefault", OrgRoleMember)
+	projGroup := testUser(t, s, "projgroup", OrgRoleMember)
+	outsider := testUser(t, s, "outsider", OrgRoleMember)
+	otherOrg := testUser(t, s, "otherorg", 0)
+	guest := testUser(t, s, "guest", OrgRoleMember)
+	expired := testUser(t, s, "expired", OrgRoleMember)
+	guestInGroup := testUser(t, s, "guestgroup", OrgRoleMember)
+	siteAdmin := testUser(t, s, "siteadmin", 0)
+	_, err := s.db.ExecContext(ctx, `update users set is_admin=true where id=$1`, siteAdmin.ID)
+	must(t, err)
+	siteAdmin.IsAdmin = true
+
+	p, err := s.CreateProject(ctx, s.defaultOrg, projOwner.ID, "authz project")
+	must(t, err)
+	b, err := s.CreateBoard(ctx, s.defaultOrg, owner.ID, "authz board")
+	must(t, err)
+	must(t, s.SetBoardProject(ctx, b.ID, p.ID))
+	l, err := s.CreateList(ctx, b.ID, "list")
+	must(t, err)
+	c, err := s.CreateCard(ctx, l.ID, "card", "", false)
+	must(t, err)
+
+	must(t, s.AddBoardMember(ctx, b.ID, direct.ID, RoleViewer, owner.ID))
+	must(t, s.AddBoardMember(ctx, b.ID, otherOrg.ID, RoleOwner, owner.ID))
+	must(t, s.AddBoardMember(ctx, b.ID, guest.ID, RoleMember, owner.ID))
+	must(t, s.AddBoardMember(ctx, b.ID, expired.ID, RoleMember, owner.ID))
+
+	g, err := s.CreateGroupOwned(ctx, s.defaultOrg, groupAdmin.ID, "authz group")
+	must(t, err)
+	must(t, s.AddUserToGroupRole(ctx, g.ID, groupMember.ID, 1))
+	must(t, s.AddUserToGroupRole(ctx, g.ID, guestInGroup.ID, 1))
+	must(t, s.AddBoardToGroup(ctx, b.ID, g.ID))
+
+	pg, err := s.CreateGroupOwned(ctx, s.defaultOrg, projGroup.ID, "authz project group")
+	must(t, err)
+	must(t, s.SetProjectGroup(ctx, p.ID, pg.ID, RoleMember))
+	viewer := int(RoleViewer)
+	must(t, s.AddProjectMember(ctx, p.ID, projMember.ID, &viewer))
+	must(t, s.AddProjectMember(ctx, p.ID, projDefault.ID, nil))
+
+	must(t, s.SetUserGuest(ctx, guest.ID, true, nil))
+	past := time.Now().Add(-time.Hour)
+	must(t, s.SetUserGuest(ctx, expired.ID, true, &past))
+	must(t, s.SetUserGuest(ctx, guestInGroup.ID, true, nil))
+
+	tests := []struct {
+		name          string
+		u             User
+		board, projct Role
+	}{
+		{"board owner", owner, RoleOwner, RoleNone},
+		{"org admin", orgAdmin, RoleOwner, RoleOwner},
+		{"direct viewer", direct, RoleViewer, RoleNone},
+		{"group member", groupMember, RoleMember, RoleNone},
+		{"group admin", groupAdmin, RoleMaintainer, RoleNone},
+		{"project owner", projOwner, RoleOwner, RoleOwner},
+		{"project viewer", projMember, RoleViewer, RoleViewer},
+		{"project member without role", projDefault, RoleMaintainer, RoleMaintainer},
+		{"project group", projGroup, RoleMember, RoleMember},
+		{"outsider", outsider, RoleNone, RoleNone},
+		{"outside the organization", otherOrg, RoleNone, RoleNone},
+		{"guest", guest, RoleMember, RoleNone},
+		{"expired guest", expired, RoleNone, RoleNone},
+		{"guest in a group", guestInGroup, RoleNone, RoleNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, res := range []Resource{boardResource(b.ID), listResource(l.ID), cardResource(c.ID)} {
+				role, err := a.RoleOn(ctx, &tt.u, res)
+				if err != nil || role != tt.board {
+					t.Errorf("%s %d: %s %v, want %s", res.Kind, res.ID, role, err, tt.board)
+				}
+			}
+			if role, err := a.RoleOn(ctx, &tt.u, projectResource(p.ID)); err != nil || role != tt.projct {
+				t.Errorf("project: %s %v, want %s", role, err, tt.projct)
+			}
+			for act, need := range wantMinRole {
+				res := cardResource(c.ID)
+				want := tt.board >= need
+				if act == ActProjectView || act == ActProjectUpdate || act == ActProjectCreateBoard ||
+					act == ActProjectManageMembers || act == ActProjectTransfer || act == ActProjectDelete {
+					res, want = projectResource(p.ID), tt.projct >= need
+				}
+				if ok, err := a.Can(ctx, &tt.u, act, res); err != nil || ok != want {
+					t.Errorf("%s on %s: %v %v, want %v", act, res.Kind, ok, err, want)
+				}
+			}
+		})
+	}
+
+	t.Run("site admin", func(t *testing.T) {
+		for act := range wantMinRole {
+			if ok, err := a.Can(ctx, &siteAdmin, act, boardResource(b.ID)); !ok || err != nil {
+				t.Errorf("%s: %v %v", act, ok, err)
+			}
+		}
+		if role := a.effectiveRole(ctx, &siteAdmin, boardResource(b.ID)); role != RoleOwner {
+			t.Errorf("effective role %s", role)
+		}
+	})
+
+	t.Run("missing resources", func(t *testing.T) {
+		for _, u := range []User{owner, siteAdmin} {
+			for _, res := range []Resource{boardResource(-1), listResource(-1), cardResource(-1), projectResource(-1)} {
+				if ok, err := a.Can(ctx, &u, ActBoardView, res); ok || !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s %s: %v %v, want not found", u.Name, res.Kind, ok, err)
+				}
+			}
+		}
+	})
+
+	t.Run("accessible boards", func(t *testing.T) {
+		for _, tt := range tests {
+			boards, err := s.AccessibleBoards(ctx, tt.u.ID)
+			must(t, err)
+			if boards[b.ID] != (tt.board != RoleNone) {
+				t.Errorf("%s: accessible %v, role %s", tt.name, boards[b.ID], tt.board)
+			}
+		}
+	})
+
+	t.Run("members", func(t *testing.T) {
+		members, err := s.BoardMembers(ctx, b.ID)
+		must(t, err)
+		got := map[int64]Role{}
+		for _, m := range members {
+			got[m.ID] = m.Role
+		}
+		for _, tt := range tests {
+			role, listed := got[tt.u.ID]
+			if listed != (tt.board != RoleNone) || listed && role != tt.board {
+				t.Errorf("%s: listed %v as %s, want %s", tt.name, listed, role, tt.board)
+			}
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func mustOp(t *testing.T, s string) textOp {
+	t.Helper()
+	var op textOp
+	must(t, json.Unmarshal([]byte(s), &op))
+	return op
+}
+
+// TestCardDocWriteThrough checks that readers of the card row see the description with
+// every operation applied, including descriptions left behind by older versions.
+func TestCardDocWriteThrough(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	u := testUser(t, s, "doc", OrgRoleMember)
+	b, err := s.CreateBoard(ctx, s.defaultOrg, u.ID, "doc board")
+	must(t, err)
+	l, err := s.CreateList(ctx, b.ID, "list")
+	must(t, err)
+	c, err := s.CreateCard(ctx, l.ID, "card", "hello", false)
+	must(t, err)
+
+	// two editors on revision 0: the second operation is transformed over the first
+	_, _, err = s.ApplyCardDocOp(ctx, c.ID, u.ID, "a", 0, mustOp(t, `[5," world"]`))
+	must(t, err)
+	_, rev, err := s.ApplyCardDocOp(ctx, c.ID, u.ID, "b", 0, mustOp(t, `["Oh, ",5]`))
+	must(t, err)
+	const merged = "Oh, hello world"
+	if got, err := s.GetCard(ctx, c.ID); err != nil || got.Description != merged || rev != 2 {
+		t.Fatalf("GetCard: %q %v at rev %d, want %q", got.Description, err, rev, merged)
+	}
+	if doc, err := s.CardDoc(ctx, c.ID, -1); err != nil || doc.Text != merged || doc.Rev != rev {
+		t.Fatalf("CardDoc: %q rev %d %v", doc.Text, doc.Rev, err)
+	}
+
+	// a description written back only lazily, as before: caught up at startup
+	_, err = s.db.ExecContext(ctx, `update cards set description='hello', doc_rev=0 where id=$1`, c.ID)
+	must(t, err)
+	if n, err := s.SnapshotCardDocs(ctx); err != nil || n < 1 {
+		t.Fatalf("SnapshotCardDocs: %d %v", n, err)
+	}
+	if got, err := s.GetCard(ctx, c.ID); err != nil || got.Description != merged {
+		t.Fatalf("after catching up: %q %v", got.Description, err)
+	}
+}
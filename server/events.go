@@ -1,86 +1,608 @@
 package main
 
 import (
-    "encoding/json"
-    "net/http"
-    "sync"
-    "time"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Event struct {
-    Type    string `json:"type"`
-    Entity  string `json:"entity,omitempty"`
-    BoardID int64  `json:"board_id"`
-    ListID  *int64 `json:"list_id,omitempty"`
-    Payload any    `json:"payload,omitempty"`
+	Type    string `json:"type"`
+	Entity  string `json:"entity,omitempty"`
+	BoardID int64  `json:"board_id"`
+	ListID  *int64 `json:"list_id,omitempty"`
+	Payload any    `json:"payload,omitempty"`
+}
+
+// LoggedEvent is a published event as it goes over the wire: its per-board id
+// (0 when it couldn't be logged) and the JSON sent as SSE data.
+type LoggedEvent struct {
+	ID   int64
+	Data []byte
+	// Resync is a marker, never sent as is: events may have been lost, catch up from the log
+	Resync bool
+}
+
+// EventLog persists events so reconnecting clients can replay what they missed.
+// Ids are per board and grow by one with every event.
+type EventLog interface {
+	// AppendEvent stores data as the board's next event, keeping only the last keep ones.
+	AppendEvent(ctx context.Context, boardID int64, data []byte, keep int) (int64, error)
+	// EventsSince returns the events after id after; complete is false when the log
+	// no longer covers the gap (pruned, more than limit behind, or an unknown id).
+	EventsSince(ctx context.Context, boardID, after int64, limit int) (events []LoggedEvent, complete bool, err error)
+}
+
+// EventTransport carries events between server instances. With a transport, Publish
+// only sends and every instance, this one included, delivers what Run receives.
+type EventTransport interface {
+	Send(ctx context.Context, boardID int64, msg LoggedEvent) error
+	// Run receives events until ctx ends; lost() is called whenever events may have
+	// been missed, e.g. after reconnecting.
+	Run(ctx context.Context, deliver func(boardID int64, msg LoggedEvent), lost func())
+}
+
+// presence timing: a user's last connection closing (a reload, a reconnect) only counts
+// as leaving after presenceGrace; an editing mark lapses unless refreshed within editingTTL.
+// Variables so that tests can shorten them.
+var (
+	presenceGrace = 10 * time.Second
+	editingTTL    = 60 * time.Second
+)
+
+// sseWriteTimeout bounds every write to an event stream; a client that takes longer is dead.
+const sseWriteTimeout = 10 * time.Second
+
+// subState is how well a subscriber keeps up. Deliveries never block: when its buffer is
+// full an event is dropped and the subscriber marked lagging, and once its reader has
+// drained the buffer it catches up from the log (or gets a resync). A subscriber whose
+// buffer stays full for longer than the bus's slowTimeout is disconnected.
+type subState struct {
+	dropped        atomic.Int64 // events dropped for this subscriber
+	lagging        atomic.Bool  // dropped something since the buffer last drained
+	saturatedSince atomic.Int64 // unix nanos of the first drop since then, 0 when not saturated
+	kicked         chan struct{}
+	kickOnce       sync.Once
+}
+
+func newSubState() subState { return subState{kicked: make(chan struct{})} }
+
+// drop records an event dropped for the subscriber, disconnecting it once it has been
+// saturated for longer than slowTimeout. Safe under b.mu.RLock.
+func (s *subState) drop(b *EventBus, boardID int64) {
+	s.dropped.Add(1)
+	b.dropped.Add(1)
+	s.lagging.Store(true)
+	now := time.Now().UnixNano()
+	if !s.saturatedSince.CompareAndSwap(0, now) && b.slowTimeout > 0 &&
+		time.Duration(now-s.saturatedSince.Load()) > b.slowTimeout {
+		s.kickOnce.Do(func() {
+			b.disconnected.Add(1)
+			b.log.Warn("event subscriber too slow, disconnecting", "board_id", boardID, "dropped", s.dropped.Load())
+			close(s.kicked)
+		})
+	}
+}
+
+// drained is called by the reader after each message; it reports whether the buffer is
+// now empty after events were dropped, i.e. whether the reader should catch up.
+func (s *subState) drained(empty bool) bool {
+	if !empty {
+		return false
+	}
+	s.saturatedSince.Store(0)
+	return s.lagging.Swap(false)
+}
+
+// subscription is a board stream's end of the bus.
+type subscription struct {
+	subState
+	revocable
+	ch chan LoggedEvent
+}
+
+// presence is a user viewing a board over one or more connections.
+type presence struct {
+	PresenceUser
+	conns   int
+	leave   *time.Timer // pending presence.left once conns drops to 0
+	editTTL *time.Timer
 }
 
 type EventBus struct {
-    mu   sync.RWMutex
-    subs map[int64]map[chan []byte]struct{}
+	mu       sync.RWMutex
+	subs     map[int64]map[*subscription]struct{}
+	presence map[int64]map[int64]*presence // board → user
+	// per-user streams spanning boards (GET /api/me/events)
+	userSubs      map[*userSub]struct{}
+	userConns     map[int64]int
+	userStreamMax int
+	accessGen     atomic.Int64 // bumped by AccessChanged
+	// set by CheckAccessWith: board streams are re-checked after AccessChanged
+	canAccess func(ctx context.Context, userID, boardID int64) (bool, error)
+	recheck   chan struct{}
+
+	buffer       int           // events a subscriber may fall behind before drops
+	slowTimeout  time.Duration // saturated for longer: disconnected (0: never)
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+
+	// pubMu keeps log order and delivery order the same for a board
+	pubMu     [32]sync.Mutex
+	events    EventLog       // nil: events carry no ids and can't be replayed
+	transport EventTransport // nil: single instance, events stay in this process
+	keep      int
+	log       *slog.Logger
+}
+
+func NewEventBus(events EventLog, log *slog.Logger) *EventBus {
+	keep := 1000
+	if n, err := strconv.Atoi(getenv("EVENT_LOG_SIZE", "")); err == nil && n > 0 {
+		keep = n
+	}
+	userStreamMax := 5
+	if n, err := strconv.Atoi(getenv("EVENT_STREAMS_PER_USER", "")); err == nil && n >= 0 {
+		userStreamMax = n
+	}
+	buffer := 16
+	if n, err := strconv.Atoi(getenv("EVENT_BUFFER", "")); err == nil && n > 0 {
+		buffer = n
+	}
+	slowTimeout := 30 * time.Second
+	if d, err := time.ParseDuration(getenv("EVENT_SLOW_TIMEOUT", "")); err == nil && d >= 0 {
+		slowTimeout = d
+	}
+	return &EventBus{subs: make(map[int64]map[*subscription]struct{}), presence: make(map[int64]map[int64]*presence),
+		userSubs: make(map[*userSub]struct{}), userConns: make(map[int64]int), userStreamMax: userStreamMax,
+		buffer: buffer, slowTimeout: slowTimeout, events: events, keep: keep, log: log}
 }
 
-func NewEventBus() *EventBus { return &EventBus{subs: make(map[int64]map[chan []byte]struct{})} }
+// Subscribe opens a stream of the board's events. A non-nil viewer is shown as present
+// on the board for as long as they have a stream open, and the stream is revoked if they
+// lose access. The reader should stop when sub.kicked or sub.revoked is closed.
+func (b *EventBus) Subscribe(boardID int64, viewer *User) (sub *subscription, cancel func()) {
+	sub = &subscription{subState: newSubState(), revocable: revocable{revoked: make(chan struct{})}, ch: make(chan LoggedEvent, b.buffer)}
+	if viewer != nil {
+		sub.userID = viewer.ID
+	}
+	b.mu.Lock()
+	if b.subs[boardID] == nil {
+		b.subs[boardID] = make(map[*subscription]struct{})
+	}
+	b.subs[boardID][sub] = struct{}{}
+	joined := viewer != nil && b.join(boardID, viewer)
+	b.mu.Unlock()
+	if joined {
+		b.PublishEphemeral(Event{Type: "presence.joined", Entity: "user", BoardID: boardID, Payload: map[string]any{"user_id": viewer.ID, "name": viewer.Name}})
+	}
+	return sub, func() {
+		b.mu.Lock()
+		if subs, ok := b.subs[boardID]; ok {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(b.subs, boardID)
+			}
+		}
+		if viewer != nil {
+			b.leave(boardID, viewer.ID)
+		}
+		b.mu.Unlock()
+		close(sub.ch)
+		if n := sub.dropped.Load(); n > 0 {
+			b.log.Info("event subscriber closed", "board_id", boardID, "dropped", n)
+		}
+	}
+}
+
+// join counts a new connection of u on the board and reports whether u just arrived.
+// Called with b.mu held.
+func (b *EventBus) join(boardID int64, u *User) bool {
+	users := b.presence[boardID]
+	if users == nil {
+		users = make(map[int64]*presence)
+		b.presence[boardID] = users
+	}
+	if p := users[u.ID]; p != nil {
+		p.conns++
+		if p.leave != nil {
+			p.leave.Stop()
+			p.leave = nil
+		}
+		return false
+	}
+	users[u.ID] = &presence{PresenceUser: PresenceUser{UserID: u.ID, Name: u.Name, Since: time.Now()}, conns: 1}
+	return true
+}
+
+// leave drops a connection; the user leaves after presenceGrace without a new one.
+// Called with b.mu held.
+func (b *EventBus) leave(boardID, userID int64) {
+	p := b.presence[boardID][userID]
+	if p == nil {
+		return
+	}
+	if p.conns--; p.conns > 0 {
+		return
+	}
+	p.leave = time.AfterFunc(presenceGrace, func() {
+		b.mu.Lock()
+		if b.presence[boardID][userID] != p || p.conns > 0 {
+			b.mu.Unlock()
+			return
+		}
+		delete(b.presence[boardID], userID)
+		if len(b.presence[boardID]) == 0 {
+			delete(b.presence, boardID)
+		}
+		editing := p.EditingCardID
+		if p.editTTL != nil {
+			p.editTTL.Stop()
+		}
+		b.mu.Unlock()
+		if editing != 0 {
+			b.publishEditing(boardID, editing, userID, "", false)
+		}
+		b.PublishEphemeral(Event{Type: "presence.left", Entity: "user", BoardID: boardID, Payload: map[string]any{"user_id": userID}})
+	})
+}
+
+// EventStats describes this instance's subscribers (GET /api/admin/system).
+type EventStats struct {
+	Boards       int   `json:"boards"` // boards with at least one stream open
+	Subscribers  int   `json:"subscribers"`
+	UserStreams  int   `json:"user_streams"`
+	Lagging      int   `json:"lagging"` // subscribers behind, catching up once drained
+	Buffer       int   `json:"buffer"`
+	Dropped      int64 `json:"dropped"`      // events dropped for slow subscribers since start
+	Disconnected int64 `json:"disconnected"` // subscribers disconnected for staying saturated
+}
 
-func (b *EventBus) Subscribe(boardID int64) (ch chan []byte, cancel func()) {
-    ch = make(chan []byte, 16)
-    b.mu.Lock()
-    if b.subs[boardID] == nil { b.subs[boardID] = make(map[chan []byte]struct{}) }
-    b.subs[boardID][ch] = struct{}{}
-    b.mu.Unlock()
-    return ch, func() {
-        b.mu.Lock()
-        if subs, ok := b.subs[boardID]; ok {
-            delete(subs, ch)
-            if len(subs) == 0 { delete(b.subs, boardID) }
-        }
-        b.mu.Unlock()
-        close(ch)
-    }
+func (b *EventBus) Stats() EventStats {
+	st := EventStats{Buffer: b.buffer, Dropped: b.dropped.Load(), Disconnected: b.disconnected.Load()}
+	b.mu.RLock()
+	st.Boards = len(b.subs)
+	for _, subs := range b.subs {
+		st.Subscribers += len(subs)
+		for sub := range subs {
+			if sub.lagging.Load() {
+				st.Lagging++
+			}
+		}
+	}
+	st.UserStreams = len(b.userSubs)
+	for sub := range b.userSubs {
+		if sub.lagging.Load() {
+			st.Lagging++
+		}
+	}
+	b.mu.RUnlock()
+	return st
+}
+
+// Presence lists the users viewing a board through this instance, earliest first.
+func (b *EventBus) Presence(boardID int64) []PresenceUser {
+	b.mu.RLock()
+	out := make([]PresenceUser, 0, len(b.presence[boardID]))
+	for _, p := range b.presence[boardID] {
+		out = append(out, p.PresenceUser)
+	}
+	b.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Since.Before(out[j].Since) })
+	return out
+}
+
+// SetEditing marks u as editing a card (or no longer) and tells the board. A mark lapses
+// after editingTTL unless set again, so clients refresh it while the editor is open.
+func (b *EventBus) SetEditing(boardID, cardID int64, u *User, editing bool) {
+	var replaced int64
+	b.mu.Lock()
+	if p := b.presence[boardID][u.ID]; p != nil {
+		if p.editTTL != nil {
+			p.editTTL.Stop()
+			p.editTTL = nil
+		}
+		switch {
+		case editing:
+			if p.EditingCardID != cardID {
+				replaced = p.EditingCardID
+			}
+			p.EditingCardID = cardID
+			p.editTTL = time.AfterFunc(editingTTL, func() {
+				b.mu.Lock()
+				lapsed := b.presence[boardID][u.ID] == p && p.EditingCardID == cardID
+				if lapsed {
+					p.EditingCardID = 0
+				}
+				b.mu.Unlock()
+				if lapsed {
+					b.publishEditing(boardID, cardID, u.ID, "", false)
+				}
+			})
+		case p.EditingCardID == cardID:
+			p.EditingCardID = 0
+		}
+	}
+	b.mu.Unlock()
+	// published even without local presence: the user's stream may be on another instance
+	if replaced != 0 {
+		b.publishEditing(boardID, replaced, u.ID, "", false)
+	}
+	b.publishEditing(boardID, cardID, u.ID, u.Name, editing)
+}
+
+func (b *EventBus) publishEditing(boardID, cardID, userID int64, name string, editing bool) {
+	ev := Event{Type: "card.stopped", Entity: "card", BoardID: boardID, Payload: map[string]any{"card_id": cardID, "user_id": userID}}
+	if editing {
+		ev.Type = "card.editing"
+		ev.Payload = map[string]any{"card_id": cardID, "user_id": userID, "name": name}
+	}
+	b.PublishEphemeral(ev)
 }
 
 func (b *EventBus) Publish(ev Event) {
-    data, _ := json.Marshal(ev)
-    b.mu.RLock()
-    subs := b.subs[ev.BoardID]
-    for ch := range subs {
-        select { case ch <- data: default: /* drop if slow */ }
-    }
-    b.mu.RUnlock()
+	data, _ := json.Marshal(ev)
+	mu := &b.pubMu[uint64(ev.BoardID)%uint64(len(b.pubMu))]
+	mu.Lock()
+	defer mu.Unlock()
+	msg := LoggedEvent{Data: data}
+	if b.events != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		id, err := b.events.AppendEvent(ctx, ev.BoardID, data, b.keep)
+		cancel()
+		if err != nil {
+			b.log.Error("event log append", "board_id", ev.BoardID, "err", err)
+		} else {
+			msg.ID = id
+		}
+	}
+	b.send(ev.BoardID, msg)
+}
+
+// PublishEphemeral delivers an event to the current subscribers only: it gets no id and
+// isn't logged or replayed (presence pings and the like).
+func (b *EventBus) PublishEphemeral(ev Event) {
+	data, _ := json.Marshal(ev)
+	b.send(ev.BoardID, LoggedEvent{Data: data})
+}
+
+func (b *EventBus) send(boardID int64, msg LoggedEvent) {
+	if b.transport != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := b.transport.Send(ctx, boardID, msg)
+		cancel()
+		if err == nil {
+			return
+		}
+		// other instances miss it, but their clients catch up from the log on the next event
+		b.log.Error("event bus send", "board_id", boardID, "err", err)
+	}
+	b.deliver(boardID, msg)
+}
+
+// Distribute switches the bus to a multi-instance transport and starts receiving from it.
+// Call it before serving requests.
+func (b *EventBus) Distribute(ctx context.Context, t EventTransport) {
+	b.transport = t
+	go t.Run(ctx, b.deliver, b.lost)
+}
+
+func (b *EventBus) deliver(boardID int64, msg LoggedEvent) {
+	switch {
+	case boardID == accessChangedBoard:
+		b.accessGen.Add(1)
+		b.mu.RLock()
+		for sub := range b.userSubs {
+			select {
+			case sub.ch <- boardEvent{boardID, msg}:
+			default: // noticed with the next event
+			}
+		}
+		b.mu.RUnlock()
+		b.scheduleRecheck()
+		return
+	case boardID < 0:
+		b.mu.RLock()
+		b.deliverUser(-boardID, msg)
+		b.mu.RUnlock()
+		return
+	}
+	b.mu.RLock()
+	subs := b.subs[boardID]
+	for sub := range subs {
+		select {
+		case sub.ch <- msg:
+		default: // slow: it catches up once it has drained its buffer
+			sub.drop(b, boardID)
+		}
+	}
+	b.deliverUsers(boardID, msg)
+	b.mu.RUnlock()
+}
+
+// lost asks every local subscriber to catch up from the log. An AccessChanged may have
+// been missed as well, so user streams check access again.
+func (b *EventBus) lost() {
+	b.accessGen.Add(1)
+	b.scheduleRecheck()
+	b.mu.RLock()
+	for _, subs := range b.subs {
+		for sub := range subs {
+			select {
+			case sub.ch <- LoggedEvent{Resync: true}:
+			default: // busy: it catches up once drained
+				sub.lagging.Store(true)
+			}
+		}
+	}
+	for sub := range b.userSubs {
+		select {
+		case sub.ch <- boardEvent{msg: LoggedEvent{Resync: true}}:
+		default:
+			sub.lagging.Store(true)
+		}
+	}
+	b.mu.RUnlock()
+}
+
+// lastEventID is where the client wants to resume: the Last-Event-ID header sent by
+// EventSource on reconnect, or ?last_event_id= for a fresh connection.
+func lastEventID(r *http.Request) (int64, bool) {
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+func writeSSE(w http.ResponseWriter, msg LoggedEvent) {
+	if msg.ID > 0 {
+		_, _ = fmt.Fprintf(w, "id: %d\n", msg.ID)
+	}
+	_, _ = w.Write([]byte("data: "))
+	_, _ = w.Write(msg.Data)
+	_, _ = w.Write([]byte("\n\n"))
+}
+
+// writeResync tells the client to reload the board: what it missed can't be replayed.
+func writeResync(w http.ResponseWriter, boardID int64) {
+	_, _ = fmt.Fprintf(w, "event: resync\ndata: {\"board_id\":%d}\n\n", boardID)
+}
+
+// boardStream follows one client's position in a board's events and hands each event
+// to emit exactly once and in order, replaying from the log whatever the subscription
+// dropped; resync is called when the log can't fill a gap. SSE and WebSocket share it.
+type boardStream struct {
+	bus     *EventBus
+	boardID int64
+	last    int64 // id of the last event emitted, 0 when unknown
+	emit    func(LoggedEvent)
+	resync  func()
+}
+
+// catchUp replays the logged events after s.last, or resyncs when the log can't fill the gap.
+func (s *boardStream) catchUp(ctx context.Context) {
+	var evs []LoggedEvent
+	complete := false
+	if s.bus.events != nil {
+		var err error
+		evs, complete, err = s.bus.events.EventsSince(ctx, s.boardID, s.last, s.bus.keep)
+		if err != nil {
+			s.bus.log.Error("event log replay", "board_id", s.boardID, "err", err)
+			complete = false
+		}
+	}
+	if !complete {
+		s.resync()
+		s.last = 0
+		return
+	}
+	for _, ev := range evs {
+		s.emit(ev)
+		s.last = ev.ID
+	}
+}
+
+// handle processes one message from the subscription channel.
+func (s *boardStream) handle(ctx context.Context, msg LoggedEvent) {
+	if msg.Resync {
+		if s.last > 0 {
+			s.catchUp(ctx)
+		} else {
+			s.resync()
+		}
+		return
+	}
+	if msg.ID > 0 {
+		if msg.ID <= s.last {
+			return // already replayed
+		}
+		if s.last > 0 && msg.ID > s.last+1 {
+			// events were dropped while this connection was slow
+			s.catchUp(ctx)
+			if s.last == 0 || msg.ID <= s.last {
+				return
+			}
+		}
+		s.last = msg.ID
+	}
+	s.emit(msg)
 }
 
 // Serve a single SSE connection for the given board.
-func (b *EventBus) ServeSSE(w http.ResponseWriter, r *http.Request, boardID int64) {
-    w.Header().Set("Content-Type", "text/event-stream")
-    w.Header().Set("Cache-Control", "no-cache")
-    w.Header().Set("Connection", "keep-alive")
-    flusher, ok := w.(http.Flusher)
-    if !ok { http.Error(w, "stream unsupported", http.StatusInternalServerError); return }
-
-    ch, cancel := b.Subscribe(boardID)
-    defer cancel()
-
-    // Initial comment to open the stream
-    _, _ = w.Write([]byte(": connected\n\n"))
-    flusher.Flush()
-
-    ticker := time.NewTicker(25 * time.Second)
-    defer ticker.Stop()
-
-    for {
-        select {
-        case <-r.Context().Done():
-            return
-        case <-ticker.C:
-            // heartbeat comment to keep connection alive through proxies
-            _, _ = w.Write([]byte(": ping\n\n"))
-            flusher.Flush()
-        case msg, ok := <-ch:
-            if !ok { return }
-            _, _ = w.Write([]byte("data: "))
-            _, _ = w.Write(msg)
-            _, _ = w.Write([]byte("\n\n"))
-            flusher.Flush()
-        }
-    }
+func (b *EventBus) ServeSSE(w http.ResponseWriter, r *http.Request, boardID int64, viewer *User) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "stream unsupported", http.StatusInternalServerError)
+		return
+	}
+	// the stream outlives the server's WriteTimeout; each flush gets its own deadline
+	// instead, so a dead client is noticed at the next heartbeat at the latest
+	rc := http.NewResponseController(w)
+	flush := func() bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		return rc.Flush() == nil
+	}
+
+	// subscribe before replaying so nothing published in between is lost
+	sub, cancel := b.Subscribe(boardID, viewer)
+	defer cancel()
+	stream := &boardStream{bus: b, boardID: boardID,
+		emit:   func(msg LoggedEvent) { writeSSE(w, msg) },
+		resync: func() { writeResync(w, boardID) }}
+
+	// Initial comment to open the stream
+	_, _ = w.Write([]byte(": connected\n\n"))
+	if last, resume := lastEventID(r); resume {
+		stream.last = last
+		stream.catchUp(r.Context())
+	}
+	if !flush() {
+		return
+	}
+
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			// heartbeat comment to keep connection alive through proxies
+			_, _ = w.Write([]byte(": ping\n\n"))
+			if !flush() {
+				return
+			}
+		case <-sub.kicked:
+			return
+		case <-sub.revoked:
+			writeSSE(w, accessRevokedEvent(boardID, sub.userID))
+			flush()
+			return
+		case msg, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			stream.handle(r.Context(), msg)
+			if sub.drained(len(sub.ch) == 0) {
+				stream.handle(r.Context(), LoggedEvent{Resync: true})
+			}
+			if !flush() {
+				return
+			}
+		}
+	}
 }
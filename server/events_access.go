@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Access revocation and personal events. After AccessChanged every instance checks the
+// viewers of its open board streams again and closes, with an access.revoked event,
+// those of users who can no longer see the board (a deleted board included). Personal
+// events (group and project membership) are sent on the pseudo board -userID and reach
+// only that user's streams from GET /api/me/events.
+
+// revocable is the part of a board subscription that access checks close.
+type revocable struct {
+	userID     int64 // the viewer, 0 for anonymous streams that are never checked
+	revoked    chan struct{}
+	revokeOnce sync.Once
+}
+
+func (s *revocable) revoke() { s.revokeOnce.Do(func() { close(s.revoked) }) }
+
+// accessRevokedEvent is the last event a stream gets before it is closed.
+func accessRevokedEvent(boardID, userID int64) LoggedEvent {
+	data, _ := json.Marshal(Event{Type: "access.revoked", Entity: "board", BoardID: boardID, Payload: map[string]any{"board_id": boardID, "user_id": userID}})
+	return LoggedEvent{Data: data}
+}
+
+// CheckAccessWith makes the bus re-check board streams with canAccess whenever access
+// changed. A guest account expiring changes access without any request, so after each
+// re-check the bus also schedules one for the next expiry nextExpiry reports (zero time:
+// none ahead). Call it before serving requests.
+func (b *EventBus) CheckAccessWith(canAccess func(ctx context.Context, userID, boardID int64) (bool, error), nextExpiry func(ctx context.Context) (time.Time, error)) {
+	b.canAccess = canAccess
+	b.recheck = make(chan struct{}, 1)
+	go func() {
+		var expiry *time.Timer
+		for range b.recheck {
+			b.recheckAccess()
+			if expiry != nil {
+				expiry.Stop()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			at, err := nextExpiry(ctx)
+			cancel()
+			if err != nil {
+				b.log.Error("event stream guest expiry", "err", err)
+				continue
+			}
+			if !at.IsZero() {
+				// a second late, so the database's now() is past it as well
+				expiry = time.AfterFunc(time.Until(at)+time.Second, b.scheduleRecheck)
+			}
+		}
+	}()
+	// arms the timer for guests that were already there at startup
+	b.scheduleRecheck()
+}
+
+// scheduleRecheck asks for a re-check; requests arriving while one runs are coalesced.
+func (b *EventBus) scheduleRecheck() {
+	if b.recheck == nil {
+		return
+	}
+	select {
+	case b.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// recheckAccess revokes the board streams whose viewer lost access to the board and
+// reloads the boards user streams are queued events of.
+func (b *EventBus) recheckAccess() {
+	type viewer struct{ userID, boardID int64 }
+	streams := map[viewer][]*subscription{}
+	var userSubs []*userSub
+	b.mu.RLock()
+	for boardID, subs := range b.subs {
+		for sub := range subs {
+			if sub.userID != 0 {
+				v := viewer{sub.userID, boardID}
+				streams[v] = append(streams[v], sub)
+			}
+		}
+	}
+	for sub := range b.userSubs {
+		userSubs = append(userSubs, sub)
+	}
+	b.mu.RUnlock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, sub := range userSubs {
+		sub.refresh(ctx, b)
+	}
+	for v, subs := range streams {
+		ok, err := b.canAccess(ctx, v.userID, v.boardID)
+		if err != nil {
+			b.log.Error("event stream access", "board_id", v.boardID, "user_id", v.userID, "err", err)
+			continue
+		}
+		if !ok {
+			b.log.Info("event stream access revoked", "board_id", v.boardID, "user_id", v.userID)
+			for _, sub := range subs {
+				sub.revoke()
+			}
+		}
+	}
+}
+
+// PublishUser sends a personal event to the user's streams from GET /api/me/events on
+// every instance. It isn't logged or replayed.
+func (b *EventBus) PublishUser(userID int64, ev Event) {
+	data, _ := json.Marshal(ev)
+	b.send(-userID, LoggedEvent{Data: data})
+}
+
+// deliverUser hands a personal event to the user's streams. Called with b.mu held.
+func (b *EventBus) deliverUser(userID int64, msg LoggedEvent) {
+	for sub := range b.userSubs {
+		if sub.userID != userID {
+			continue
+		}
+		select {
+		case sub.ch <- boardEvent{-userID, msg}:
+		default:
+			sub.drop(b, 0)
+		}
+	}
+}
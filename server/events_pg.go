@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// pgEventChannel is the NOTIFY channel shared by all instances (EVENT_BUS=postgres).
+const pgEventChannel = "trellolite_events"
+
+// pgInlineLimit keeps NOTIFY payloads under Postgres' 8000-byte limit; bigger events
+// are sent as a reference to their row in board_events.
+const pgInlineLimit = 7000
+
+// pgEventTransport fans events out to every instance through Postgres LISTEN/NOTIFY.
+// Payloads are "<board_id>:<event_id>:<json>", or "<board_id>:<event_id>" when the
+// JSON is too big and the receivers load it from the event log.
+type pgEventTransport struct {
+	dsn   string
+	store *Store
+	log   *slog.Logger
+}
+
+func newPGEventTransport(dsn string, store *Store, log *slog.Logger) *pgEventTransport {
+	return &pgEventTransport{dsn: dsn, store: store, log: log}
+}
+
+func (t *pgEventTransport) Send(ctx context.Context, boardID int64, msg LoggedEvent) error {
+	payload := strconv.FormatInt(boardID, 10) + ":" + strconv.FormatInt(msg.ID, 10)
+	if len(msg.Data) <= pgInlineLimit {
+		payload += ":" + string(msg.Data)
+	} else if msg.ID == 0 {
+		return errors.New("event too large to notify and not in the event log")
+	}
+	return t.store.Notify(ctx, pgEventChannel, payload)
+}
+
+// Run listens on its own connection (outside the pool) and reconnects with backoff.
+func (t *pgEventTransport) Run(ctx context.Context, deliver func(boardID int64, msg LoggedEvent), lost func()) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := t.listen(ctx, deliver, lost, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+		t.log.Error("event bus listen", "err", err, "retry_in", backoff.String())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+func (t *pgEventTransport) listen(ctx context.Context, deliver func(int64, LoggedEvent), lost func(), connected func()) error {
+	conn, err := pgx.Connect(ctx, t.dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "listen "+pgEventChannel); err != nil {
+		return err
+	}
+	connected()
+	// anything sent while we weren't listening is gone; subscribers catch up from the log
+	lost()
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		boardID, msg, err := t.parse(ctx, n.Payload)
+		if err != nil {
+			t.log.Error("event bus receive", "err", err)
+			continue
+		}
+		deliver(boardID, msg)
+	}
+}
+
+func (t *pgEventTransport) parse(ctx context.Context, payload string) (int64, LoggedEvent, error) {
+	parts := strings.SplitN(payload, ":", 3)
+	if len(parts) < 2 {
+		return 0, LoggedEvent{}, errors.New("bad event payload")
+	}
+	boardID, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, LoggedEvent{}, err
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, LoggedEvent{}, err
+	}
+	msg := LoggedEvent{ID: id}
+	if len(parts) == 3 {
+		msg.Data = []byte(parts[2])
+		return boardID, msg, nil
+	}
+	msg.Data, err = t.store.EventData(ctx, boardID, id)
+	return boardID, msg, err
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testBus(events EventLog) *EventBus {
+	return NewEventBus(events, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// memEventLog is an EventLog in memory.
+type memEventLog struct {
+	mu     sync.Mutex
+	events map[int64][]LoggedEvent
+}
+
+func (l *memEventLog) AppendEvent(ctx context.Context, boardID int64, data []byte, keep int) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.events == nil {
+		l.events = map[int64][]LoggedEvent{}
+	}
+	evs := l.events[boardID]
+	id := int64(1)
+	if n := len(evs); n > 0 {
+		id = evs[n-1].ID + 1
+	}
+	evs = append(evs, LoggedEvent{ID: id, Data: data})
+	if len(evs) > keep {
+		evs = evs[len(evs)-keep:]
+	}
+	l.events[boardID] = evs
+	return id, nil
+}
+
+func (l *memEventLog) EventsSince(ctx context.Context, boardID, after int64, limit int) ([]LoggedEvent, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	evs := l.events[boardID]
+	if len(evs) == 0 {
+		return nil, after == 0, nil
+	}
+	first, last := evs[0].ID, evs[len(evs)-1].ID
+	if after < first-1 || after > last || last-after > int64(limit) {
+		return nil, false, nil
+	}
+	return append([]LoggedEvent(nil), evs[after-first+1:]...), true, nil
+}
+
+// nextEvent waits for the subscription's next event and returns its type and payload.
+func nextEvent(t *testing.T, ch <-chan LoggedEvent) (string, map[string]any) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		var ev struct {
+			Type    string         `json:"type"`
+			Payload map[string]any `json:"payload"`
+		}
+		must(t, json.Unmarshal(msg.Data, &ev))
+		return ev.Type, ev.Payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return "", nil
+	}
+}
+
+func noEvent(t *testing.T, ch <-chan LoggedEvent, wait time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		t.Fatalf("unexpected event %s", msg.Data)
+	case <-time.After(wait):
+	}
+}
+
+// shorten sets a timing variable for the duration of the test.
+func shorten(t *testing.T, v *time.Duration, d time.Duration) {
+	old := *v
+	*v = d
+	t.Cleanup(func() { *v = old })
+}
+
+func TestPresence(t *testing.T) {
+	shorten(t, &presenceGrace, 50*time.Millisecond)
+	b := testBus(nil)
+	ann := &User{ID: 1, Name: "Ann"}
+	obs, cancelObs := b.Subscribe(1, nil)
+	defer cancelObs()
+
+	_, cancel1 := b.Subscribe(1, ann)
+	if typ, p := nextEvent(t, obs.ch); typ != "presence.joined" || p["user_id"] != float64(1) || p["name"] != "Ann" {
+		t.Fatalf("join: %s %v", typ, p)
+	}
+	_, cancel2 := b.Subscribe(1, ann) // a second tab
+	if got := b.Presence(1); len(got) != 1 || got[0].UserID != 1 {
+		t.Fatalf("presence: %+v", got)
+	}
+	if len(b.Presence(2)) != 0 {
+		t.Fatal("present on another board")
+	}
+
+	cancel1()
+	cancel2()
+	// a reload within the grace period is no leave
+	_, cancel3 := b.Subscribe(1, ann)
+	noEvent(t, obs.ch, 3*presenceGrace)
+	if len(b.Presence(1)) != 1 {
+		t.Fatal("left during a reload")
+	}
+
+	b.SetEditing(1, 5, ann, true)
+	if typ, _ := nextEvent(t, obs.ch); typ != "card.editing" {
+		t.Fatalf("editing: %s", typ)
+	}
+	cancel3()
+	if typ, p := nextEvent(t, obs.ch); typ != "card.stopped" || p["card_id"] != float64(5) {
+		t.Fatalf("editing cleared on leaving: %s %v", typ, p)
+	}
+	if typ, p := nextEvent(t, obs.ch); typ != "presence.left" || p["user_id"] != float64(1) {
+		t.Fatalf("leave: %s %v", typ, p)
+	}
+	if len(b.Presence(1)) != 0 {
+		t.Fatalf("still present: %+v", b.Presence(1))
+	}
+}
+
+func TestEditingTTL(t *testing.T) {
+	shorten(t, &editingTTL, 100*time.Millisecond)
+	b := testBus(nil)
+	ann := &User{ID: 1, Name: "Ann"}
+	obs, cancelObs := b.Subscribe(1, nil)
+	defer cancelObs()
+	_, cancel := b.Subscribe(1, ann)
+	defer cancel()
+	nextEvent(t, obs.ch) // joined
+
+	b.SetEditing(1, 5, ann, true)
+	if typ, p := nextEvent(t, obs.ch); typ != "card.editing" || p["card_id"] != float64(5) || p["name"] != "Ann" {
+		t.Fatalf("editing: %s %v", typ, p)
+	}
+	// switching cards stops the first
+	b.SetEditing(1, 6, ann, true)
+	if typ, p := nextEvent(t, obs.ch); typ != "card.stopped" || p["card_id"] != float64(5) {
+		t.Fatalf("switch: %s %v", typ, p)
+	}
+	nextEvent(t, obs.ch) // editing 6
+	// a refresh keeps the mark past the first TTL
+	time.Sleep(editingTTL * 2 / 3)
+	b.SetEditing(1, 6, ann, true)
+	nextEvent(t, obs.ch)
+	time.Sleep(editingTTL * 2 / 3)
+	if got := b.Presence(1); got[0].EditingCardID != 6 {
+		t.Fatalf("refreshed mark lapsed: %+v", got)
+	}
+
+	start := time.Now()
+	if typ, p := nextEvent(t, obs.ch); typ != "card.stopped" || p["card_id"] != float64(6) || p["user_id"] != float64(1) {
+		t.Fatalf("lapse: %s %v", typ, p)
+	}
+	if time.Since(start) > editingTTL {
+		t.Fatal("lapsed late")
+	}
+	if got := b.Presence(1); got[0].EditingCardID != 0 {
+		t.Fatalf("after the TTL: %+v", got)
+	}
+
+	// stopping is published once, not again at the TTL
+	b.SetEditing(1, 7, ann, true)
+	nextEvent(t, obs.ch)
+	b.SetEditing(1, 7, ann, false)
+	if typ, _ := nextEvent(t, obs.ch); typ != "card.stopped" {
+		t.Fatalf("stop: %s", typ)
+	}
+	noEvent(t, obs.ch, 2*editingTTL)
+}
+
+func TestUserStreams(t *testing.T) {
+	b := testBus(nil)
+	b.userStreamMax = 2
+	ctx := context.Background()
+	accessible := func(ctx context.Context) (map[int64]bool, error) { return map[int64]bool{1: true, 2: true}, nil }
+
+	all, cancel1, ok := b.SubscribeUser(ctx, 7, nil, accessible)
+	if !ok {
+		t.Fatal("first stream refused")
+	}
+	filtered, cancel2, ok := b.SubscribeUser(ctx, 7, map[int64]bool{2: true}, accessible)
+	if !ok {
+		t.Fatal("second stream refused")
+	}
+	if _, _, ok := b.SubscribeUser(ctx, 7, nil, accessible); ok {
+		t.Fatal("third stream allowed")
+	}
+	other, cancelOther, ok := b.SubscribeUser(ctx, 8, nil, accessible)
+	if !ok {
+		t.Fatal("the cap is per user")
+	}
+	defer cancelOther()
+	if st := b.Stats(); st.UserStreams != 3 {
+		t.Fatalf("stats: %+v", st)
+	}
+
+	for _, board := range []int64{1, 2, 3} {
+		b.Publish(Event{Type: "card.updated", BoardID: board})
+	}
+	b.PublishUser(7, Event{Type: "invite.received"})
+	next := func(sub *userSub) int64 {
+		t.Helper()
+		select {
+		case be := <-sub.ch:
+			return be.boardID
+		default:
+			return 0
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		sub  *userSub
+		want []int64
+	}{
+		{"every board", all, []int64{1, 2, -7}},
+		{"?board=2", filtered, []int64{2, -7}},
+		{"other user", other, []int64{1, 2}},
+	} {
+		var got []int64
+		for id := next(tt.sub); id != 0; id = next(tt.sub) {
+			got = append(got, id)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: boards %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	cancel1()
+	_, cancel3, ok := b.SubscribeUser(ctx, 7, nil, accessible)
+	if !ok {
+		t.Fatal("closing a stream frees its slot")
+	}
+	cancel3()
+	cancel2()
+	if b.userConns[7] != 0 {
+		t.Fatalf("%d connections left", b.userConns[7])
+	}
+}
+
+// sseLines reads an event stream until it has n data or resync events and returns its
+// id:, data: and event: lines.
+func sseLines(t *testing.T, srv *httptest.Server, lastEventID string, n int) []string {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	must(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	must(t, err)
+	defer resp.Body.Close()
+	var lines []string
+	sc := bufio.NewScanner(resp.Body)
+	for n > 0 && sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, ":") {
+			continue
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "data: ") {
+			n--
+		}
+	}
+	return lines
+}
+
+func TestSSEReplay(t *testing.T) {
+	log := &memEventLog{}
+	b := testBus(log)
+	b.keep = 3
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.ServeSSE(w, r, 1, nil)
+	}))
+	defer srv.Close()
+	for i := 1; i <= 5; i++ {
+		b.Publish(Event{Type: fmt.Sprintf("e%d", i), BoardID: 1})
+	}
+
+	// ids 3..5 are kept: a client that saw 3 gets 4 and 5
+	got := sseLines(t, srv, "3", 2)
+	want := []string{"id: 4", `data: {"type":"e4","board_id":1}`, "id: 5", `data: {"type":"e5","board_id":1}`}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("replay: %q", got)
+	}
+	// one that saw 1 missed the pruned 2: it reloads
+	if got := sseLines(t, srv, "1", 1); len(got) != 2 || got[0] != "event: resync" || got[1] != `data: {"board_id":1}` {
+		t.Fatalf("pruned gap: %q", got)
+	}
+	// as does one ahead of the log
+	if got := sseLines(t, srv, "9", 1); len(got) != 2 || got[0] != "event: resync" {
+		t.Fatalf("unknown id: %q", got)
+	}
+
+	// a stream follows its position: dropped events are replayed, repeated ones skipped
+	var emitted []int64
+	resyncs := 0
+	s := &boardStream{bus: b, boardID: 1, last: 3,
+		emit:   func(msg LoggedEvent) { emitted = append(emitted, msg.ID) },
+		resync: func() { resyncs++ }}
+	s.handle(context.Background(), LoggedEvent{ID: 5, Data: []byte(`{}`)}) // 4 was dropped
+	s.handle(context.Background(), LoggedEvent{ID: 4, Data: []byte(`{}`)})
+	s.handle(context.Background(), LoggedEvent{Data: []byte(`{}`)}) // ephemeral, no id
+	if fmt.Sprint(emitted) != "[4 5 0]" || resyncs != 0 || s.last != 5 {
+		t.Fatalf("emitted %v, %d resyncs, at %d", emitted, resyncs, s.last)
+	}
+	s.last = 1
+	s.handle(context.Background(), LoggedEvent{Resync: true})
+	if resyncs != 1 || s.last != 0 {
+		t.Fatalf("resync marker past the log: %d resyncs, at %d", resyncs, s.last)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	log := &memEventLog{}
+	b := testBus(log)
+	b.buffer, b.slowTimeout = 2, 50*time.Millisecond
+	sub, cancel := b.Subscribe(1, nil)
+	defer cancel()
+	fast, cancelFast := b.Subscribe(1, nil)
+	defer cancelFast()
+
+	for i := 1; i <= 3; i++ {
+		b.Publish(Event{Type: "e", BoardID: 1})
+		<-fast.ch
+	}
+	if st := b.Stats(); st.Dropped != 1 || st.Lagging != 1 || !sub.lagging.Load() {
+		t.Fatalf("after a drop: %+v", st)
+	}
+
+	// once drained, the reader catches up from the log
+	var emitted []int64
+	s := &boardStream{bus: b, boardID: 1,
+		emit:   func(msg LoggedEvent) { emitted = append(emitted, msg.ID) },
+		resync: func() { t.Fatal("resync") }}
+	for range 2 {
+		s.handle(context.Background(), <-sub.ch)
+		if sub.drained(len(sub.ch) == 0) {
+			s.handle(context.Background(), LoggedEvent{Resync: true})
+		}
+	}
+	if fmt.Sprint(emitted) != "[1 2 3]" || sub.lagging.Load() {
+		t.Fatalf("emitted %v", emitted)
+	}
+
+	// saturated for longer than slowTimeout: disconnected
+	for range 3 {
+		b.Publish(Event{Type: "e", BoardID: 1})
+		<-fast.ch
+	}
+	select {
+	case <-sub.kicked:
+		t.Fatal("kicked at the first drop")
+	default:
+	}
+	time.Sleep(2 * b.slowTimeout)
+	b.Publish(Event{Type: "e", BoardID: 1})
+	<-fast.ch
+	select {
+	case <-sub.kicked:
+	default:
+		t.Fatal("still connected")
+	}
+	select {
+	case <-fast.kicked:
+		t.Fatal("fast subscriber kicked")
+	default:
+	}
+	if st := b.Stats(); st.Disconnected != 1 || st.Dropped != 3 {
+		t.Fatalf("stats: %+v", st)
+	}
+}
+
+// TestGuestExpiryRevokesStreams checks that a guest's open stream is revoked once the
+// account expires, without any AccessChanged.
+func TestGuestExpiryRevokesStreams(t *testing.T) {
+	b := NewEventBus(nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	const guestID, memberID = 7, 8
+	expires := time.Now().Add(200 * time.Millisecond)
+	guest, cancelGuest := b.Subscribe(1, &User{ID: guestID, Name: "guest"})
+	defer cancelGuest()
+	member, cancelMember := b.Subscribe(1, &User{ID: memberID, Name: "member"})
+	defer cancelMember()
+
+	b.CheckAccessWith(
+		func(ctx context.Context, userID, boardID int64) (bool, error) {
+			return userID != guestID || time.Now().Before(expires), nil
+		},
+		func(ctx context.Context) (time.Time, error) {
+			if time.Now().Before(expires) {
+				return expires, nil
+			}
+			return time.Time{}, nil
+		})
+
+	select {
+	case <-guest.revoked:
+		if time.Now().Before(expires) {
+			t.Fatal("revoked before the expiry")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still open after the guest expired")
+	}
+	select {
+	case <-member.revoked:
+		t.Fatal("member's stream revoked")
+	default:
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Per-user event stream (GET /api/me/events): the events of every board the user can
+// access over one connection, plus the user's personal events. The bus only queues a
+// stream the events of the boards in its cached set of accessible boards, reloaded after
+// AccessChanged. The stream itself checks access to a board when the board's first event
+// arrives and remembers the answer until AccessChanged says memberships moved; boards it
+// was following then get access.revoked.
+
+// boardEvent is an event on its way to a user stream, which spans boards.
+type boardEvent struct {
+	boardID int64
+	msg     LoggedEvent
+}
+
+type userSub struct {
+	subState
+	userID int64
+	boards map[int64]bool // ?board= filter, nil for every board
+	ch     chan boardEvent
+	// the boards the user can access, nil until loaded; refreshes are serialized, so the
+	// last one stored is the last one started
+	visible    atomic.Pointer[map[int64]bool]
+	accessible func(ctx context.Context) (map[int64]bool, error)
+	refreshMu  sync.Mutex
+}
+
+// refresh reloads the stream's set of accessible boards. On error the old set is kept,
+// or every event is queued if there is none yet: the stream still checks access itself.
+func (s *userSub) refresh(ctx context.Context, b *EventBus) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+	boards, err := s.accessible(ctx)
+	if err != nil {
+		b.log.Error("user stream boards", "user_id", s.userID, "err", err)
+		return
+	}
+	s.visible.Store(&boards)
+}
+
+// sees reports whether the stream is to be queued the board's events.
+func (s *userSub) sees(boardID int64) bool {
+	if s.boards != nil && !s.boards[boardID] {
+		return false
+	}
+	v := s.visible.Load()
+	return v == nil || (*v)[boardID]
+}
+
+// accessChangedBoard is the pseudo board AccessChanged is sent on: no board has id 0.
+const accessChangedBoard = 0
+
+// SubscribeUser opens a stream of the events of the boards accessible lists (and the
+// ?board= filter boards allows). ok is false when the user already has the maximum
+// number of streams open. The buffer is four times a board stream's, as it is shared by
+// many boards.
+func (b *EventBus) SubscribeUser(ctx context.Context, userID int64, boards map[int64]bool, accessible func(ctx context.Context) (map[int64]bool, error)) (sub *userSub, cancel func(), ok bool) {
+	sub = &userSub{subState: newSubState(), userID: userID, boards: boards, ch: make(chan boardEvent, 4*b.buffer), accessible: accessible}
+	b.mu.Lock()
+	if b.userStreamMax > 0 && b.userConns[userID] >= b.userStreamMax {
+		b.mu.Unlock()
+		return nil, nil, false
+	}
+	b.userConns[userID]++
+	b.userSubs[sub] = struct{}{}
+	b.mu.Unlock()
+	// loaded once subscribed, so an AccessChanged in between isn't missed
+	sub.refresh(ctx, b)
+	return sub, func() {
+		b.mu.Lock()
+		delete(b.userSubs, sub)
+		if b.userConns[userID]--; b.userConns[userID] <= 0 {
+			delete(b.userConns, userID)
+		}
+		b.mu.Unlock()
+		close(sub.ch)
+		if n := sub.dropped.Load(); n > 0 {
+			b.log.Info("user event stream closed", "user_id", userID, "dropped", n)
+		}
+	}, true
+}
+
+// deliverUsers hands a board's event to the user streams. Called with b.mu held.
+func (b *EventBus) deliverUsers(boardID int64, msg LoggedEvent) {
+	for sub := range b.userSubs {
+		if !sub.sees(boardID) {
+			continue
+		}
+		select {
+		case sub.ch <- boardEvent{boardID, msg}:
+		default: // slow: the stream catches up once drained
+			sub.drop(b, boardID)
+		}
+	}
+}
+
+// AccessChanged makes user streams check board access again. Call it after changes to
+// board, project, group or organization membership; it reaches every instance.
+func (b *EventBus) AccessChanged() {
+	b.send(accessChangedBoard, LoggedEvent{Data: []byte(`{"type":"access.changed"}`)})
+}
+
+// matchEventType reports whether an event type passes a ?types= filter: exact types
+// and prefixes like "card.*".
+func matchEventType(types []string, typ string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if t == typ || (strings.HasSuffix(t, ".*") && strings.HasPrefix(typ, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeUserSSE streams sub as SSE, keeping the events of boards canAccess allows and
+// whose type passes types. Events carry no SSE id (ids are per board); their JSON has
+// board_id, and a board whose gap can't be replayed gets a resync event.
+func (b *EventBus) ServeUserSSE(w http.ResponseWriter, r *http.Request, sub *userSub, canAccess func(ctx context.Context, boardID int64) (bool, error), types []string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	rc := http.NewResponseController(w)
+	flush := func() bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		return rc.Flush() == nil
+	}
+
+	ctx := r.Context()
+	emit := func(msg LoggedEvent) {
+		var ev struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(msg.Data, &ev) == nil && matchEventType(types, ev.Type) {
+			writeSSE(w, LoggedEvent{Data: msg.Data})
+		}
+	}
+	access := map[int64]bool{}
+	streams := map[int64]*boardStream{}
+	gen := b.accessGen.Load()
+
+	_, _ = w.Write([]byte(": connected\n\n"))
+	if !flush() {
+		return
+	}
+	ticker := time.NewTicker(25 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = w.Write([]byte(": ping\n\n"))
+			if !flush() {
+				return
+			}
+		case <-sub.kicked:
+			return
+		case be, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if drained := sub.drained(len(sub.ch) == 0); be.msg.Resync || drained {
+				// lost events may belong to any board: each one catches up
+				for _, s := range streams {
+					s.handle(ctx, LoggedEvent{Resync: true})
+				}
+				if be.msg.Resync {
+					if !flush() {
+						return
+					}
+					continue
+				}
+			}
+			if g := b.accessGen.Load(); g != gen {
+				// boards the stream was following are checked now, so a lost board gets its
+				// access.revoked; the others again with their next event
+				gen = g
+				prev := access
+				access = map[int64]bool{}
+				for boardID, allowed := range prev {
+					if !allowed {
+						continue
+					}
+					ok, err := canAccess(ctx, boardID)
+					if err != nil {
+						b.log.Error("user stream access", "board_id", boardID, "err", err)
+						continue
+					}
+					access[boardID] = ok
+					if !ok {
+						delete(streams, boardID)
+						emit(accessRevokedEvent(boardID, sub.userID))
+					}
+				}
+			}
+			switch {
+			case be.boardID == accessChangedBoard:
+				if !flush() {
+					return
+				}
+				continue
+			case be.boardID < 0: // personal event
+				emit(be.msg)
+				if !flush() {
+					return
+				}
+				continue
+			}
+			allowed, known := access[be.boardID]
+			if !known {
+				var err error
+				if allowed, err = canAccess(ctx, be.boardID); err != nil {
+					b.log.Error("user stream access", "board_id", be.boardID, "err", err)
+					continue
+				}
+				access[be.boardID] = allowed
+			}
+			if !allowed {
+				delete(streams, be.boardID)
+				continue
+			}
+			s := streams[be.boardID]
+			if s == nil {
+				boardID := be.boardID
+				s = &boardStream{bus: b, boardID: boardID, emit: emit, resync: func() { writeResync(w, boardID) }}
+				streams[boardID] = s
+			}
+			s.handle(ctx, be.msg)
+			if !flush() {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Minimal LDAPv3 client (RFC 4511): simple bind, search and StartTLS.
+// Only what the auth backend needs; no paging, referrals are ignored.
+
+const (
+	berSequence    = 0x30
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berBoolean     = 0x01
+
+	ldapBindRequest        = 0x60
+	ldapBindResponse       = 0x61
+	ldapUnbindRequest      = 0x42
+	ldapSearchRequest      = 0x63
+	ldapSearchResultEntry  = 0x64
+	ldapSearchResultDone   = 0x65
+	ldapSearchResultRef    = 0x73
+	ldapExtendedRequest    = 0x77
+	ldapExtendedResponse   = 0x78
+	ldapAuthSimple         = 0x80
+	ldapExtendedRequestOID = 0x80
+
+	ldapScopeBase    = 0
+	ldapScopeOne     = 1
+	ldapScopeSubtree = 2
+
+	ldapResultSuccess            = 0
+	ldapResultInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// LDAPError carries the LDAP result code of a failed operation.
+type LDAPError struct {
+	Code    int
+	Message string
+}
+
+func (e *LDAPError) Error() string { return fmt.Sprintf("ldap: result %d: %s", e.Code, e.Message) }
+
+var errLDAPInvalidCredentials = &LDAPError{Code: ldapResultInvalidCredentials, Message: "invalid credentials"}
+
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string // lowercased attribute names
+}
+
+func (e ldapEntry) first(attr string) string {
+	if v := e.Attrs[strings.ToLower(attr)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// --- BER encoding ---
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for n > 0 {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	size := 0
+	for _, c := range content {
+		size += len(c)
+	}
+	out := append([]byte{tag}, berLength(size)...)
+	for _, c := range content {
+		out = append(out, c...)
+	}
+	return out
+}
+
+func berInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if (v >= -128 && v < 128) || len(b) >= 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte { return berTLV(tag, []byte(s)) }
+
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(berBoolean, []byte{0xff})
+	}
+	return berTLV(berBoolean, []byte{0x00})
+}
+
+// --- BER decoding ---
+
+type berNode struct {
+	Tag     byte
+	Content []byte
+}
+
+func (n berNode) children() ([]berNode, error) { return berParseAll(n.Content) }
+
+func (n berNode) int() int64 {
+	var v int64
+	for i, b := range n.Content {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+func berParseAll(b []byte) ([]berNode, error) {
+	var out []berNode
+	for len(b) > 0 {
+		n, rest, err := berParse(b)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+		b = rest
+	}
+	return out, nil
+}
+
+func berParse(b []byte) (berNode, []byte, error) {
+	if len(b) < 2 {
+		return berNode{}, nil, io.ErrUnexpectedEOF
+	}
+	tag := b[0]
+	l, hdr := int(b[1]), 2
+	if l&0x80 != 0 {
+		nb := l & 0x7f
+		if nb == 0 || nb > 4 || len(b) < 2+nb {
+			return berNode{}, nil, errors.New("ber: bad length")
+		}
+		l = 0
+		for _, x := range b[2 : 2+nb] {
+			l = l<<8 | int(x)
+		}
+		hdr += nb
+	}
+	if l < 0 || len(b) < hdr+l {
+		return berNode{}, nil, io.ErrUnexpectedEOF
+	}
+	return berNode{Tag: tag, Content: b[hdr : hdr+l]}, b[hdr+l:], nil
+}
+
+// berRead reads a single TLV from the stream.
+func berRead(r *bufio.Reader) (berNode, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berNode{}, err
+	}
+	lb, err := r.ReadByte()
+	if err != nil {
+		return berNode{}, err
+	}
+	l := int(lb)
+	if lb&0x80 != 0 {
+		nb := int(lb & 0x7f)
+		if nb == 0 || nb > 4 {
+			return berNode{}, errors.New("ber: bad length")
+		}
+		l = 0
+		for i := 0; i < nb; i++ {
+			x, err := r.ReadByte()
+			if err != nil {
+				return berNode{}, err
+			}
+			l = l<<8 | int(x)
+		}
+	}
+	if l > 16<<20 {
+		return berNode{}, errors.New("ber: message too large")
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return berNode{}, err
+	}
+	return berNode{Tag: tag, Content: buf}, nil
+}
+
+// --- Filters (RFC 4515) ---
+
+// ldapEscapeFilter escapes a value for safe substitution into a filter template.
+func ldapEscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString(fmt.Sprintf("\\%02x", c))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapCompileFilter turns a string filter into its BER encoding.
+func ldapCompileFilter(f string) ([]byte, error) {
+	f = strings.TrimSpace(f)
+	if f == "" {
+		f = "(objectClass=*)"
+	}
+	if f[0] != '(' {
+		f = "(" + f + ")"
+	}
+	out, rest, err := ldapParseFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, errors.New("ldap filter: trailing data")
+	}
+	return out, nil
+}
+
+func ldapParseFilter(f string) ([]byte, string, error) {
+	if len(f) < 2 || f[0] != '(' {
+		return nil, "", errors.New("ldap filter: expected '('")
+	}
+	f = f[1:]
+	switch f[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if f[0] == '|' {
+			tag = 0xa1
+		}
+		f = f[1:]
+		var parts [][]byte
+		for len(f) > 0 && f[0] == '(' {
+			p, rest, err := ldapParseFilter(f)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, p)
+			f = rest
+		}
+		if len(f) == 0 || f[0] != ')' {
+			return nil, "", errors.New("ldap filter: expected ')'")
+		}
+		return berTLV(tag, parts...), f[1:], nil
+	case '!':
+		p, rest, err := ldapParseFilter(f[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", errors.New("ldap filter: expected ')'")
+		}
+		return berTLV(0xa2, p), rest[1:], nil
+	}
+	end := strings.IndexByte(f, ')')
+	if end < 0 {
+		return nil, "", errors.New("ldap filter: expected ')'")
+	}
+	item, rest := f[:end], f[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", errors.New("ldap filter: bad item")
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(0xa3) // equalityMatch
+	switch attr[len(attr)-1] {
+	case '~':
+		tag, attr = 0xa8, attr[:len(attr)-1]
+	case '>':
+		tag, attr = 0xa5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = 0xa6, attr[:len(attr)-1]
+	}
+	if tag == 0xa3 && value == "*" {
+		return berString(0x87, attr), rest, nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		chunks := strings.Split(value, "*")
+		var subs [][]byte
+		for i, c := range chunks {
+			if c == "" {
+				continue
+			}
+			v, err := ldapUnescapeFilter(c)
+			if err != nil {
+				return nil, "", err
+			}
+			st := byte(0x81) // any
+			if i == 0 {
+				st = 0x80 // initial
+			} else if i == len(chunks)-1 {
+				st = 0x82 // final
+			}
+			subs = append(subs, berString(st, v))
+		}
+		return berTLV(0xa4, berString(berOctetString, attr), berTLV(berSequence, subs...)), rest, nil
+	}
+	v, err := ldapUnescapeFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berTLV(tag, berString(berOctetString, attr), berString(berOctetString, v)), rest, nil
+}
+
+func ldapUnescapeFilter(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", errors.New("ldap filter: bad escape")
+		}
+		x, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", errors.New("ldap filter: bad escape")
+		}
+		b.Write(x)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// --- Connection ---
+
+type ldapConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	msgID   int64
+	timeout time.Duration
+}
+
+// dialLDAP connects to ldap:// or ldaps:// URLs, optionally upgrading with StartTLS.
+func dialLDAP(rawURL string, startTLS bool, tlsCfg *tls.Config, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	d := &net.Dialer{Timeout: timeout}
+	var c net.Conn
+	switch strings.ToLower(u.Scheme) {
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		cfg := tlsCfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		c, err = tls.DialWithDialer(d, "tcp", host, cfg)
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		c, err = d.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lc := &ldapConn{conn: c, r: bufio.NewReader(c), timeout: timeout}
+	if startTLS && strings.EqualFold(u.Scheme, "ldap") {
+		cfg := tlsCfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		if err := lc.startTLS(cfg); err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+	}
+	return lc, nil
+}
+
+func (c *ldapConn) send(op []byte) (int64, error) {
+	c.msgID++
+	msg := berTLV(berSequence, berInt(berInteger, c.msgID), op)
+	_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(msg)
+	return c.msgID, err
+}
+
+// recv reads the next message for id and returns its protocolOp node.
+func (c *ldapConn) recv(id int64) (berNode, error) {
+	for {
+		_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+		msg, err := berRead(c.r)
+		if err != nil {
+			return berNode{}, err
+		}
+		parts, err := msg.children()
+		if err != nil || len(parts) < 2 {
+			return berNode{}, errors.New("ldap: malformed message")
+		}
+		if parts[0].int() != id {
+			continue
+		}
+		return parts[1], nil
+	}
+}
+
+func ldapResult(op berNode) error {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	if code := int(parts[0].int()); code != ldapResultSuccess {
+		if code == ldapResultInvalidCredentials {
+			return errLDAPInvalidCredentials
+		}
+		return &LDAPError{Code: code, Message: string(parts[2].Content)}
+	}
+	return nil
+}
+
+func (c *ldapConn) startTLS(cfg *tls.Config) error {
+	id, err := c.send(berTLV(ldapExtendedRequest, berString(ldapExtendedRequestOID, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := c.recv(id)
+	if err != nil {
+		return err
+	}
+	if op.Tag != ldapExtendedResponse {
+		return errors.New("ldap: unexpected starttls response")
+	}
+	if err := ldapResult(op); err != nil {
+		return err
+	}
+	tc := tls.Client(c.conn, cfg)
+	_ = tc.SetDeadline(time.Now().Add(c.timeout))
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.conn, c.r = tc, bufio.NewReader(tc)
+	return nil
+}
+
+// Bind performs a simple bind. Empty passwords are refused client-side: most
+// servers treat them as an unauthenticated bind that "succeeds".
+func (c *ldapConn) Bind(dn, password string) error {
+	if password == "" {
+		return errLDAPInvalidCredentials
+	}
+	id, err := c.send(berTLV(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, dn), berString(ldapAuthSimple, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.recv(id)
+	if err != nil {
+		return err
+	}
+	if op.Tag != ldapBindResponse {
+		return errors.New("ldap: unexpected bind response")
+	}
+	return ldapResult(op)
+}
+
+func (c *ldapConn) Search(base string, scope int, filter string, attrs []string, sizeLimit int) ([]ldapEntry, error) {
+	fb, err := ldapCompileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var al [][]byte
+	for _, a := range attrs {
+		al = append(al, berString(berOctetString, a))
+	}
+	req := berTLV(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, int64(scope)),
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, int64(sizeLimit)),
+		berInt(berInteger, int64(c.timeout/time.Second)),
+		berBool(false),
+		fb,
+		berTLV(berSequence, al...),
+	)
+	id, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	var out []ldapEntry
+	for {
+		op, err := c.recv(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Tag {
+		case ldapSearchResultEntry:
+			parts, err := op.children()
+			if err != nil || len(parts) < 2 {
+				return nil, errors.New("ldap: malformed entry")
+			}
+			e := ldapEntry{DN: string(parts[0].Content), Attrs: map[string][]string{}}
+			list, _ := parts[1].children()
+			for _, pa := range list {
+				kv, err := pa.children()
+				if err != nil || len(kv) < 2 {
+					continue
+				}
+				vals, _ := kv[1].children()
+				name := strings.ToLower(string(kv[0].Content))
+				for _, v := range vals {
+					e.Attrs[name] = append(e.Attrs[name], string(v.Content))
+				}
+			}
+			out = append(out, e)
+		case ldapSearchResultRef:
+			// referrals are not followed
+		case ldapSearchResultDone:
+			return out, ldapResult(op)
+		default:
+			return nil, errors.New("ldap: unexpected search response")
+		}
+	}
+}
+
+func (c *ldapConn) Close() error {
+	_, _ = c.send(berTLV(ldapUnbindRequest))
+	return c.conn.Close()
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeDirectory is an ldapDirectory with fixed passwords and search results.
+type fakeDirectory struct {
+	passwords map[string]string // dn → password
+	bindErr   error             // when set, every bind fails with it
+	search    func(base, filter string) []ldapEntry
+	binds     []string
+	searches  []string // base + " " + filter
+	closed    bool
+}
+
+func (d *fakeDirectory) Bind(dn, password string) error {
+	d.binds = append(d.binds, dn)
+	if d.bindErr != nil {
+		return d.bindErr
+	}
+	if want, ok := d.passwords[dn]; !ok || want != password {
+		return errLDAPInvalidCredentials
+	}
+	return nil
+}
+
+func (d *fakeDirectory) Search(base string, scope int, filter string, attrs []string, sizeLimit int) ([]ldapEntry, error) {
+	d.searches = append(d.searches, base+" "+filter)
+	if d.search == nil {
+		return nil, nil
+	}
+	return d.search(base, filter), nil
+}
+
+func (d *fakeDirectory) Close() error {
+	d.closed = true
+	return nil
+}
+
+const (
+	ldapTestService = "cn=svc,dc=example,dc=org"
+	ldapTestAnn     = "uid=ann,ou=people,dc=example,dc=org"
+	ldapTestGroups  = "ou=groups,dc=example,dc=org"
+)
+
+func annEntry() ldapEntry {
+	return ldapEntry{DN: ldapTestAnn, Attrs: map[string][]string{
+		"entryuuid": {"8f14e45f-ceea-4e7a-9f6b-1d2c3b4a5e6f"},
+		"mail":      {" ann@example.org "},
+		"cn":        {"Ann Example"},
+		"memberof":  {"CN=Devs, OU=Groups,DC=example,DC=org", "cn=ops,ou=groups,dc=example,dc=org"},
+	}}
+}
+
+// testLDAP returns a backend with the default attribute settings over dir, and counts dials.
+func testLDAP(dir *fakeDirectory, dials *int) *ldapBackend {
+	return &ldapBackend{
+		cfg: ldapConfig{
+			BindDN: ldapTestService, BindPassword: "svc-pw", BaseDN: "dc=example,dc=org",
+			UserFilter: "(&(objectClass=person)(|(uid={login})(mail={login})))",
+			AttrUID:    "entryUUID", AttrEmail: "mail", AttrName: "cn", AttrGroups: "memberOf",
+			GroupFilter: "(|(member={dn})(uniqueMember={dn}))", GroupMap: map[string]string{}, LocalFallback: "admins",
+		},
+		dial: func() (ldapDirectory, error) {
+			*dials++
+			return dir, nil
+		},
+	}
+}
+
+func newFakeDirectory(entries ...ldapEntry) *fakeDirectory {
+	return &fakeDirectory{
+		passwords: map[string]string{ldapTestService: "svc-pw", ldapTestAnn: "ann-pw"},
+		search:    func(base, filter string) []ldapEntry { return entries },
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	t.Run("memberOf", func(t *testing.T) {
+		dir, dials := newFakeDirectory(annEntry()), 0
+		id, err := testLDAP(dir, &dials).Authenticate(" ann ", "ann-pw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ldapIdentity{DN: ldapTestAnn, UID: "8f14e45f-ceea-4e7a-9f6b-1d2c3b4a5e6f", Email: "ann@example.org", Name: "Ann Example",
+			Groups: []string{"cn=devs,ou=groups,dc=example,dc=org", "cn=ops,ou=groups,dc=example,dc=org"}}
+		if id.DN != want.DN || id.UID != want.UID || id.Email != want.Email || id.Name != want.Name || strings.Join(id.Groups, ";") != strings.Join(want.Groups, ";") {
+			t.Fatalf("identity %+v", id)
+		}
+		if strings.Join(dir.binds, ";") != ldapTestService+";"+ldapTestAnn {
+			t.Fatalf("binds %v", dir.binds)
+		}
+		if len(dir.searches) != 1 || dir.searches[0] != "dc=example,dc=org (&(objectClass=person)(|(uid=ann)(mail=ann)))" {
+			t.Fatalf("searches %v", dir.searches)
+		}
+		if !dir.closed {
+			t.Fatal("connection left open")
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		dir, dials := newFakeDirectory(), 0
+		if _, err := testLDAP(dir, &dials).Authenticate("nobody", "pw"); !errors.Is(err, errLDAPUserNotFound) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("several matches", func(t *testing.T) {
+		other := annEntry()
+		other.DN = "uid=ann,ou=contractors,dc=example,dc=org"
+		dir, dials := newFakeDirectory(annEntry(), other), 0
+		if _, err := testLDAP(dir, &dials).Authenticate("ann", "ann-pw"); err == nil || !strings.Contains(err.Error(), "several") {
+			t.Fatalf("got %v", err)
+		}
+		if len(dir.binds) != 1 {
+			t.Fatalf("bound as an ambiguous user: %v", dir.binds)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		dir, dials := newFakeDirectory(annEntry()), 0
+		if _, err := testLDAP(dir, &dials).Authenticate("ann", "guess"); !errors.Is(err, errLDAPInvalidCredentials) {
+			t.Fatalf("got %v", err)
+		}
+	})
+
+	t.Run("service bind fails", func(t *testing.T) {
+		dir, dials := newFakeDirectory(annEntry()), 0
+		dir.bindErr = &LDAPError{Code: 52, Message: "unavailable"}
+		if _, err := testLDAP(dir, &dials).Authenticate("ann", "ann-pw"); err == nil || len(dir.searches) != 0 {
+			t.Fatalf("got %v after %d searches", err, len(dir.searches))
+		}
+	})
+
+	t.Run("empty credentials are not sent", func(t *testing.T) {
+		dir, dials := newFakeDirectory(annEntry()), 0
+		b := testLDAP(dir, &dials)
+		for _, c := range [][2]string{{"ann", ""}, {"  ", "ann-pw"}} {
+			if _, err := b.Authenticate(c[0], c[1]); !errors.Is(err, errLDAPInvalidCredentials) {
+				t.Fatalf("%q: got %v", c, err)
+			}
+		}
+		if dials != 0 {
+			t.Fatalf("%d dials", dials)
+		}
+	})
+
+	t.Run("login is escaped", func(t *testing.T) {
+		dir, dials := newFakeDirectory(), 0
+		_, _ = testLDAP(dir, &dials).Authenticate("*)(uid=*", "pw")
+		if len(dir.searches) != 1 || !strings.Contains(dir.searches[0], `(uid=\2a\29\28uid=\2a)`) {
+			t.Fatalf("searches %v", dir.searches)
+		}
+	})
+
+	t.Run("binary uid", func(t *testing.T) {
+		e := annEntry()
+		e.Attrs["entryuuid"] = []string{string([]byte{0x01, 0xff, 0x00, 0xfe})}
+		dir, dials := newFakeDirectory(e), 0
+		id, err := testLDAP(dir, &dials).Authenticate("ann", "ann-pw")
+		if err != nil || id.UID != "01ff00fe" {
+			t.Fatalf("uid %q, %v", id.UID, err)
+		}
+	})
+
+	t.Run("no uid attribute", func(t *testing.T) {
+		e := annEntry()
+		delete(e.Attrs, "entryuuid")
+		e.DN = "UID=Ann, OU=People,DC=example,DC=org"
+		dir, dials := newFakeDirectory(e), 0
+		dir.passwords[e.DN] = "ann-pw"
+		id, err := testLDAP(dir, &dials).Authenticate("ann", "ann-pw")
+		if err != nil || id.UID != ldapTestAnn {
+			t.Fatalf("uid %q, %v", id.UID, err)
+		}
+	})
+
+	t.Run("group search", func(t *testing.T) {
+		dir, dials := newFakeDirectory(), 0
+		dir.search = func(base, filter string) []ldapEntry {
+			if base == ldapTestGroups {
+				return []ldapEntry{{DN: "CN=Admins,OU=Groups,DC=example,DC=org"}}
+			}
+			return []ldapEntry{annEntry()}
+		}
+		b := testLDAP(dir, &dials)
+		b.cfg.GroupBaseDN = ldapTestGroups
+		id, err := b.Authenticate("ann", "ann-pw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// memberOf is not read when groups are searched
+		if strings.Join(id.Groups, ";") != "cn=admins,ou=groups,dc=example,dc=org" {
+			t.Fatalf("groups %v", id.Groups)
+		}
+		// back to the service account for the group search
+		if strings.Join(dir.binds, ";") != ldapTestService+";"+ldapTestAnn+";"+ldapTestService {
+			t.Fatalf("binds %v", dir.binds)
+		}
+		if want := ldapTestGroups + " (|(member=" + ldapTestAnn + ")(uniqueMember=" + ldapTestAnn + "))"; len(dir.searches) != 2 || dir.searches[1] != want {
+			t.Fatalf("searches %v", dir.searches)
+		}
+	})
+}
+
+func TestLDAPLocalFallback(t *testing.T) {
+	tests := []struct {
+		mode         string
+		admin, other bool
+	}{
+		{"admins", true, false},
+		{"", true, false},
+		{"all", true, true},
+		{"none", false, false},
+	}
+	for _, tt := range tests {
+		b := &ldapBackend{cfg: ldapConfig{LocalFallback: tt.mode}}
+		if got := b.localLoginAllowed(User{IsAdmin: true}); got != tt.admin {
+			t.Errorf("%q: admin allowed %v", tt.mode, got)
+		}
+		if got := b.localLoginAllowed(User{}); got != tt.other {
+			t.Errorf("%q: user allowed %v", tt.mode, got)
+		}
+	}
+}
+
+// TestLDAPAuthenticateLocal runs authenticate against local accounts: the fallback
+// modes when the directory doesn't know the login, and provisioning when it does.
+func TestLDAPAuthenticateLocal(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	hash, err := bcrypt.GenerateFromPassword([]byte("local-pw"), bcrypt.MinCost)
+	must(t, err)
+	local := func(name string, admin bool) User {
+		u := testUser(t, s, name, 0)
+		_, err := s.db.ExecContext(ctx, `update users set password_hash=$2, email_verified=true, is_admin=$3 where id=$1`, u.ID, string(hash), admin)
+		must(t, err)
+		return u
+	}
+	admin, user := local("ldapadmin", true), local("ldapuser", false)
+
+	dir, dials := newFakeDirectory(), 0
+	a := &api{store: s, log: slog.New(slog.NewTextHandler(io.Discard, nil)), ldap: testLDAP(dir, &dials)}
+	for _, tt := range []struct {
+		mode         string
+		admin, other bool
+	}{{"admins", true, false}, {"all", true, true}, {"none", false, false}} {
+		a.ldap.cfg.LocalFallback = tt.mode
+		for _, c := range []struct {
+			u    User
+			want bool
+		}{{admin, tt.admin}, {user, tt.other}} {
+			got, err := a.authenticate(ctx, c.u.Email, "local-pw")
+			if c.want && (err != nil || got.ID != c.u.ID) || !c.want && !errors.Is(err, ErrNotFound) {
+				t.Errorf("%s, %s: %v %v", tt.mode, c.u.Name, got.ID, err)
+			}
+		}
+		if _, err := a.authenticate(ctx, admin.Email, "wrong"); err == nil {
+			t.Errorf("%s: wrong local password accepted", tt.mode)
+		}
+	}
+
+	// known to the directory: the local password no longer matters
+	e := annEntry()
+	e.Attrs["mail"] = []string{strings.Replace(user.Email, "@", "+ldap@", 1)}
+	e.Attrs["entryuuid"] = []string{"uid-" + user.Email}
+	dir.search = func(base, filter string) []ldapEntry { return []ldapEntry{e} }
+	got, err := a.authenticate(ctx, "ann", "ann-pw")
+	if err != nil || got.Email != e.Attrs["mail"][0] || got.Name != "Ann Example" {
+		t.Fatalf("provisioned %+v, %v", got, err)
+	}
+	again, err := a.authenticate(ctx, "ann", "ann-pw")
+	if err != nil || again.ID != got.ID {
+		t.Fatalf("second login %+v, %v", again, err)
+	}
+}
+
+func TestBERLength(t *testing.T) {
+	for n, want := range map[int]string{0: "00", 127: "7f", 128: "8180", 255: "81ff", 256: "820100", 70000: "83011170"} {
+		if got := hex.EncodeToString(berLength(n)); got != want {
+			t.Errorf("%d: %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestBERIntRoundTrip(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 65535, 1 << 31, -(1 << 40), math.MaxInt64, math.MinInt64} {
+		n, rest, err := berParse(berInt(berInteger, v))
+		if err != nil || len(rest) != 0 || n.Tag != berInteger {
+			t.Fatalf("%d: %v %v %x", v, err, rest, n.Tag)
+		}
+		if n.int() != v {
+			t.Errorf("%d decoded as %d (% x)", v, n.int(), n.Content)
+		}
+	}
+	// minimal encodings
+	for v, want := range map[int64]string{0: "020100", 127: "02017f", 128: "02020080", -128: "020180", -129: "0202ff7f"} {
+		if got := hex.EncodeToString(berInt(berInteger, v)); got != want {
+			t.Errorf("%d: %s, want %s", v, got, want)
+		}
+	}
+}
+
+func TestBERParse(t *testing.T) {
+	msg := berTLV(berSequence, berInt(berInteger, 7), berString(berOctetString, strings.Repeat("x", 300)), berBool(true))
+	n, rest, err := berParse(append(msg, 0x05, 0x00))
+	if err != nil || n.Tag != berSequence || hex.EncodeToString(rest) != "0500" {
+		t.Fatalf("%v %x %x", err, n.Tag, rest)
+	}
+	parts, err := n.children()
+	if err != nil || len(parts) != 3 || parts[0].int() != 7 || len(parts[1].Content) != 300 || hex.EncodeToString(parts[2].Content) != "ff" {
+		t.Fatalf("children %v %v", parts, err)
+	}
+	for _, bad := range []string{"", "04", "0405616263", "0480", "048500000001", "0482ff"} {
+		b, _ := hex.DecodeString(bad)
+		if _, _, err := berParse(b); err == nil {
+			t.Errorf("%s parsed", bad)
+		}
+	}
+}
+
+func TestBERRead(t *testing.T) {
+	msg := berTLV(berSequence, berString(berOctetString, strings.Repeat("y", 70000)))
+	r := bufio.NewReader(bytes.NewReader(append(msg, berBool(false)...)))
+	n, err := berRead(r)
+	if err != nil || n.Tag != berSequence || len(n.Content) != 70000+5 {
+		t.Fatalf("%v %x %d", err, n.Tag, len(n.Content))
+	}
+	if n, err := berRead(r); err != nil || n.Tag != berBoolean {
+		t.Fatalf("second message: %v %x", err, n.Tag)
+	}
+	if _, err := berRead(r); err != io.EOF {
+		t.Fatalf("at the end: %v", err)
+	}
+	for _, bad := range []string{"0484ffffffff", "0480", "04050102", "04"} {
+		b, _ := hex.DecodeString(bad)
+		if _, err := berRead(bufio.NewReader(bytes.NewReader(b))); err == nil {
+			t.Errorf("%s read", bad)
+		}
+	}
+}
+
+func TestLDAPCompileFilter(t *testing.T) {
+	tests := map[string]string{
+		"(uid=bob)":         "a30a0403756964040362" + "6f62",
+		"uid=bob":           "a30a04037569640403626f62",
+		"":                  "870b6f626a656374436c617373",
+		"(objectClass=*)":   "870b6f626a656374436c617373",
+		"(!(a=b))":          "a208a30604016104016" + "2",
+		"(&(a=b)(c=d))":     "a010a306040161040162a306040163040164",
+		"(|(a=b))":          "a108a306040161040162",
+		"(cn=J*o*n)":        "a40f04026" + "36e300980014a81016f82016e",
+		"(cn=*son)":         "a40b0402636e30058203736f6e",
+		"(cn=Jo*)":          "a40a0402636e300480024a6f",
+		"(a>=5)":            "a506040161040135",
+		"(a<=5)":            "a606040161040135",
+		"(a~=x)":            "a806040161040178",
+		`(cn=a\2ab)`:        "a3090402636e0403612a62",
+		`(cn=\28x\29\5c)`:   "a30a0402636e0404287829" + "5c",
+		"(&(a=b)(!(c=d)))":  "a012a306040161040162a208a306040163040164",
+		" (uid=bob)  ":      "a30a04037569640403626f62",
+		"(member=cn=x,o=y)": "a31204066d656d6265720408636e3d782c6f3d79",
+	}
+	for f, want := range tests {
+		got, err := ldapCompileFilter(f)
+		if err != nil || hex.EncodeToString(got) != want {
+			t.Errorf("%q: %x %v, want %s", f, got, err, want)
+		}
+	}
+	for _, bad := range []string{"(uid=bob", "(&(a=b)", "(=x)", `(a=\zz)`, `(a=\2)`, "(a=b))", "(!(a=b)", "(a)"} {
+		if _, err := ldapCompileFilter(bad); err == nil {
+			t.Errorf("%q compiled", bad)
+		}
+	}
+}
+
+func TestLDAPEscapeFilter(t *testing.T) {
+	in := "a*(b)\\\x00c"
+	esc := ldapEscapeFilter(in)
+	if esc != `a\2a\28b\29\5c\00c` {
+		t.Fatalf("escaped %q", esc)
+	}
+	if back, err := ldapUnescapeFilter(esc); err != nil || back != in {
+		t.Fatalf("unescaped %q %v", back, err)
+	}
+	if got := normalizeDN(" CN=Devs, OU=Groups ,DC=Example "); got != "cn=devs,ou=groups,dc=example" {
+		t.Fatalf("normalized %q", got)
+	}
+}
+
+// fakeLDAPServer answers binds (only ann-pw is a valid password) and searches on the
+// server end of a pipe until it gets an unbind.
+func fakeLDAPServer(t *testing.T, conn net.Conn, searches chan<- []berNode) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(id int64, op []byte) {
+		_, _ = conn.Write(berTLV(berSequence, berInt(berInteger, id), op))
+	}
+	result := func(tag byte, code int64, msg string) []byte {
+		return berTLV(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, msg))
+	}
+	for {
+		msg, err := berRead(r)
+		if err != nil {
+			return
+		}
+		parts, err := msg.children()
+		if err != nil || len(parts) < 2 {
+			t.Errorf("malformed request % x", msg.Content)
+			return
+		}
+		id, op := parts[0].int(), parts[1]
+		fields, _ := op.children()
+		switch op.Tag {
+		case ldapBindRequest:
+			if len(fields) != 3 || fields[0].int() != 3 || fields[2].Tag != ldapAuthSimple {
+				t.Errorf("bind request %v", fields)
+			}
+			if string(fields[2].Content) == "ann-pw" {
+				reply(id, result(ldapBindResponse, ldapResultSuccess, ""))
+			} else {
+				reply(id, result(ldapBindResponse, ldapResultInvalidCredentials, "invalid credentials"))
+			}
+		case ldapSearchRequest:
+			searches <- fields
+			// a stray message for another id is skipped by the client
+			reply(id+100, result(ldapSearchResultDone, ldapResultSuccess, ""))
+			reply(id, berTLV(ldapSearchResultEntry, berString(berOctetString, ldapTestAnn), berTLV(berSequence,
+				berTLV(berSequence, berString(berOctetString, "Mail"), berTLV(0x31, berString(berOctetString, "ann@example.org"))),
+				berTLV(berSequence, berString(berOctetString, "memberOf"), berTLV(0x31, berString(berOctetString, "cn=a"), berString(berOctetString, "cn=b"))),
+			)))
+			reply(id, berTLV(ldapSearchResultRef, berString(berOctetString, "ldap://elsewhere/")))
+			reply(id, result(ldapSearchResultDone, ldapResultSuccess, ""))
+		case ldapUnbindRequest:
+			return
+		default:
+			t.Errorf("unexpected op %x", op.Tag)
+			return
+		}
+	}
+}
+
+func TestLDAPConn(t *testing.T) {
+	client, server := net.Pipe()
+	searches := make(chan []berNode, 1)
+	done := make(chan struct{})
+	go func() {
+		fakeLDAPServer(t, server, searches)
+		close(done)
+	}()
+	c := &ldapConn{conn: client, r: bufio.NewReader(client), timeout: 5 * time.Second}
+
+	if err := c.Bind(ldapTestAnn, "ann-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Bind(ldapTestAnn, "guess"); !errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if err := c.Bind(ldapTestAnn, ""); !errors.Is(err, errLDAPInvalidCredentials) {
+		t.Fatalf("empty password: %v", err)
+	}
+
+	entries, err := c.Search("dc=example,dc=org", ldapScopeSubtree, "(uid=ann)", []string{"mail", "memberOf"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].DN != ldapTestAnn || entries[0].first("mail") != "ann@example.org" ||
+		strings.Join(entries[0].Attrs["memberof"], ";") != "cn=a;cn=b" {
+		t.Fatalf("entries %+v", entries)
+	}
+	req := <-searches
+	filter, _ := ldapCompileFilter("(uid=ann)")
+	if len(req) != 8 || string(req[0].Content) != "dc=example,dc=org" || req[1].int() != ldapScopeSubtree || req[3].int() != 2 ||
+		req[6].Tag != filter[0] || !bytes.Equal(berTLV(req[6].Tag, req[6].Content), filter) {
+		t.Fatalf("search request %v", req)
+	}
+	attrs, _ := req[7].children()
+	if len(attrs) != 2 || string(attrs[0].Content) != "mail" || string(attrs[1].Content) != "memberOf" {
+		t.Fatalf("attributes %v", attrs)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
@@ -47,6 +48,32 @@ func main() {
 		log.Error("migrate", "err", err)
 		os.Exit(1)
 	}
+	if n, err := store.SnapshotCardDocs(context.Background()); err != nil {
+		log.Error("card doc snapshots", "err", err)
+	} else if n > 0 {
+		log.Info("card doc snapshots", "cards", n)
+	}
+	// organizations of the groups SCIM and LDAP manage
+	for _, name := range []string{"SCIM_ORG_ID", "LDAP_ORG_ID"} {
+		if v := getenv(name, ""); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err == nil {
+				_, err = store.GetOrg(context.Background(), id)
+			}
+			if err != nil {
+				log.Error("invalid "+name, "value", v, "err", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if projectsRequired() {
+		projects, boards, orphans, err := store.MigrateDefaultProjects(context.Background())
+		if err != nil {
+			log.Error("migrate default projects", "err", err)
+			os.Exit(1)
+		}
+		log.Info("default projects", "created", projects, "boards_moved", boards, "boards_without_owner", orphans)
+	}
 
 	mux := http.NewServeMux()
 	fs := http.FileServer(http.Dir("./web"))
@@ -115,9 +142,18 @@ func main() {
 	})
 
 	api := newAPI(store, log)
+	switch bus := getenv("EVENT_BUS", "memory"); bus {
+	case "memory":
+	case "postgres":
+		// several instances behind a load balancer share events through LISTEN/NOTIFY
+		api.bus.Distribute(context.Background(), newPGEventTransport(dsn, store, log))
+	default:
+		log.Error("unknown EVENT_BUS (memory | postgres)", "value", bus)
+		os.Exit(1)
+	}
 	api.routes(mux)
 
-	srv := &http.Server{Addr: addr, Handler: withLogging(log, mux),
+	srv := &http.Server{Addr: addr, Handler: withLogging(log, withSecurityHeaders(loadSecurityHeaders(log, "./web"), mux)),
 		ReadTimeout: 15 * time.Second, ReadHeaderTimeout: 10 * time.Second,
 		WriteTimeout: 30 * time.Second, IdleTimeout: 120 * time.Second}
 
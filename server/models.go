@@ -11,10 +11,35 @@ type Board struct {
 	CreatedAt time.Time `json:"created_at"`
 	ProjectID *int64    `json:"project_id,omitempty"`
 	CreatedBy *int64    `json:"created_by,omitempty"`
-	// ViaGroup indicates the board is accessible to the current user via their group membership
+	OrgID     int64     `json:"org_id,omitempty"`
+	Version   int64     `json:"version"`
+	// ViaGroup indicates the board is shared with the current user: via their group
+	// membership or as a direct board member
 	ViaGroup bool `json:"via_group,omitempty"`
 }
 
+// Member is a user with access to a board or project, their effective role there
+// and every source the role comes from. Direct is set for board_members/project_members
+// rows, the only ones managed via the /members endpoints.
+type Member struct {
+	User
+	Role    Role           `json:"role"`
+	Direct  bool           `json:"direct"`
+	Sources []AccessSource `json:"sources"`
+}
+
+// AccessSource is one grant behind a user's role: kind is owner, direct, group (board or
+// project shared with a group), project (member or owner of the board's project) or
+// project_group (a group attached to the board's project).
+type AccessSource struct {
+	Kind        string `json:"kind"`
+	Role        Role   `json:"role"`
+	GroupID     int64  `json:"group_id,omitempty"`
+	GroupName   string `json:"group_name,omitempty"`
+	ProjectID   int64  `json:"project_id,omitempty"`
+	ProjectName string `json:"project_name,omitempty"`
+}
+
 type List struct {
 	ID        int64     `json:"id"`
 	BoardID   int64     `json:"board_id"`
@@ -22,6 +47,7 @@ type List struct {
 	Color     string    `json:"color,omitempty"`
 	Pos       int64     `json:"pos"`
 	CreatedAt time.Time `json:"created_at"`
+	Version   int64     `json:"version"`
 }
 
 type Card struct {
@@ -37,6 +63,7 @@ type Card struct {
 	AssigneeUserID  *int64     `json:"assignee_id,omitempty"`
 	Assignee        string     `json:"assignee,omitempty"`
 	CreatedAt       time.Time  `json:"created_at"`
+	Version         int64      `json:"version"`
 }
 
 type Comment struct {
@@ -46,6 +73,7 @@ type Comment struct {
 	CreatedAt time.Time `json:"created_at"`
 	UserID    *int64    `json:"user_id,omitempty"`
 	Author    string    `json:"author,omitempty"`
+	Version   int64     `json:"version"`
 }
 
 // Below are preliminary models for upcoming auth/admin features.
@@ -61,12 +89,50 @@ type User struct {
 	EmailVerified bool      `json:"email_verified"`
 	Lang          string    `json:"lang,omitempty"`
 	CreatedAt     time.Time `json:"created_at"`
+	// IsGuest marks external collaborators: they only reach boards they are direct
+	// members of, and lose access at GuestExpiresAt when set.
+	IsGuest        bool       `json:"is_guest,omitempty"`
+	GuestExpiresAt *time.Time `json:"guest_expires_at,omitempty"`
 }
 
 type Project struct {
 	ID        int64     `json:"id"`
 	Name      string    `json:"name"`
 	OwnerID   int64     `json:"owner_user_id"`
+	IsDefault bool      `json:"is_default,omitempty"`
+	OrgID     int64     `json:"org_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Org roles (org_members.role). Org admins act as Owner on every board and project of the
+// organization and manage its members; users.is_admin is the instance-wide admin.
+const (
+	OrgRoleMember = 1
+	OrgRoleAdmin  = 2
+	OrgRoleOwner  = 3
+)
+
+// Org is an organization (tenant) owning boards, projects and groups.
+type Org struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	IsDefault bool      `json:"is_default,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Role is the current user's org role when listed for them (0 = not a member)
+	Role int `json:"role,omitempty"`
+}
+
+// OrgMember is a user with their role in an organization.
+type OrgMember struct {
+	User
+	Role int `json:"role"`
+}
+
+// ProjectGroup is a group attached to a project; its members get Role on every board of the project.
+type ProjectGroup struct {
+	GroupID   int64     `json:"group_id"`
+	Name      string    `json:"name"`
+	Role      Role      `json:"role"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -77,3 +143,107 @@ type Group struct {
 	// Role is the current user's role in this group when applicable (1=member, 2=admin)
 	Role int `json:"role,omitempty"`
 }
+
+// LoginAttempts is the failed-login state of a login name.
+type LoginAttempts struct {
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   time.Time
+}
+
+// SecurityEvent is an entry of the per-user security log (logins, password and role changes...).
+type SecurityEvent struct {
+	ID        int64          `json:"id"`
+	UserID    *int64         `json:"user_id,omitempty"`
+	Email     string         `json:"email,omitempty"`
+	Type      string         `json:"type"`
+	IP        string         `json:"ip,omitempty"`
+	UserAgent string         `json:"user_agent,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// Identity is an external login (OAuth/OIDC/LDAP) linked to a user.
+type Identity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Invite is an invitation to a board, project or group with the role it grants.
+// Invites without Email are reusable links; email invites are accepted once.
+type Invite struct {
+	ID            int64      `json:"id"`
+	Token         string     `json:"token"`
+	Kind          string     `json:"kind"` // board, project, group
+	TargetID      int64      `json:"target_id"`
+	Role          int        `json:"role"`
+	Email         string     `json:"email,omitempty"`
+	CreatedBy     *int64     `json:"created_by,omitempty"`
+	CreatedByName string     `json:"created_by_name,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	AcceptedAt    *time.Time `json:"accepted_at,omitempty"`
+	Uses          int        `json:"uses"`
+	// Guest board invites create guest accounts (with GuestExpiresAt) on registration.
+	Guest          bool       `json:"guest,omitempty"`
+	GuestExpiresAt *time.Time `json:"guest_expires_at,omitempty"`
+}
+
+// ScimUser and ScimGroup carry the identity provider's externalId next to the record.
+type ScimUser struct {
+	User
+	ExternalID string
+}
+
+type ScimGroup struct {
+	Group
+	ExternalID string
+}
+
+// PresenceUser is someone viewing a board right now (GET /api/boards/{id}/presence).
+type PresenceUser struct {
+	UserID        int64     `json:"user_id"`
+	Name          string    `json:"name"`
+	Since         time.Time `json:"since"`
+	EditingCardID int64     `json:"editing_card_id,omitempty"`
+}
+
+// CardDoc is a card description under collaborative editing (GET /api/cards/{id}/doc):
+// Text is the document at revision Rev, the base for the next operation a client sends.
+type CardDoc struct {
+	CardID int64  `json:"card_id"`
+	Text   string `json:"text"`
+	Rev    int64  `json:"rev"`
+	IsMD   bool   `json:"description_is_md"`
+	// Ops are the operations after the ?since= revision, for an editor catching up
+	Ops []CardDocOp `json:"ops,omitempty"`
+}
+
+// CardDocOp is an applied operation on a card description (ot.js format), the revision
+// it produced and the editor it came from.
+type CardDocOp struct {
+	Rev      int64  `json:"rev"`
+	Op       textOp `json:"op"`
+	UserID   *int64 `json:"user_id,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// BoardChanges is what changed on a board since a sync cursor (GET /api/boards/{id}/changes).
+// Board is set when the board itself changed; rows may repeat ones sent before.
+type BoardChanges struct {
+	Cursor   int64       `json:"cursor"`
+	Board    *Board      `json:"board,omitempty"`
+	Lists    []List      `json:"lists"`
+	Cards    []Card      `json:"cards"`
+	Comments []Comment   `json:"comments"`
+	Deleted  []Tombstone `json:"deleted"`
+}
+
+// Tombstone is a deleted list, card or comment. Deleting a list also deletes its cards
+// and their comments, deleting a card its comments: those get no tombstones of their own.
+type Tombstone struct {
+	Kind      string    `json:"kind"`
+	ID        int64     `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcProvider is a generic OpenID Connect provider configured via env:
+//
+//	OIDC_PROVIDERS=keycloak,authentik
+//	OIDC_KEYCLOAK_ISSUER=https://sso.example.com/realms/main
+//	OIDC_KEYCLOAK_CLIENT_ID=trellolite
+//	OIDC_KEYCLOAK_CLIENT_SECRET=...
+//	OIDC_KEYCLOAK_SCOPES=openid email profile   (optional)
+//	OIDC_KEYCLOAK_NAME=Keycloak                 (optional, display name)
+//	OIDC_KEYCLOAK_REDIRECT_URL=...              (optional)
+//	OIDC_KEYCLOAK_TRUST_EMAIL=true              (optional, link by email even if email_verified is false)
+type oidcProvider struct {
+	ID           string
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	RedirectURL  string
+	TrustEmail   bool
+
+	client *http.Client
+
+	mu      sync.Mutex
+	disc    *oidcDiscovery
+	discAt  time.Time
+	keys    map[string]crypto.PublicKey
+	keysAt  time.Time
+	keysAll []crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+}
+
+// oidcClaims holds the subset of ID token claims we rely on.
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	AuthorizedParty   string          `json:"azp"`
+	Expiry            int64           `json:"exp"`
+	IssuedAt          int64           `json:"iat"`
+	NotBefore         int64           `json:"nbf"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     any             `json:"email_verified"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+const (
+	oidcDiscoveryTTL = time.Hour
+	oidcKeysTTL      = time.Hour
+	// minimum interval between JWKS refreshes triggered by an unknown kid
+	oidcKeysMinRefresh = 30 * time.Second
+	oidcClockSkew      = 2 * time.Minute
+)
+
+var oidcIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// loadOIDCProviders reads OIDC_PROVIDERS and per-provider settings. Misconfigured
+// entries are skipped (and reported through the returned errors) so one broken
+// provider doesn't disable login entirely.
+func loadOIDCProviders() ([]*oidcProvider, []error) {
+	var out []*oidcProvider
+	var errs []error
+	seen := map[string]bool{}
+	for _, raw := range strings.Split(getenv("OIDC_PROVIDERS", ""), ",") {
+		id := strings.ToLower(strings.TrimSpace(raw))
+		if id == "" {
+			continue
+		}
+		if !oidcIDPattern.MatchString(id) || id == "github" || id == "google" || seen[id] {
+			errs = append(errs, fmt.Errorf("oidc: invalid or duplicate provider id %q", id))
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_")) + "_"
+		p := &oidcProvider{
+			ID:           id,
+			Name:         getenv(prefix+"NAME", id),
+			Issuer:       strings.TrimRight(getenv(prefix+"ISSUER", ""), "/"),
+			ClientID:     getenv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getenv(prefix+"CLIENT_SECRET", ""),
+			Scopes:       strings.Fields(getenv(prefix+"SCOPES", "openid email profile")),
+			RedirectURL:  getenv(prefix+"REDIRECT_URL", ""),
+			TrustEmail:   getenv(prefix+"TRUST_EMAIL", "false") == "true",
+			client:       &http.Client{Timeout: 10 * time.Second},
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			errs = append(errs, fmt.Errorf("oidc: provider %q requires %sISSUER and %sCLIENT_ID", id, prefix, prefix))
+			continue
+		}
+		hasOpenID := false
+		for _, s := range p.Scopes {
+			if s == "openid" {
+				hasOpenID = true
+			}
+		}
+		if !hasOpenID {
+			p.Scopes = append([]string{"openid"}, p.Scopes...)
+		}
+		seen[id] = true
+		out = append(out, p)
+	}
+	return out, errs
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: status %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// discovery fetches (and caches) the provider's .well-known/openid-configuration.
+func (p *oidcProvider) discovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	if p.disc != nil && time.Since(p.discAt) < oidcDiscoveryTTL {
+		d := p.disc
+		p.mu.Unlock()
+		return d, nil
+	}
+	p.mu.Unlock()
+	var d oidcDiscovery
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch in discovery: %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("oidc: incomplete discovery document")
+	}
+	p.mu.Lock()
+	p.disc, p.discAt = &d, time.Now()
+	p.mu.Unlock()
+	return &d, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("bad rsa exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("ec point not on curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// signingKeys returns the JWKS keyed by kid. When force is set the cache is
+// bypassed (rate limited), which handles provider key rotation.
+func (p *oidcProvider) signingKeys(ctx context.Context, force bool) (map[string]crypto.PublicKey, []crypto.PublicKey, error) {
+	p.mu.Lock()
+	fresh := p.keys != nil && time.Since(p.keysAt) < oidcKeysTTL
+	if p.keys != nil && (fresh && !force || force && time.Since(p.keysAt) < oidcKeysMinRefresh) {
+		keys, all := p.keys, p.keysAll
+		p.mu.Unlock()
+		return keys, all, nil
+	}
+	p.mu.Unlock()
+	d, err := p.discovery(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	var all []crypto.PublicKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		if k.Kid != "" {
+			keys[k.Kid] = pub
+		}
+		all = append(all, pub)
+	}
+	if len(all) == 0 {
+		return nil, nil, errors.New("oidc: no usable signing keys in jwks")
+	}
+	p.mu.Lock()
+	p.keys, p.keysAll, p.keysAt = keys, all, time.Now()
+	p.mu.Unlock()
+	return keys, all, nil
+}
+
+// verifyIDToken checks the JWS signature against the provider JWKS and validates
+// iss, aud/azp, exp/iat/nbf and nonce.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed id_token")
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("oidc: malformed id_token header")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(hb, &hdr); err != nil {
+		return nil, errors.New("oidc: malformed id_token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("oidc: malformed id_token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	keys, all, err := p.signingKeys(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Kid != "" {
+		if _, ok := keys[hdr.Kid]; !ok {
+			if keys, all, err = p.signingKeys(ctx, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+	candidates := all
+	if hdr.Kid != "" {
+		k, ok := keys[hdr.Kid]
+		if !ok {
+			return nil, fmt.Errorf("oidc: unknown signing key %q", hdr.Kid)
+		}
+		candidates = []crypto.PublicKey{k}
+	}
+	verified := false
+	for _, k := range candidates {
+		if verifyJWS(hdr.Alg, k, signed, sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("oidc: invalid id_token signature")
+	}
+
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("oidc: malformed id_token payload")
+	}
+	var c oidcClaims
+	if err := json.Unmarshal(pb, &c); err != nil {
+		return nil, errors.New("oidc: malformed id_token payload")
+	}
+	if strings.TrimRight(c.Issuer, "/") != p.Issuer {
+		return nil, errors.New("oidc: issuer mismatch")
+	}
+	aud := c.audiences()
+	if !containsString(aud, p.ClientID) {
+		return nil, errors.New("oidc: audience mismatch")
+	}
+	if len(aud) > 1 && c.AuthorizedParty != "" && c.AuthorizedParty != p.ClientID {
+		return nil, errors.New("oidc: azp mismatch")
+	}
+	now := time.Now()
+	if c.Expiry == 0 || now.After(time.Unix(c.Expiry, 0).Add(oidcClockSkew)) {
+		return nil, errors.New("oidc: id_token expired")
+	}
+	if c.IssuedAt != 0 && time.Unix(c.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("oidc: id_token issued in the future")
+	}
+	if c.NotBefore != 0 && time.Unix(c.NotBefore, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("oidc: id_token not yet valid")
+	}
+	if c.Nonce == "" || c.Nonce != nonce {
+		return nil, errors.New("oidc: nonce mismatch")
+	}
+	if c.Subject == "" {
+		return nil, errors.New("oidc: missing sub")
+	}
+	return &c, nil
+}
+
+func (c *oidcClaims) audiences() []string {
+	var one string
+	if err := json.Unmarshal(c.Audience, &one); err == nil {
+		return []string{one}
+	}
+	var many []string
+	_ = json.Unmarshal(c.Audience, &many)
+	return many
+}
+
+// emailVerified accepts both boolean and "true"/"false" string encodings.
+func (c *oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyJWS verifies a compact JWS signature for the supported algorithms.
+// "none" and HMAC algorithms are rejected on purpose.
+func verifyJWS(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		h = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		h = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	hasher := h.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+	switch alg[:2] {
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		return rsa.VerifyPKCS1v15(k, h, digest, sig)
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		return rsa.VerifyPSS(k, h, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch")
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad ecdsa signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("ecdsa verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %q", alg)
+}
+
+// authCodeURL builds the authorization request with state, nonce and PKCE (S256).
+func (p *oidcProvider) authCodeURL(ctx context.Context, redirectURI, state, nonce, verifier string) (string, error) {
+	d, err := p.discovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("response_type", "code")
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchange redeems the authorization code and returns the raw ID token and access token.
+func (p *oidcProvider) exchange(ctx context.Context, code, redirectURI, verifier string) (idToken, accessToken string, err error) {
+	d, err := p.discovery(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	data := url.Values{}
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", redirectURI)
+	data.Set("client_id", p.ClientID)
+	data.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		IDToken     string `json:"id_token"`
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK || out.Error != "" || out.IDToken == "" {
+		return "", "", fmt.Errorf("oidc token error: status=%d error=%q", resp.StatusCode, out.Error)
+	}
+	return out.IDToken, out.AccessToken, nil
+}
+
+// userinfo fills missing email/name claims from the userinfo endpoint. The
+// returned sub must match the ID token's sub per OIDC Core 5.3.2.
+func (p *oidcProvider) userinfo(ctx context.Context, accessToken string, c *oidcClaims) error {
+	d, err := p.discovery(ctx)
+	if err != nil || d.UserinfoEndpoint == "" || accessToken == "" {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.UserinfoEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc userinfo: status %d", resp.StatusCode)
+	}
+	var ui oidcClaims
+	if err := json.NewDecoder(resp.Body).Decode(&ui); err != nil {
+		return err
+	}
+	if ui.Subject != c.Subject {
+		return errors.New("oidc userinfo: sub mismatch")
+	}
+	if c.Email == "" {
+		c.Email, c.EmailVerified = ui.Email, ui.EmailVerified
+	}
+	if c.Name == "" {
+		c.Name = ui.Name
+	}
+	if c.PreferredUsername == "" {
+		c.PreferredUsername = ui.PreferredUsername
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OpenID provider on httptest: discovery, JWKS, token and userinfo
+// endpoints, with keys that can be rotated.
+type mockIssuer struct {
+	srv *httptest.Server
+
+	mu         sync.Mutex
+	issuer     string // issuer in the discovery document, the server URL by default
+	noJWKS     bool   // leave jwks_uri out of discovery
+	keys       map[string]crypto.Signer
+	discHits   int
+	jwksHits   int
+	idToken    string // answered by the token endpoint
+	tokenForm  url.Values
+	tokenAuth  [2]string
+	userinfo   map[string]any
+	bearerSeen string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	m := &mockIssuer{keys: map[string]crypto.Signer{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.discHits++
+		iss := m.issuer
+		if iss == "" {
+			iss = m.srv.URL
+		}
+		d := map[string]any{
+			"issuer":                 iss,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"userinfo_endpoint":      m.srv.URL + "/userinfo",
+		}
+		if !m.noJWKS {
+			d["jwks_uri"] = m.srv.URL + "/jwks"
+		}
+		_ = json.NewEncoder(w).Encode(d)
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.jwksHits++
+		var keys []map[string]string
+		for kid, k := range m.keys {
+			keys = append(keys, publicJWK(kid, k.Public()))
+		}
+		// keys for other uses are skipped
+		keys = append(keys, map[string]string{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"})
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		_ = r.ParseForm()
+		m.tokenForm = r.PostForm
+		user, pass, _ := r.BasicAuth()
+		m.tokenAuth = [2]string{user, pass}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": m.idToken, "access_token": "at-1", "token_type": "Bearer"})
+	})
+	mux.HandleFunc("GET /userinfo", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.bearerSeen = r.Header.Get("Authorization")
+		_ = json.NewEncoder(w).Encode(m.userinfo)
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func (m *mockIssuer) provider() *oidcProvider {
+	return &oidcProvider{ID: "mock", Name: "Mock", Issuer: m.srv.URL, ClientID: "trellolite", ClientSecret: "s3cret",
+		Scopes: []string{"openid", "email"}, client: m.srv.Client()}
+}
+
+func (m *mockIssuer) setKeys(keys map[string]crypto.Signer) {
+	m.mu.Lock()
+	m.keys = keys
+	m.mu.Unlock()
+}
+
+func publicJWK(kid string, pub crypto.PublicKey) map[string]string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return map[string]string{"kty": "EC", "kid": kid, "crv": k.Curve.Params().Name, "x": b64(k.X.FillBytes(make([]byte, size))), "y": b64(k.Y.FillBytes(make([]byte, size)))}
+	}
+	panic("unsupported key")
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// signJWT signs claims as a compact JWS; kid is left out of the header when empty.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	hdr := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		hdr["kid"] = kid
+	}
+	hb, _ := json.Marshal(hdr)
+	cb, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, k, digest[:]); err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (m *mockIssuer) claims(nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss": m.srv.URL, "sub": "user-1", "aud": "trellolite", "exp": now.Add(5 * time.Minute).Unix(), "iat": now.Unix(),
+		"nonce": nonce, "email": "ann@example.com", "email_verified": true, "name": "Ann",
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+	d, err := p.discovery(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.TokenEndpoint != m.srv.URL+"/token" || d.JWKSURI != m.srv.URL+"/jwks" {
+		t.Fatalf("discovery %+v", d)
+	}
+	if _, err := p.discovery(t.Context()); err != nil || m.discHits != 1 {
+		t.Fatalf("cached discovery: %v, %d fetches", err, m.discHits)
+	}
+
+	m.issuer = "https://evil.example.com"
+	if _, err := m.provider().discovery(t.Context()); err == nil || !strings.Contains(err.Error(), "issuer mismatch") {
+		t.Fatalf("foreign issuer: %v", err)
+	}
+	m.issuer, m.noJWKS = "", true
+	if _, err := m.provider().discovery(t.Context()); err == nil || !strings.Contains(err.Error(), "incomplete") {
+		t.Fatalf("missing jwks_uri: %v", err)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	m := newMockIssuer(t)
+	k1, other := rsaKey(t), rsaKey(t)
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setKeys(map[string]crypto.Signer{"k1": k1, "ec1": ec})
+	p := m.provider()
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		alg     string
+		kid     string
+		key     crypto.Signer
+		edit    func(c map[string]any)
+		raw     string // instead of a signed token
+		wantErr string
+	}{
+		{name: "valid", kid: "k1", key: k1},
+		{name: "valid EC", alg: "ES256", kid: "ec1", key: ec},
+		{name: "no kid tries every key", key: k1},
+		{name: "aud list with azp", kid: "k1", key: k1, edit: func(c map[string]any) { c["aud"] = []string{"other", "trellolite"}; c["azp"] = "trellolite" }},
+		{name: "expired within clock skew", kid: "k1", key: k1, edit: func(c map[string]any) { c["exp"] = now.Add(-time.Minute).Unix() }},
+		{name: "signed by another key", kid: "k1", key: other, wantErr: "invalid id_token signature"},
+		{name: "no kid, unknown key", key: other, wantErr: "invalid id_token signature"},
+		{name: "unknown kid", kid: "k9", key: k1, wantErr: "unknown signing key"},
+		{name: "alg none", raw: "eyJhbGciOiJub25lIn0.eyJzdWIiOiJ4In0.", wantErr: "invalid id_token signature"},
+		{name: "malformed", raw: "abc.def", wantErr: "malformed"},
+		{name: "issuer", kid: "k1", key: k1, edit: func(c map[string]any) { c["iss"] = "https://evil.example.com" }, wantErr: "issuer mismatch"},
+		{name: "audience", kid: "k1", key: k1, edit: func(c map[string]any) { c["aud"] = "someone-else" }, wantErr: "audience mismatch"},
+		{name: "azp", kid: "k1", key: k1, edit: func(c map[string]any) { c["aud"] = []string{"other", "trellolite"}; c["azp"] = "other" }, wantErr: "azp mismatch"},
+		{name: "expired", kid: "k1", key: k1, edit: func(c map[string]any) { c["exp"] = now.Add(-time.Hour).Unix() }, wantErr: "expired"},
+		{name: "no exp", kid: "k1", key: k1, edit: func(c map[string]any) { delete(c, "exp") }, wantErr: "expired"},
+		{name: "issued in the future", kid: "k1", key: k1, edit: func(c map[string]any) { c["iat"] = now.Add(time.Hour).Unix() }, wantErr: "future"},
+		{name: "not yet valid", kid: "k1", key: k1, edit: func(c map[string]any) { c["nbf"] = now.Add(time.Hour).Unix() }, wantErr: "not yet valid"},
+		{name: "nonce", kid: "k1", key: k1, edit: func(c map[string]any) { c["nonce"] = "replayed" }, wantErr: "nonce mismatch"},
+		{name: "no nonce", kid: "k1", key: k1, edit: func(c map[string]any) { delete(c, "nonce") }, wantErr: "nonce mismatch"},
+		{name: "no sub", kid: "k1", key: k1, edit: func(c map[string]any) { delete(c, "sub") }, wantErr: "missing sub"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := tt.raw
+			if raw == "" {
+				c := m.claims("n-1")
+				if tt.edit != nil {
+					tt.edit(c)
+				}
+				alg := tt.alg
+				if alg == "" {
+					alg = "RS256"
+				}
+				raw = signJWT(t, alg, tt.kid, tt.key, c)
+			}
+			c, err := p.verifyIDToken(t.Context(), raw, "n-1")
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("rejected: %v", err)
+			case tt.wantErr == "" && (c.Subject != "user-1" || c.Email != "ann@example.com" || !c.emailVerified()):
+				t.Fatalf("claims %+v", c)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// HMAC with the public key as secret is the classic confusion attack
+	if err := verifyJWS("HS256", &k1.PublicKey, []byte("x"), []byte("y")); err == nil {
+		t.Fatal("HS256 accepted")
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	m := newMockIssuer(t)
+	k1, k2 := rsaKey(t), rsaKey(t)
+	m.setKeys(map[string]crypto.Signer{"k1": k1})
+	p := m.provider()
+	verify := func(kid string, key crypto.Signer) error {
+		_, err := p.verifyIDToken(t.Context(), signJWT(t, "RS256", kid, key, m.claims("n")), "n")
+		return err
+	}
+	if err := verify("k1", k1); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify("k1", k1); err != nil || m.jwksHits != 1 {
+		t.Fatalf("cached keys: %v, %d fetches", err, m.jwksHits)
+	}
+
+	m.setKeys(map[string]crypto.Signer{"k2": k2})
+	// an unknown kid refreshes the keys, but not more often than oidcKeysMinRefresh
+	if err := verify("k2", k2); err == nil || m.jwksHits != 1 {
+		t.Fatalf("refresh right after a fetch: %v, %d fetches", err, m.jwksHits)
+	}
+	p.mu.Lock()
+	p.keysAt = time.Now().Add(-oidcKeysMinRefresh - time.Second)
+	p.mu.Unlock()
+	if err := verify("k2", k2); err != nil || m.jwksHits != 2 {
+		t.Fatalf("rotated key: %v, %d fetches", err, m.jwksHits)
+	}
+	if err := verify("k1", k1); err == nil {
+		t.Fatal("retired key still accepted")
+	}
+
+	// expired cache: refetched even for a known kid
+	p.mu.Lock()
+	p.keysAt = time.Now().Add(-oidcKeysTTL - time.Second)
+	p.mu.Unlock()
+	if err := verify("k2", k2); err != nil || m.jwksHits != 3 {
+		t.Fatalf("after TTL: %v, %d fetches", err, m.jwksHits)
+	}
+}
+
+func TestOIDCExchangeAndUserinfo(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+	authURL, err := p.authCodeURL(t.Context(), "http://app/cb", "st", "nn", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authURL)
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("state") != "st" || q.Get("nonce") != "nn" || q.Get("client_id") != "trellolite" ||
+		q.Get("code_challenge") != pkceChallenge("verifier") || q.Get("code_challenge_method") != "S256" || q.Get("scope") != "openid email" {
+		t.Fatalf("auth URL %s", authURL)
+	}
+
+	m.idToken = "the.id.token"
+	id, access, err := p.exchange(t.Context(), "code-1", "http://app/cb", "verifier")
+	if err != nil || id != "the.id.token" || access != "at-1" {
+		t.Fatalf("exchange: %q %q %v", id, access, err)
+	}
+	if f := m.tokenForm; f.Get("code") != "code-1" || f.Get("code_verifier") != "verifier" || f.Get("redirect_uri") != "http://app/cb" ||
+		f.Get("grant_type") != "authorization_code" || m.tokenAuth != [2]string{"trellolite", "s3cret"} {
+		t.Fatalf("token request %v, auth %v", f, m.tokenAuth)
+	}
+
+	m.userinfo = map[string]any{"sub": "user-1", "email": "ann@example.com", "email_verified": "true", "name": "Ann"}
+	c := &oidcClaims{Subject: "user-1"}
+	if err := p.userinfo(t.Context(), access, c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Email != "ann@example.com" || !c.emailVerified() || c.Name != "Ann" || m.bearerSeen != "Bearer at-1" {
+		t.Fatalf("userinfo claims %+v, auth %q", c, m.bearerSeen)
+	}
+	m.userinfo["sub"] = "someone-else"
+	if err := p.userinfo(t.Context(), access, &oidcClaims{Subject: "user-1"}); err == nil {
+		t.Fatal("userinfo for another subject accepted")
+	}
+}
+
+// oidcRoundTrip starts a login on a, follows the redirect to the mock issuer far enough
+// to learn state and nonce, and returns the callback request the browser would make.
+func oidcRoundTrip(t *testing.T, a *api, m *mockIssuer, key crypto.Signer, edit func(c map[string]any)) *http.Request {
+	t.Helper()
+	start := httptest.NewRequest("GET", "http://app.test/api/auth/oidc/mock/start", nil)
+	start.SetPathValue("provider", "mock")
+	rec := httptest.NewRecorder()
+	a.handleOIDCStart(rec, start)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("start: %d %s", rec.Code, rec.Body)
+	}
+	loc, _ := url.Parse(rec.Header().Get("Location"))
+	q := loc.Query()
+	if !strings.HasPrefix(loc.String(), m.srv.URL+"/authorize") || q.Get("redirect_uri") != "http://app.test/api/auth/oidc/mock/callback" {
+		t.Fatalf("redirect to %s", loc)
+	}
+	c := m.claims(q.Get("nonce"))
+	if edit != nil {
+		edit(c)
+	}
+	m.idToken = signJWT(t, "RS256", "k1", key, c)
+	cb := httptest.NewRequest("GET", "http://app.test/api/auth/oidc/mock/callback?code=c1&state="+url.QueryEscape(q.Get("state")), nil)
+	cb.SetPathValue("provider", "mock")
+	for _, ck := range rec.Result().Cookies() {
+		cb.AddCookie(ck)
+	}
+	return cb
+}
+
+func TestOIDCCallback(t *testing.T) {
+	m := newMockIssuer(t)
+	k1 := rsaKey(t)
+	m.setKeys(map[string]crypto.Signer{"k1": k1})
+	a := &api{log: slog.New(slog.NewTextHandler(io.Discard, nil)), oidc: []*oidcProvider{m.provider()}, oidcFlows: map[string]oidcFlow{}}
+	callback := func(r *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.handleOIDCCallback(rec, r)
+		return rec
+	}
+
+	t.Run("state cookie missing", func(t *testing.T) {
+		r := oidcRoundTrip(t, a, m, k1, nil)
+		r.Header.Del("Cookie")
+		if rec := callback(r); rec.Code != 400 {
+			t.Fatalf("got %d", rec.Code)
+		}
+	})
+	t.Run("wrong nonce", func(t *testing.T) {
+		r := oidcRoundTrip(t, a, m, k1, func(c map[string]any) { c["nonce"] = "other" })
+		if rec := callback(r); rec.Code != 401 {
+			t.Fatalf("got %d", rec.Code)
+		}
+		// the flow is used up
+		if rec := callback(r); rec.Code != 400 {
+			t.Fatalf("replayed state: %d", rec.Code)
+		}
+	})
+	t.Run("forged signature", func(t *testing.T) {
+		if rec := callback(oidcRoundTrip(t, a, m, rsaKey(t), nil)); rec.Code != 401 {
+			t.Fatalf("got %d", rec.Code)
+		}
+	})
+	t.Run("provider error", func(t *testing.T) {
+		r := httptest.NewRequest("GET", "http://app.test/api/auth/oidc/mock/callback?error=access_denied", nil)
+		r.SetPathValue("provider", "mock")
+		if rec := callback(r); rec.Code != http.StatusFound || rec.Header().Get("Location") != "/web/login.html" {
+			t.Fatalf("got %d %s", rec.Code, rec.Header().Get("Location"))
+		}
+	})
+	t.Run("sign in", func(t *testing.T) {
+		a.store = testStore(t)
+		sub := "user-" + time.Now().Format("150405.000000000")
+		r := oidcRoundTrip(t, a, m, k1, func(c map[string]any) { c["sub"] = sub; c["email"] = sub + "@oidc.test" })
+		rec := callback(r)
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+			t.Fatalf("got %d %s %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+		}
+		var session bool
+		for _, ck := range rec.Result().Cookies() {
+			session = session || ck.Name == a.sessionCookieName() && ck.Value != ""
+		}
+		if !session {
+			t.Fatalf("no session cookie: %v", rec.Result().Cookies())
+		}
+	})
+}
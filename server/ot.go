@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"unicode/utf16"
+)
+
+// Operational transformation for plain text, compatible with ot.js. An operation walks
+// the whole document: in JSON a positive number retains that many characters, a negative
+// one deletes them and a string inserts itself, e.g. [5, "abc", -2, 10]. Positions count
+// UTF-16 code units, like JavaScript strings, so browser clients can use them as is.
+
+var errOpLength = errors.New("operation does not match the document length")
+
+// opPartMax bounds a single retain or delete, so lengths can be summed without overflow:
+// no document is longer than the largest message a client may send.
+const opPartMax = wsMaxMessage
+
+type opPart struct {
+	retain int    // > 0: keep this many units
+	delete int    // > 0: remove this many units
+	insert string // non-empty: insert this text
+}
+
+type textOp []opPart
+
+func u16len(s string) int { return len(utf16.Encode([]rune(s))) }
+
+// baseLen is the length of the document the operation applies to.
+func (o textOp) baseLen() int {
+	n := 0
+	for _, p := range o {
+		n += p.retain + p.delete
+	}
+	return n
+}
+
+// targetLen is the length of the document after the operation.
+func (o textOp) targetLen() int {
+	n := 0
+	for _, p := range o {
+		n += p.retain + u16len(p.insert)
+	}
+	return n
+}
+
+// isNoop reports whether the operation leaves the document unchanged.
+func (o textOp) isNoop() bool {
+	return len(o) == 0 || (len(o) == 1 && o[0].retain > 0)
+}
+
+// The add methods append a component, merging it with the previous one of the same kind
+// and keeping inserts before deletes, so equal edits always have the same form.
+
+func (o *textOp) addRetain(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(*o); l > 0 && (*o)[l-1].retain > 0 {
+		(*o)[l-1].retain += n
+		return
+	}
+	*o = append(*o, opPart{retain: n})
+}
+
+func (o *textOp) addDelete(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(*o); l > 0 && (*o)[l-1].delete > 0 {
+		(*o)[l-1].delete += n
+		return
+	}
+	*o = append(*o, opPart{delete: n})
+}
+
+func (o *textOp) addInsert(s string) {
+	if s == "" {
+		return
+	}
+	ops := *o
+	l := len(ops)
+	switch {
+	case l > 0 && ops[l-1].insert != "":
+		ops[l-1].insert += s
+	case l > 0 && ops[l-1].delete > 0:
+		if l > 1 && ops[l-2].insert != "" {
+			ops[l-2].insert += s
+			return
+		}
+		*o = append(ops, ops[l-1])
+		(*o)[l-1] = opPart{insert: s}
+	default:
+		*o = append(ops, opPart{insert: s})
+	}
+}
+
+func (o textOp) MarshalJSON() ([]byte, error) {
+	out := make([]any, 0, len(o))
+	for _, p := range o {
+		switch {
+		case p.retain > 0:
+			out = append(out, p.retain)
+		case p.delete > 0:
+			out = append(out, -p.delete)
+		default:
+			out = append(out, p.insert)
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (o *textOp) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	var op textOp
+	for _, r := range raw {
+		if len(r) > 0 && r[0] == '"' {
+			var s string
+			if err := json.Unmarshal(r, &s); err != nil {
+				return err
+			}
+			if s == "" {
+				return errors.New("empty insert")
+			}
+			op.addInsert(s)
+			continue
+		}
+		var n int
+		if err := json.Unmarshal(r, &n); err != nil || n == 0 {
+			return errors.New("operation components must be non-zero integers or strings")
+		}
+		if n > opPartMax || n < -opPartMax {
+			return errOpLength
+		}
+		if n > 0 {
+			op.addRetain(n)
+		} else {
+			op.addDelete(-n)
+		}
+	}
+	*o = op
+	return nil
+}
+
+// apply returns doc with the operation applied.
+func (o textOp) apply(doc string) (string, error) {
+	in := utf16.Encode([]rune(doc))
+	if o.baseLen() != len(in) {
+		return "", errOpLength
+	}
+	out := make([]uint16, 0, o.targetLen())
+	i := 0
+	for _, p := range o {
+		// checked part by part too: the sum alone could wrap around
+		if p.retain > len(in)-i || p.delete > len(in)-i {
+			return "", errOpLength
+		}
+		switch {
+		case p.retain > 0:
+			out = append(out, in[i:i+p.retain]...)
+			i += p.retain
+		case p.delete > 0:
+			i += p.delete
+		default:
+			out = append(out, utf16.Encode([]rune(p.insert))...)
+		}
+	}
+	return string(utf16.Decode(out)), nil
+}
+
+// transform takes two operations made concurrently on the same document and returns
+// a' and b' such that applying a then b' gives the same text as b then a'. When both
+// insert at the same position, a's text goes first.
+func transform(a, b textOp) (textOp, textOp, error) {
+	if a.baseLen() != b.baseLen() {
+		return nil, nil, errOpLength
+	}
+	var a2, b2 textOp
+	i, j := 0, 0
+	next := func(ops textOp, k *int) (opPart, bool) {
+		if *k < len(ops) {
+			*k++
+			return ops[*k-1], true
+		}
+		return opPart{}, false
+	}
+	pa, hasA := next(a, &i)
+	pb, hasB := next(b, &j)
+	for hasA || hasB {
+		if hasA && pa.insert != "" {
+			a2.addInsert(pa.insert)
+			b2.addRetain(u16len(pa.insert))
+			pa, hasA = next(a, &i)
+			continue
+		}
+		if hasB && pb.insert != "" {
+			a2.addRetain(u16len(pb.insert))
+			b2.addInsert(pb.insert)
+			pb, hasB = next(b, &j)
+			continue
+		}
+		if !hasA || !hasB {
+			return nil, nil, errOpLength
+		}
+		na, nb := pa.retain+pa.delete, pb.retain+pb.delete
+		n := min(na, nb)
+		switch {
+		case pa.retain > 0 && pb.retain > 0:
+			a2.addRetain(n)
+			b2.addRetain(n)
+		case pa.delete > 0 && pb.delete > 0:
+			// deleted on both sides: nothing left for either to do
+		case pa.delete > 0:
+			a2.addDelete(n)
+		default:
+			b2.addDelete(n)
+		}
+		if na == n {
+			pa, hasA = next(a, &i)
+		} else {
+			pa.retain, pa.delete = max(pa.retain-n, 0), max(pa.delete-n, 0)
+		}
+		if nb == n {
+			pb, hasB = next(b, &j)
+		} else {
+			pb.retain, pb.delete = max(pb.retain-n, 0), max(pb.delete-n, 0)
+		}
+	}
+	return a2, b2, nil
+}
+
+// replaceOp turns from into to with one change around the common prefix and suffix.
+func replaceOp(from, to string) textOp {
+	a, b := utf16.Encode([]rune(from)), utf16.Encode([]rune(to))
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	s := 0
+	for s < len(a)-p && s < len(b)-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	// don't split a surrogate pair between the kept and the changed part
+	if p > 0 && utf16.IsSurrogate(rune(a[p-1])) && a[p-1] < 0xdc00 {
+		p--
+	}
+	if s > 0 && utf16.IsSurrogate(rune(a[len(a)-s])) && a[len(a)-s] >= 0xdc00 {
+		s--
+	}
+	var op textOp
+	op.addRetain(p)
+	op.addInsert(string(utf16.Decode(b[p : len(b)-s])))
+	op.addDelete(len(a) - p - s)
+	op.addRetain(s)
+	return op
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+	"unicode/utf16"
+)
+
+// randomOp makes a random operation on doc: retains, deletes and inserts (some of them
+// outside the BMP, so surrogate pairs are covered). doc must be within the BMP, so random
+// retains and deletes never split a pair.
+func randomOp(rng *rand.Rand, doc string) textOp {
+	return randomOpWith(rng, doc, randomText)
+}
+
+func randomOpWith(rng *rand.Rand, doc string, randomText func(*rand.Rand) string) textOp {
+	n := u16len(doc)
+	var op textOp
+	for i := 0; i < n; {
+		k := 1 + rng.Intn(n-i)
+		switch rng.Intn(3) {
+		case 0:
+			op.addRetain(k)
+		case 1:
+			op.addDelete(k)
+		default:
+			op.addInsert(randomText(rng))
+			continue
+		}
+		i += k
+	}
+	if rng.Intn(2) == 0 {
+		op.addInsert(randomText(rng))
+	}
+	return op
+}
+
+func randomText(rng *rand.Rand) string { return randomFrom(rng, "ab é😀") }
+
+func randomBMPText(rng *rand.Rand) string { return randomFrom(rng, "ab é") }
+
+func randomFrom(rng *rand.Rand, chars string) string {
+	alphabet := []rune(chars)
+	r := make([]rune, 1+rng.Intn(4))
+	for i := range r {
+		r[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return string(r)
+}
+
+// randomDoc keeps to the BMP so random retains and deletes never split a surrogate pair.
+func randomDoc(rng *rand.Rand) string {
+	r := make([]rune, rng.Intn(12))
+	for i := range r {
+		r[i] = rune("abcdé "[rng.Intn(6)])
+	}
+	return string(r)
+}
+
+func mustApply(t *testing.T, op textOp, doc string) string {
+	t.Helper()
+	out, err := op.apply(doc)
+	if err != nil {
+		t.Fatalf("apply %v to %q: %v", op, doc, err)
+	}
+	return out
+}
+
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for range 2000 {
+		doc := randomDoc(rng)
+		a, b := randomOp(rng, doc), randomOp(rng, doc)
+		a2, b2, err := transform(a, b)
+		if err != nil {
+			t.Fatalf("transform %v %v: %v", a, b, err)
+		}
+		left := mustApply(t, b2, mustApply(t, a, doc))
+		right := mustApply(t, a2, mustApply(t, b, doc))
+		if left != right {
+			t.Fatalf("doc %q a %v b %v: %q != %q", doc, a, b, left, right)
+		}
+	}
+}
+
+// Transforming against a sequence of operations one by one, as the server does with the
+// log since the client's revision, must give the sequence's result plus the client's
+// edit: the composition of the sequence is never built, but has to be respected.
+func TestTransformAgainstSequence(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for range 500 {
+		doc := randomDoc(rng)
+		client := randomOp(rng, doc)
+		server, head := doc, doc
+		var log []textOp
+		for range 1 + rng.Intn(4) {
+			op := randomOpWith(rng, head, randomBMPText)
+			log = append(log, op)
+			head = mustApply(t, op, head)
+		}
+		// the client's edit after the log, transformed against it op by op...
+		pending := client
+		server = mustApply(t, client, server)
+		for _, op := range log {
+			var op2 textOp
+			var err error
+			if pending, op2, err = transform(pending, op); err != nil {
+				t.Fatalf("transform: %v", err)
+			}
+			// ...equals the log applied after the client's edit
+			server = mustApply(t, op2, server)
+		}
+		got := mustApply(t, pending, head)
+		if got != server {
+			t.Fatalf("doc %q client %v log %v: %q != %q", doc, client, log, got, server)
+		}
+	}
+}
+
+func TestTransformTieInsertOrder(t *testing.T) {
+	a, b := textOp{{insert: "A"}, {retain: 1}}, textOp{{insert: "B"}, {retain: 1}}
+	a2, b2, err := transform(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustApply(t, b2, mustApply(t, a, "x")); got != "ABx" {
+		t.Fatalf("got %q, want a's insert first", got)
+	}
+	if got := mustApply(t, a2, mustApply(t, b, "x")); got != "ABx" {
+		t.Fatalf("got %q, want a's insert first", got)
+	}
+}
+
+func TestReplaceOp(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+	pairs := [][2]string{{"", ""}, {"", "abc"}, {"abc", ""}, {"hello world", "hello there world"}, {"😀😁", "😀😂"}, {"a😀b", "a😁b"}}
+	for range 300 {
+		pairs = append(pairs, [2]string{randomText(rng) + randomDoc(rng), randomDoc(rng) + randomText(rng)})
+	}
+	for _, p := range pairs {
+		op := replaceOp(p[0], p[1])
+		if got := mustApply(t, op, p[0]); got != p[1] {
+			t.Fatalf("replaceOp(%q, %q) gives %q", p[0], p[1], got)
+		}
+		for _, part := range op {
+			if part.insert != "" && !utf16Valid(part.insert) {
+				t.Fatalf("replaceOp(%q, %q) splits a surrogate pair: %v", p[0], p[1], op)
+			}
+		}
+	}
+}
+
+func utf16Valid(s string) bool {
+	return string(utf16.Decode(utf16.Encode([]rune(s)))) == s && !containsRune(s, '�')
+}
+
+func containsRune(s string, r rune) bool {
+	for _, c := range s {
+		if c == r {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOpJSON(t *testing.T) {
+	var op textOp
+	if err := json.Unmarshal([]byte(`[5,"abc",-2,10]`), &op); err != nil {
+		t.Fatal(err)
+	}
+	if op.baseLen() != 17 || op.targetLen() != 18 {
+		t.Fatalf("lengths %d %d", op.baseLen(), op.targetLen())
+	}
+	data, _ := json.Marshal(op)
+	if string(data) != `[5,"abc",-2,10]` {
+		t.Fatalf("round trip: %s", data)
+	}
+	for _, bad := range []string{`[0]`, `[""]`, `[1.5]`, `{}`, `[true]`} {
+		if json.Unmarshal([]byte(bad), &op) == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+// Huge components used to sum to a small base length by overflowing and then slice
+// out of range in apply.
+func TestOpOverflow(t *testing.T) {
+	var op textOp
+	err := json.Unmarshal([]byte(`[4611686018427387904,"x",4611686018427387904,"x",4611686018427387904,"x",4611686018427387904]`), &op)
+	if err == nil {
+		t.Fatal("oversized components accepted")
+	}
+	// built directly, bypassing JSON: apply must still refuse it
+	const big = 1 << 62
+	op = textOp{{retain: big}, {insert: "x"}, {retain: big}, {insert: "x"}, {retain: big}, {insert: "x"}, {retain: big}}
+	if _, err := op.apply(""); err == nil {
+		t.Fatal("overflowing operation applied")
+	}
+	if _, err := (textOp{{delete: 2}}).apply("a"); err == nil {
+		t.Fatal("delete past the end applied")
+	}
+}
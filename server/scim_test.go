@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSCIMFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   []ScimCond
+	}{
+		{``, nil},
+		{`userName eq "Ann@Example.com"`, []ScimCond{{"username", "eq", "Ann@Example.com"}}},
+		{`userName EQ "x"`, []ScimCond{{"username", "eq", "x"}}},
+		{`externalId eq "e1" and active eq True`, []ScimCond{{"externalid", "eq", "e1"}, {"active", "eq", "true"}}},
+		{`title pr and userName sw "a"`, []ScimCond{{"title", "pr", ""}, {"username", "sw", "a"}}},
+		{`displayName eq "a \"b\" c"`, []ScimCond{{"displayname", "eq", `a "b" c`}}},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "x"`, []ScimCond{{"username", "eq", "x"}}},
+		{`emails[type eq "work"].value eq "w@x"`, []ScimCond{{"emails.value", "eq", "w@x"}}},
+		{`emails[value eq "w@x y"]`, []ScimCond{{"emails.value", "eq", "w@x y"}}},
+		{`members[value eq "42"]`, []ScimCond{{"members.value", "eq", "42"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSCIMFilter(tt.filter)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v %v, want %+v", tt.filter, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{
+		`userName eq "a" or userName eq "b"`,
+		`(userName eq "a")`,
+		`userName eq "a`,
+		`userName eq`,
+		`userName`,
+		`userName eq "a" and`,
+		`emails[type eq "work"`,
+		`emails[type eq "work" and primary eq true]`,
+	} {
+		if got, err := parseSCIMFilter(bad); err == nil {
+			t.Errorf("%s: accepted as %+v", bad, got)
+		}
+	}
+}
+
+func TestParseSCIMUserPatch(t *testing.T) {
+	show := func(p scimUserPatch) string {
+		var parts []string
+		for _, f := range []struct {
+			name string
+			v    *string
+		}{{"name", p.name}, {"email", p.email}, {"ext", p.ext}, {"password", p.password}} {
+			if f.v != nil {
+				parts = append(parts, fmt.Sprintf("%s=%q", f.name, *f.v))
+			}
+		}
+		if p.active != nil {
+			parts = append(parts, fmt.Sprintf("active=%v", *p.active))
+		}
+		return strings.Join(parts, " ")
+	}
+	tests := []struct {
+		name, ops, want string
+	}{
+		{"deactivate", `[{"op":"replace","path":"active","value":false}]`, `active=false`},
+		{"string boolean, op in any case", `[{"op":"Replace","path":"active","value":"True"}]`, `active=true`},
+		{"remove active", `[{"op":"remove","path":"active"}]`, `active=false`},
+		{"no path", `[{"op":"replace","value":{"active":false,"displayName":" Ann B "}}]`, `name="Ann B" active=false`},
+		{"primary email", `[{"op":"add","path":"emails","value":[{"value":"w@x"},{"value":"p@x","primary":"true"}]}]`, `email="p@x"`},
+		{"first email", `[{"op":"replace","path":"emails","value":[{"value":""},{"value":"w@x"}]}]`, `email="w@x"`},
+		{"email value filter", `[{"op":"replace","path":"emails[type eq \"work\"].value","value":"w@x"}]`, `email="w@x"`},
+		{"empty email ignored", `[{"op":"replace","path":"emails[type eq \"work\"].value","value":""}]`, ``},
+		{"userName as email", `[{"op":"replace","path":"userName","value":"new@x"}]`, `email="new@x"`},
+		{"userName not an email", `[{"op":"replace","path":"userName","value":"ann"}]`, ``},
+		{"given name", `[{"op":"replace","path":"name.givenName","value":"Bea"}]`, `name="Bea Smith Jones"`},
+		{"family name", `[{"op":"replace","path":"name","value":{"familyName":"Lee"}}]`, `name="Ann Lee"`},
+		{"formatted wins", `[{"op":"replace","path":"name","value":{"formatted":"A L","givenName":"B"}}]`, `name="A L"`},
+		{"external id", `[{"op":"add","path":"externalId","value":"e1"},{"op":"remove","path":"externalId"}]`, `ext=""`},
+		{"password", `[{"op":"replace","path":"password","value":"s3cret"}]`, `password="s3cret"`},
+		{"later ops win", `[{"op":"replace","path":"active","value":false},{"op":"replace","path":"active","value":true}]`, `active=true`},
+		{"unknown attribute", `[{"op":"replace","path":"title","value":"CTO"}]`, ``},
+	}
+	for _, tt := range tests {
+		var ops []scimPatchOp
+		must(t, json.Unmarshal([]byte(tt.ops), &ops))
+		p, err := parseSCIMUserPatch(ops, "Ann Smith Jones")
+		if err != nil || show(p) != tt.want {
+			t.Errorf("%s: %s %v, want %s", tt.name, show(p), err, tt.want)
+		}
+	}
+	for ops, scimType := range map[string]string{
+		`[{"op":"move","path":"active","value":false}]`:      "invalidSyntax",
+		`[{"op":"replace","path":"active","value":"maybe"}]`: "invalidValue",
+		`[{"op":"replace","path":"emails","value":"w@x"}]`:   "invalidValue",
+		`[{"op":"replace","value":[1]}]`:                     "invalidValue",
+	} {
+		var list []scimPatchOp
+		must(t, json.Unmarshal([]byte(ops), &list))
+		if _, err := parseSCIMUserPatch(list, ""); err == nil || err.scimType != scimType {
+			t.Errorf("%s: %v, want %s", ops, err, scimType)
+		}
+	}
+}
+
+func TestSCIMGroupPatch(t *testing.T) {
+	tests := []struct {
+		name, ops string
+		want      scimGroupPatch
+	}{
+		{"add members", `[{"op":"add","path":"members","value":[{"value":"3"},{"value":"2"},{"value":"3"}]}]`,
+			scimGroupPatch{"g", "e", []string{"1", "2", "3"}}},
+		{"remove members", `[{"op":"remove","path":"members","value":[{"value":"1"},{"value":"9"}]}]`,
+			scimGroupPatch{"g", "e", []string{"2"}}},
+		{"remove all members", `[{"op":"remove","path":"members"}]`,
+			scimGroupPatch{"g", "e", nil}},
+		{"replace members", `[{"op":"replace","path":"members","value":[{"value":"5"},{"value":"05"}]}]`,
+			scimGroupPatch{"g", "e", []string{"5"}}},
+		{"remove one member", `[{"op":"remove","path":"members[value eq \"2\"]"}]`,
+			scimGroupPatch{"g", "e", []string{"1"}}},
+		{"no path", `[{"op":"replace","value":{"displayName":" h ","members":[{"value":"4"}]}}]`,
+			scimGroupPatch{"h", "e", []string{"4"}}},
+		{"in order", `[{"op":"add","path":"members","value":[{"value":"3"}]},{"op":"remove","path":"members[value eq \"1\"]"}]`,
+			scimGroupPatch{"g", "e", []string{"2", "3"}}},
+		{"external id", `[{"op":"remove","path":"externalId"}]`,
+			scimGroupPatch{"g", "", []string{"1", "2"}}},
+		{"unknown attribute", `[{"op":"replace","path":"description","value":"x"}]`,
+			scimGroupPatch{"g", "e", []string{"1", "2"}}},
+	}
+	for _, tt := range tests {
+		var ops []scimPatchOp
+		must(t, json.Unmarshal([]byte(tt.ops), &ops))
+		g := scimGroupPatch{name: "g", externalID: "e", members: []string{"1", "2"}}
+		if err := g.apply(ops); err != nil || !reflect.DeepEqual(g, tt.want) {
+			t.Errorf("%s: %+v %v, want %+v", tt.name, g, err, tt.want)
+		}
+	}
+	for ops, scimType := range map[string]string{
+		`[{"op":"copy","path":"members","value":[]}]`:                    "invalidSyntax",
+		`[{"op":"add","path":"members[value eq \"2\"]"}]`:                "invalidValue",
+		`[{"op":"remove","path":"members[value eq \"x\"]"}]`:             "invalidValue",
+		`[{"op":"remove","path":"members[display eq \"2\"]"}]`:           "invalidValue",
+		`[{"op":"add","path":"members","value":{"value":"3"}}]`:          "invalidValue",
+		`[{"op":"remove","path":"displayName"}]`:                         "invalidValue",
+		`[{"op":"replace","path":"displayName","value":" "}]`:            "invalidValue",
+		`[{"op":"replace","path":"displayName","value":"h"},{"op":"x"}]`: "invalidSyntax",
+	} {
+		var list []scimPatchOp
+		must(t, json.Unmarshal([]byte(ops), &list))
+		g := scimGroupPatch{name: "g", members: []string{"1", "2"}}
+		if err := g.apply(list); err == nil || err.scimType != scimType {
+			t.Errorf("%s: %v, want %s", ops, err, scimType)
+		}
+	}
+}
+
+// TestSCIMToken checks that every SCIM route wants the SCIM_TOKEN bearer token.
+func TestSCIMToken(t *testing.T) {
+	a := &api{log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	mux := http.NewServeMux()
+	a.routes(mux)
+	var patterns []string
+	for pattern := range routeActions {
+		if strings.Contains(pattern, " /scim/") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	if len(patterns) == 0 {
+		t.Fatal("no SCIM routes")
+	}
+	call := func(pattern, auth string) *httptest.ResponseRecorder {
+		method, path, _ := strings.Cut(pattern, " ")
+		req := httptest.NewRequest(method, strings.ReplaceAll(path, "{id}", "1"), strings.NewReader("{}"))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Setenv("SCIM_TOKEN", "")
+	for _, pattern := range patterns {
+		if w := call(pattern, "Bearer "); w.Code != 404 {
+			t.Errorf("%s without SCIM_TOKEN: %d", pattern, w.Code)
+		}
+	}
+	t.Setenv("SCIM_TOKEN", "s3cret")
+	for _, pattern := range patterns {
+		for _, auth := range []string{"", "Bearer", "Bearer wrong", "Bearer s3cret2", "Basic s3cret", "s3cret"} {
+			w := call(pattern, auth)
+			if w.Code != 401 || w.Header().Get("WWW-Authenticate") == "" || !strings.Contains(w.Body.String(), scimErrorSchema) {
+				t.Errorf("%s with %q: %d %s", pattern, auth, w.Code, w.Body)
+			}
+		}
+	}
+	passed := false
+	next := a.requireSCIM(func(w http.ResponseWriter, r *http.Request) { passed = true })
+	req := httptest.NewRequest("GET", "/scim/v2/Users", nil)
+	req.Header.Set("Authorization", "bearer  s3cret ")
+	next(httptest.NewRecorder(), req)
+	if !passed {
+		t.Fatal("the right token was refused")
+	}
+}
+
+// TestGroupOrgScope checks that SCIM lookups and LDAP group sync stay inside their
+// organization even when another one has a group of the same name.
+func TestGroupOrgScope(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	owner := testUser(t, s, "scimowner", OrgRoleMember)
+	user := testUser(t, s, "scimuser", 0)
+	o, err := s.CreateOrg(ctx, "scim org", owner.ID)
+	must(t, err)
+
+	name := fmt.Sprintf("scim-%d", time.Now().UnixNano())
+	here, err := s.CreateGroup(ctx, o.ID, name)
+	must(t, err)
+	other, err := s.CreateGroup(ctx, s.DefaultOrgID(), name)
+	must(t, err)
+
+	groups, total, err := s.ScimGroups(ctx, o.ID, []ScimCond{{Attr: "displayname", Op: "eq", Value: name}}, 0, 10)
+	must(t, err)
+	if total != 1 || len(groups) != 1 || groups[0].ID != here.ID {
+		t.Fatalf("displayName filter: %d %+v", total, groups)
+	}
+	if _, err := s.ScimGroupByID(ctx, o.ID, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("group of another organization: %v", err)
+	}
+	if sg, err := s.ScimGroupByID(ctx, o.ID, here.ID); err != nil || sg.Name != name {
+		t.Fatalf("own group: %+v %v", sg, err)
+	}
+
+	must(t, s.SyncManagedGroups(ctx, o.ID, user.ID, []string{name}, []string{name}))
+	mine, err := s.MyGroups(ctx, user.ID, o.ID)
+	must(t, err)
+	if len(mine) != 1 || mine[0].ID != here.ID {
+		t.Fatalf("synced into %+v", mine)
+	}
+	if elsewhere, err := s.MyGroups(ctx, user.ID, s.DefaultOrgID()); err != nil || len(elsewhere) != 0 {
+		t.Fatalf("synced into the default organization: %+v %v", elsewhere, err)
+	}
+	if _, err := s.OrgRole(ctx, o.ID, user.ID); err != nil {
+		t.Fatalf("not joined to the group's organization: %v", err)
+	}
+}
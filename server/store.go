@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -15,246 +16,975 @@ import (
 
 type Store struct {
 	db *sql.DB
+	// defaultOrg is the id of the default organization, loaded by Migrate
+	defaultOrg int64
 }
 
 func NewStore(db *sql.DB) *Store { return &Store{db: db} }
 
 func (s *Store) Migrate(ctx context.Context) error {
-	_, err := s.db.ExecContext(ctx, schema)
-	return err
+	if _, err := s.db.ExecContext(ctx, schema); err != nil {
+		return err
+	}
+	return s.db.QueryRowContext(ctx, `select id from orgs where is_default`).Scan(&s.defaultOrg)
 }
 
-func (s *Store) ListBoards(ctx context.Context, userID int64, scope string) ([]Board, error) {
+// guestBoards limits ListBoards for guests ($1) to boards they own or are direct members of.
+const guestBoards = `(not exists (select 1 from users gu where gu.id = $1 and gu.is_guest)
+	or b.created_by = $1 or exists (select 1 from board_members bm where bm.board_id = b.id and bm.user_id = $1))`
+
+// ListBoards lists the user's boards of organization orgID; scope is mine, groups or all.
+func (s *Store) ListBoards(ctx context.Context, userID, orgID int64, scope string) ([]Board, error) {
 	var rows *sql.Rows
 	var err error
 	switch strings.ToLower(scope) {
 	case "groups", "group":
+		// shared with the user: through a group or as a direct board member
 		rows, err = s.db.QueryContext(ctx, `
-			select b.id, b.title, coalesce(b.color,''), b.created_at, b.project_id, b.created_by,
+			select b.id, b.title, coalesce(b.color,''), b.created_at, b.project_id, b.created_by, b.org_id, b.version,
 				   true as via_group
 			from boards b
-			where exists (
+			where b.org_id = $2 and `+guestBoards+` and (exists (
 				select 1 from board_groups bg
 				join user_groups ug on ug.group_id = bg.group_id
 				where bg.board_id = b.id and ug.user_id = $1
-			)
-			order by b.pos, b.id`, userID)
+			) or exists (
+				select 1 from board_members bm where bm.board_id = b.id and bm.user_id = $1
+			) or exists (
+				select 1 from project_groups pg join user_groups ug on ug.group_id = pg.group_id
+				where pg.project_id = b.project_id and ug.user_id = $1
+			))
+			order by b.pos, b.id`, userID, orgID)
 	case "all":
 		rows, err = s.db.QueryContext(ctx, `
-			select b.id, b.title, coalesce(b.color,''), b.created_at, b.project_id, b.created_by,
+			select b.id, b.title, coalesce(b.color,''), b.created_at, b.project_id, b.created_by, b.org_id, b.version,
 				   exists (
 					   select 1 from board_groups bg
 					   join user_groups ug on ug.group_id = bg.group_id
 					   where bg.board_id = b.id and ug.user_id = $1
+				   ) or exists (
+					   select 1 from board_members bm where bm.board_id = b.id and bm.user_id = $1
+				   ) or exists (
+					   select 1 from project_groups pg join user_groups ug on ug.group_id = pg.group_id
+					   where pg.project_id = b.project_id and ug.user_id = $1
 				   ) as via_group
 			from boards b
-			where b.created_by = $1
+			where b.org_id = $2 and `+guestBoards+` and (b.created_by = $1
 			   or exists (
 				   select 1 from board_groups bg
 				   join user_groups ug on ug.group_id = bg.group_id
 				   where bg.board_id = b.id and ug.user_id = $1
 			   )
+			   or exists (
+				   select 1 from board_members bm where bm.board_id = b.id and bm.user_id = $1
+			   )
 			   or exists (
 				   select 1 from projects p left join project_members pm on pm.project_id = p.id and pm.user_id = $1
 				   where p.id = b.project_id and (p.owner_user_id = $1 or pm.user_id is not null)
 			   )
-			order by b.pos, b.id`, userID)
+			   or exists (
+				   select 1 from project_groups pg join user_groups ug on ug.group_id = pg.group_id
+				   where pg.project_id = b.project_id and ug.user_id = $1
+			   )
+			   or exists (
+				   select 1 from org_members om where om.org_id = b.org_id and om.user_id = $1 and om.role >= 2
+			   ))
+			order by b.pos, b.id`, userID, orgID)
 	default: // "mine"
 		rows, err = s.db.QueryContext(ctx, `
-			select id, title, coalesce(color,''), created_at, project_id, created_by,
+			select id, title, coalesce(color,''), created_at, project_id, created_by, org_id, version,
 				   false as via_group
 			from boards
-			where created_by = $1
-			order by pos, id`, userID)
+			where created_by = $1 and org_id = $2
+			order by pos, id`, userID, orgID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Board
+	for rows.Next() {
+		var b Board
+		if err := rows.Scan(&b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.ProjectID, &b.CreatedBy, &b.OrgID, &b.Version, &b.ViaGroup); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// CreateBoard creates a board at the end of organization orgID's board order.
+func (s *Store) CreateBoard(ctx context.Context, orgID, userID int64, title string) (Board, error) {
+	var next int64 = 1000
+	_ = s.db.QueryRowContext(ctx, `select coalesce(max(pos),0)+1000 from boards where org_id=$1`, orgID).Scan(&next)
+	var b Board
+	err := s.db.QueryRowContext(ctx, `insert into boards(title, pos, created_by, org_id) values($1,$2,$3,$4) returning id, title, coalesce(color,''), created_at, created_by, org_id, version`, title, next, userID, orgID).
+		Scan(&b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.CreatedBy, &b.OrgID, &b.Version)
+	return b, err
+}
+
+// Projects
+func (s *Store) ListProjects(ctx context.Context, userID, orgID int64) ([]Project, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		select p.id, p.name, p.owner_user_id, p.is_default, p.org_id, p.created_at
+		from projects p
+		where p.org_id = $2 and (p.owner_user_id = $1
+			or exists (select 1 from project_members pm where pm.project_id = p.id and pm.user_id = $1)
+			or exists (select 1 from project_groups pg join user_groups ug on ug.group_id = pg.group_id
+				where pg.project_id = p.id and ug.user_id = $1))
+		order by p.created_at desc, p.id desc`, userID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Project
+	for rows.Next() {
+		var p Project
+		if err := rows.Scan(&p.ID, &p.Name, &p.OwnerID, &p.IsDefault, &p.OrgID, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) CreateProject(ctx context.Context, orgID, ownerID int64, name string) (Project, error) {
+	var p Project
+	err := s.db.QueryRowContext(ctx, `insert into projects(name, owner_user_id, org_id) values($1,$2,$3) returning id, name, owner_user_id, org_id, created_at`, name, ownerID, orgID).
+		Scan(&p.ID, &p.Name, &p.OwnerID, &p.OrgID, &p.CreatedAt)
+	return p, err
+}
+
+// DefaultProjectName is the name given to the per-owner default project.
+const DefaultProjectName = "Default Project"
+
+// DefaultProject returns the owner's default project in organization orgID, creating it when missing.
+func (s *Store) DefaultProject(ctx context.Context, orgID, ownerID int64) (Project, error) {
+	if _, err := s.db.ExecContext(ctx, `insert into projects(name, owner_user_id, is_default, org_id) values($1,$2,true,$3) on conflict do nothing`,
+		DefaultProjectName, ownerID, orgID); err != nil {
+		return Project{}, err
+	}
+	var id int64
+	if err := s.db.QueryRowContext(ctx, `select id from projects where owner_user_id=$1 and org_id=$2 and is_default`, ownerID, orgID).Scan(&id); err != nil {
+		return Project{}, err
+	}
+	return s.GetProject(ctx, id)
+}
+
+// MigrateDefaultProjects moves every board without a project into its owner's default
+// project of the board's organization, creating those projects as needed. It is idempotent: once all boards have a
+// project it changes nothing. Boards without an owner (created_by null) are left as is
+// and counted in orphans.
+func (s *Store) MigrateDefaultProjects(ctx context.Context) (projects, boards, orphans int64, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, 0, err
 	}
+	defer func() { _ = tx.Rollback() }()
+	res, err := tx.ExecContext(ctx, `insert into projects(name, owner_user_id, is_default, org_id)
+		select distinct $1, b.created_by, true, b.org_id from boards b
+		where b.project_id is null and b.created_by is not null
+		on conflict do nothing`, DefaultProjectName)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	projects, _ = res.RowsAffected()
+	res, err = tx.ExecContext(ctx, `update boards b set project_id = p.id
+		from projects p
+		where b.project_id is null and p.owner_user_id = b.created_by and p.org_id = b.org_id and p.is_default`)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	boards, _ = res.RowsAffected()
+	if err := tx.QueryRowContext(ctx, `select count(*) from boards where project_id is null`).Scan(&orphans); err != nil {
+		return 0, 0, 0, err
+	}
+	return projects, boards, orphans, tx.Commit()
+}
+
+// AddProjectMember adds or updates a project member. A missing (nil) or out of range role
+// means Maintainer; 0 is Viewer.
+func (s *Store) AddProjectMember(ctx context.Context, projectID, userID int64, role *int) error {
+	r := int(RoleMaintainer)
+	if role != nil && *role >= int(RoleViewer) && *role <= int(RoleOwner) {
+		r = *role
+	}
+	_, err := s.db.ExecContext(ctx, `insert into project_members(project_id, user_id, role) values($1,$2,$3)
+		on conflict (project_id, user_id) do update set role=excluded.role`, projectID, userID, r)
+	return err
+}
+
+func (s *Store) RemoveProjectMember(ctx context.Context, projectID, userID int64) error {
+	_, err := s.db.ExecContext(ctx, `delete from project_members where project_id=$1 and user_id=$2`, projectID, userID)
+	return err
+}
+
+func (s *Store) GetProject(ctx context.Context, id int64) (Project, error) {
+	var p Project
+	var owner sql.NullInt64
+	err := s.db.QueryRowContext(ctx, `select id, name, owner_user_id, is_default, org_id, created_at from projects where id=$1`, id).
+		Scan(&p.ID, &p.Name, &owner, &p.IsDefault, &p.OrgID, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Project{}, ErrNotFound
+	}
+	p.OwnerID = owner.Int64
+	return p, err
+}
+
+func (s *Store) RenameProject(ctx context.Context, id int64, name string) error {
+	res, err := s.db.ExecContext(ctx, `update projects set name=$2 where id=$1`, id, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteProject removes a project with its memberships; its boards are detached
+// (boards.project_id is set to null) and stay with their owners.
+func (s *Store) DeleteProject(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `delete from projects where id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetProjectMemberRole changes the role of a project_members row, ErrNotFound if there is none.
+func (s *Store) SetProjectMemberRole(ctx context.Context, projectID, userID int64, role Role) error {
+	res, err := s.db.ExecContext(ctx, `update project_members set role=$3 where project_id=$1 and user_id=$2`, projectID, userID, int(role))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TransferProjectOwnership makes newOwner the project's owner_user_id. As with boards, the
+// previous owner stays as a Maintainer member and the new owner's member row is dropped.
+func (s *Store) TransferProjectOwnership(ctx context.Context, projectID, newOwner int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var prev sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `select owner_user_id from projects where id=$1 for update`, projectID).Scan(&prev); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `update projects set owner_user_id=$2 where id=$1`, projectID, newOwner); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `delete from project_members where project_id=$1 and user_id=$2`, projectID, newOwner); err != nil {
+		return err
+	}
+	if prev.Valid && prev.Int64 != newOwner {
+		if _, err := tx.ExecContext(ctx, `insert into project_members(project_id, user_id, role) values($1,$2,$3)
+			on conflict (project_id, user_id) do update set role=excluded.role`, projectID, prev.Int64, int(RoleMaintainer)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// projectBoardOrder maps the ?sort= values of GET /api/projects/{id}/boards to SQL.
+var projectBoardOrder = map[string]string{
+	"":        "pos, id",
+	"pos":     "pos, id",
+	"title":   "lower(title), id",
+	"created": "created_at desc, id desc",
+}
+
+// ProjectBoards lists the boards of a project in the given order (pos, title or created).
+func (s *Store) ProjectBoards(ctx context.Context, projectID int64, sort string) ([]Board, error) {
+	order, ok := projectBoardOrder[sort]
+	if !ok {
+		order = projectBoardOrder["pos"]
+	}
+	rows, err := s.db.QueryContext(ctx, `select id, title, coalesce(color,''), created_at, project_id, created_by, version
+		from boards where project_id=$1 order by `+order, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Board{}
+	for rows.Next() {
+		var b Board
+		if err := rows.Scan(&b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.ProjectID, &b.CreatedBy, &b.Version); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// ProjectMembers returns the owner, direct members and members of attached groups with their role.
+func (s *Store) ProjectMembers(ctx context.Context, projectID int64) ([]Member, error) {
+	return s.members(ctx, projectGrants, projectID)
+}
+
+// ProjectGroups lists the groups attached to a project.
+func (s *Store) ProjectGroups(ctx context.Context, projectID int64) ([]ProjectGroup, error) {
+	rows, err := s.db.QueryContext(ctx, `select g.id, g.name, pg.role, pg.created_at
+		from project_groups pg join groups g on g.id = pg.group_id
+		where pg.project_id=$1 order by g.name`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ProjectGroup{}
+	for rows.Next() {
+		var g ProjectGroup
+		if err := rows.Scan(&g.GroupID, &g.Name, &g.Role, &g.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, g)
+	}
+	return out, rows.Err()
+}
+
+// SetProjectGroup attaches a group to a project with a role, or changes the role.
+// ErrNotFound when the group doesn't exist.
+func (s *Store) SetProjectGroup(ctx context.Context, projectID, groupID int64, role Role) error {
+	res, err := s.db.ExecContext(ctx, `insert into project_groups(project_id, group_id, role) select $1, id, $3 from groups where id=$2
+		on conflict (project_id, group_id) do update set role=excluded.role`, projectID, groupID, int(role))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) RemoveProjectGroup(ctx context.Context, projectID, groupID int64) error {
+	res, err := s.db.ExecContext(ctx, `delete from project_groups where project_id=$1 and group_id=$2`, projectID, groupID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// boardGrants lists every grant of a role on board $1 as
+// (user_id, role, kind, group_id, group_name, project_id, project_name), see AccessSource:
+// the board owner, direct members, groups the board is shared with (group admin =
+// Maintainer, member = Member), the project owner and members, groups attached to the
+// project and admins of the board's organization (Owner). Only grants of members of
+// that organization count; guests only keep owner and direct grants, until they expire.
+// guestExpired is true for users (alias u) whose guest access has expired.
+const guestExpired = `(u.is_guest and u.guest_expires_at is not null and u.guest_expires_at <= now())`
+
+const boardGrants = `with raw as (
+	select om.user_id, 3 as role, 'org_admin' as kind, null::bigint as group_id, null::text as group_name, null::bigint as project_id, null::text as project_name
+	from boards b join org_members om on om.org_id = b.org_id
+	where b.id = $1 and om.role >= 2
+	union all
+	select b.created_by as user_id, 3 as role, 'owner' as kind, null::bigint as group_id, null::text as group_name, null::bigint as project_id, null::text as project_name
+	from boards b where b.id = $1 and b.created_by is not null
+	union all
+	select bm.user_id, bm.role, 'direct', null, null, null, null
+	from board_members bm where bm.board_id = $1
+	union all
+	select ug.user_id, case when ug.role >= 2 then 2 else 1 end, 'group', g.id, g.name, null, null
+	from board_groups bg join groups g on g.id = bg.group_id join user_groups ug on ug.group_id = g.id
+	where bg.board_id = $1
+	union all
+	select p.owner_user_id, 3, 'project', null, null, p.id, p.name
+	from boards b join projects p on p.id = b.project_id
+	where b.id = $1 and p.owner_user_id is not null
+	union all
+	select pm.user_id, pm.role, 'project', null, null, p.id, p.name
+	from boards b join projects p on p.id = b.project_id join project_members pm on pm.project_id = p.id
+	where b.id = $1
+	union all
+	select ug.user_id, pg.role, 'project_group', g.id, g.name, p.id, p.name
+	from boards b join projects p on p.id = b.project_id join project_groups pg on pg.project_id = p.id
+		join groups g on g.id = pg.group_id join user_groups ug on ug.group_id = g.id
+	where b.id = $1
+), grants as (
+	select r.* from raw r join boards b on b.id = $1
+	join org_members om on om.org_id = b.org_id and om.user_id = r.user_id
+	join users u on u.id = r.user_id
+	where not u.is_guest or (r.kind in ('owner', 'direct') and not ` + guestExpired + `)
+)
+`
+
+// projectGrants is boardGrants for project $1: org admins, its owner, project_members and attached groups.
+// Guests get no project roles.
+const projectGrants = `with raw as (
+	select om.user_id, 3 as role, 'org_admin' as kind, null::bigint as group_id, null::text as group_name, null::bigint as project_id, null::text as project_name
+	from projects p join org_members om on om.org_id = p.org_id
+	where p.id = $1 and om.role >= 2
+	union all
+	select p.owner_user_id as user_id, 3 as role, 'owner' as kind, null::bigint as group_id, null::text as group_name, null::bigint as project_id, null::text as project_name
+	from projects p where p.id = $1 and p.owner_user_id is not null
+	union all
+	select pm.user_id, pm.role, 'direct', null, null, null, null
+	from project_members pm where pm.project_id = $1
+	union all
+	select ug.user_id, pg.role, 'group', g.id, g.name, null, null
+	from project_groups pg join groups g on g.id = pg.group_id join user_groups ug on ug.group_id = g.id
+	where pg.project_id = $1
+), grants as (
+	select r.* from raw r join projects p on p.id = $1
+	join org_members om on om.org_id = p.org_id and om.user_id = r.user_id
+	join users u on u.id = r.user_id
+	where not u.is_guest
+)
+`
+
+// grantSources aggregates the grants rows in scope into a JSON array of AccessSource.
+const grantSources = `coalesce(json_agg(json_build_object('kind', g.kind, 'role', g.role, 'group_id', g.group_id,
+	'group_name', g.group_name, 'project_id', g.project_id, 'project_name', g.project_name) order by g.role desc, g.kind), '[]')`
+
+// members runs a grants CTE ($1 = board or project id) and returns one Member per user.
+func (s *Store) members(ctx context.Context, grants string, id int64) ([]Member, error) {
+	rows, err := s.db.QueryContext(ctx, grants+`
+		select u.id, u.email, u.name, coalesce(u.avatar_url,''), u.is_active, u.is_admin, coalesce(u.email_verified,false), u.created_at,
+			max(g.role), bool_or(g.kind = 'direct'), `+grantSources+`
+		from grants g join users u on u.id = g.user_id
+		group by u.id
+		order by u.email`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Member{}
+	for rows.Next() {
+		var m Member
+		var src []byte
+		if err := rows.Scan(&m.ID, &m.Email, &m.Name, &m.AvatarURL, &m.IsActive, &m.IsAdmin, &m.EmailVerified, &m.CreatedAt, &m.Role, &m.Direct, &src); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(src, &m.Sources); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// access returns the user's grants on a board or project; ErrNotFound when table has no row id.
+func (s *Store) access(ctx context.Context, grants, table string, id, userID int64) (Role, []AccessSource, error) {
+	var exists bool
+	var src []byte
+	err := s.db.QueryRowContext(ctx, grants+`
+		select exists(select 1 from `+table+` where id = $1),
+			(select `+grantSources+` from grants g where g.user_id = $2)`, id, userID).Scan(&exists, &src)
+	if err != nil {
+		return RoleNone, nil, err
+	}
+	if !exists {
+		return RoleNone, nil, ErrNotFound
+	}
+	var sources []AccessSource
+	if err := json.Unmarshal(src, &sources); err != nil {
+		return RoleNone, nil, err
+	}
+	role := RoleNone
+	for _, src := range sources {
+		role = max(role, src.Role)
+	}
+	return role, sources, nil
+}
+
+// BoardMembers returns every user with a role on the board, with the effective
+// (highest) role and where it comes from.
+func (s *Store) BoardMembers(ctx context.Context, boardID int64) ([]Member, error) {
+	return s.members(ctx, boardGrants, boardID)
+}
+
+// BoardAccess returns the user's effective role on a board and the grants behind it.
+func (s *Store) BoardAccess(ctx context.Context, userID, boardID int64) (Role, []AccessSource, error) {
+	return s.access(ctx, boardGrants, "boards", boardID, userID)
+}
+
+// ProjectAccess is BoardAccess for projects.
+func (s *Store) ProjectAccess(ctx context.Context, userID, projectID int64) (Role, []AccessSource, error) {
+	return s.access(ctx, projectGrants, "projects", projectID, userID)
+}
+
+// DirectBoardRole returns the role from board_members, ErrNotFound if the user isn't a direct member.
+func (s *Store) DirectBoardRole(ctx context.Context, boardID, userID int64) (Role, error) {
+	var role int
+	err := s.db.QueryRowContext(ctx, `select role from board_members where board_id=$1 and user_id=$2`, boardID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return RoleNone, ErrNotFound
+	}
+	return Role(role), err
+}
+
+// AddBoardMember adds or updates a direct board member; addedBy 0 leaves added_by empty.
+func (s *Store) AddBoardMember(ctx context.Context, boardID, userID int64, role Role, addedBy int64) error {
+	var by any
+	if addedBy != 0 {
+		by = addedBy
+	}
+	_, err := s.db.ExecContext(ctx, `insert into board_members(board_id, user_id, role, added_by) values($1,$2,$3,$4)
+		on conflict (board_id, user_id) do update set role=excluded.role`, boardID, userID, int(role), by)
+	return err
+}
+
+func (s *Store) SetBoardMemberRole(ctx context.Context, boardID, userID int64, role Role) error {
+	res, err := s.db.ExecContext(ctx, `update board_members set role=$3 where board_id=$1 and user_id=$2`, boardID, userID, int(role))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) RemoveBoardMember(ctx context.Context, boardID, userID int64) error {
+	res, err := s.db.ExecContext(ctx, `delete from board_members where board_id=$1 and user_id=$2`, boardID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TransferBoardOwnership makes newOwner the board's created_by. The previous owner stays
+// on the board as a direct Maintainer; the new owner's direct membership is dropped.
+func (s *Store) TransferBoardOwnership(ctx context.Context, boardID, newOwner int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var prev sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `select created_by from boards where id=$1 for update`, boardID).Scan(&prev); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `update boards set created_by=$2 where id=$1`, boardID, newOwner); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `delete from board_members where board_id=$1 and user_id=$2`, boardID, newOwner); err != nil {
+		return err
+	}
+	if prev.Valid && prev.Int64 != newOwner {
+		if _, err := tx.ExecContext(ctx, `insert into board_members(board_id, user_id, role, added_by) values($1,$2,$3,$4)
+			on conflict (board_id, user_id) do update set role=excluded.role`, boardID, prev.Int64, int(RoleMaintainer), newOwner); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// --- Invitations ---
+
+const inviteCols = `i.id, i.token, case when i.board_id is not null then 'board' when i.project_id is not null then 'project' else 'group' end,
+	coalesce(i.board_id, i.project_id, i.group_id), i.role, coalesce(i.email,''), i.created_by, coalesce(u.name,''), i.created_at, i.expires_at, i.accepted_at, i.uses,
+	i.guest, i.guest_expires_at`
+
+func scanInvite(sc interface{ Scan(...any) error }) (Invite, error) {
+	var inv Invite
+	var by sql.NullInt64
+	var accepted sql.NullTime
+	err := sc.Scan(&inv.ID, &inv.Token, &inv.Kind, &inv.TargetID, &inv.Role, &inv.Email, &by, &inv.CreatedByName, &inv.CreatedAt, &inv.ExpiresAt, &accepted, &inv.Uses,
+		&inv.Guest, &inv.GuestExpiresAt)
+	if by.Valid {
+		inv.CreatedBy = &by.Int64
+	}
+	if accepted.Valid {
+		inv.AcceptedAt = &accepted.Time
+	}
+	return inv, err
+}
+
+// inviteTargetColumn maps an invite kind to its target column; unknown kinds yield "".
+func inviteTargetColumn(kind string) string {
+	switch kind {
+	case "board":
+		return "board_id"
+	case "project":
+		return "project_id"
+	case "group":
+		return "group_id"
+	}
+	return ""
+}
+
+// CreateInvite stores a new invitation; inv.Email empty means a reusable link.
+func (s *Store) CreateInvite(ctx context.Context, inv Invite) (Invite, error) {
+	col := inviteTargetColumn(inv.Kind)
+	if col == "" {
+		return Invite{}, errors.New("invalid invite kind")
+	}
+	var email any
+	if inv.Email != "" {
+		email = strings.ToLower(inv.Email)
+	}
+	var id int64
+	err := s.db.QueryRowContext(ctx, fmt.Sprintf(`insert into invites(token, %s, role, email, created_by, expires_at, guest, guest_expires_at) values($1,$2,$3,$4,$5,$6,$7,$8) returning id`, col),
+		inv.Token, inv.TargetID, inv.Role, email, inv.CreatedBy, inv.ExpiresAt, inv.Guest, inv.GuestExpiresAt).Scan(&id)
+	if err != nil {
+		return Invite{}, err
+	}
+	return s.InviteByID(ctx, id)
+}
+
+func (s *Store) InviteByID(ctx context.Context, id int64) (Invite, error) {
+	inv, err := scanInvite(s.db.QueryRowContext(ctx, `select `+inviteCols+` from invites i left join users u on u.id=i.created_by where i.id=$1`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Invite{}, ErrNotFound
+	}
+	return inv, err
+}
+
+// InviteByToken returns a pending invitation: not expired and, for email invites, not yet accepted.
+func (s *Store) InviteByToken(ctx context.Context, token string) (Invite, error) {
+	inv, err := scanInvite(s.db.QueryRowContext(ctx, `select `+inviteCols+` from invites i left join users u on u.id=i.created_by
+		where i.token=$1 and i.expires_at > now() and i.accepted_at is null`, token))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Invite{}, ErrNotFound
+	}
+	return inv, err
+}
+
+// ListInvites returns the pending invitations for a board, project or group.
+func (s *Store) ListInvites(ctx context.Context, kind string, targetID int64) ([]Invite, error) {
+	col := inviteTargetColumn(kind)
+	if col == "" {
+		return nil, errors.New("invalid invite kind")
+	}
+	rows, err := s.db.QueryContext(ctx, `select `+inviteCols+` from invites i left join users u on u.id=i.created_by
+		where i.`+col+`=$1 and i.expires_at > now() and i.accepted_at is null order by i.created_at desc`, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Invite{}
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, inv)
+	}
+	return out, rows.Err()
+}
+
+// PendingInvitesForEmail returns unexpired, unaccepted email invitations addressed to email.
+func (s *Store) PendingInvitesForEmail(ctx context.Context, email string) ([]Invite, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+inviteCols+` from invites i left join users u on u.id=i.created_by
+		where i.email=lower($1) and i.expires_at > now() and i.accepted_at is null order by i.id`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Invite
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, inv)
+	}
+	return out, rows.Err()
+}
+
+// UseInvite records an acceptance: email invites are single-use and get closed,
+// links only count their uses.
+func (s *Store) UseInvite(ctx context.Context, id, userID int64) error {
+	_, err := s.db.ExecContext(ctx, `update invites set uses=uses+1,
+		accepted_at=case when email is not null then now() else accepted_at end,
+		accepted_by=case when email is not null then $2 else accepted_by end
+		where id=$1`, id, userID)
+	return err
+}
+
+func (s *Store) DeleteInvite(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `delete from invites where id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// InviteTargetName returns the board title, project or group name an invitation points to.
+func (s *Store) InviteTargetName(ctx context.Context, kind string, id int64) (string, error) {
+	q := map[string]string{
+		"board":   `select title from boards where id=$1`,
+		"project": `select name from projects where id=$1`,
+		"group":   `select name from groups where id=$1`,
+	}[kind]
+	if q == "" {
+		return "", ErrNotFound
+	}
+	var name string
+	err := s.db.QueryRowContext(ctx, q, id).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return name, err
+}
+
+// AddUserToGroupRole adds a user to a group with a role (1 member, 2 admin) without
+// downgrading an existing membership.
+func (s *Store) AddUserToGroupRole(ctx context.Context, groupID, userID int64, role int) error {
+	if err := s.joinGroupOrg(ctx, s.db, groupID, userID); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `insert into user_groups(user_id, group_id, role) values($1,$2,$3)
+		on conflict (user_id, group_id) do update set role=greatest(user_groups.role, excluded.role)`, userID, groupID, role)
+	return err
+}
+
+// --- Organizations ---
+
+// execer is implemented by *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// DefaultOrgID returns the id of the default organization.
+func (s *Store) DefaultOrgID() int64 { return s.defaultOrg }
+
+const orgCols = `o.id, o.name, o.is_default, o.created_at`
+
+// ListOrgs returns the user's organizations with their role, or every organization when
+// all is set (instance admins; Role stays 0 where they aren't a member). Default first.
+func (s *Store) ListOrgs(ctx context.Context, userID int64, all bool) ([]Org, error) {
+	rows, err := s.db.QueryContext(ctx, `select `+orgCols+`, coalesce(om.role, 0)
+		from orgs o left join org_members om on om.org_id = o.id and om.user_id = $1
+		where $2 or om.user_id is not null
+		order by o.is_default desc, lower(o.name), o.id`, userID, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Org{}
+	for rows.Next() {
+		var o Org
+		if err := rows.Scan(&o.ID, &o.Name, &o.IsDefault, &o.CreatedAt, &o.Role); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, rows.Err()
+}
+
+func (s *Store) GetOrg(ctx context.Context, id int64) (Org, error) {
+	var o Org
+	err := s.db.QueryRowContext(ctx, `select `+orgCols+` from orgs o where o.id=$1`, id).Scan(&o.ID, &o.Name, &o.IsDefault, &o.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Org{}, ErrNotFound
+	}
+	return o, err
+}
+
+// OrgRole returns the user's role in the organization, ErrNotFound if they aren't a member.
+func (s *Store) OrgRole(ctx context.Context, orgID, userID int64) (int, error) {
+	var role int
+	err := s.db.QueryRowContext(ctx, `select role from org_members where org_id=$1 and user_id=$2`, orgID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return role, err
+}
+
+// CreateOrg creates an organization with ownerID as its owner.
+func (s *Store) CreateOrg(ctx context.Context, name string, ownerID int64) (Org, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Org{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var o Org
+	if err := tx.QueryRowContext(ctx, `insert into orgs(name) values($1) returning id, name, is_default, created_at`, name).
+		Scan(&o.ID, &o.Name, &o.IsDefault, &o.CreatedAt); err != nil {
+		return Org{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `insert into org_members(org_id, user_id, role) values($1,$2,$3)`, o.ID, ownerID, OrgRoleOwner); err != nil {
+		return Org{}, err
+	}
+	o.Role = OrgRoleOwner
+	return o, tx.Commit()
+}
+
+func (s *Store) RenameOrg(ctx context.Context, id int64, name string) error {
+	res, err := s.db.ExecContext(ctx, `update orgs set name=$2 where id=$1`, id, name)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	var out []Board
-	for rows.Next() {
-		var b Board
-		if err := rows.Scan(&b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.ProjectID, &b.CreatedBy, &b.ViaGroup); err != nil {
-			return nil, err
-		}
-		out = append(out, b)
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
 	}
-	return out, rows.Err()
+	return nil
 }
 
-func (s *Store) CreateBoard(ctx context.Context, userID int64, title string) (Board, error) {
-	var next int64 = 1000
-	_ = s.db.QueryRowContext(ctx, `select coalesce(max(pos),0)+1000 from boards`).Scan(&next)
-	var b Board
-	err := s.db.QueryRowContext(ctx, `insert into boards(title, pos, created_by) values($1,$2,$3) returning id, title, coalesce(color,''), created_at, created_by`, title, next, userID).
-		Scan(&b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.CreatedBy)
-	return b, err
+// DeleteOrg deletes an organization with all of its boards, projects and groups.
+// The default organization can't be deleted (ErrNotFound).
+func (s *Store) DeleteOrg(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `delete from orgs where id=$1 and not is_default`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-// Projects
-func (s *Store) ListProjects(ctx context.Context, userID int64) ([]Project, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		select p.id, p.name, p.owner_user_id, p.created_at
-		from projects p
-		left join project_members pm on pm.project_id = p.id and pm.user_id = $1
-		where p.owner_user_id = $1 or pm.user_id is not null
-		order by p.created_at desc, p.id desc`, userID)
+func (s *Store) OrgMembers(ctx context.Context, orgID int64) ([]OrgMember, error) {
+	rows, err := s.db.QueryContext(ctx, `select u.id, u.email, u.name, coalesce(u.avatar_url,''), u.is_active, u.is_admin, coalesce(u.email_verified,false), u.created_at, om.role
+		from org_members om join users u on u.id = om.user_id where om.org_id=$1 order by om.role desc, u.email`, orgID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var out []Project
+	out := []OrgMember{}
 	for rows.Next() {
-		var p Project
-		if err := rows.Scan(&p.ID, &p.Name, &p.OwnerID, &p.CreatedAt); err != nil {
+		var m OrgMember
+		if err := rows.Scan(&m.ID, &m.Email, &m.Name, &m.AvatarURL, &m.IsActive, &m.IsAdmin, &m.EmailVerified, &m.CreatedAt, &m.Role); err != nil {
 			return nil, err
 		}
-		out = append(out, p)
+		out = append(out, m)
 	}
 	return out, rows.Err()
 }
 
-func (s *Store) CreateProject(ctx context.Context, ownerID int64, name string) (Project, error) {
-	var p Project
-	err := s.db.QueryRowContext(ctx, `insert into projects(name, owner_user_id) values($1,$2) returning id, name, owner_user_id, created_at`, name, ownerID).
-		Scan(&p.ID, &p.Name, &p.OwnerID, &p.CreatedAt)
-	return p, err
+// JoinOrg adds the user to the organization with role; existing members keep their role.
+func (s *Store) JoinOrg(ctx context.Context, orgID, userID int64, role int) error {
+	_, err := s.db.ExecContext(ctx, `insert into org_members(org_id, user_id, role) values($1,$2,$3) on conflict do nothing`, orgID, userID, role)
+	return err
 }
 
-func (s *Store) AddProjectMember(ctx context.Context, projectID, userID int64, role int) error {
-	if role <= 0 {
-		role = 2
+// SetOrgMemberRole changes a member's org role, ErrNotFound for non-members.
+func (s *Store) SetOrgMemberRole(ctx context.Context, orgID, userID int64, role int) error {
+	res, err := s.db.ExecContext(ctx, `update org_members set role=$3 where org_id=$1 and user_id=$2`, orgID, userID, role)
+	if err != nil {
+		return err
 	}
-	_, err := s.db.ExecContext(ctx, `insert into project_members(project_id, user_id, role) values($1,$2,$3)
-		on conflict (project_id, user_id) do update set role=excluded.role`, projectID, userID, role)
-	return err
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-func (s *Store) RemoveProjectMember(ctx context.Context, projectID, userID int64) error {
-	_, err := s.db.ExecContext(ctx, `delete from project_members where project_id=$1 and user_id=$2`, projectID, userID)
-	return err
+// OrgOwners counts the owners of an organization.
+func (s *Store) OrgOwners(ctx context.Context, orgID int64) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `select count(*) from org_members where org_id=$1 and role>=$2`, orgID, OrgRoleOwner).Scan(&n)
+	return n, err
 }
 
-func (s *Store) ProjectMembers(ctx context.Context, projectID int64) ([]User, error) {
-	rows, err := s.db.QueryContext(ctx, `select u.id, u.email, u.name, coalesce(u.avatar_url,''), u.is_active, u.is_admin, coalesce(u.email_verified,false), u.created_at
-		from project_members pm join users u on u.id = pm.user_id where pm.project_id=$1 order by u.email`, projectID)
+// RemoveOrgMember removes the user from the organization together with their group, board
+// and project memberships there. Boards and projects they own stay (and become unreachable
+// for them) until ownership is transferred.
+func (s *Store) RemoveOrgMember(ctx context.Context, orgID, userID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var out []User
-	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.CreatedAt); err != nil {
-			return nil, err
-		}
-		out = append(out, u)
+		return err
 	}
-	return out, rows.Err()
-}
-
-// BoardMembers returns distinct users who have access/participate in the board:
-// - board owner
-// - users from groups that have access to the board
-// - project owner and project members, if the board is linked to a project
-func (s *Store) BoardMembers(ctx context.Context, boardID int64) ([]User, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		with owners as (
-			select u.id, u.email, u.name, coalesce(u.avatar_url,'') as avatar_url, u.is_active, u.is_admin, coalesce(u.email_verified,false) as email_verified, u.created_at
-			from boards b join users u on u.id = b.created_by
-			where b.id = $1
-		),
-		via_groups as (
-			select u.id, u.email, u.name, coalesce(u.avatar_url,'') as avatar_url, u.is_active, u.is_admin, coalesce(u.email_verified,false) as email_verified, u.created_at
-			from board_groups bg
-			join user_groups ug on ug.group_id = bg.group_id
-			join users u on u.id = ug.user_id
-			where bg.board_id = $1
-		),
-		project_side as (
-			select u.id, u.email, u.name, coalesce(u.avatar_url,'') as avatar_url, u.is_active, u.is_admin, coalesce(u.email_verified,false) as email_verified, u.created_at
-			from boards b
-			join projects p on p.id = b.project_id
-			join users u on u.id = p.owner_user_id
-			where b.id = $1 and b.project_id is not null
-			union
-			select u.id, u.email, u.name, coalesce(u.avatar_url,'') as avatar_url, u.is_active, u.is_admin, coalesce(u.email_verified,false) as email_verified, u.created_at
-			from boards b
-			join project_members pm on pm.project_id = b.project_id
-			join users u on u.id = pm.user_id
-			where b.id = $1 and b.project_id is not null
-		)
-		select distinct id, email, name, avatar_url, is_active, is_admin, email_verified, created_at
-		from (
-			select * from owners
-			union all
-			select * from via_groups
-			union all
-			select * from project_side
-		) allu
-		order by email
-	`, boardID)
+	defer func() { _ = tx.Rollback() }()
+	res, err := tx.ExecContext(ctx, `delete from org_members where org_id=$1 and user_id=$2`, orgID, userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	var out []User
-	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.CreatedAt); err != nil {
-			return nil, err
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	for _, q := range []string{
+		`delete from user_groups where user_id=$2 and group_id in (select id from groups where org_id=$1)`,
+		`delete from board_members where user_id=$2 and board_id in (select id from boards where org_id=$1)`,
+		`delete from project_members where user_id=$2 and project_id in (select id from projects where org_id=$1)`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, orgID, userID); err != nil {
+			return err
 		}
-		out = append(out, u)
 	}
-	return out, rows.Err()
+	return tx.Commit()
 }
 
-func (s *Store) SetBoardProject(ctx context.Context, boardID, projectID int64) error {
-	_, err := s.db.ExecContext(ctx, `update boards set project_id=$1 where id=$2`, projectID, boardID)
-	return err
+// orgOfQueries resolves the organization of a board, project, group, list or card.
+var orgOfQueries = map[string]string{
+	"board":   `select org_id from boards where id=$1`,
+	"project": `select org_id from projects where id=$1`,
+	"group":   `select org_id from groups where id=$1`,
+	"list":    `select b.org_id from lists l join boards b on b.id = l.board_id where l.id=$1`,
+	"card":    `select b.org_id from cards c join lists l on l.id = c.list_id join boards b on b.id = l.board_id where c.id=$1`,
 }
 
-func (s *Store) IsProjectOwner(ctx context.Context, projectID, userID int64) (bool, error) {
-	var x int
-	err := s.db.QueryRowContext(ctx, `select 1 from projects where id=$1 and owner_user_id=$2`, projectID, userID).Scan(&x)
+// OrgOf returns the organization id of the entity kind/id, ErrNotFound if it doesn't exist.
+func (s *Store) OrgOf(ctx context.Context, kind string, id int64) (int64, error) {
+	q, ok := orgOfQueries[kind]
+	if !ok {
+		return 0, fmt.Errorf("org of unknown kind %q", kind)
+	}
+	var orgID int64
+	err := s.db.QueryRowContext(ctx, q, id).Scan(&orgID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return false, nil
+		return 0, ErrNotFound
 	}
-	return err == nil, err
+	return orgID, err
 }
 
-func (s *Store) CanAccessProject(ctx context.Context, projectID, userID int64) (bool, error) {
-	var x int
-	if err := s.db.QueryRowContext(ctx, `select 1 from projects where id=$1 and owner_user_id=$2`, projectID, userID).Scan(&x); err == nil {
-		return true, nil
+// SetBoardProject moves a board into a project; projectID 0 detaches it.
+func (s *Store) SetBoardProject(ctx context.Context, boardID, projectID int64) error {
+	var pid any
+	if projectID != 0 {
+		pid = projectID
 	}
-	err := s.db.QueryRowContext(ctx, `select 1 from project_members where project_id=$1 and user_id=$2`, projectID, userID).Scan(&x)
-	if errors.Is(err, sql.ErrNoRows) {
-		return false, nil
+	res, err := s.db.ExecContext(ctx, `update boards set project_id=$1 where id=$2`, pid, boardID)
+	if err != nil {
+		return err
 	}
-	return err == nil, err
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
 func (s *Store) GetBoard(ctx context.Context, id int64) (Board, error) {
 	var b Board
-	err := s.db.QueryRowContext(ctx, `select id, title, coalesce(color,''), created_at, project_id, created_by from boards where id=$1`, id).
-		Scan(&b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.ProjectID, &b.CreatedBy)
+	err := s.db.QueryRowContext(ctx, `select id, title, coalesce(color,''), created_at, project_id, created_by, org_id, version from boards where id=$1`, id).
+		Scan(&b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.ProjectID, &b.CreatedBy, &b.OrgID, &b.Version)
 	if errors.Is(err, sql.ErrNoRows) {
 		return Board{}, ErrNotFound
 	}
 	return b, err
 }
 
-func (s *Store) UpdateBoard(ctx context.Context, id int64, title string) error {
-	res, err := s.db.ExecContext(ctx, `update boards set title=$1 where id=$2`, title, id)
+// UpdateBoard sets the board's title and color (nil: unchanged) and bumps its version in
+// the same transaction, checked against ifVersion unless that is 0 (see PatchCard).
+func (s *Store) UpdateBoard(ctx context.Context, id, ifVersion int64, title, color *string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
-		return ErrNotFound
+	defer func() { _ = tx.Rollback() }()
+	version, err := bumpVersion(ctx, tx, "board", id, ifVersion)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	if _, err := tx.ExecContext(ctx, `update boards set title=coalesce($1,title), color=coalesce($2,color) where id=$3`, title, color, id); err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
 }
 
 func (s *Store) DeleteBoard(ctx context.Context, id int64) error {
@@ -271,7 +1001,7 @@ func (s *Store) DeleteBoard(ctx context.Context, id int64) error {
 
 func (s *Store) ListsByBoard(ctx context.Context, boardID int64) ([]List, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`select id, board_id, title, coalesce(color,''), pos, created_at from lists where board_id=$1 order by pos, id`, boardID)
+		`select id, board_id, title, coalesce(color,''), pos, created_at, version from lists where board_id=$1 order by pos, id`, boardID)
 	if err != nil {
 		return nil, err
 	}
@@ -279,7 +1009,7 @@ func (s *Store) ListsByBoard(ctx context.Context, boardID int64) ([]List, error)
 	var out []List
 	for rows.Next() {
 		var l List
-		if err := rows.Scan(&l.ID, &l.BoardID, &l.Title, &l.Color, &l.Pos, &l.CreatedAt); err != nil {
+		if err := rows.Scan(&l.ID, &l.BoardID, &l.Title, &l.Color, &l.Pos, &l.CreatedAt, &l.Version); err != nil {
 			return nil, err
 		}
 		out = append(out, l)
@@ -292,39 +1022,34 @@ func (s *Store) CreateList(ctx context.Context, boardID int64, title string) (Li
 	_ = s.db.QueryRowContext(ctx, `select coalesce(max(pos),0)+1000 from lists where board_id=$1`, boardID).Scan(&next)
 	var l List
 	err := s.db.QueryRowContext(ctx,
-		`insert into lists(board_id, title, pos) values($1,$2,$3) returning id, board_id, title, coalesce(color,''), pos, created_at`,
+		`insert into lists(board_id, title, pos) values($1,$2,$3) returning id, board_id, title, coalesce(color,''), pos, created_at, version`,
 		boardID, title, next).
-		Scan(&l.ID, &l.BoardID, &l.Title, &l.Color, &l.Pos, &l.CreatedAt)
+		Scan(&l.ID, &l.BoardID, &l.Title, &l.Color, &l.Pos, &l.CreatedAt, &l.Version)
 	return l, err
 }
 
-func (s *Store) UpdateList(ctx context.Context, id int64, title *string, pos *int64) error {
-	if title == nil && pos == nil {
-		return nil
+// UpdateList sets the list's title, pos and color (nil: unchanged) and bumps its version
+// in the same transaction, checked against ifVersion unless that is 0 (see PatchCard).
+func (s *Store) UpdateList(ctx context.Context, id, ifVersion int64, title *string, pos *int64, color *string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
 	}
-	if title != nil && pos != nil {
-		_, err := s.db.ExecContext(ctx, `update lists set title=$1, pos=$2 where id=$3`, *title, *pos, id)
-		if err != nil {
-			return err
-		}
-	} else if title != nil {
-		_, err := s.db.ExecContext(ctx, `update lists set title=$1 where id=$2`, *title, id)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err := s.db.ExecContext(ctx, `update lists set pos=$1 where id=$2`, *pos, id)
-		if err != nil {
-			return err
-		}
+	defer func() { _ = tx.Rollback() }()
+	version, err := bumpVersion(ctx, tx, "list", id, ifVersion)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	if _, err := tx.ExecContext(ctx, `update lists set title=coalesce($1,title), pos=coalesce($2,pos), color=coalesce($3,color) where id=$4`, title, pos, color, id); err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
 }
 
 func (s *Store) GetList(ctx context.Context, id int64) (List, error) {
 	var l List
-	err := s.db.QueryRowContext(ctx, `select id, board_id, title, coalesce(color,''), pos, created_at from lists where id=$1`, id).
-		Scan(&l.ID, &l.BoardID, &l.Title, &l.Color, &l.Pos, &l.CreatedAt)
+	err := s.db.QueryRowContext(ctx, `select id, board_id, title, coalesce(color,''), pos, created_at, version from lists where id=$1`, id).
+		Scan(&l.ID, &l.BoardID, &l.Title, &l.Color, &l.Pos, &l.CreatedAt, &l.Version)
 	if errors.Is(err, sql.ErrNoRows) {
 		return List{}, ErrNotFound
 	}
@@ -345,7 +1070,7 @@ func (s *Store) DeleteList(ctx context.Context, id int64) error {
 
 func (s *Store) CardsByList(ctx context.Context, listID int64) ([]Card, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`select id, list_id, parent_card_id, title, description, coalesce(color,''), pos, due_at, assignee_user_id, created_at, coalesce(description_is_md,false)
+		`select id, list_id, parent_card_id, title, description, coalesce(color,''), pos, due_at, assignee_user_id, created_at, coalesce(description_is_md,false), version
 	 from cards where list_id=$1 order by pos, id`, listID)
 	if err != nil {
 		return nil, err
@@ -354,7 +1079,7 @@ func (s *Store) CardsByList(ctx context.Context, listID int64) ([]Card, error) {
 	var out []Card
 	for rows.Next() {
 		var c Card
-		if err := rows.Scan(&c.ID, &c.ListID, &c.ParentID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.AssigneeUserID, &c.CreatedAt, &c.DescriptionIsMD); err != nil {
+		if err := rows.Scan(&c.ID, &c.ListID, &c.ParentID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.AssigneeUserID, &c.CreatedAt, &c.DescriptionIsMD, &c.Version); err != nil {
 			return nil, err
 		}
 		out = append(out, c)
@@ -368,17 +1093,18 @@ func (s *Store) CreateCard(ctx context.Context, listID int64, title, description
 	var c Card
 	err := s.db.QueryRowContext(ctx,
 		`insert into cards(list_id, title, description, pos, description_is_md) values($1,$2,$3,$4,$5)
-	  returning id, list_id, parent_card_id, title, description, coalesce(color,''), pos, due_at, assignee_user_id, created_at, coalesce(description_is_md,false)`,
+	  returning id, list_id, parent_card_id, title, description, coalesce(color,''), pos, due_at, assignee_user_id, created_at, coalesce(description_is_md,false), version`,
 		listID, title, description, next, isMD).
-		Scan(&c.ID, &c.ListID, &c.ParentID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.AssigneeUserID, &c.CreatedAt, &c.DescriptionIsMD)
+		Scan(&c.ID, &c.ListID, &c.ParentID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.AssigneeUserID, &c.CreatedAt, &c.DescriptionIsMD, &c.Version)
 	return c, err
 }
 
 // --- Groups & board visibility ---
-func (s *Store) MyGroups(ctx context.Context, userID int64) ([]Group, error) {
+// MyGroups lists the user's groups in organization orgID with their group role.
+func (s *Store) MyGroups(ctx context.Context, userID, orgID int64) ([]Group, error) {
 	rows, err := s.db.QueryContext(ctx, `select g.id, g.name, g.created_at, ug.role
 		from groups g join user_groups ug on ug.group_id = g.id
-		where ug.user_id=$1 order by g.name`, userID)
+		where ug.user_id=$1 and g.org_id=$2 order by g.name`, userID, orgID)
 	if err != nil {
 		return nil, err
 	}
@@ -457,15 +1183,6 @@ func (s *Store) RemoveBoardFromGroup(ctx context.Context, boardID, groupID int64
 	return err
 }
 
-func (s *Store) IsBoardOwner(ctx context.Context, boardID, userID int64) (bool, error) {
-	var x int
-	err := s.db.QueryRowContext(ctx, `select 1 from boards where id=$1 and created_by=$2`, boardID, userID).Scan(&x)
-	if errors.Is(err, sql.ErrNoRows) {
-		return false, nil
-	}
-	return err == nil, err
-}
-
 func (s *Store) IsUserInGroup(ctx context.Context, userID, groupID int64) (bool, error) {
 	var x int
 	err := s.db.QueryRowContext(ctx, `select 1 from user_groups where user_id=$1 and group_id=$2`, userID, groupID).Scan(&x)
@@ -493,21 +1210,22 @@ func (s *Store) ListGroups(ctx context.Context) ([]Group, error) {
 	return out, rows.Err()
 }
 
-func (s *Store) CreateGroup(ctx context.Context, name string) (Group, error) {
+// CreateGroup creates a group without members in organization orgID (admin panel, SCIM).
+func (s *Store) CreateGroup(ctx context.Context, orgID int64, name string) (Group, error) {
 	var g Group
-	err := s.db.QueryRowContext(ctx, `insert into groups(name) values($1) returning id, name, created_at`, name).Scan(&g.ID, &g.Name, &g.CreatedAt)
+	err := s.db.QueryRowContext(ctx, `insert into groups(name, org_id) values($1,$2) returning id, name, created_at`, name, orgID).Scan(&g.ID, &g.Name, &g.CreatedAt)
 	return g, err
 }
 
-// CreateGroupOwned creates a group and adds the owner as admin (role=2)
-func (s *Store) CreateGroupOwned(ctx context.Context, ownerID int64, name string) (Group, error) {
+// CreateGroupOwned creates a group in organization orgID and adds the owner as admin (role=2)
+func (s *Store) CreateGroupOwned(ctx context.Context, orgID, ownerID int64, name string) (Group, error) {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return Group{}, err
 	}
 	defer func() { _ = tx.Rollback() }()
 	var g Group
-	if err := tx.QueryRowContext(ctx, `insert into groups(name) values($1) returning id, name, created_at`, name).Scan(&g.ID, &g.Name, &g.CreatedAt); err != nil {
+	if err := tx.QueryRowContext(ctx, `insert into groups(name, org_id) values($1,$2) returning id, name, created_at`, name, orgID).Scan(&g.ID, &g.Name, &g.CreatedAt); err != nil {
 		return Group{}, err
 	}
 	// role: 2 = admin, 1 = member
@@ -549,20 +1267,269 @@ func (s *Store) GroupUsers(ctx context.Context, groupID int64) ([]User, error) {
 	return out, rows.Err()
 }
 
+// AddUserToGroup adds the user as a member; they also join the group's organization.
 func (s *Store) AddUserToGroup(ctx context.Context, groupID, userID int64) error {
+	if err := s.joinGroupOrg(ctx, s.db, groupID, userID); err != nil {
+		return err
+	}
 	// default role=1 (member) when not specified
 	_, err := s.db.ExecContext(ctx, `insert into user_groups(user_id, group_id, role) values($1,$2,1)
 		on conflict (user_id, group_id) do update set role=coalesce(user_groups.role,1)`, userID, groupID)
 	return err
 }
 
+// joinGroupOrg makes the user a member of the group's organization if they aren't one yet.
+func (s *Store) joinGroupOrg(ctx context.Context, db execer, groupID, userID int64) error {
+	_, err := db.ExecContext(ctx, `insert into org_members(org_id, user_id, role)
+		select org_id, $2, 1 from groups where id=$1 on conflict do nothing`, groupID, userID)
+	return err
+}
+
 func (s *Store) RemoveUserFromGroup(ctx context.Context, groupID, userID int64) error {
 	_, err := s.db.ExecContext(ctx, `delete from user_groups where user_id=$1 and group_id=$2`, userID, groupID)
 	return err
 }
 
-// ListUsers returns users filtered by query (ILIKE on email or name). Limit is capped to [1,200].
-func (s *Store) ListUsers(ctx context.Context, query string, limit int) ([]User, error) {
+// SyncManagedGroups makes the user's membership in the externally managed groups
+// (by name, in organization orgID) match member: missing groups are created, the user
+// is added to those in member and removed from the other managed ones. Unmanaged
+// groups and groups of other organizations are untouched.
+func (s *Store) SyncManagedGroups(ctx context.Context, orgID, userID int64, managed, member []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	isMember := map[string]bool{}
+	for _, g := range member {
+		isMember[g] = true
+	}
+	for _, name := range managed {
+		var gid int64
+		if err := tx.QueryRowContext(ctx, `insert into groups(name, org_id) values($1,$2) on conflict (org_id, name) do update set name=excluded.name returning id`, name, orgID).Scan(&gid); err != nil {
+			return err
+		}
+		if isMember[name] {
+			if err := s.joinGroupOrg(ctx, tx, gid, userID); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `insert into user_groups(user_id, group_id, role) values($1,$2,1) on conflict (user_id, group_id) do nothing`, userID, gid)
+		} else {
+			_, err = tx.ExecContext(ctx, `delete from user_groups where user_id=$1 and group_id=$2`, userID, gid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ScimCond is one "attr op value" term of a SCIM filter; terms are AND-ed.
+// Attr is a lowercased attribute path, Op one of eq, ne, co, sw, ew, pr.
+type ScimCond struct {
+	Attr  string
+	Op    string
+	Value string
+}
+
+// scimUserColumns and scimGroupColumns map filterable SCIM attributes to SQL.
+var scimUserColumns = map[string]string{
+	"id":             "u.id::text",
+	"username":       "u.email",
+	"emails":         "u.email",
+	"emails.value":   "u.email",
+	"externalid":     "u.scim_external_id",
+	"displayname":    "u.name",
+	"name.formatted": "u.name",
+	"active":         "u.is_active::text",
+}
+
+var scimGroupColumns = map[string]string{
+	"id":            "g.id::text",
+	"displayname":   "g.name",
+	"externalid":    "g.scim_external_id",
+	"members":       "members",
+	"members.value": "members",
+}
+
+// scimWhere renders conds as a SQL condition, appending bind values to args.
+func scimWhere(columns map[string]string, conds []ScimCond, args []any) (string, []any, error) {
+	parts := []string{"true"}
+	for _, c := range conds {
+		col, ok := columns[c.Attr]
+		if !ok {
+			return "", nil, fmt.Errorf("%w: unsupported attribute %q", ErrInvalidFilter, c.Attr)
+		}
+		if col == "members" {
+			// group membership is only matchable by user id
+			if c.Op != "eq" {
+				return "", nil, fmt.Errorf("%w: unsupported operator %q for members", ErrInvalidFilter, c.Op)
+			}
+			args = append(args, c.Value)
+			parts = append(parts, fmt.Sprintf("exists (select 1 from user_groups ug where ug.group_id = g.id and ug.user_id::text = $%d)", len(args)))
+			continue
+		}
+		if c.Op == "pr" {
+			parts = append(parts, fmt.Sprintf("coalesce(%s,'') <> ''", col))
+			continue
+		}
+		esc := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(c.Value)
+		var expr string
+		switch c.Op {
+		case "eq":
+			args = append(args, c.Value)
+			expr = "lower(%s) = lower($%d)"
+		case "ne":
+			args = append(args, c.Value)
+			expr = "lower(coalesce(%s,'')) <> lower($%d)"
+		case "co":
+			args = append(args, "%"+esc+"%")
+			expr = "%s ilike $%d"
+		case "sw":
+			args = append(args, esc+"%")
+			expr = "%s ilike $%d"
+		case "ew":
+			args = append(args, "%"+esc)
+			expr = "%s ilike $%d"
+		default:
+			return "", nil, fmt.Errorf("%w: unsupported operator %q", ErrInvalidFilter, c.Op)
+		}
+		parts = append(parts, fmt.Sprintf(expr, col, len(args)))
+	}
+	return strings.Join(parts, " and "), args, nil
+}
+
+// ScimUsers returns a page of users matching conds together with the total match count.
+func (s *Store) ScimUsers(ctx context.Context, conds []ScimCond, offset, limit int) ([]ScimUser, int, error) {
+	where, args, err := scimWhere(scimUserColumns, conds, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from users u where `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, offset, limit)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`select u.id, u.email, u.name, coalesce(u.avatar_url,''), u.is_active, u.is_admin, coalesce(u.email_verified,false), u.created_at, coalesce(u.scim_external_id,'')
+		from users u where %s order by u.id offset $%d limit $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []ScimUser{}
+	for rows.Next() {
+		var su ScimUser
+		u := &su.User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.CreatedAt, &su.ExternalID); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, su)
+	}
+	return out, total, rows.Err()
+}
+
+// ScimUserByID returns a single user with its SCIM externalId.
+func (s *Store) ScimUserByID(ctx context.Context, id int64) (ScimUser, error) {
+	var su ScimUser
+	u := &su.User
+	err := s.db.QueryRowContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, coalesce(email_verified,false), created_at, coalesce(scim_external_id,'')
+		from users where id=$1`, id).
+		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.CreatedAt, &su.ExternalID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ScimUser{}, ErrNotFound
+	}
+	return su, err
+}
+
+// SetUserExternalID stores the identity provider's id for the user; empty clears it.
+func (s *Store) SetUserExternalID(ctx context.Context, id int64, externalID string) error {
+	_, err := s.db.ExecContext(ctx, `update users set scim_external_id=nullif($1,'') where id=$2`, externalID, id)
+	return err
+}
+
+// SetUserActive enables or disables a user. Disabling also ends all of the user's sessions.
+func (s *Store) SetUserActive(ctx context.Context, id int64, active bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	res, err := tx.ExecContext(ctx, `update users set is_active=$1 where id=$2`, active, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if !active {
+		if _, err := tx.ExecContext(ctx, `delete from sessions where user_id=$1`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ScimGroups returns a page of the groups of organization orgID matching conds together
+// with the total match count.
+func (s *Store) ScimGroups(ctx context.Context, orgID int64, conds []ScimCond, offset, limit int) ([]ScimGroup, int, error) {
+	where, args, err := scimWhere(scimGroupColumns, conds, []any{orgID})
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := s.db.QueryRowContext(ctx, `select count(*) from groups g where g.org_id = $1 and `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, offset, limit)
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(`select g.id, g.name, g.created_at, coalesce(g.scim_external_id,'')
+		from groups g where g.org_id = $1 and %s order by g.id offset $%d limit $%d`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	out := []ScimGroup{}
+	for rows.Next() {
+		var sg ScimGroup
+		if err := rows.Scan(&sg.ID, &sg.Name, &sg.CreatedAt, &sg.ExternalID); err != nil {
+			return nil, 0, err
+		}
+		out = append(out, sg)
+	}
+	return out, total, rows.Err()
+}
+
+// ScimGroupByID returns a single group of organization orgID with its SCIM externalId.
+func (s *Store) ScimGroupByID(ctx context.Context, orgID, id int64) (ScimGroup, error) {
+	var sg ScimGroup
+	err := s.db.QueryRowContext(ctx, `select id, name, created_at, coalesce(scim_external_id,'') from groups where id=$1 and org_id=$2`, id, orgID).
+		Scan(&sg.ID, &sg.Name, &sg.CreatedAt, &sg.ExternalID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ScimGroup{}, ErrNotFound
+	}
+	return sg, err
+}
+
+// RenameGroup changes a group's name.
+func (s *Store) RenameGroup(ctx context.Context, id int64, name string) error {
+	res, err := s.db.ExecContext(ctx, `update groups set name=$1 where id=$2`, name, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetGroupExternalID stores the identity provider's id for the group; empty clears it.
+func (s *Store) SetGroupExternalID(ctx context.Context, id int64, externalID string) error {
+	_, err := s.db.ExecContext(ctx, `update groups set scim_external_id=nullif($1,'') where id=$2`, externalID, id)
+	return err
+}
+
+// ListUsers returns users filtered by query (ILIKE on email or name), only members of
+// organization orgID unless it is 0. Limit is capped to [1,200].
+func (s *Store) ListUsers(ctx context.Context, query string, orgID int64, limit int) ([]User, error) {
 	if limit <= 0 {
 		limit = 50
 	}
@@ -571,12 +1538,15 @@ func (s *Store) ListUsers(ctx context.Context, query string, limit int) ([]User,
 	}
 	var rows *sql.Rows
 	var err error
+	const inOrg = `($2 = 0 or exists (select 1 from org_members om where om.org_id = $2 and om.user_id = users.id))`
 	q := strings.TrimSpace(query)
 	if q == "" {
-		rows, err = s.db.QueryContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, coalesce(email_verified,false), created_at from users order by id desc limit $1`, limit)
+		rows, err = s.db.QueryContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, coalesce(email_verified,false), created_at, is_guest, guest_expires_at from users
+			where `+inOrg+` order by id desc limit $1`, limit, orgID)
 	} else {
 		like := "%" + q + "%"
-		rows, err = s.db.QueryContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, coalesce(email_verified,false), created_at from users where email ilike $1 or name ilike $1 order by email limit $2`, like, limit)
+		rows, err = s.db.QueryContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, coalesce(email_verified,false), created_at, is_guest, guest_expires_at from users
+			where (email ilike $3 or name ilike $3) and `+inOrg+` order by email limit $1`, limit, orgID, like)
 	}
 	if err != nil {
 		return nil, err
@@ -585,42 +1555,90 @@ func (s *Store) ListUsers(ctx context.Context, query string, limit int) ([]User,
 	var out []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.CreatedAt); err != nil {
+		if err := rows.Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.CreatedAt, &u.IsGuest, &u.GuestExpiresAt); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// BoardRole returns the user's effective role on a board: the highest of all grants
+// in boardGrants (org admin, owner, direct, groups, project and project groups).
+// RoleNone means no access, also for users outside the board's organization.
+func (s *Store) BoardRole(ctx context.Context, userID, boardID int64) (Role, error) {
+	var exists bool
+	var role int
+	err := s.db.QueryRowContext(ctx, boardGrants+`
+		select exists(select 1 from boards where id = $1),
+			coalesce((select max(role) from grants where user_id = $2), -1)`, boardID, userID).Scan(&exists, &role)
+	if err != nil {
+		return RoleNone, err
+	}
+	if !exists {
+		return RoleNone, ErrNotFound
+	}
+	return Role(role), nil
+}
+
+// ProjectRole returns the user's role in a project: Owner for owner_user_id and org admins,
+// otherwise the highest of project_members and attached groups. RoleNone for non-members.
+func (s *Store) ProjectRole(ctx context.Context, userID, projectID int64) (Role, error) {
+	var exists bool
+	var role int
+	err := s.db.QueryRowContext(ctx, projectGrants+`
+		select exists(select 1 from projects where id = $1),
+			coalesce((select max(role) from grants where user_id = $2), -1)`, projectID, userID).Scan(&exists, &role)
+	if err != nil {
+		return RoleNone, err
+	}
+	if !exists {
+		return RoleNone, ErrNotFound
+	}
+	return Role(role), nil
+}
+
+// CanAccessBoard: user has any role on the board (owner, member, project or via a group)
+func (s *Store) CanAccessBoard(ctx context.Context, userID, boardID int64) (bool, error) {
+	role, err := s.BoardRole(ctx, userID, boardID)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return role >= RoleViewer, err
+}
+
+// AccessibleBoards returns the ids of every board the user has a role on: the boards
+// BoardRole gives them at least Viewer on, by the same grants as boardGrants.
+func (s *Store) AccessibleBoards(ctx context.Context, userID int64) (map[int64]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		select b.id from boards b
+		join org_members om on om.org_id = b.org_id and om.user_id = $1
+		join users u on u.id = $1
+		where ((b.created_by = $1
+				or exists (select 1 from board_members bm where bm.board_id = b.id and bm.user_id = $1))
+			and not `+guestExpired+`)
+		or (not u.is_guest and (om.role >= 2
+			or exists (select 1 from board_groups bg join user_groups ug on ug.group_id = bg.group_id
+				where bg.board_id = b.id and ug.user_id = $1)
+			or exists (select 1 from projects p where p.id = b.project_id and p.owner_user_id = $1)
+			or exists (select 1 from project_members pm where pm.project_id = b.project_id and pm.user_id = $1)
+			or exists (select 1 from project_groups pg join user_groups ug on ug.group_id = pg.group_id
+				where pg.project_id = b.project_id and ug.user_id = $1)))`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[int64]bool{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		out = append(out, u)
+		out[id] = true
 	}
 	return out, rows.Err()
 }
 
-// CanAccessBoard: user is owner OR belongs to a group that has access to the board
-func (s *Store) CanAccessBoard(ctx context.Context, userID, boardID int64) (bool, error) {
-	var x int
-	// owner
-	if err := s.db.QueryRowContext(ctx, `select 1 from boards where id=$1 and created_by=$2`, boardID, userID).Scan(&x); err == nil {
-		return true, nil
-	}
-	// via groups
-	err := s.db.QueryRowContext(ctx, `select 1 from board_groups bg join user_groups ug on ug.group_id=bg.group_id where bg.board_id=$1 and ug.user_id=$2`, boardID, userID).Scan(&x)
-	if err == nil {
-		return true, nil
-	}
-	if !errors.Is(err, sql.ErrNoRows) {
-		return false, err
-	}
-	// via project membership
-	err = s.db.QueryRowContext(ctx, `
-		select 1 from boards b
-		left join projects p on p.id = b.project_id
-		left join project_members pm on pm.project_id = b.project_id and pm.user_id = $2
-		where b.id=$1 and (p.owner_user_id = $2 or pm.user_id is not null)
-	`, boardID, userID).Scan(&x)
-	if errors.Is(err, sql.ErrNoRows) {
-		return false, nil
-	}
-	return err == nil, err
-}
-
 // Helpers for API layer to resolve board/list relationships for events
 func (s *Store) BoardIDByList(ctx context.Context, listID int64) (int64, error) {
 	var boardID int64
@@ -643,7 +1661,7 @@ func (s *Store) BoardAndListByCard(ctx context.Context, cardID int64) (int64, in
 
 func (s *Store) CommentsByCard(ctx context.Context, cardID int64) ([]Comment, error) {
 	rows, err := s.db.QueryContext(ctx,
-		`select c.id, c.card_id, c.body, c.created_at, c.user_id, coalesce(u.name, u.email, '') as author
+		`select c.id, c.card_id, c.body, c.created_at, c.user_id, c.version, coalesce(u.name, u.email, '') as author
 		 from comments c left join users u on u.id = c.user_id
 		 where c.card_id=$1 order by c.id`, cardID)
 	if err != nil {
@@ -653,7 +1671,7 @@ func (s *Store) CommentsByCard(ctx context.Context, cardID int64) ([]Comment, er
 	var out []Comment
 	for rows.Next() {
 		var c Comment
-		if err := rows.Scan(&c.ID, &c.CardID, &c.Body, &c.CreatedAt, &c.UserID, &c.Author); err != nil {
+		if err := rows.Scan(&c.ID, &c.CardID, &c.Body, &c.CreatedAt, &c.UserID, &c.Version, &c.Author); err != nil {
 			return nil, err
 		}
 		out = append(out, c)
@@ -664,9 +1682,9 @@ func (s *Store) CommentsByCard(ctx context.Context, cardID int64) ([]Comment, er
 func (s *Store) AddComment(ctx context.Context, cardID int64, body string, userID *int64) (Comment, error) {
 	var c Comment
 	err := s.db.QueryRowContext(ctx,
-		`insert into comments(card_id, body, user_id) values($1, $2, $3) returning id, card_id, body, created_at, user_id`,
+		`insert into comments(card_id, body, user_id) values($1, $2, $3) returning id, card_id, body, created_at, user_id, version`,
 		cardID, body, userID,
-	).Scan(&c.ID, &c.CardID, &c.Body, &c.CreatedAt, &c.UserID)
+	).Scan(&c.ID, &c.CardID, &c.Body, &c.CreatedAt, &c.UserID, &c.Version)
 	if err == nil && c.UserID != nil {
 		// fetch author display
 		_ = s.db.QueryRowContext(ctx, `select coalesce(name, email, '') from users where id=$1`, *c.UserID).Scan(&c.Author)
@@ -691,8 +1709,8 @@ func (s *Store) userCredsByEmail(ctx context.Context, email string) (User, strin
 	var u User
 	var hash string
 	var verified bool
-	err := s.db.QueryRowContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, created_at, password_hash, coalesce(email_verified,false), coalesce(lang,'') from users where lower(email)=lower($1)`, email).
-		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.CreatedAt, &hash, &verified, &u.Lang)
+	err := s.db.QueryRowContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, created_at, password_hash, coalesce(email_verified,false), coalesce(lang,''), is_guest, guest_expires_at from users where lower(email)=lower($1)`, email).
+		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.CreatedAt, &hash, &verified, &u.Lang, &u.IsGuest, &u.GuestExpiresAt)
 	if errors.Is(err, sql.ErrNoRows) {
 		return User{}, "", ErrNotFound
 	}
@@ -719,10 +1737,11 @@ func (s *Store) CreateSession(ctx context.Context, userID int64, ttl time.Durati
 
 func (s *Store) UserBySession(ctx context.Context, token string) (User, error) {
 	var u User
-	err := s.db.QueryRowContext(ctx, `select u.id, u.email, u.name, coalesce(u.avatar_url,''), u.is_active, u.is_admin, coalesce(u.email_verified,false), coalesce(u.lang,''), u.created_at
+	err := s.db.QueryRowContext(ctx, `select u.id, u.email, u.name, coalesce(u.avatar_url,''), u.is_active, u.is_admin, coalesce(u.email_verified,false), coalesce(u.lang,''), u.created_at,
+			u.is_guest, u.guest_expires_at
 		from sessions s join users u on u.id=s.user_id
-		where s.token=$1 and s.expires_at > now()`, token).
-		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.Lang, &u.CreatedAt)
+		where s.token=$1 and s.expires_at > now() and u.is_active and not `+guestExpired, token).
+		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.Lang, &u.CreatedAt, &u.IsGuest, &u.GuestExpiresAt)
 	if errors.Is(err, sql.ErrNoRows) {
 		return User{}, ErrNotFound
 	}
@@ -746,6 +1765,9 @@ func (s *Store) Authenticate(ctx context.Context, email, password string) (User,
 	if !u.IsActive {
 		return User{}, errors.New("user_inactive")
 	}
+	if u.IsGuest && u.GuestExpiresAt != nil && !u.GuestExpiresAt.After(time.Now()) {
+		return User{}, errors.New("guest_expired")
+	}
 	return u, nil
 }
 
@@ -829,6 +1851,29 @@ func (s *Store) AdminUpdateUser(ctx context.Context, id int64, name *string, ema
 	return nil
 }
 
+// NextGuestExpiry returns the earliest guest_expires_at still ahead, the zero time when
+// no guest account is going to expire.
+func (s *Store) NextGuestExpiry(ctx context.Context) (time.Time, error) {
+	var at sql.NullTime
+	err := s.db.QueryRowContext(ctx, `select min(guest_expires_at) from users where is_guest and guest_expires_at > now()`).Scan(&at)
+	return at.Time, err
+}
+
+// SetUserGuest makes the user a guest (with an optional expiry) or a regular user again.
+func (s *Store) SetUserGuest(ctx context.Context, id int64, guest bool, expiresAt *time.Time) error {
+	if !guest {
+		expiresAt = nil
+	}
+	res, err := s.db.ExecContext(ctx, `update users set is_guest=$2, guest_expires_at=$3 where id=$1`, id, guest, expiresAt)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 // MarkEmailVerified sets users.email_verified=true by email (case-insensitive)
 func (s *Store) MarkEmailVerified(ctx context.Context, email string) error {
 	if strings.TrimSpace(email) == "" {
@@ -838,19 +1883,32 @@ func (s *Store) MarkEmailVerified(ctx context.Context, email string) error {
 	return err
 }
 
+// UserByID returns a user by id.
+func (s *Store) UserByID(ctx context.Context, id int64) (User, error) {
+	var u User
+	err := s.db.QueryRowContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, coalesce(email_verified,false), coalesce(lang,''), created_at, is_guest, guest_expires_at from users where id=$1`, id).
+		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.EmailVerified, &u.Lang, &u.CreatedAt, &u.IsGuest, &u.GuestExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	return u, err
+}
+
 // get user by email (without password hash)
 func (s *Store) userByEmail(ctx context.Context, email string) (User, error) {
 	var u User
-	err := s.db.QueryRowContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, created_at from users where lower(email)=lower($1)`, email).
-		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.CreatedAt)
+	err := s.db.QueryRowContext(ctx, `select id, email, name, coalesce(avatar_url,''), is_active, is_admin, created_at, is_guest, guest_expires_at from users where lower(email)=lower($1)`, email).
+		Scan(&u.ID, &u.Email, &u.Name, &u.AvatarURL, &u.IsActive, &u.IsAdmin, &u.CreatedAt, &u.IsGuest, &u.GuestExpiresAt)
 	if errors.Is(err, sql.ErrNoRows) {
 		return User{}, ErrNotFound
 	}
 	return u, err
 }
 
-// EnsureOAuthUser links or creates a user for given provider and provider_user_id, returns the user
-func (s *Store) EnsureOAuthUser(ctx context.Context, provider, providerUserID, email, name string) (User, error) {
+// EnsureOAuthUser links or creates a user for given provider and provider_user_id, returns the user.
+// An unknown identity whose email matches an existing user is attached to that user only when
+// linkByEmail is set; otherwise ErrEmailTaken is returned.
+func (s *Store) EnsureOAuthUser(ctx context.Context, provider, providerUserID, email, name string, linkByEmail bool) (User, error) {
 	// 1) Try find by oauth_accounts
 	var u User
 	err := s.db.QueryRowContext(ctx, `select u.id, u.email, u.name, coalesce(u.avatar_url,''), u.is_active, u.is_admin, u.created_at
@@ -869,6 +1927,9 @@ func (s *Store) EnsureOAuthUser(ctx context.Context, provider, providerUserID, e
 	if err != nil && !notFound {
 		return User{}, err
 	}
+	if !notFound && !linkByEmail {
+		return User{}, ErrEmailTaken
+	}
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return User{}, err
@@ -886,8 +1947,8 @@ func (s *Store) EnsureOAuthUser(ctx context.Context, provider, providerUserID, e
 		u = haveUser
 	}
 	// 3) Link oauth account (ignore duplicate unique constraint)
-	if _, err = tx.ExecContext(ctx, `insert into oauth_accounts(user_id, provider, provider_user_id) values($1,$2,$3)
-			on conflict (provider, provider_user_id) do nothing`, u.ID, provider, providerUserID); err != nil {
+	if _, err = tx.ExecContext(ctx, `insert into oauth_accounts(user_id, provider, provider_user_id, email) values($1,$2,$3,$4)
+			on conflict (provider, provider_user_id) do nothing`, u.ID, provider, providerUserID, email); err != nil {
 		return User{}, err
 	}
 	if err = tx.Commit(); err != nil {
@@ -896,6 +1957,192 @@ func (s *Store) EnsureOAuthUser(ctx context.Context, provider, providerUserID, e
 	return u, nil
 }
 
+// UserIdentities lists the external login identities linked to a user.
+func (s *Store) UserIdentities(ctx context.Context, userID int64) ([]Identity, error) {
+	rows, err := s.db.QueryContext(ctx, `select provider, coalesce(email,''), created_at from oauth_accounts where user_id=$1 order by created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Identity{}
+	for rows.Next() {
+		var id Identity
+		if err := rows.Scan(&id.Provider, &id.Email, &id.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// UserHasPassword reports whether the user can log in with a local password.
+func (s *Store) UserHasPassword(ctx context.Context, userID int64) (bool, error) {
+	var has bool
+	err := s.db.QueryRowContext(ctx, `select password_hash <> '' from users where id=$1`, userID).Scan(&has)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, ErrNotFound
+	}
+	return has, err
+}
+
+// LinkIdentity attaches a provider identity to an existing user regardless of email.
+// It fails with ErrIdentityTaken when the identity belongs to someone else and with
+// ErrProviderLinked when the user already has a different identity at that provider.
+func (s *Store) LinkIdentity(ctx context.Context, userID int64, provider, providerUserID, email string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var owner int64
+	err = tx.QueryRowContext(ctx, `select user_id from oauth_accounts where provider=$1 and provider_user_id=$2`, provider, providerUserID).Scan(&owner)
+	switch {
+	case err == nil && owner == userID:
+		return nil
+	case err == nil:
+		return ErrIdentityTaken
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	var n int
+	if err := tx.QueryRowContext(ctx, `select count(*) from oauth_accounts where user_id=$1 and provider=$2`, userID, provider).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrProviderLinked
+	}
+	if _, err := tx.ExecContext(ctx, `insert into oauth_accounts(user_id, provider, provider_user_id, email) values($1,$2,$3,$4)`, userID, provider, providerUserID, email); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnlinkIdentity removes the user's identity at provider. The last way to log in
+// (no password and no other identity) cannot be removed: ErrLastLoginMethod.
+func (s *Store) UnlinkIdentity(ctx context.Context, userID int64, provider string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	var hasPassword bool
+	var others, linked int
+	err = tx.QueryRowContext(ctx, `select u.password_hash <> '',
+			(select count(*) from oauth_accounts where user_id=u.id and provider<>$2),
+			(select count(*) from oauth_accounts where user_id=u.id and provider=$2)
+		from users u where u.id=$1 for update`, userID, provider).Scan(&hasPassword, &others, &linked)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && linked == 0) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !hasPassword && others == 0 {
+		return ErrLastLoginMethod
+	}
+	if _, err := tx.ExecContext(ctx, `delete from oauth_accounts where user_id=$1 and provider=$2`, userID, provider); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LoginAttempts returns the failed-login state for a login name (zero value if none).
+func (s *Store) LoginAttempts(ctx context.Context, login string) (LoginAttempts, error) {
+	var la LoginAttempts
+	var locked sql.NullTime
+	err := s.db.QueryRowContext(ctx, `select failures, last_failure_at, locked_until from login_attempts where login=lower($1)`, login).
+		Scan(&la.Failures, &la.LastFailureAt, &locked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginAttempts{}, nil
+	}
+	la.LockedUntil = locked.Time
+	return la, err
+}
+
+// RecordLoginFailure counts a failed login. The counter restarts when the previous
+// failure is older than window; reaching maxFailures locks the login for lockFor.
+func (s *Store) RecordLoginFailure(ctx context.Context, login string, maxFailures int, lockFor, window time.Duration) (LoginAttempts, error) {
+	var la LoginAttempts
+	var locked sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		insert into login_attempts(login, failures, last_failure_at) values(lower($1), 1, now())
+		on conflict (login) do update set
+			failures = case when login_attempts.last_failure_at < now() - make_interval(secs => $3) then 1 else login_attempts.failures + 1 end,
+			last_failure_at = now()
+		returning failures, last_failure_at, locked_until`, login, maxFailures, window.Seconds()).
+		Scan(&la.Failures, &la.LastFailureAt, &locked)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	la.LockedUntil = locked.Time
+	if maxFailures > 0 && la.Failures >= maxFailures {
+		err = s.db.QueryRowContext(ctx, `update login_attempts set locked_until = now() + make_interval(secs => $2) where login=lower($1) returning locked_until`, login, lockFor.Seconds()).
+			Scan(&la.LockedUntil)
+	}
+	return la, err
+}
+
+// ClearLoginFailures resets the counter after a successful login or password reset.
+func (s *Store) ClearLoginFailures(ctx context.Context, login string) error {
+	_, err := s.db.ExecContext(ctx, `delete from login_attempts where login=lower($1)`, login)
+	return err
+}
+
+// AddSecurityEvent appends an entry to the security event log.
+func (s *Store) AddSecurityEvent(ctx context.Context, e SecurityEvent) error {
+	details := []byte("{}")
+	if len(e.Details) > 0 {
+		var err error
+		if details, err = json.Marshal(e.Details); err != nil {
+			return err
+		}
+	}
+	_, err := s.db.ExecContext(ctx, `insert into security_events(user_id, type, ip, user_agent, details) values($1,$2,$3,$4,$5)`,
+		e.UserID, e.Type, e.IP, e.UserAgent, details)
+	return err
+}
+
+// SecurityEvents returns the newest events, optionally filtered by user and type. Limit is capped to [1,500].
+func (s *Store) SecurityEvents(ctx context.Context, userID *int64, typ string, limit int) ([]SecurityEvent, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 500 {
+		limit = 500
+	}
+	rows, err := s.db.QueryContext(ctx, `select e.id, e.user_id, coalesce(u.email,''), e.type, e.ip, e.user_agent, e.details, e.created_at
+		from security_events e left join users u on u.id = e.user_id
+		where ($1::bigint is null or e.user_id = $1) and ($2 = '' or e.type = $2)
+		order by e.created_at desc, e.id desc limit $3`, userID, typ, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []SecurityEvent{}
+	for rows.Next() {
+		var e SecurityEvent
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Email, &e.Type, &e.IP, &e.UserAgent, &details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(details, &e.Details); err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+// KnownLoginSource reports whether the user has logged in before at all (first) and
+// whether an earlier successful login came from the same IP and user agent (known).
+func (s *Store) KnownLoginSource(ctx context.Context, userID int64, ip, userAgent string) (first, known bool, err error) {
+	err = s.db.QueryRowContext(ctx, `select
+			not exists (select 1 from security_events where user_id=$1 and type='login_success'),
+			exists (select 1 from security_events where user_id=$1 and type='login_success' and ip=$2 and user_agent=$3)`,
+		userID, ip, userAgent).Scan(&first, &known)
+	return first, known, err
+}
+
 // DeleteUser removes a user and nullifies ownership references to satisfy FKs.
 // It sets projects.owner_user_id = NULL for projects owned by the user, then deletes the user.
 func (s *Store) DeleteUser(ctx context.Context, id int64) error {
@@ -922,6 +2169,10 @@ func (s *Store) DeleteUser(ctx context.Context, id int64) error {
 }
 
 func (s *Store) UpdateCard(ctx context.Context, id int64, title *string, description *string, pos *int64, dueAt *time.Time, descriptionIsMD *bool, assigneeUserID *int64, parentID *int64) error {
+	return updateCard(ctx, s.db, id, title, description, pos, dueAt, descriptionIsMD, assigneeUserID, parentID)
+}
+
+func updateCard(ctx context.Context, db execer, id int64, title *string, description *string, pos *int64, dueAt *time.Time, descriptionIsMD *bool, assigneeUserID *int64, parentID *int64) error {
 	q := "update cards set "
 	args := []any{}
 	idx := 1
@@ -966,18 +2217,116 @@ func (s *Store) UpdateCard(ctx context.Context, id int64, title *string, descrip
 	}
 	q += fmt.Sprintf("%s where id=$%d", joinComma(set), idx)
 	args = append(args, id)
-	_, err := s.db.ExecContext(ctx, q, args...)
+	_, err := db.ExecContext(ctx, q, args...)
 	return err
 }
 
-// CanAccessBoard returns true if the user has access to the given board
-// CanAccessCard returns true if the user has access to the board of the card
-func (s *Store) CanAccessCard(ctx context.Context, userID, cardID int64) (bool, error) {
-	bid, _, err := s.BoardAndListByCard(ctx, cardID)
+// CardPatch is a PATCH of a card; nil fields are left alone.
+type CardPatch struct {
+	Title           *string
+	Description     *string // replaced through the collaborative document
+	Pos             *int64
+	DueAt           *time.Time
+	DescriptionIsMD *bool
+	AssigneeID      *int64
+	ParentID        *int64
+	ParentList      int64 // with ParentID: the parent's list, which the card and its subtree follow
+	Color           *string
+}
+
+// PatchCard bumps the card's version and applies p in one transaction, so with
+// ifVersion != 0 either the whole patch lands on that version or nothing does
+// (ErrVersionConflict). A new description is an operation by userID on the card's
+// document, returned with its revision (nil when the text didn't change).
+func (s *Store) PatchCard(ctx context.Context, id, ifVersion, userID int64, p CardPatch) (version int64, docOp textOp, docRev int64, err error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return false, err
+		return 0, nil, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if version, err = bumpVersion(ctx, tx, "card", id, ifVersion); err != nil {
+		return 0, nil, 0, err
+	}
+	if p.ParentID != nil {
+		// a card moved under a parent in another list goes to the end of that list
+		res, err := tx.ExecContext(ctx, `
+with recursive sub as (
+  select id from cards where id=$1 and list_id<>$2
+  union all
+  select c.id from cards c join sub s on c.parent_card_id = s.id
+)
+update cards set list_id=$2 where id in (select id from sub)`, id, p.ParentList)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if _, err := tx.ExecContext(ctx, `update cards set pos=(select coalesce(max(pos),0)+1000 from cards where list_id=$2 and id<>$1) where id=$1`, id, p.ParentList); err != nil {
+				return 0, nil, 0, err
+			}
+		}
+	}
+	if p.Description != nil {
+		if docOp, docRev, err = editCardDocTx(ctx, tx, id, userID, "", -1, replaceCardDoc(*p.Description)); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+	if err := updateCard(ctx, tx, id, p.Title, nil, p.Pos, p.DueAt, p.DescriptionIsMD, p.AssigneeID, p.ParentID); err != nil {
+		return 0, nil, 0, err
+	}
+	if p.Color != nil {
+		if _, err := tx.ExecContext(ctx, `update cards set color=$1 where id=$2`, *p.Color, id); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+	return version, docOp, docRev, tx.Commit()
+}
+
+func (s *Store) GetCard(ctx context.Context, id int64) (Card, error) {
+	var c Card
+	err := s.db.QueryRowContext(ctx, `
+	select c.id, c.list_id, c.parent_card_id, c.title, c.description, coalesce(c.color,''), c.pos, c.due_at, c.assignee_user_id,
+		   coalesce(u.name, u.email, ''), c.created_at, coalesce(c.description_is_md,false), c.version
+	from cards c left join users u on u.id = c.assignee_user_id
+	where c.id=$1`, id).
+		Scan(&c.ID, &c.ListID, &c.ParentID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.AssigneeUserID,
+			&c.Assignee, &c.CreatedAt, &c.DescriptionIsMD, &c.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Card{}, ErrNotFound
+	}
+	return c, err
+}
+
+// versionTables maps the entity kinds that carry a version to their tables.
+var versionTables = map[string]string{"board": "boards", "list": "lists", "card": "cards", "comment": "comments"}
+
+// rowQueryer is implemented by *sql.DB and *sql.Tx.
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// bumpVersion increments the version of a board, list, card or comment and returns the new
+// one. With ifVersion != 0 the row must still be at that version, otherwise
+// ErrVersionConflict: the check and the bump are one statement, so of two writers that
+// read the same version exactly one gets through. Run it in the write's transaction, so a
+// failed write doesn't leave the version bumped.
+func bumpVersion(ctx context.Context, db rowQueryer, kind string, id, ifVersion int64) (int64, error) {
+	table, ok := versionTables[kind]
+	if !ok {
+		return 0, fmt.Errorf("bump version: unknown kind %q", kind)
+	}
+	var v int64
+	err := db.QueryRowContext(ctx, `update `+table+` set version=version+1 where id=$1 and ($2::bigint = 0 or version=$2) returning version`, id, ifVersion).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+		if err := db.QueryRowContext(ctx, `select exists(select 1 from `+table+` where id=$1)`, id).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if exists {
+			return 0, ErrVersionConflict
+		}
+		return 0, ErrNotFound
 	}
-	return s.CanAccessBoard(ctx, userID, bid)
+	return v, err
 }
 
 // GetOrCreateCardShare returns existing or creates new public share token for the card
@@ -1008,13 +2357,13 @@ func (s *Store) GetOrCreateCardShare(ctx context.Context, cardID int64) (string,
 func (s *Store) CardByShareToken(ctx context.Context, token string) (Card, error) {
 	var c Card
 	err := s.db.QueryRowContext(ctx, `
-	select c.id, c.list_id, c.title, c.description, coalesce(c.color,''), c.pos, c.due_at, c.description_is_md, c.assignee_user_id, c.parent_card_id,
+	select c.id, c.list_id, c.title, c.description, coalesce(c.color,''), c.pos, c.due_at, c.description_is_md, c.assignee_user_id, c.parent_card_id, c.version,
 		   coalesce(u.name, u.email, '') as assignee
 	from card_shares cs
 	join cards c on c.id = cs.card_id
 	left join users u on u.id = c.assignee_user_id
 	where cs.token=$1`, token).
-		Scan(&c.ID, &c.ListID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.DescriptionIsMD, &c.AssigneeUserID, &c.ParentID, &c.Assignee)
+		Scan(&c.ID, &c.ListID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.DescriptionIsMD, &c.AssigneeUserID, &c.ParentID, &c.Version, &c.Assignee)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Card{}, ErrNotFound
@@ -1024,26 +2373,26 @@ func (s *Store) CardByShareToken(ctx context.Context, token string) (Card, error
 	return c, nil
 }
 
-func (s *Store) MoveCard(ctx context.Context, cardID int64, targetList int64, newIndex int) error {
-	attempts := 0
-retry:
-	var listID int64
-	var pos int64
-	if err := s.db.QueryRowContext(ctx, `select list_id, pos from cards where id=$1`, cardID).Scan(&listID, &pos); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return ErrNotFound
-		}
-		return err
-	}
-
+// MoveCard moves a card with its subcards to index newIndex of targetList. Like PatchCard
+// it bumps the card's version in the same transaction, checked against ifVersion unless
+// that is 0, and returns the new version.
+func (s *Store) MoveCard(ctx context.Context, cardID, targetList int64, newIndex int, ifVersion int64) (int64, error) {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	version, err := bumpVersion(ctx, tx, "card", cardID, ifVersion)
+	if err != nil {
+		return 0, err
+	}
+	var listID int64
+	if err := tx.QueryRowContext(ctx, `select list_id from cards where id=$1`, cardID).Scan(&listID); err != nil {
+		return 0, err
 	}
-
 	if targetList != listID {
 		// Move the card and all its descendants to the target list to preserve hierarchy across lists
-		_, err = tx.ExecContext(ctx, `
+		_, err := tx.ExecContext(ctx, `
 with recursive sub as (
   select id from cards where id=$1
   union all
@@ -1051,273 +2400,133 @@ with recursive sub as (
 )
 update cards set list_id=$2 where id in (select id from sub)`, cardID, targetList)
 		if err != nil {
-			_ = tx.Rollback()
-			return err
+			return 0, err
 		}
 		listID = targetList
 	}
-
-	rows, err := tx.QueryContext(ctx,
-		`select pos from cards where list_id=$1 and id<>$2 order by pos, id`, listID, cardID)
+	pos, err := positionAt(ctx, tx, newIndex, `select pos from cards where list_id=$1 and id<>$2 order by pos, id`, []any{listID, cardID},
+		func() error { return renumberPositions(ctx, tx, listID) })
 	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	defer rows.Close()
-	var positions []int64
-	for rows.Next() {
-		var p int64
-		if err = rows.Scan(&p); err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-		positions = append(positions, p)
-	}
-	if err = rows.Err(); err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-
-	if newIndex < 0 {
-		newIndex = 0
-	}
-	if newIndex > len(positions) {
-		newIndex = len(positions)
-	}
-
-	var beforePos, afterPos *int64
-	if newIndex > 0 {
-		v := positions[newIndex-1]
-		beforePos = &v
-	}
-	if newIndex < len(positions) {
-		v := positions[newIndex]
-		afterPos = &v
-	}
-
-	var newPos int64
-	switch {
-	case beforePos == nil && afterPos == nil:
-		newPos = 1000
-	case beforePos != nil && afterPos == nil:
-		newPos = *beforePos + 1000
-	case beforePos == nil && afterPos != nil:
-		newPos = *afterPos - 500
-		if newPos <= 0 {
-			newPos = 1
-		}
-	default:
-		gap := (*afterPos - *beforePos)
-		if gap <= 1 {
-			if err = renumberPositions(ctx, tx, listID); err != nil {
-				_ = tx.Rollback()
-				return err
-			}
-			if err = tx.Commit(); err != nil {
-				return err
-			}
-			attempts++
-			if attempts < 2 {
-				goto retry
-			}
-			return errors.New("move failed after renumber")
-		}
-		newPos = *beforePos + gap/2
-	}
-
-	if _, err = tx.ExecContext(ctx, `update cards set pos=$1 where id=$2`, newPos, cardID); err != nil {
-		_ = tx.Rollback()
-		return err
+		return 0, err
 	}
-	if err = tx.Commit(); err != nil {
-		return err
+	if _, err := tx.ExecContext(ctx, `update cards set pos=$1 where id=$2`, pos, cardID); err != nil {
+		return 0, err
 	}
-	return nil
+	return version, tx.Commit()
 }
 
-// MoveList moves a list within its board or to another board at given index
-func (s *Store) MoveList(ctx context.Context, listID int64, targetBoardID int64, newIndex int) error {
-	attempts := 0
-retry:
-	var boardID int64
-	var pos int64
-	if err := s.db.QueryRowContext(ctx, `select board_id, pos from lists where id=$1`, listID).Scan(&boardID, &pos); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return ErrNotFound
-		}
-		return err
-	}
+// MoveList moves a list within its board or to another board at given index, bumping
+// its version in the same transaction (see MoveCard).
+func (s *Store) MoveList(ctx context.Context, listID, targetBoardID int64, newIndex int, ifVersion int64) (int64, error) {
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	version, err := bumpVersion(ctx, tx, "list", listID, ifVersion)
+	if err != nil {
+		return 0, err
+	}
+	var boardID int64
+	if err := tx.QueryRowContext(ctx, `select board_id from lists where id=$1`, listID).Scan(&boardID); err != nil {
+		return 0, err
 	}
 	// change board if requested
 	if targetBoardID != 0 && targetBoardID != boardID {
-		if _, err = tx.ExecContext(ctx, `update lists set board_id=$1 where id=$2`, targetBoardID, listID); err != nil {
-			_ = tx.Rollback()
-			return err
+		if _, err := tx.ExecContext(ctx, `update lists set board_id=$1 where id=$2`, targetBoardID, listID); err != nil {
+			return 0, err
 		}
 		boardID = targetBoardID
 	}
-	rows, err := tx.QueryContext(ctx, `select pos from lists where board_id=$1 and id<>$2 order by pos, id`, boardID, listID)
+	pos, err := positionAt(ctx, tx, newIndex, `select pos from lists where board_id=$1 and id<>$2 order by pos, id`, []any{boardID, listID},
+		func() error { return renumberListPositions(ctx, tx, boardID) })
 	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	defer rows.Close()
-	var positions []int64
-	for rows.Next() {
-		var p int64
-		if err = rows.Scan(&p); err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-		positions = append(positions, p)
-	}
-	if err = rows.Err(); err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	if newIndex < 0 {
-		newIndex = 0
-	}
-	if newIndex > len(positions) {
-		newIndex = len(positions)
+		return 0, err
 	}
-	var beforePos, afterPos *int64
-	if newIndex > 0 {
-		v := positions[newIndex-1]
-		beforePos = &v
+	if _, err := tx.ExecContext(ctx, `update lists set pos=$1 where id=$2`, pos, listID); err != nil {
+		return 0, err
 	}
-	if newIndex < len(positions) {
-		v := positions[newIndex]
-		afterPos = &v
-	}
-	var newPos int64
-	switch {
-	case beforePos == nil && afterPos == nil:
-		newPos = 1000
-	case beforePos != nil && afterPos == nil:
-		newPos = *beforePos + 1000
-	case beforePos == nil && afterPos != nil:
-		newPos = *afterPos - 500
-		if newPos <= 0 {
-			newPos = 1
-		}
-	default:
-		gap := (*afterPos - *beforePos)
-		if gap <= 1 {
-			if err = renumberListPositions(ctx, tx, boardID); err != nil {
-				_ = tx.Rollback()
-				return err
-			}
-			if err = tx.Commit(); err != nil {
-				return err
-			}
-			attempts++
-			if attempts < 2 {
-				goto retry
-			}
-			return errors.New("move list failed after renumber")
-		}
-		newPos = *beforePos + gap/2
-	}
-	if _, err = tx.ExecContext(ctx, `update lists set pos=$1 where id=$2`, newPos, listID); err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	if err = tx.Commit(); err != nil {
-		return err
-	}
-	return nil
+	return version, tx.Commit()
 }
 
-// MoveBoard reorders a board among all boards
-func (s *Store) MoveBoard(ctx context.Context, boardID int64, newIndex int) error {
-	attempts := 0
-retry:
-	var pos int64
-	if err := s.db.QueryRowContext(ctx, `select pos from boards where id=$1`, boardID).Scan(&pos); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return ErrNotFound
-		}
-		return err
-	}
+// MoveBoard reorders a board among the boards of its organization, bumping its version
+// in the same transaction (see MoveCard).
+func (s *Store) MoveBoard(ctx context.Context, boardID int64, newIndex int, ifVersion int64) (int64, error) {
 	tx, err := s.db.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	rows, err := tx.QueryContext(ctx, `select pos from boards where id<>$1 order by pos, id`, boardID)
-	if err != nil {
-		_ = tx.Rollback()
-		return err
-	}
-	defer rows.Close()
-	var positions []int64
-	for rows.Next() {
-		var p int64
-		if err = rows.Scan(&p); err != nil {
-			_ = tx.Rollback()
-			return err
-		}
-		positions = append(positions, p)
-	}
-	if err = rows.Err(); err != nil {
-		_ = tx.Rollback()
-		return err
+	if err != nil {
+		return 0, err
 	}
-	if newIndex < 0 {
-		newIndex = 0
+	defer func() { _ = tx.Rollback() }()
+	version, err := bumpVersion(ctx, tx, "board", boardID, ifVersion)
+	if err != nil {
+		return 0, err
 	}
-	if newIndex > len(positions) {
-		newIndex = len(positions)
+	var orgID int64
+	if err := tx.QueryRowContext(ctx, `select org_id from boards where id=$1`, boardID).Scan(&orgID); err != nil {
+		return 0, err
 	}
-	var beforePos, afterPos *int64
-	if newIndex > 0 {
-		v := positions[newIndex-1]
-		beforePos = &v
+	pos, err := positionAt(ctx, tx, newIndex, `select pos from boards where id<>$1 and org_id=$2 order by pos, id`, []any{boardID, orgID},
+		func() error { return renumberBoardPositions(ctx, tx, orgID) })
+	if err != nil {
+		return 0, err
 	}
-	if newIndex < len(positions) {
-		v := positions[newIndex]
-		afterPos = &v
+	if _, err := tx.ExecContext(ctx, `update boards set pos=$1 where id=$2`, pos, boardID); err != nil {
+		return 0, err
 	}
-	var newPos int64
-	switch {
-	case beforePos == nil && afterPos == nil:
-		newPos = 1000
-	case beforePos != nil && afterPos == nil:
-		newPos = *beforePos + 1000
-	case beforePos == nil && afterPos != nil:
-		newPos = *afterPos - 500
-		if newPos <= 0 {
-			newPos = 1
-		}
-	default:
-		gap := (*afterPos - *beforePos)
-		if gap <= 1 {
-			if err = renumberBoardPositions(ctx, tx); err != nil {
-				_ = tx.Rollback()
-				return err
-			}
-			if err = tx.Commit(); err != nil {
-				return err
-			}
-			attempts++
-			if attempts < 2 {
-				goto retry
+	return version, tx.Commit()
+}
+
+// positionAt picks the pos that puts a row at index newIndex among its siblings, whose
+// positions query returns in order (the row itself excluded). When the neighbours there
+// leave no room, renumber spaces the siblings out within tx and it looks again.
+func positionAt(ctx context.Context, tx *sql.Tx, newIndex int, query string, args []any, renumber func() error) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return 0, err
+		}
+		var positions []int64
+		for rows.Next() {
+			var p int64
+			if err := rows.Scan(&p); err != nil {
+				rows.Close()
+				return 0, err
 			}
-			return errors.New("move board failed after renumber")
+			positions = append(positions, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		if pos, ok := positionBetween(positions, newIndex); ok {
+			return pos, nil
+		}
+		if attempt > 0 {
+			return 0, errors.New("move failed after renumber")
+		}
+		if err := renumber(); err != nil {
+			return 0, err
 		}
-		newPos = *beforePos + gap/2
 	}
-	if _, err = tx.ExecContext(ctx, `update boards set pos=$1 where id=$2`, newPos, boardID); err != nil {
-		_ = tx.Rollback()
-		return err
+}
+
+// positionBetween returns the pos for index newIndex (clamped to the ends) among the
+// ordered positions, false when the neighbours at that index are adjacent.
+func positionBetween(positions []int64, newIndex int) (int64, bool) {
+	newIndex = max(0, min(newIndex, len(positions)))
+	switch {
+	case len(positions) == 0:
+		return 1000, true
+	case newIndex == len(positions):
+		return positions[newIndex-1] + 1000, true
+	case newIndex == 0:
+		return max(positions[0]-500, 1), true
 	}
-	if err = tx.Commit(); err != nil {
-		return err
+	before, after := positions[newIndex-1], positions[newIndex]
+	if after-before <= 1 {
+		return 0, false
 	}
-	return nil
+	return before + (after-before)/2, true
 }
 
 func renumberPositions(ctx context.Context, tx *sql.Tx, listID int64) error {
@@ -1374,8 +2583,8 @@ func renumberListPositions(ctx context.Context, tx *sql.Tx, boardID int64) error
 	return nil
 }
 
-func renumberBoardPositions(ctx context.Context, tx *sql.Tx) error {
-	rows, err := tx.QueryContext(ctx, `select id from boards order by pos, id`)
+func renumberBoardPositions(ctx context.Context, tx *sql.Tx, orgID int64) error {
+	rows, err := tx.QueryContext(ctx, `select id from boards where org_id=$1 order by pos, id`, orgID)
 	if err != nil {
 		return err
 	}
@@ -1403,6 +2612,20 @@ func renumberBoardPositions(ctx context.Context, tx *sql.Tx) error {
 
 var ErrNotFound = errors.New("not found")
 
+// ErrVersionConflict is returned when a row's version no longer matches the one the client read.
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrInvalidFilter is returned for SCIM filters the store cannot translate.
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// Account linking errors.
+var (
+	ErrEmailTaken      = errors.New("email belongs to another account")
+	ErrIdentityTaken   = errors.New("identity linked to another account")
+	ErrProviderLinked  = errors.New("provider already linked")
+	ErrLastLoginMethod = errors.New("last login method")
+)
+
 func joinComma(parts []string) string {
 	if len(parts) == 0 {
 		return ""
@@ -1498,6 +2721,9 @@ create table if not exists users(
 alter table users add column if not exists email_verified boolean not null default false;
 -- ensure per-user language exists
 alter table users add column if not exists lang text;
+-- guests (external collaborators) only see boards they are direct members of, until guest_expires_at
+alter table users add column if not exists is_guest boolean not null default false;
+alter table users add column if not exists guest_expires_at timestamptz;
 
 create table if not exists oauth_accounts(
 		id bigserial primary key,
@@ -1510,6 +2736,10 @@ create table if not exists oauth_accounts(
 		unique(provider, provider_user_id)
 );
 
+-- email reported by the provider when linked, for display in the profile
+alter table oauth_accounts add column if not exists email text;
+alter table oauth_accounts add column if not exists created_at timestamptz not null default now();
+
 create table if not exists sessions(
 		id bigserial primary key,
 		user_id bigint not null references users(id) on delete cascade,
@@ -1518,6 +2748,28 @@ create table if not exists sessions(
 		expires_at timestamptz not null
 );
 
+-- Failed password logins per login name (also for unknown accounts, so lockout
+-- does not reveal which emails exist)
+create table if not exists login_attempts(
+		login text primary key,
+		failures int not null default 0,
+		last_failure_at timestamptz not null default now(),
+		locked_until timestamptz
+);
+
+-- Security-relevant account events, visible to the user and to admins
+create table if not exists security_events(
+		id bigserial primary key,
+		user_id bigint references users(id) on delete cascade,
+		type text not null,
+		ip text not null default '',
+		user_agent text not null default '',
+		details jsonb not null default '{}'::jsonb,
+		created_at timestamptz not null default now()
+);
+create index if not exists security_events_user_idx on security_events(user_id, created_at desc);
+create index if not exists security_events_type_idx on security_events(type, created_at desc);
+
 -- Groups
 create table if not exists groups(
 		id bigserial primary key,
@@ -1533,6 +2785,10 @@ create table if not exists user_groups(
 -- ensure role column exists for older installs
 alter table user_groups add column if not exists role smallint not null default 1;
 
+-- SCIM provisioning: identifiers assigned by the identity provider
+alter table users add column if not exists scim_external_id text;
+alter table groups add column if not exists scim_external_id text;
+
 -- Projects and membership
 create table if not exists projects(
 		id bigserial primary key,
@@ -1540,6 +2796,9 @@ create table if not exists projects(
 		owner_user_id bigint references users(id),
 		created_at timestamptz not null default now()
 );
+-- one "Default Project" per owner and organization, filled by MigrateDefaultProjects
+-- (the unique index is created with the organizations below)
+alter table projects add column if not exists is_default boolean not null default false;
 create table if not exists project_members(
 		project_id bigint not null references projects(id) on delete cascade,
 		user_id bigint not null references users(id) on delete cascade,
@@ -1547,6 +2806,17 @@ create table if not exists project_members(
 		primary key(project_id, user_id)
 );
 
+-- Groups attached to projects: members of the group get role (0 Viewer, 1 Member, 2 Maintainer)
+-- on the project and all of its boards
+create table if not exists project_groups(
+	project_id bigint not null references projects(id) on delete cascade,
+	group_id bigint not null references groups(id) on delete cascade,
+	role smallint not null default 1,
+	created_at timestamptz not null default now(),
+	primary key(project_id, group_id)
+);
+create index if not exists project_groups_group_idx on project_groups(group_id);
+
 -- Boards to groups mapping (visibility of boards for groups)
 create table if not exists board_groups(
 	board_id bigint not null references boards(id) on delete cascade,
@@ -1554,6 +2824,39 @@ create table if not exists board_groups(
 	primary key(board_id, group_id)
 );
 
+-- Direct board members with a role (0 Viewer, 1 Member, 2 Maintainer); the owner is boards.created_by
+create table if not exists board_members(
+	board_id bigint not null references boards(id) on delete cascade,
+	user_id bigint not null references users(id) on delete cascade,
+	role smallint not null default 1,
+	added_by bigint references users(id) on delete set null,
+	created_at timestamptz not null default now(),
+	primary key(board_id, user_id)
+);
+create index if not exists board_members_user_idx on board_members(user_id);
+
+-- Invitations to a board, project or group: reusable links (email null) or single-use email invites
+create table if not exists invites(
+	id bigserial primary key,
+	token text unique not null,
+	board_id bigint references boards(id) on delete cascade,
+	project_id bigint references projects(id) on delete cascade,
+	group_id bigint references groups(id) on delete cascade,
+	role smallint not null default 1,
+	email text,
+	created_by bigint references users(id) on delete set null,
+	created_at timestamptz not null default now(),
+	expires_at timestamptz not null,
+	accepted_by bigint references users(id) on delete set null,
+	accepted_at timestamptz,
+	uses int not null default 0,
+	check (num_nonnulls(board_id, project_id, group_id) = 1)
+);
+create index if not exists invites_email_idx on invites(email) where email is not null and accepted_at is null;
+-- guest invites (boards only) create guest accounts on registration
+alter table invites add column if not exists guest boolean not null default false;
+alter table invites add column if not exists guest_expires_at timestamptz;
+
 -- Link boards.project_id to projects.id, created_by to users.id if tables exist
 do $$ begin
 	if exists (select 1 from information_schema.tables where table_name='projects') then
@@ -1573,4 +2876,635 @@ do $$ begin
 		exception when duplicate_object then null; end;
 	end if;
 end $$;
+
+-- Organizations (tenants): they own boards, projects and groups. Members have an org role
+-- (1 member, 2 admin, 3 owner); users.is_admin stays the instance-wide admin.
+create table if not exists orgs(
+	id bigserial primary key,
+	name text not null check (length(name) > 0),
+	is_default boolean not null default false,
+	created_at timestamptz not null default now()
+);
+create unique index if not exists orgs_default_idx on orgs(is_default) where is_default;
+create table if not exists org_members(
+	org_id bigint not null references orgs(id) on delete cascade,
+	user_id bigint not null references users(id) on delete cascade,
+	role smallint not null default 1,
+	created_at timestamptz not null default now(),
+	primary key(org_id, user_id)
+);
+create index if not exists org_members_user_idx on org_members(user_id);
+-- the default organization takes over everything created before organizations existed
+insert into orgs(name, is_default) select 'Default', true where not exists (select 1 from orgs where is_default);
+alter table boards add column if not exists org_id bigint references orgs(id) on delete cascade;
+alter table projects add column if not exists org_id bigint references orgs(id) on delete cascade;
+alter table groups add column if not exists org_id bigint references orgs(id) on delete cascade;
+update boards set org_id = (select id from orgs where is_default) where org_id is null;
+update projects set org_id = (select id from orgs where is_default) where org_id is null;
+update groups set org_id = (select id from orgs where is_default) where org_id is null;
+alter table boards alter column org_id set not null;
+alter table projects alter column org_id set not null;
+alter table groups alter column org_id set not null;
+create index if not exists boards_org_pos_idx on boards(org_id, pos);
+create index if not exists projects_org_idx on projects(org_id);
+-- existing users join the default organization once, instance admins as its owners
+insert into org_members(org_id, user_id, role)
+	select o.id, u.id, case when u.is_admin then 3 else 1 end from orgs o cross join users u
+	where o.is_default and not exists (select 1 from org_members);
+-- group names and default projects are unique per organization
+alter table groups drop constraint if exists groups_name_key;
+create unique index if not exists groups_org_name_idx on groups(org_id, name);
+drop index if exists projects_default_owner_idx;
+create unique index if not exists projects_default_org_owner_idx on projects(org_id, owner_user_id) where is_default;
+-- Event log for SSE resume (Last-Event-ID): per-board ids, the last EVENT_LOG_SIZE events per board.
+-- No foreign key: events of a deleted board stay replayable until pruned.
+create table if not exists board_event_seq (
+  board_id bigint primary key,
+  seq bigint not null default 0
+);
+create table if not exists board_events (
+  board_id bigint not null,
+  seq bigint not null,
+  data jsonb not null,
+  created_at timestamptz not null default now(),
+  primary key (board_id, seq)
+);
+-- Optimistic concurrency: bumped on every change to the row's own fields (not on sibling renumbering).
+alter table boards add column if not exists version bigint not null default 1;
+alter table lists add column if not exists version bigint not null default 1;
+alter table cards add column if not exists version bigint not null default 1;
+alter table comments add column if not exists version bigint not null default 1;
+-- Collaborative description editing: cards.description is the text at doc_rev, written
+-- with every operation; the last few hundred operations are kept in card_doc_ops.
+alter table cards add column if not exists doc_rev bigint not null default 0;
+create table if not exists card_doc_ops (
+  card_id bigint not null references cards(id) on delete cascade,
+  rev bigint not null,
+  user_id bigint,
+  client_id text not null default '',
+  op jsonb not null,
+  created_at timestamptz not null default now(),
+  primary key (card_id, rev)
+);
+-- Delta sync: every write stamps the row with its transaction id (sync_xid), deletes
+-- leave tombstones. A sync cursor is the xmin of a snapshot: whatever it didn't see
+-- was written by a transaction numbered at least that, so "sync_xid >= cursor" misses nothing.
+alter table boards add column if not exists sync_xid bigint not null default 0;
+alter table lists add column if not exists sync_xid bigint not null default 0;
+alter table cards add column if not exists sync_xid bigint not null default 0;
+alter table comments add column if not exists sync_xid bigint not null default 0;
+create table if not exists sync_tombstones (
+  board_id bigint not null references boards(id) on delete cascade,
+  kind text not null, -- list, card, comment
+  entity_id bigint not null,
+  sync_xid bigint not null default pg_current_xact_id()::text::bigint,
+  deleted_at timestamptz not null default now()
+);
+create index if not exists sync_tombstones_board on sync_tombstones(board_id, sync_xid);
+-- newest pruned tombstone per board: older cursors can't be served any more
+create table if not exists sync_horizons (
+  board_id bigint primary key references boards(id) on delete cascade,
+  sync_xid bigint not null
+);
+create or replace function sync_touch() returns trigger language plpgsql as $$
+begin
+  new.sync_xid := pg_current_xact_id()::text::bigint;
+  return new;
+end $$;
+-- tombstones only for rows deleted on their own: a list or card deleted along with its
+-- parent is covered by the parent's tombstone (the parent is already gone here)
+create or replace function sync_tombstone() returns trigger language plpgsql as $$
+declare b bigint;
+begin
+  if tg_table_name = 'lists' then
+    select id into b from boards where id = old.board_id;
+  elsif tg_table_name = 'cards' then
+    select board_id into b from lists where id = old.list_id;
+  else
+    select l.board_id into b from cards c join lists l on l.id = c.list_id where c.id = old.card_id;
+  end if;
+  if b is not null then
+    insert into sync_tombstones(board_id, kind, entity_id) values (b, tg_argv[0], old.id);
+  end if;
+  return old;
+end $$;
+-- a card moved to another board is deleted from the old one; its comments move along
+create or replace function sync_card_moved() returns trigger language plpgsql as $$
+declare ob bigint; nb bigint;
+begin
+  select board_id into ob from lists where id = old.list_id;
+  select board_id into nb from lists where id = new.list_id;
+  if ob is distinct from nb and ob is not null then
+    insert into sync_tombstones(board_id, kind, entity_id) values (ob, 'card', old.id);
+    update comments set card_id = card_id where card_id = new.id; -- re-stamped by sync_touch
+  end if;
+  return null;
+end $$;
+-- a list moved to another board is deleted from the old one (its cards and comments
+-- with it, as for a deleted list); they all show up as changed on the new one
+create or replace function sync_list_moved() returns trigger language plpgsql as $$
+begin
+  if old.board_id is distinct from new.board_id then
+    insert into sync_tombstones(board_id, kind, entity_id) values (old.board_id, 'list', old.id);
+    update cards set pos = pos where list_id = new.id; -- re-stamped by sync_touch
+    update comments set card_id = card_id where card_id in (select id from cards where list_id = new.id);
+  end if;
+  return null;
+end $$;
+create or replace trigger boards_sync_touch before insert or update on boards for each row execute function sync_touch();
+create or replace trigger lists_sync_touch before insert or update on lists for each row execute function sync_touch();
+create or replace trigger cards_sync_touch before insert or update on cards for each row execute function sync_touch();
+create or replace trigger comments_sync_touch before insert or update on comments for each row execute function sync_touch();
+create or replace trigger lists_sync_tombstone after delete on lists for each row execute function sync_tombstone('list');
+create or replace trigger cards_sync_tombstone after delete on cards for each row execute function sync_tombstone('card');
+create or replace trigger comments_sync_tombstone after delete on comments for each row execute function sync_tombstone('comment');
+create or replace trigger cards_sync_moved after update of list_id on cards for each row execute function sync_card_moved();
+create or replace trigger lists_sync_moved after update of board_id on lists for each row execute function sync_list_moved();
+-- pushed offline operations by client id, so a push retried after a lost response
+-- doesn't apply them twice; status 0 while the operation runs (a stale claim is
+-- taken over, see ClaimSyncOp)
+create table if not exists sync_ops (
+  user_id bigint not null references users(id) on delete cascade,
+  op_id text not null,
+  status int not null default 0,
+  body text not null default '',
+  created_at timestamptz not null default now(),
+  primary key (user_id, op_id)
+);
 `
+
+// Event log
+
+// AppendEvent implements EventLog: it takes the board's next event id and stores the event,
+// pruning everything but the last keep events.
+func (s *Store) AppendEvent(ctx context.Context, boardID int64, data []byte, keep int) (int64, error) {
+	var seq int64
+	err := s.db.QueryRowContext(ctx, `with next as (
+		insert into board_event_seq(board_id, seq) values ($1, 1)
+		on conflict (board_id) do update set seq = board_event_seq.seq + 1
+		returning seq
+	)
+	insert into board_events(board_id, seq, data) select $1, seq, $2 from next returning seq`, boardID, string(data)).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	if keep > 0 && seq > int64(keep) {
+		if _, err := s.db.ExecContext(ctx, `delete from board_events where board_id=$1 and seq <= $2`, boardID, seq-int64(keep)); err != nil {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// EventsSince implements EventLog.
+func (s *Store) EventsSince(ctx context.Context, boardID, after int64, limit int) ([]LoggedEvent, bool, error) {
+	head, err := s.LastEventID(ctx, boardID)
+	if err != nil {
+		return nil, false, err
+	}
+	if after == head {
+		return nil, true, nil
+	}
+	if after > head || head-after > int64(limit) {
+		return nil, false, nil
+	}
+	rows, err := s.db.QueryContext(ctx, `select seq, data from board_events where board_id=$1 and seq > $2 order by seq limit $3`, boardID, after, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var out []LoggedEvent
+	for rows.Next() {
+		var ev LoggedEvent
+		if err := rows.Scan(&ev.ID, &ev.Data); err != nil {
+			return nil, false, err
+		}
+		out = append(out, ev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(out) == 0 || out[0].ID != after+1 {
+		return nil, false, nil
+	}
+	return out, true, nil
+}
+
+// EventData loads one logged event, for NOTIFY payloads that only carry its id.
+func (s *Store) EventData(ctx context.Context, boardID, id int64) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `select data from board_events where board_id=$1 and seq=$2`, boardID, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Notify sends a Postgres notification on channel.
+func (s *Store) Notify(ctx context.Context, channel, payload string) error {
+	_, err := s.db.ExecContext(ctx, `select pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+// LastEventID is the id of the board's latest event, 0 when it has none.
+func (s *Store) LastEventID(ctx context.Context, boardID int64) (int64, error) {
+	var seq int64
+	err := s.db.QueryRowContext(ctx, `select coalesce((select seq from board_event_seq where board_id=$1), 0)`, boardID).Scan(&seq)
+	return seq, err
+}
+
+// Collaborative card descriptions
+
+// cardDocOpsKept operations stay in the log, so a client that far behind can still have
+// its operation transformed.
+const cardDocOpsKept = 500
+
+// ErrDocStale is returned for an operation based on a revision that is no longer (or
+// not yet) in the log; the client has to reload the document.
+var ErrDocStale = errors.New("document revision unavailable")
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// replayCardDoc brings the snapshot (text at snapRev) up to the latest revision and
+// also returns the operations after revision from, which must still be in the log.
+func replayCardDoc(ctx context.Context, q queryer, cardID int64, text string, snapRev, from int64) (string, int64, []CardDocOp, error) {
+	lo := min(from, snapRev)
+	rows, err := q.QueryContext(ctx, `select rev, op, user_id, client_id from card_doc_ops where card_id=$1 and rev > $2 order by rev`, cardID, lo)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer rows.Close()
+	head := lo
+	var since []CardDocOp
+	for rows.Next() {
+		var o CardDocOp
+		var data []byte
+		if err := rows.Scan(&o.Rev, &data, &o.UserID, &o.ClientID); err != nil {
+			return "", 0, nil, err
+		}
+		if o.Rev != head+1 {
+			return "", 0, nil, ErrDocStale // pruned
+		}
+		head = o.Rev
+		if err := json.Unmarshal(data, &o.Op); err != nil {
+			return "", 0, nil, err
+		}
+		if o.Rev > snapRev {
+			if text, err = o.Op.apply(text); err != nil {
+				return "", 0, nil, fmt.Errorf("card %d doc rev %d: %w", cardID, o.Rev, err)
+			}
+		}
+		if o.Rev > from {
+			since = append(since, o)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", 0, nil, err
+	}
+	if head < snapRev || from > head {
+		return "", 0, nil, ErrDocStale
+	}
+	return text, head, since, nil
+}
+
+// CardDoc returns the card's description at its latest revision; with since >= 0 also
+// the operations after that revision.
+func (s *Store) CardDoc(ctx context.Context, cardID, since int64) (CardDoc, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return CardDoc{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	d := CardDoc{CardID: cardID}
+	var snapRev int64
+	err = tx.QueryRowContext(ctx, `select description, doc_rev, coalesce(description_is_md,false) from cards where id=$1`, cardID).
+		Scan(&d.Text, &snapRev, &d.IsMD)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CardDoc{}, ErrNotFound
+	}
+	if err != nil {
+		return CardDoc{}, err
+	}
+	from := since
+	if from < 0 {
+		from = snapRev
+	}
+	d.Text, d.Rev, d.Ops, err = replayCardDoc(ctx, tx, cardID, d.Text, snapRev, from)
+	if since < 0 {
+		d.Ops = nil
+	}
+	return d, err
+}
+
+// ApplyCardDocOp applies an operation a client made on revision baseRev: it is
+// transformed against everything applied since, logged as the next revision and
+// returned in that transformed form, which is what the other editors apply.
+func (s *Store) ApplyCardDocOp(ctx context.Context, cardID, userID int64, clientID string, baseRev int64, op textOp) (textOp, int64, error) {
+	return s.editCardDoc(ctx, cardID, userID, clientID, baseRev, func(text string, since []CardDocOp) (textOp, error) {
+		for _, o := range since {
+			var err error
+			if op, _, err = transform(op, o.Op); err != nil {
+				return nil, err
+			}
+		}
+		if op == nil {
+			op = textOp{} // still logged: it is the sender's acknowledgement
+		}
+		return op, nil
+	})
+}
+
+// replaceCardDoc is the edit that sets the whole description (a plain PATCH) as an
+// operation on the latest revision, so editors that have the card open follow along.
+func replaceCardDoc(text string) func(string, []CardDocOp) (textOp, error) {
+	return func(cur string, _ []CardDocOp) (textOp, error) {
+		if op := replaceOp(cur, text); !op.isNoop() {
+			return op, nil
+		}
+		return nil, nil
+	}
+}
+
+// SnapshotCardDoc writes the latest revision back to cards.description.
+func (s *Store) SnapshotCardDoc(ctx context.Context, cardID int64) error {
+	_, _, err := s.editCardDoc(ctx, cardID, 0, "", -1, func(string, []CardDocOp) (textOp, error) { return nil, nil })
+	return err
+}
+
+// SnapshotCardDocs catches up the cards whose description is behind their operation
+// log, which earlier versions wrote back only after a pause in editing. Run at startup.
+func (s *Store) SnapshotCardDocs(ctx context.Context) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `select c.id from cards c where exists (select 1 from card_doc_ops o where o.card_id = c.id and o.rev > c.doc_rev)`)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		if err := s.SnapshotCardDoc(ctx, id); err != nil && !errors.Is(err, ErrNotFound) {
+			return 0, fmt.Errorf("card %d: %w", id, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// editCardDoc runs an edit with the card row locked, so revisions are assigned one at a
+// time across instances, and writes the resulting text to cards.description in the same
+// transaction: readers of the card never see it behind the log. baseRev -1 means the
+// latest revision. A nil operation from edit only catches the description up.
+func (s *Store) editCardDoc(ctx context.Context, cardID, userID int64, clientID string, baseRev int64, edit func(text string, since []CardDocOp) (textOp, error)) (textOp, int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+	op, rev, err := editCardDocTx(ctx, tx, cardID, userID, clientID, baseRev, edit)
+	if err != nil {
+		return nil, 0, err
+	}
+	return op, rev, tx.Commit()
+}
+
+// editCardDocTx is editCardDoc within the caller's transaction.
+func editCardDocTx(ctx context.Context, tx *sql.Tx, cardID, userID int64, clientID string, baseRev int64, edit func(text string, since []CardDocOp) (textOp, error)) (textOp, int64, error) {
+	var text string
+	var snapRev int64
+	err := tx.QueryRowContext(ctx, `select description, doc_rev from cards where id=$1 for update`, cardID).Scan(&text, &snapRev)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	from := baseRev
+	if from < 0 {
+		from = snapRev
+	}
+	text, rev, since, err := replayCardDoc(ctx, tx, cardID, text, snapRev, from)
+	if err != nil {
+		return nil, 0, err
+	}
+	op, err := edit(text, since)
+	if err != nil {
+		return nil, 0, err
+	}
+	if op != nil {
+		if text, err = op.apply(text); err != nil {
+			return nil, 0, err
+		}
+		data, err := json.Marshal(op)
+		if err != nil {
+			return nil, 0, err
+		}
+		var uid *int64
+		if userID != 0 {
+			uid = &userID
+		}
+		rev++
+		if _, err := tx.ExecContext(ctx, `insert into card_doc_ops(card_id, rev, user_id, client_id, op) values($1,$2,$3,$4,$5)`, cardID, rev, uid, clientID, string(data)); err != nil {
+			return nil, 0, err
+		}
+	}
+	if rev > snapRev {
+		if _, err := tx.ExecContext(ctx, `update cards set description=$1, doc_rev=$2 where id=$3`, text, rev, cardID); err != nil {
+			return nil, 0, err
+		}
+		if _, err := tx.ExecContext(ctx, `delete from card_doc_ops where card_id=$1 and rev <= $2`, cardID, rev-cardDocOpsKept); err != nil {
+			return nil, 0, err
+		}
+	}
+	return op, rev, nil
+}
+
+// Delta sync
+
+// ErrCursorExpired is returned for a sync cursor older than the tombstones still kept;
+// the client has to reload the board.
+var ErrCursorExpired = errors.New("sync cursor expired")
+
+// SyncCursor is a cursor for changes after now, e.g. for a snapshot read right after.
+func (s *Store) SyncCursor(ctx context.Context) (int64, error) {
+	var cursor int64
+	err := s.db.QueryRowContext(ctx, `select pg_snapshot_xmin(pg_current_snapshot())::text::bigint`).Scan(&cursor)
+	return cursor, err
+}
+
+// PruneTombstones drops the board's tombstones older than ttl, remembering the newest
+// dropped one so that cursors from before it are refused.
+func (s *Store) PruneTombstones(ctx context.Context, boardID int64, ttl time.Duration) error {
+	_, err := s.db.ExecContext(ctx, `with pruned as (
+		delete from sync_tombstones where board_id=$1 and deleted_at < now() - $2::interval returning sync_xid
+	)
+	insert into sync_horizons(board_id, sync_xid) select $1, max(sync_xid) from pruned having count(*) > 0
+	on conflict (board_id) do update set sync_xid = greatest(sync_horizons.sync_xid, excluded.sync_xid)`,
+		boardID, fmt.Sprintf("%d seconds", int64(ttl.Seconds())))
+	return err
+}
+
+// BoardChanges returns the board's rows written and deleted since cursor (0: everything)
+// and the cursor to continue from, all read from one snapshot.
+func (s *Store) BoardChanges(ctx context.Context, boardID, cursor int64) (*BoardChanges, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	out := &BoardChanges{Lists: []List{}, Cards: []Card{}, Comments: []Comment{}, Deleted: []Tombstone{}}
+	var b Board
+	var horizon, boardXid int64
+	err = tx.QueryRowContext(ctx, `select pg_snapshot_xmin(pg_current_snapshot())::text::bigint, coalesce(h.sync_xid, 0),
+		b.sync_xid, b.id, b.title, coalesce(b.color,''), b.created_at, b.project_id, b.created_by, b.org_id, b.version
+		from boards b left join sync_horizons h on h.board_id = b.id where b.id=$1`, boardID).
+		Scan(&out.Cursor, &horizon, &boardXid, &b.ID, &b.Title, &b.Color, &b.CreatedAt, &b.ProjectID, &b.CreatedBy, &b.OrgID, &b.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cursor > 0 && cursor <= horizon {
+		return nil, ErrCursorExpired
+	}
+	if boardXid >= cursor {
+		out.Board = &b
+	}
+
+	rows, err := tx.QueryContext(ctx, `select id, board_id, title, coalesce(color,''), pos, created_at, version
+		from lists where board_id=$1 and sync_xid >= $2 order by pos, id`, boardID, cursor)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var l List
+		if err := rows.Scan(&l.ID, &l.BoardID, &l.Title, &l.Color, &l.Pos, &l.CreatedAt, &l.Version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out.Lists = append(out.Lists, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+	select c.id, c.list_id, c.parent_card_id, c.title, c.description, coalesce(c.color,''), c.pos, c.due_at, c.assignee_user_id,
+		   coalesce(u.name, u.email, ''), c.created_at, coalesce(c.description_is_md,false), c.version
+	from cards c join lists l on l.id = c.list_id left join users u on u.id = c.assignee_user_id
+	where l.board_id=$1 and c.sync_xid >= $2 order by c.list_id, c.pos, c.id`, boardID, cursor)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c Card
+		if err := rows.Scan(&c.ID, &c.ListID, &c.ParentID, &c.Title, &c.Description, &c.Color, &c.Pos, &c.DueAt, &c.AssigneeUserID,
+			&c.Assignee, &c.CreatedAt, &c.DescriptionIsMD, &c.Version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out.Cards = append(out.Cards, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+	select cm.id, cm.card_id, cm.body, cm.created_at, cm.user_id, cm.version, coalesce(u.name, u.email, '')
+	from comments cm join cards c on c.id = cm.card_id join lists l on l.id = c.list_id left join users u on u.id = cm.user_id
+	where l.board_id=$1 and cm.sync_xid >= $2 order by cm.id`, boardID, cursor)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c Comment
+		if err := rows.Scan(&c.ID, &c.CardID, &c.Body, &c.CreatedAt, &c.UserID, &c.Version, &c.Author); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out.Comments = append(out.Comments, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if cursor > 0 {
+		rows, err = tx.QueryContext(ctx, `select kind, entity_id, deleted_at from sync_tombstones
+			where board_id=$1 and sync_xid >= $2 order by sync_xid, deleted_at`, boardID, cursor)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var t Tombstone
+			if err := rows.Scan(&t.Kind, &t.ID, &t.DeletedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out.Deleted = append(out.Deleted, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return out, tx.Commit()
+}
+
+// syncOpsKept is how long results of pushed operations are remembered for retries.
+const syncOpsKept = 7 * 24 * time.Hour
+
+// syncOpClaimTimeout is how long a claim (status 0) holds: one left behind by a crash is
+// taken over after that. Operations are single REST calls, far shorter than this.
+const syncOpClaimTimeout = 2 * time.Minute
+
+// ClaimSyncOp reserves a pushed operation id for running it. When the id is taken the
+// operation ran (or is running, status 0) already and its stored result is returned;
+// a claim older than syncOpClaimTimeout is taken over instead.
+func (s *Store) ClaimSyncOp(ctx context.Context, userID int64, opID string) (claimed bool, status int, body []byte, err error) {
+	res, err := s.db.ExecContext(ctx, `insert into sync_ops(user_id, op_id) values($1,$2)
+		on conflict (user_id, op_id) do update set created_at=now()
+		where sync_ops.status=0 and sync_ops.created_at < now() - $3::interval`,
+		userID, opID, fmt.Sprintf("%d seconds", int64(syncOpClaimTimeout.Seconds())))
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return true, 0, nil, nil
+	}
+	var b string
+	err = s.db.QueryRowContext(ctx, `select status, body from sync_ops where user_id=$1 and op_id=$2`, userID, opID).Scan(&status, &b)
+	return false, status, []byte(b), err
+}
+
+// FinishSyncOp stores the result of a claimed operation; a nil body releases the claim
+// instead, so the operation can be retried.
+func (s *Store) FinishSyncOp(ctx context.Context, userID int64, opID string, status int, body []byte) error {
+	if body == nil {
+		_, err := s.db.ExecContext(ctx, `delete from sync_ops where user_id=$1 and op_id=$2`, userID, opID)
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, `update sync_ops set status=$3, body=$4 where user_id=$1 and op_id=$2`, userID, opID, status, string(body))
+	return err
+}
+
+// PruneSyncOps forgets the user's pushed operations older than syncOpsKept.
+func (s *Store) PruneSyncOps(ctx context.Context, userID int64) error {
+	_, err := s.db.ExecContext(ctx, `delete from sync_ops where user_id=$1 and created_at < now() - $2::interval`,
+		userID, fmt.Sprintf("%d seconds", int64(syncOpsKept.Seconds())))
+	return err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResolveSyncRefs(t *testing.T) {
+	refs := map[string]int64{"list": 7, "failed": 0}
+	tests := []struct {
+		name   string
+		target string
+		body   string
+		want   int64
+		ok     bool
+		wantBd string
+	}{
+		{"no target is the board", ``, `{"title":"x"}`, 3, true, `{"title":"x"}`},
+		{"null target is the board", `null`, `{}`, 3, true, `{}`},
+		{"id", `15`, `{}`, 15, true, `{}`},
+		{"ref", `"list"`, `{}`, 7, true, `{}`},
+		{"unknown ref", `"nope"`, `{}`, 0, true, `{}`},
+		{"failed ref", `"failed"`, `{}`, 0, false, ``},
+		{"ref in the body", `9`, `{"target_list_id":"list","new_index":0}`, 9, true, `{"new_index":0,"target_list_id":7}`},
+		{"failed ref in the body", `9`, `{"parent_id":"failed"}`, 0, false, ``},
+		{"ids and other fields kept", `9`, `{"parent_id":4, "title":"list"}`, 9, true, `{"parent_id":4, "title":"list"}`},
+		{"body not an object", `9`, `[1]`, 9, true, `[1]`},
+	}
+	for _, tt := range tests {
+		op := syncOp{Type: "card.move", Target: json.RawMessage(tt.target), Body: json.RawMessage(tt.body)}
+		target, body, ok := resolveSyncRefs(op, 3, refs)
+		if target != tt.want || ok != tt.ok || ok && string(body) != tt.wantBd {
+			t.Errorf("%s: %d %s %v, want %d %s %v", tt.name, target, body, ok, tt.want, tt.wantBd, tt.ok)
+		}
+	}
+
+	// the operation fails without running
+	r := httptest.NewRequest("POST", "/api/boards/3/changes", nil)
+	res := (&api{}).runSyncOp(r, 1, 3, syncOp{ID: "op", Ref: "card", Type: "card.create", Target: json.RawMessage(`"failed"`)}, refs)
+	if res.Status != http.StatusFailedDependency || res.ID != "op" || res.Ref != "card" {
+		t.Fatalf("dependent op: %+v", res)
+	}
+}
+
+func TestClaimSyncOp(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	u := testUser(t, s, "syncops", OrgRoleMember)
+	opID := fmt.Sprintf("op-%d", time.Now().UnixNano())
+	age := func(d time.Duration) {
+		t.Helper()
+		_, err := s.db.ExecContext(ctx, `update sync_ops set created_at=now() - $3::interval where user_id=$1 and op_id=$2`,
+			u.ID, opID, fmt.Sprintf("%d seconds", int64(d.Seconds())))
+		must(t, err)
+	}
+	claim := func(want bool, wantStatus int, wantBody string) {
+		t.Helper()
+		claimed, status, body, err := s.ClaimSyncOp(ctx, u.ID, opID)
+		if err != nil || claimed != want || !claimed && (status != wantStatus || string(body) != wantBody) {
+			t.Fatalf("claimed %v, %d %q, %v; want %v, %d %q", claimed, status, body, err, want, wantStatus, wantBody)
+		}
+	}
+
+	claim(true, 0, "")
+	claim(false, 0, "") // running
+	age(syncOpClaimTimeout / 2)
+	claim(false, 0, "")
+	age(syncOpClaimTimeout + time.Minute) // abandoned by a crashed instance
+	claim(true, 0, "")
+	claim(false, 0, "") // the takeover is a fresh claim
+
+	must(t, s.FinishSyncOp(ctx, u.ID, opID, 201, []byte(`{"ok":true}`)))
+	claim(false, 201, `{"ok":true}`)
+	age(syncOpClaimTimeout + time.Minute) // results are kept
+	claim(false, 201, `{"ok":true}`)
+
+	// a released claim can be retried at once
+	opID += "-released"
+	claim(true, 0, "")
+	must(t, s.FinishSyncOp(ctx, u.ID, opID, 500, nil))
+	claim(true, 0, "")
+}
+
+func TestBoardChanges(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	u := testUser(t, s, "changes", OrgRoleMember)
+	b, err := s.CreateBoard(ctx, s.defaultOrg, u.ID, "changes board")
+	must(t, err)
+	l, err := s.CreateList(ctx, b.ID, "list")
+	must(t, err)
+	kept, err := s.CreateCard(ctx, l.ID, "kept", "", false)
+	must(t, err)
+	edited, err := s.CreateCard(ctx, l.ID, "edited", "", false)
+	must(t, err)
+	deleted, err := s.CreateCard(ctx, l.ID, "deleted", "", false)
+	must(t, err)
+
+	all, err := s.BoardChanges(ctx, b.ID, 0)
+	must(t, err)
+	if all.Board == nil || len(all.Lists) != 1 || len(all.Cards) != 3 || len(all.Deleted) != 0 || all.Cursor <= 0 {
+		t.Fatalf("full read: %+v", all)
+	}
+	if _, err := s.BoardChanges(ctx, -1, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing board: %v", err)
+	}
+
+	title := "edited again"
+	must(t, s.UpdateCard(ctx, edited.ID, &title, nil, nil, nil, nil, nil, nil))
+	_, err = s.AddComment(ctx, kept.ID, "hi", &u.ID)
+	must(t, err)
+	_, err = s.db.ExecContext(ctx, `delete from cards where id=$1`, deleted.ID)
+	must(t, err)
+
+	ch, err := s.BoardChanges(ctx, b.ID, all.Cursor)
+	must(t, err)
+	if len(ch.Cards) != 1 || ch.Cards[0].ID != edited.ID || ch.Cards[0].Title != title {
+		t.Fatalf("changed cards: %+v", ch.Cards)
+	}
+	if len(ch.Lists) != 0 || len(ch.Comments) != 1 || ch.Comments[0].CardID != kept.ID {
+		t.Fatalf("changed lists %+v, comments %+v", ch.Lists, ch.Comments)
+	}
+	if len(ch.Deleted) != 1 || ch.Deleted[0] != (Tombstone{Kind: "card", ID: deleted.ID, DeletedAt: ch.Deleted[0].DeletedAt}) {
+		t.Fatalf("tombstones: %+v", ch.Deleted)
+	}
+	if ch.Cursor < all.Cursor {
+		t.Fatalf("cursor went back: %d < %d", ch.Cursor, all.Cursor)
+	}
+
+	// recent tombstones stay; pruning older ones refuses the cursors that could miss them
+	must(t, s.PruneTombstones(ctx, b.ID, time.Hour))
+	if _, err := s.BoardChanges(ctx, b.ID, all.Cursor); err != nil {
+		t.Fatalf("after pruning nothing: %v", err)
+	}
+	_, err = s.db.ExecContext(ctx, `update sync_tombstones set deleted_at=now() - interval '2 hours' where board_id=$1`, b.ID)
+	must(t, err)
+	must(t, s.PruneTombstones(ctx, b.ID, time.Hour))
+	var left int
+	must(t, s.db.QueryRowContext(ctx, `select count(*) from sync_tombstones where board_id=$1`, b.ID).Scan(&left))
+	if left != 0 {
+		t.Fatalf("%d tombstones left", left)
+	}
+	if _, err := s.BoardChanges(ctx, b.ID, all.Cursor); !errors.Is(err, ErrCursorExpired) {
+		t.Fatalf("expired cursor: %v", err)
+	}
+	if _, err := s.BoardChanges(ctx, b.ID, ch.Cursor); err != nil {
+		t.Fatalf("cursor after the pruned tombstone: %v", err)
+	}
+
+	a := newAPI(s, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	mux := http.NewServeMux()
+	a.routes(mux)
+	token, _, err := s.CreateSession(ctx, u.ID, time.Hour)
+	must(t, err)
+	for cursor, want := range map[int64]int{all.Cursor: 410, ch.Cursor: 200} {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/boards/%d/changes?since=%d", b.ID, cursor), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("since=%d: %d %s, want %d", cursor, w.Code, w.Body, want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPositionBetween(t *testing.T) {
+	tests := []struct {
+		positions []int64
+		index     int
+		want      int64
+		ok        bool
+	}{
+		{nil, 0, 1000, true},
+		{nil, 5, 1000, true},
+		{[]int64{1000, 2000}, 2, 3000, true},
+		{[]int64{1000, 2000}, 9, 3000, true},
+		{[]int64{1000, 2000}, 0, 500, true},
+		{[]int64{1000, 2000}, -3, 500, true},
+		{[]int64{300, 2000}, 0, 1, true},
+		{[]int64{1000, 2000}, 1, 1500, true},
+		{[]int64{1000, 1002}, 1, 1001, true},
+		{[]int64{1000, 1001}, 1, 0, false},
+		{[]int64{1000, 1000}, 1, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := positionBetween(tt.positions, tt.index)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%v at %d: %d %v, want %d %v", tt.positions, tt.index, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestVersionedWrites checks that the version is bumped only together with a write that
+// lands: stale versions and failed writes leave it (and the row) as it was.
+func TestVersionedWrites(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	u := testUser(t, s, "versions", OrgRoleMember)
+	b, err := s.CreateBoard(ctx, s.defaultOrg, u.ID, "versions board")
+	must(t, err)
+	l, err := s.CreateList(ctx, b.ID, "list")
+	must(t, err)
+	other, err := s.CreateList(ctx, b.ID, "other")
+	must(t, err)
+	c, err := s.CreateCard(ctx, l.ID, "card", "", false)
+	must(t, err)
+	title := "renamed"
+
+	// board
+	v, err := s.UpdateBoard(ctx, b.ID, b.Version, &title, nil)
+	if err != nil || v != b.Version+1 {
+		t.Fatalf("update board: %d %v", v, err)
+	}
+	stale := "stale"
+	if _, err := s.UpdateBoard(ctx, b.ID, b.Version, &stale, nil); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("stale board update: %v", err)
+	}
+	if got, _ := s.GetBoard(ctx, b.ID); got.Title != title || got.Version != v {
+		t.Fatalf("board after conflict: %q v%d", got.Title, got.Version)
+	}
+	if _, err := s.UpdateBoard(ctx, -1, 0, &title, nil); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing board: %v", err)
+	}
+	if v2, err := s.MoveBoard(ctx, b.ID, 0, v); err != nil || v2 != v+1 {
+		t.Fatalf("move board: %d %v", v2, err)
+	}
+
+	// list
+	v, err = s.UpdateList(ctx, l.ID, l.Version, &title, nil, nil)
+	must(t, err)
+	if _, err := s.MoveList(ctx, l.ID, 0, 1, l.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("stale list move: %v", err)
+	}
+	if _, err := s.MoveList(ctx, l.ID, -1, 0, v); err == nil {
+		t.Fatal("list moved to a missing board")
+	}
+	if got, _ := s.GetList(ctx, l.ID); got.Version != v || got.BoardID != b.ID {
+		t.Fatalf("list after failed move: v%d, want v%d on %d", got.Version, v, got.BoardID)
+	}
+
+	// card: a move that fails rolls the bump back
+	if _, err := s.MoveCard(ctx, c.ID, -1, 0, c.Version); err == nil {
+		t.Fatal("card moved to a missing list")
+	}
+	got, _ := s.GetCard(ctx, c.ID)
+	if got.Version != c.Version || got.ListID != l.ID {
+		t.Fatalf("card after failed move: v%d in %d", got.Version, got.ListID)
+	}
+	v, err = s.MoveCard(ctx, c.ID, other.ID, 0, c.Version)
+	if err != nil || v != c.Version+1 {
+		t.Fatalf("move card: %d %v", v, err)
+	}
+	if got, _ := s.GetCard(ctx, c.ID); got.ListID != other.ID || got.Version != v {
+		t.Fatalf("card after move: v%d in %d", got.Version, got.ListID)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Minimal server side of RFC 6455 WebSockets on top of net/http hijacking, with no
+// dependencies: text and binary messages, fragmentation, ping/pong and the closing
+// handshake. No extensions (permessage-deflate) or subprotocols are negotiated.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// close status codes (RFC 6455 section 7.4.1)
+const (
+	wsCloseNormal    = 1000
+	wsCloseGoingAway = 1001
+	wsCloseProtocol  = 1002
+	wsClosePolicy    = 1008
+	wsCloseTooBig    = 1009
+)
+
+const (
+	wsMaxMessage   = 1 << 20
+	wsWriteTimeout = 10 * time.Second
+	// the server pings every 25s, so a healthy client is never idle this long
+	wsIdleTimeout = 60 * time.Second
+)
+
+var errWSClosed = errors.New("websocket: closed by peer")
+
+type wsError struct {
+	code   uint16
+	reason string
+}
+
+func (e *wsError) Error() string { return "websocket: " + e.reason }
+
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex // one writer at a time: events, replies and pings share the connection
+}
+
+func headerHasToken(h http.Header, key, token string) bool {
+	for _, v := range h.Values(key) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsUpgrade performs the opening handshake. On failure it has already answered the
+// request and returns an error.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		writeError(w, 400, "websocket upgrade required")
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, 426, "unsupported websocket version")
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		writeError(w, 400, "bad websocket key")
+		return nil, errors.New("bad websocket key")
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, 500, "websocket unsupported")
+		return nil, err
+	}
+	// drop the server's read/write timeouts: they were meant for a single request
+	_ = conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " +
+		base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// readFrame reads one frame and unmasks its payload.
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return
+	}
+	fin, op = h[0]&0x80 != 0, h[0]&0x0f
+	if h[0]&0x70 != 0 {
+		return false, 0, nil, &wsError{wsCloseProtocol, "reserved bits set"}
+	}
+	if h[1]&0x80 == 0 {
+		return false, 0, nil, &wsError{wsCloseProtocol, "client frames must be masked"}
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= wsOpClose && (n > 125 || !fin) {
+		return false, 0, nil, &wsError{wsCloseProtocol, "bad control frame"}
+	}
+	if n > wsMaxMessage {
+		return false, 0, nil, &wsError{wsCloseTooBig, "message too big"}
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// ReadMessage returns the next text or binary message, answering pings and joining
+// fragments on the way. A close from the peer is answered and reported as errWSClosed;
+// protocol violations close the connection with the matching status.
+func (c *wsConn) ReadMessage() (op byte, msg []byte, err error) {
+	for {
+		fin, fop, payload, err := c.readFrame()
+		if err != nil {
+			var we *wsError
+			if errors.As(err, &we) {
+				c.Close(we.code, we.reason)
+			}
+			return 0, nil, err
+		}
+		switch fop {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			code := uint16(wsCloseNormal)
+			if len(payload) >= 2 {
+				code = binary.BigEndian.Uint16(payload)
+			}
+			c.Close(code, "")
+			return 0, nil, errWSClosed
+		case wsOpText, wsOpBinary:
+			if op != 0 {
+				c.Close(wsCloseProtocol, "expected continuation frame")
+				return 0, nil, &wsError{wsCloseProtocol, "expected continuation frame"}
+			}
+			op, msg = fop, payload
+		case wsOpContinuation:
+			if op == 0 {
+				c.Close(wsCloseProtocol, "unexpected continuation frame")
+				return 0, nil, &wsError{wsCloseProtocol, "unexpected continuation frame"}
+			}
+			if len(msg)+len(payload) > wsMaxMessage {
+				c.Close(wsCloseTooBig, "message too big")
+				return 0, nil, &wsError{wsCloseTooBig, "message too big"}
+			}
+			msg = append(msg, payload...)
+		default:
+			c.Close(wsCloseProtocol, "unknown opcode")
+			return 0, nil, &wsError{wsCloseProtocol, "unknown opcode"}
+		}
+		if fin {
+			return op, msg, nil
+		}
+	}
+}
+
+// writeFrame sends one unfragmented, unmasked frame. A client that doesn't read for
+// wsWriteTimeout makes it fail, which is what bounds a slow connection.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	hdr := make([]byte, 2, 10)
+	hdr[0] = 0x80 | op
+	switch n := len(payload); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	bufs := net.Buffers{hdr, payload}
+	_, err := bufs.WriteTo(c.conn)
+	return err
+}
+
+func (c *wsConn) WriteText(data []byte) error { return c.writeFrame(wsOpText, data) }
+
+func (c *wsConn) Ping() error { return c.writeFrame(wsOpPing, nil) }
+
+// Close sends a close frame (best effort) and closes the connection.
+func (c *wsConn) Close(code uint16, reason string) {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	_ = c.writeFrame(wsOpClose, append(payload, reason...))
+	_ = c.conn.Close()
+}
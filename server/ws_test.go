@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsClient is the client side of a test connection: it masks what it sends and reads the
+// server's frames as they come, without answering pings or closes itself.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// wsDial opens a socket on srv and performs the handshake with the extra headers.
+func wsDial(t *testing.T, srv *httptest.Server, path string, header http.Header) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	must(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	must(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	must(t, req.Write(conn))
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	must(t, err)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %d", resp.StatusCode)
+	}
+	// the RFC 6455 sample key and its accept value
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept %q", got)
+	}
+	return &wsClient{t: t, conn: conn, br: br}
+}
+
+func (c *wsClient) send(fin bool, op byte, payload []byte, masked bool) {
+	c.t.Helper()
+	b := []byte{op, 0}
+	if fin {
+		b[0] |= 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		b[1] = byte(n)
+	case n <= 0xffff:
+		b[1] = 126
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b[1] = 127
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	if masked {
+		b[1] |= 0x80
+		mask := [4]byte{1, 2, 3, 4}
+		b = append(b, mask[:]...)
+		for i, x := range payload {
+			b = append(b, x^mask[i%4])
+		}
+	} else {
+		b = append(b, payload...)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *wsClient) read() (op byte, payload []byte) {
+	c.t.Helper()
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if h[1]&0x80 != 0 {
+		c.t.Fatal("server frame is masked")
+	}
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		_, _ = io.ReadFull(c.br, b[:])
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		_, _ = io.ReadFull(c.br, b[:])
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return h[0] & 0x0f, payload
+}
+
+// expectClose reads the close frame the server sends and returns its status code.
+func (c *wsClient) expectClose() uint16 {
+	c.t.Helper()
+	op, payload := c.read()
+	if op != wsOpClose || len(payload) < 2 {
+		c.t.Fatalf("got opcode %d %q, want a close", op, payload)
+	}
+	return binary.BigEndian.Uint16(payload)
+}
+
+// wsEchoServer upgrades every request and echoes messages back; the error that ended a
+// connection is sent on the channel.
+func wsEchoServer(t *testing.T) (*httptest.Server, chan error) {
+	errs := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := wsUpgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			op, msg, err := conn.ReadMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			_ = conn.writeFrame(op, msg)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, errs
+}
+
+func TestWSUpgradeRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"plain request", map[string]string{"Sec-WebSocket-Version": "13"}, 400},
+		{"old version", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, 426},
+		{"key not base64", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "not a key!"}, 400},
+		{"short key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "c2hvcnQ="}, 400},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		if conn, err := wsUpgrade(w, r); err == nil || conn != nil || w.Code != tt.want {
+			t.Errorf("%s: %d %v, want %d", tt.name, w.Code, err, tt.want)
+		}
+		if tt.want == 426 && w.Header().Get("Sec-WebSocket-Version") != "13" {
+			t.Errorf("%s: no Sec-WebSocket-Version in the answer", tt.name)
+		}
+	}
+}
+
+func TestWSFrames(t *testing.T) {
+	srv, errs := wsEchoServer(t)
+
+	t.Run("fragments and ping", func(t *testing.T) {
+		c := wsDial(t, srv, "/", nil)
+		c.send(false, wsOpText, []byte("hel"), true)
+		c.send(true, wsOpPing, []byte("p"), true) // control frames may come between fragments
+		if op, payload := c.read(); op != wsOpPong || string(payload) != "p" {
+			t.Fatalf("ping answered with %d %q", op, payload)
+		}
+		c.send(false, wsOpContinuation, []byte("lo "), true)
+		c.send(true, wsOpContinuation, []byte("world"), true)
+		if op, payload := c.read(); op != wsOpText || string(payload) != "hello world" {
+			t.Fatalf("echo %d %q", op, payload)
+		}
+		c.send(true, wsOpPong, nil, true) // unsolicited pongs are ignored
+		c.send(true, wsOpBinary, []byte{0, 1}, true)
+		if op, payload := c.read(); op != wsOpBinary || string(payload) != "\x00\x01" {
+			t.Fatalf("echo %d %q", op, payload)
+		}
+
+		c.send(true, wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal), true)
+		if code := c.expectClose(); code != wsCloseNormal {
+			t.Fatalf("close answered with %d", code)
+		}
+		if err := <-errs; !errors.Is(err, errWSClosed) {
+			t.Fatalf("server: %v", err)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		frame func(c *wsClient)
+		code  uint16
+	}{
+		{"unmasked", func(c *wsClient) { c.send(true, wsOpText, []byte("hi"), false) }, wsCloseProtocol},
+		{"reserved bits", func(c *wsClient) { c.send(true, wsOpText|0x40, []byte("hi"), true) }, wsCloseProtocol},
+		{"unknown opcode", func(c *wsClient) { c.send(true, 0x3, nil, true) }, wsCloseProtocol},
+		{"fragmented ping", func(c *wsClient) { c.send(false, wsOpPing, nil, true) }, wsCloseProtocol},
+		{"long ping", func(c *wsClient) { c.send(true, wsOpPing, make([]byte, 126), true) }, wsCloseProtocol},
+		{"stray continuation", func(c *wsClient) { c.send(true, wsOpContinuation, []byte("x"), true) }, wsCloseProtocol},
+		{"message inside a message", func(c *wsClient) {
+			c.send(false, wsOpText, []byte("a"), true)
+			c.send(true, wsOpText, []byte("b"), true)
+		}, wsCloseProtocol},
+		{"oversized frame", func(c *wsClient) {
+			// only the header: the length alone is refused
+			hdr := binary.BigEndian.AppendUint64([]byte{0x80 | wsOpBinary, 0x80 | 127}, wsMaxMessage+1)
+			_, _ = c.conn.Write(hdr)
+		}, wsCloseTooBig},
+		{"oversized message", func(c *wsClient) {
+			c.send(false, wsOpText, make([]byte, wsMaxMessage/2+1), true)
+			c.send(true, wsOpContinuation, make([]byte, wsMaxMessage/2+1), true)
+		}, wsCloseTooBig},
+	}
+	for _, tt := range tests {
+		c := wsDial(t, srv, "/", nil)
+		tt.frame(c)
+		if code := c.expectClose(); code != tt.code {
+			t.Errorf("%s: closed with %d, want %d", tt.name, code, tt.code)
+		}
+		var we *wsError
+		if err := <-errs; !errors.As(err, &we) || we.code != tt.code {
+			t.Errorf("%s: server error %v", tt.name, err)
+		}
+	}
+}
+
+// TestBoardWS covers the board socket end to end: the Origin check for cookie sessions
+// and command replies carrying the REST handler's status.
+func TestBoardWS(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+	a := newAPI(s, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	mux := http.NewServeMux()
+	a.routes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	owner := testUser(t, s, "ws-owner", OrgRoleMember)
+	viewer := testUser(t, s, "ws-viewer", OrgRoleMember)
+	b, err := s.CreateBoard(ctx, s.defaultOrg, owner.ID, "ws board")
+	must(t, err)
+	must(t, s.AddBoardMember(ctx, b.ID, viewer.ID, RoleViewer, owner.ID))
+	l, err := s.CreateList(ctx, b.ID, "list")
+	must(t, err)
+	c, err := s.CreateCard(ctx, l.ID, "card", "", false)
+	must(t, err)
+	ownerToken, _, err := s.CreateSession(ctx, owner.ID, time.Hour)
+	must(t, err)
+	viewerToken, _, err := s.CreateSession(ctx, viewer.ID, time.Hour)
+	must(t, err)
+	path := fmt.Sprintf("/api/boards/%d/ws", b.ID)
+
+	// a cookie comes along on cross-site handshakes too
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	must(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", "https://evil.example")
+	req.AddCookie(&http.Cookie{Name: a.sessionCookieName(), Value: ownerToken})
+	resp, err := http.DefaultClient.Do(req)
+	must(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("cross-origin cookie handshake: %d", resp.StatusCode)
+	}
+
+	reply := func(ws *wsClient, cmd string) wsFrame {
+		t.Helper()
+		ws.send(true, wsOpText, []byte(cmd), true)
+		for {
+			op, payload := ws.read()
+			var f wsFrame
+			if op == wsOpText && json.Unmarshal(payload, &f) == nil && f.Type == "reply" {
+				return f
+			}
+		}
+	}
+	ws := wsDial(t, srv, path, http.Header{"Authorization": {"Bearer " + viewerToken}})
+	if f := reply(ws, fmt.Sprintf(`{"type":"card.update","seq":1,"target":%d,"body":{"title":"x"}}`, c.ID)); f.Seq != 1 || f.Status != 403 {
+		t.Fatalf("viewer update: %+v", f)
+	}
+	if f := reply(ws, `{"type":"nope","seq":2}`); f.Seq != 2 || f.Status != 400 {
+		t.Fatalf("unknown command: %+v", f)
+	}
+
+	ws = wsDial(t, srv, path, http.Header{"Authorization": {"Bearer " + ownerToken}, "Origin": {"https://evil.example"}})
+	stale := fmt.Sprintf(`{"type":"card.update","seq":3,"target":%d,"body":{"title":"x","version":%d}}`, c.ID, c.Version+1)
+	if f := reply(ws, stale); f.Seq != 3 || f.Status != 409 || !strings.Contains(string(f.Body), `"current"`) {
+		t.Fatalf("stale update: %+v %s", f, f.Body)
+	}
+	ok := fmt.Sprintf(`{"type":"card.update","seq":4,"target":%d,"body":{"title":"x","version":%d}}`, c.ID, c.Version)
+	if f := reply(ws, ok); f.Status != 200 {
+		t.Fatalf("update: %+v %s", f, f.Body)
+	}
+}
@@ -49,13 +49,38 @@ const adminApi = {
   }
 };
 
+// CSRF token bound to the session (from /api/auth/me), sent with every mutation
+let csrfToken = null;
+async function ensureCsrf(force) {
+  if (csrfToken && !force) return csrfToken;
+  try {
+    const r = await fetch('/api/auth/me');
+    const j = await r.json();
+    csrfToken = (j && j.csrf_token) || null;
+  } catch {}
+  return csrfToken;
+}
+
 // Shared fetch function
-async function fetchJSON(url, opts = {}) {
+async function fetchJSON(url, opts = {}, retried = false) {
   const init = { headers: { 'Content-Type': 'application/json' } };
   if (opts.method) init.method = opts.method;
   if (opts.body) init.body = JSON.stringify(opts.body);
+  const mutating = (init.method || 'GET').toUpperCase() !== 'GET';
+  if (mutating) {
+    const tok = await ensureCsrf();
+    if (tok) init.headers['X-CSRF-Token'] = tok;
+  }
   
   const res = await fetch(url, init);
+  if (res.status === 403 && mutating && !retried) {
+    let j = null;
+    try { j = await res.clone().json(); } catch {}
+    if (j && j.error === 'invalid csrf token') {
+      await ensureCsrf(true);
+      return fetchJSON(url, opts, true);
+    }
+  }
   if (!res.ok) {
     let msg = res.statusText;
     try {
@@ -72,11 +97,14 @@ async function fetchJSON(url, opts = {}) {
   if (res.status === 204) return null;
   const text = await res.text();
   if (!text) return null;
+  let data;
   try {
-    return JSON.parse(text);
+    data = JSON.parse(text);
   } catch {
     return null;
   }
+  if (url === '/api/auth/me' && data) csrfToken = data.csrf_token || null;
+  return data;
 }
 
 // Global state
@@ -196,7 +224,7 @@ function renderUsers() {
   tbody.innerHTML = adminState.users.map(user => `
     <tr>
       <td>${user.id}</td>
-      <td>${escapeHtml(user.name)}</td>
+      <td>${escapeHtml(user.name)}${user.is_guest ? ` <span class="status inactive">${window.t ? t('admin.users.guest') : 'Гость'}${user.guest_expires_at ? ' · ' + formatDate(user.guest_expires_at) : ''}</span>` : ''}</td>
       <td>${escapeHtml(user.email)}</td>
       <td>${formatDate(user.created_at)}</td>
   <td><span class="status ${user.is_admin ? 'active' : 'inactive'}">${user.is_admin ? (window.t ? t('admin.users.yes') : 'Да') : (window.t ? t('admin.users.no') : 'Нет')}</span></td>
@@ -233,6 +261,9 @@ function openUserDialog(user = null) {
   $('userEmail').value = isEdit ? user.email : '';
   $('userPassword').value = '';
   $('userIsAdmin').checked = isEdit ? user.is_admin : false;
+  $('userIsGuest').checked = isEdit ? !!user.is_guest : false;
+  $('userGuestExpires').value = isEdit && user.guest_expires_at ? user.guest_expires_at.slice(0, 10) : '';
+  $('userGuestField').style.display = isEdit ? '' : 'none';
   const cbVerified = $('userEmailVerified');
   if (cbVerified) cbVerified.checked = isEdit ? !!user.email_verified : false;
   const badge = $('userEmailVerifiedBadge');
@@ -281,6 +312,10 @@ async function saveUser() {
 
   if (!isEdit) {
     payload.password = formData.get('password');
+  } else {
+    payload.is_guest = formData.has('is_guest');
+    const until = formData.get('guest_expires_at');
+    payload.guest_expires_at = payload.is_guest && until ? new Date(until + 'T23:59:59').toISOString() : null;
   }
 
   try {
@@ -463,7 +498,7 @@ function renderGroupMembers(members, groupId) {
         <div class="member-name-modern">${escapeHtml(member.name)}</div>
         <div class="member-email-modern">${escapeHtml(member.email)}</div>
       </div>
-  <button class="btn-remove" onclick="removeFromGroup(${groupId}, ${member.id})">${window.t ? t('admin.groups.delete') : 'Удалить'}</button>
+      <button class="btn-remove" data-group-id="${groupId}" data-user-id="${member.id}">${window.t ? t('admin.groups.delete') : 'Удалить'}</button>
     </div>
   `).join('');
 }
@@ -593,6 +628,12 @@ function setupEventListeners() {
   $('btnCloseMembersDialog').addEventListener('click', () => {
     $('dlgGroupMembers').close();
   });
+  // the list is re-rendered, so its remove buttons are handled here (no inline handlers under the CSP)
+  $('membersList').addEventListener('click', (e) => {
+    const btn = e.target.closest('button[data-user-id]');
+    if (!btn) return;
+    removeFromGroup(Number(btn.getAttribute('data-group-id')), Number(btn.getAttribute('data-user-id')));
+  });
 
   // Search
   setupSearch();
@@ -1,5 +1,6 @@
 const api = {
   async me(){ return fetchJSON('/api/auth/me'); },
+  async setActiveOrg(org_id){ return fetchJSON('/api/me/org', {method:'PUT', body:{org_id}}); },
   async logout(){ return fetchJSON('/api/auth/logout', {method:'POST'}) },
   async getBoards(scope){ return fetchJSON('/api/boards' + (scope? ('?scope='+encodeURIComponent(scope)) : '')) },
   async createBoard(title){ return fetchJSON('/api/boards', {method:'POST', body:{title}}) },
@@ -8,6 +9,14 @@ const api = {
   async boardMembers(id){ return fetchJSON(`/api/boards/${id}/members`); },
   async getBoard(id){ return fetchJSON('/api/boards/'+id) },
   async getBoardFull(id){ return fetchJSON(`/api/boards/${id}/full`) },
+  async addBoardMember(id, body){ return fetchJSON(`/api/boards/${id}/members`, {method:'POST', body}) },
+  async updateBoardMember(id, uid, role){ return fetchJSON(`/api/boards/${id}/members/${uid}`, {method:'PATCH', body:{role}}) },
+  async removeBoardMember(id, uid){ return fetchJSON(`/api/boards/${id}/members/${uid}`, {method:'DELETE'}) },
+  async transferBoard(id, user_id){ return fetchJSON(`/api/boards/${id}/transfer`, {method:'POST', body:{user_id}}) },
+  async createInvite(body){ return fetchJSON('/api/invites', {method:'POST', body}) },
+  async listInvites(kind, target_id){ return fetchJSON(`/api/invites?kind=${kind}&target_id=${target_id}`) },
+  async revokeInvite(id){ return fetchJSON(`/api/invites/${id}`, {method:'DELETE'}) },
+  async acceptInvite(token){ return fetchJSON(`/api/join/${encodeURIComponent(token)}`, {method:'POST'}) },
   async updateBoard(id, title){ return fetchJSON(`/api/boards/${id}`, {method:'PATCH', body:{title}}) },
   async setBoardColor(id, color){ return fetchJSON(`/api/boards/${id}`, {method:'PATCH', body:{color}}) },
   async deleteBoard(id){ return fetchJSON(`/api/boards/${id}`, {method:'DELETE'}) },
@@ -16,6 +25,10 @@ const api = {
   async getCards(lid){ return fetchJSON(`/api/lists/${lid}/cards`) },
   async createCard(lid, title, description){ return fetchJSON(`/api/lists/${lid}/cards`, {method:'POST', body:{title, description}}) },
   async createCardAdvanced(lid, payload){ return fetchJSON(`/api/lists/${lid}/cards`, {method:'POST', body: payload}) },
+  async boardPresence(id){ return fetchJSON(`/api/boards/${id}/presence`) },
+  async setCardEditing(id, on){ return fetchJSON(`/api/cards/${id}/editing`, {method: on ? 'PUT' : 'DELETE'}) },
+  async cardDoc(id, since){ return fetchJSON(`/api/cards/${id}/doc` + (since != null ? `?since=${since}` : '')) },
+  async cardDocOp(id, body){ return fetchJSON(`/api/cards/${id}/doc`, {method:'POST', body}) },
   async moveCard(id, targetListId, newIndex){ return fetchJSON(`/api/cards/${id}/move`, {method:'POST', body:{target_list_id: targetListId, new_index: newIndex}}) },
   async updateList(id, payload){ return fetchJSON(`/api/lists/${id}`, {method:'PATCH', body:payload}) },
   async moveList(id, newIndex, targetBoardId){ return fetchJSON(`/api/lists/${id}/move`, {method:'POST', body:{new_index: newIndex, target_board_id: targetBoardId||0}}) },
@@ -47,14 +60,29 @@ const api = {
   async getOrCreateShare(cardId){ return fetchJSON(`/api/cards/${cardId}/share`); },
 };
 
-async function fetchJSON(url, opts={}){
+// CSRF token bound to the session; handed out by /api/auth/me and required on mutations
+let csrfToken = null;
+async function ensureCsrf(force){
+  if(csrfToken && !force) return csrfToken;
+  try { const r = await fetch('/api/auth/me'); const j = await r.json(); csrfToken = (j && j.csrf_token) || null; } catch {}
+  return csrfToken;
+}
+
+async function fetchJSON(url, opts={}, retried=false){
   const init = {headers:{'Content-Type':'application/json'}};
   if(opts.method) init.method = opts.method;
   if(opts.body) init.body = JSON.stringify(opts.body);
+  const mutating = (init.method||'GET').toUpperCase() !== 'GET';
+  if(mutating){ const tok = await ensureCsrf(); if(tok) init.headers['X-CSRF-Token'] = tok; }
   const res = await fetch(url, init);
+  if(res.status === 403 && mutating && !retried){
+    // token may be stale after re-login in another tab: refresh once and retry
+    let j = null; try { j = await res.clone().json(); } catch{}
+    if(j && j.error === 'invalid csrf token'){ await ensureCsrf(true); return fetchJSON(url, opts, true); }
+  }
   if(!res.ok){
-    let msg = res.statusText;
-    try { const j = await res.json(); if(j && j.error) msg = j.error } catch{}
+    let msg = res.statusText, body = null;
+    try { body = await res.json(); if(body && body.error) msg = body.error } catch{}
     if(res.status === 401){
       // redirect to login page only for non-GET (mutation) requests
       const method = (init.method||'GET').toUpperCase();
@@ -63,16 +91,20 @@ async function fetchJSON(url, opts={}){
         return Promise.reject(new Error('unauthorized'));
       }
     }
-    throw new Error(msg);
+    const err = new Error(msg); err.status = res.status; err.body = body;
+    throw err;
   }
   if(res.status === 204) return null;
   // some backends may send empty body with 200; guard json parse
   const text = await res.text();
   if(!text) return null;
-  try { return JSON.parse(text); } catch { return null; }
+  let data = null;
+  try { data = JSON.parse(text); } catch { return null; }
+  if(url === '/api/auth/me' && data) csrfToken = data.csrf_token || null;
+  return data;
 }
 
-const state = { boards: [], currentBoardId: null, boardMembers: new Map(), lists: [], cards: new Map(), currentCard: null, dragListCrossDrop: false, user: null, searchQuery: '', boardHoverTimer: null, boardHoverTargetId: 0, duplicationInProgress: false };
+const state = { boards: [], currentBoardId: null, boardMembers: new Map(), lists: [], cards: new Map(), currentCard: null, dragListCrossDrop: false, user: null, myRole: null, projectsRequired: false, searchQuery: '', boardHoverTimer: null, boardHoverTargetId: 0, duplicationInProgress: false, presence: new Map() };
 const DND_MIME = 'application/x-trellolite';
 const el = (id) => document.getElementById(id);
 const els = { boards: el('boards'), boardTitle: el('boardTitle'), lists: el('lists'),
@@ -227,13 +259,21 @@ async function init(){
     const apply = () => { state.searchQuery = (q.value||'').trim().toLowerCase(); renderBoardsList(); };
     let t; q.addEventListener('input', () => { clearTimeout(t); t = setTimeout(apply, 150); });
     q.addEventListener('keydown', (e) => { if(e.key === 'Escape'){ q.value=''; apply(); } });
+    if(q.form) q.form.addEventListener('submit', (e) => e.preventDefault());
   }
 
+  // Invitation link (/#invite=TOKEN): keep the token across the login/registration round trip
+  try{
+    const m = (location.hash||'').match(/invite=([^&]+)/);
+    if(m){ localStorage.setItem('pendingInvite', decodeURIComponent(m[1])); history.replaceState(null, '', location.pathname); }
+  }catch{}
   // Try to fetch current user; if not authorized, redirect to login (no anonymous access)
   try {
     const me = await api.me();
     state.user = me && me.user ? me.user : null;
+    state.projectsRequired = !!(me && me.projects_required);
     if (!state.user) { location.href = '/web/login.html'; return; }
+    renderOrgSelect(me.orgs || [], me.org);
     // Apply per-user language preference if provided by server
     try{
       if(window.i18n && state.user && state.user.lang){
@@ -246,9 +286,52 @@ async function init(){
     state.user = null; updateUserBar(); location.href = '/web/login.html'; return;
   }
   await refreshBoards(); bindUI(); setupContextMenu();
+  if(await acceptPendingInvite()) return;
   if(state.boards.length) openBoard(state.boards[0].id);
 }
 
+// renderOrgSelect shows the organization switcher when the user belongs to more than one;
+// switching stores the choice server-side (cookie) and reloads the app.
+function renderOrgSelect(orgs, active){
+  const sel = document.getElementById('orgSelect');
+  if(!sel) return;
+  sel.hidden = orgs.length < 2;
+  sel.innerHTML = '';
+  for(const o of orgs){ const opt = document.createElement('option'); opt.value = String(o.id); opt.textContent = o.name; sel.appendChild(opt); }
+  if(active) sel.value = String(active.id);
+  sel.onchange = async () => {
+    try{ await api.setActiveOrg(Number(sel.value)); location.reload(); }
+    catch(e){ alert(e && e.message ? e.message : String(e)); if(active) sel.value = String(active.id); }
+  };
+}
+
+// fillProjectSelect fills the new-board project picker; "(no project)" is offered
+// only when the server doesn't require boards to live in a project.
+function fillProjectSelect(sel, items){
+  sel.innerHTML = '';
+  if(!state.projectsRequired){
+    const opt0 = document.createElement('option'); opt0.value = '';
+    opt0.textContent = (typeof t==='function'? t('app.dialogs.board_new.no_project') : '(без проекта)');
+    sel.appendChild(opt0);
+  }
+  for(const p of (items||[])){ const o = document.createElement('option'); o.value = String(p.id); o.textContent = p.name; sel.appendChild(o); }
+}
+
+// acceptPendingInvite accepts an invitation saved by init; returns true when it opened a board.
+async function acceptPendingInvite(){
+  let token = null;
+  try{ token = localStorage.getItem('pendingInvite'); localStorage.removeItem('pendingInvite'); }catch{}
+  if(!token) return false;
+  try {
+    const res = await api.acceptInvite(token);
+    await refreshBoards();
+    if(res && res.kind === 'board' && state.boards.some(b => b.id === res.target_id)){ openBoard(res.target_id); return true; }
+  } catch(err){
+    alert(typeof t==='function'? t('app.invites.failed', {msg: err.message}) : ('Не удалось принять приглашение: ' + err.message));
+  }
+  return false;
+}
+
 function bindUI(){
   const btnLogout = document.getElementById('btnLogout');
   if(btnLogout){ btnLogout.addEventListener('click', async () => { try { await api.logout(); location.href = '/web/login.html'; } catch(e){ alert((typeof t==='function'? t('app.errors.cant_save',{msg:e.message}) : ('Не удалось выйти: '+e.message))); } }); }
@@ -273,7 +356,7 @@ function bindUI(){
   els.btnNewBoard.addEventListener('click', async () => {
     els.formBoard.reset();
   // populate projects
-  const sel = document.getElementById('projectSelect'); if(sel){ sel.innerHTML=''; try{ const items = await api.listProjects(); const opt0=document.createElement('option'); opt0.value=''; opt0.textContent=(typeof t==='function'? t('app.dialogs.board_new.no_project') : '(без проекта)'); sel.appendChild(opt0); for(const p of (items||[])){ const o=document.createElement('option'); o.value=String(p.id); o.textContent=p.name; sel.appendChild(o);} } catch{} }
+  const sel = document.getElementById('projectSelect'); if(sel){ try{ fillProjectSelect(sel, await api.listProjects()); } catch{} }
     els.dlgBoard.returnValue=''; els.dlgBoard.showModal();
   });
   els.dlgBoard.addEventListener('close', async () => {
@@ -281,8 +364,10 @@ function bindUI(){
       const fd = new FormData(els.formBoard);
       const title = (fd.get('title')||'').toString().trim(); if(!title) return;
       const project_id = parseInt((fd.get('project_id')||'').toString(), 10) || 0;
-      const b = await fetchJSON('/api/boards', {method:'POST', body:{ title, project_id }});
-      await refreshBoards(); openBoard(b.id);
+      try {
+        const b = await fetchJSON('/api/boards', {method:'POST', body:{ title, project_id }});
+        await refreshBoards(); openBoard(b.id);
+      } catch(err){ alert(typeof t==='function'? t('app.errors.cant_save',{msg: err.message}) : ('Не удалось создать доску: ' + err.message)); }
     } else { els.formBoard.reset(); }
   });
   // Cancel buttons should behave like Esc (no validation)
@@ -290,7 +375,7 @@ function bindUI(){
   const btnNewProject = document.getElementById('btnNewProject');
   if(btnNewProject){ btnNewProject.addEventListener('click', async () => {
   const name = await inputDialog({ title:(typeof t==='function'? t('app.dialogs.board_new.new_project') : 'Новый проект…'), label:(typeof t==='function'? t('app.dialogs.board_new.name') : 'Название') }); if(!name) return;
-  try { await api.createProject(name.trim()); const sel=document.getElementById('projectSelect'); if(sel){ const items = await api.listProjects(); sel.innerHTML=''; const opt0=document.createElement('option'); opt0.value=''; opt0.textContent=(typeof t==='function'? t('app.dialogs.board_new.no_project') : '(без проекта)'); sel.appendChild(opt0); for(const p of (items||[])){ const o=document.createElement('option'); o.value=String(p.id); o.textContent=p.name; sel.appendChild(o);} sel.selectedIndex = 1; } }
+  try { const p = await api.createProject(name.trim()); const sel=document.getElementById('projectSelect'); if(sel){ fillProjectSelect(sel, await api.listProjects()); sel.value = String(p.id); } }
   catch(err){ alert(typeof t==='function'? t('app.errors.cant_save',{msg: err.message}) : ('Не удалось создать проект: ' + err.message)); }
   }); }
 
@@ -384,8 +469,7 @@ function bindUI(){
     btnBoardGroups.addEventListener('click', async () => {
       if(!state.currentBoardId) return;
       // Only board owner may manage access
-      const board = state.boards.find(b => b.id === state.currentBoardId);
-      if(!(state.user && board && board.created_by && state.user.id === board.created_by)){
+      if(state.myRole !== 'owner'){
   alert(typeof t==='function'? t('app.errors.failed') : 'Только владелец доски может управлять доступом.');
         return;
       }
@@ -426,13 +510,119 @@ function bindUI(){
     if(cancelBtn){ cancelBtn.addEventListener('click', () => { dlgGroups.close('cancel'); }); }
   }
 
+  // Board members dialog: direct members with roles, ownership transfer
+  const btnBoardMembers = document.getElementById('btnBoardMembers');
+  const dlgBoardMembers = document.getElementById('dlgBoardMembers');
+  const bmList = document.getElementById('bmList');
+  const bmStatus = document.getElementById('bmStatus');
+  if(btnBoardMembers && dlgBoardMembers && bmList){
+    const tr = (k, fb, p) => (typeof t==='function'? t(k, p) : fb);
+    const roleName = (r) => tr('app.roles.' + r, r);
+    async function loadBoardMembers(){
+      const id = state.currentBoardId; if(!id) return;
+      bmList.textContent = tr('profile.loading', 'Загрузка...');
+      try {
+        const members = await api.boardMembers(id);
+        const myRank = ROLE_RANK[state.myRole] ?? -1;
+        bmList.innerHTML = '';
+        for(const m of members||[]){
+          const row = document.createElement('div'); row.className = 'group-row';
+          const name = m.name || m.email;
+          row.innerHTML = `<span>${escapeHTML(name)} <small class="muted">${escapeHTML(m.email||'')}</small></span>`;
+          const rank = m.role;
+          const self = state.user && state.user.id === m.id;
+          if(m.direct && rank < 3 && rank <= myRank && !self){
+            const sel = document.createElement('select');
+            for(const [r, v] of Object.entries(ROLE_RANK)){ if(v > 2 || v > myRank) continue; const o = document.createElement('option'); o.value = v; o.textContent = roleName(r); o.selected = v === rank; sel.appendChild(o); }
+            sel.addEventListener('change', async () => { try { await api.updateBoardMember(id, m.id, parseInt(sel.value, 10)); } catch(err){ bmStatus.textContent = err.message; } });
+            row.appendChild(sel);
+          } else {
+            const role = Object.keys(ROLE_RANK).find(k => ROLE_RANK[k] === rank) || '';
+            const lbl = document.createElement('span'); lbl.className = 'muted';
+            lbl.textContent = roleName(role) + (m.direct ? '' : ' · ' + accessSourceLabel(m.sources, tr));
+            row.appendChild(lbl);
+          }
+          if(m.direct && (self || (rank <= myRank && myRank >= 2))){
+            const rm = document.createElement('button'); rm.type = 'button'; rm.className = 'btn'; rm.textContent = tr('app.dialogs.board_members.remove', 'Убрать');
+            rm.addEventListener('click', async () => { try { await api.removeBoardMember(id, m.id); await loadBoardMembers(); } catch(err){ bmStatus.textContent = err.message; } });
+            row.appendChild(rm);
+          }
+          if(myRank >= 3 && rank < 3 && !self){
+            const own = document.createElement('button'); own.type = 'button'; own.className = 'btn'; own.textContent = tr('app.dialogs.board_members.make_owner', 'Сделать владельцем');
+            own.addEventListener('click', async () => {
+              if(!await confirmDialog(tr('app.dialogs.board_members.confirm_transfer', 'Передать доску?', {name}))) return;
+              try { await api.transferBoard(id, m.id); dlgBoardMembers.close(); await refreshBoards(); await openBoard(id); } catch(err){ bmStatus.textContent = err.message; }
+            });
+            row.appendChild(own);
+          }
+          bmList.appendChild(row);
+        }
+        if(myRank >= 2){
+          const invites = await api.listInvites('board', id).catch(() => []);
+          for(const it of invites||[]){
+            const inv = it.invite; const rn = Object.keys(ROLE_RANK).find(k => ROLE_RANK[k] === inv.role) || '';
+            const row = document.createElement('div'); row.className = 'group-row invite-row';
+            const label = inv.email ? inv.email : tr('app.dialogs.board_members.invite_link', 'Ссылка-приглашение');
+            row.innerHTML = `<span>${escapeHTML(label)} <small class="muted">${escapeHTML(roleName(rn))} · ${escapeHTML(tr('app.dialogs.board_members.pending', 'ожидает'))}</small></span>`;
+            const rv = document.createElement('button'); rv.type = 'button'; rv.className = 'btn'; rv.textContent = tr('app.dialogs.board_members.revoke', 'Отозвать');
+            rv.addEventListener('click', async () => { try { await api.revokeInvite(inv.id); await loadBoardMembers(); } catch(err){ bmStatus.textContent = err.message; } });
+            row.appendChild(rv);
+            bmList.appendChild(row);
+          }
+        }
+      } catch(err){ bmList.textContent = err.message; }
+    }
+    btnBoardMembers.addEventListener('click', async () => {
+      if(!state.currentBoardId) return;
+      bmStatus.textContent = ''; const canInvite = (ROLE_RANK[state.myRole] ?? -1) >= 2 && !state.user?.is_guest; dlgBoardMembers.querySelector('.field').hidden = !canInvite; document.getElementById('bmGuestRow').hidden = !canInvite; dlgBoardMembers.showModal();
+      await loadBoardMembers();
+    });
+    // guest invites: the invitee only ever sees this board, optionally until a date
+    const bmGuest = document.getElementById('bmGuest');
+    const bmGuestExpires = document.getElementById('bmGuestExpires');
+    bmGuest?.addEventListener('change', () => { bmGuestExpires.disabled = !bmGuest.checked; });
+    const guestInvite = () => {
+      if(!bmGuest?.checked) return {};
+      const d = bmGuestExpires.value;
+      return d ? {guest: true, guest_expires_at: new Date(d + 'T23:59:59').toISOString()} : {guest: true};
+    };
+    document.getElementById('bmAdd')?.addEventListener('click', async () => {
+      const email = document.getElementById('bmEmail').value.trim(); if(!email || !state.currentBoardId) return;
+      const role = parseInt(document.getElementById('bmRole').value, 10);
+      if(bmGuest?.checked){
+        try { await api.createInvite({kind:'board', target_id: state.currentBoardId, role, email, ...guestInvite()}); document.getElementById('bmEmail').value = ''; bmStatus.textContent = tr('app.dialogs.board_members.invited', 'Приглашение отправлено'); await loadBoardMembers(); }
+        catch(err){ bmStatus.textContent = err.message; }
+        return;
+      }
+      try { await api.addBoardMember(state.currentBoardId, {email, role}); document.getElementById('bmEmail').value = ''; bmStatus.textContent = tr('app.dialogs.board_members.added', 'Участник добавлен'); await loadBoardMembers(); }
+      catch(err){
+        if(err.message !== 'user not found'){ bmStatus.textContent = err.message; return; }
+        // no account yet: send an email invitation instead
+        try { await api.createInvite({kind:'board', target_id: state.currentBoardId, role, email}); document.getElementById('bmEmail').value = ''; bmStatus.textContent = tr('app.dialogs.board_members.invited', 'Приглашение отправлено'); await loadBoardMembers(); }
+        catch(err2){ bmStatus.textContent = err2.message; }
+      }
+    });
+    document.getElementById('bmInviteLink')?.addEventListener('click', async () => {
+      if(!state.currentBoardId) return;
+      const role = parseInt(document.getElementById('bmRole').value, 10);
+      try {
+        const res = await api.createInvite({kind:'board', target_id: state.currentBoardId, role, ...guestInvite()});
+        try { await navigator.clipboard.writeText(res.url); bmStatus.textContent = tr('app.dialogs.board_members.link_copied', 'Ссылка скопирована'); }
+        catch { bmStatus.textContent = res.url; }
+        await loadBoardMembers();
+      } catch(err){ bmStatus.textContent = err.message; }
+    });
+  }
+
   // Card view dialog
   els.btnCloseCardView.addEventListener('click', () => els.dlgCardView.close());
+  els.dlgCardView.addEventListener('close', () => { stopEditing(); stopCollab(); renderPresence(); });
   els.btnSaveCardView.addEventListener('click', async () => {
     const c = state.currentCard; if(!c) return;
     const payload = {};
     const title = els.cvTitle.value.trim(); if(title && title !== c.title) payload.title = title;
-    const description = els.cvDescription.value.trim(); if(description !== c.description) payload.description = description;
+    // a live description is already saved operation by operation
+    const description = els.cvDescription.value.trim(); if(!collabActive(c.id) && description !== c.description) payload.description = description;
   const isMdToggle = document.getElementById('cvMdToggle');
   if(isMdToggle){ const md = isMdToggle.getAttribute('aria-pressed') === 'true'; if(typeof c.description_is_md === 'boolean'){ if(md !== !!c.description_is_md) payload.description_is_md = md; } else { payload.description_is_md = md; } }
   const dueVal = els.cvDueAt.dataset.iso || '';
@@ -440,11 +630,20 @@ function bindUI(){
   // Assignee (value '0' means clear)
   if(els.cvAssignee){ const v = els.cvAssignee.value || '0'; const cur = c.assignee_id ? String(c.assignee_id) : '0'; if(v !== cur){ payload.assignee_id = Number(v); } }
     if(Object.keys(payload).length===0){ els.dlgCardView.close(); return; }
+    // only save over the version this dialog was opened with; 409 means someone else saved first
+    if(c.version) payload.version = c.version;
     try { await api.updateCardFields(c.id, payload); els.dlgCardView.close(); renderBoard(state.currentBoardId); }
-  catch(err){ alert(typeof t==='function'? t('app.errors.cant_save',{msg: err.message}) : ('Не удалось сохранить карточку: ' + err.message)); }
+  catch(err){
+    if(err.status === 409 && err.body && err.body.current){
+      // keep what the user typed, compare against the newer card and let them save again
+      Object.assign(c, err.body.current);
+      alert(typeof t==='function'? t('app.errors.card_conflict') : 'Карточку уже изменил кто-то другой. Проверьте поля и сохраните ещё раз.');
+      return;
+    }
+    alert(typeof t==='function'? t('app.errors.cant_save',{msg: err.message}) : ('Не удалось сохранить карточку: ' + err.message)); }
   });
   // Live preview on typing
-  if(els.cvDescription){ els.cvDescription.addEventListener('input', () => { renderCvDescriptionPreview(state.currentCard||{}); }); }
+  if(els.cvDescription){ els.cvDescription.addEventListener('input', () => { collabInput(); renderCvDescriptionPreview(state.currentCard||{}); }); }
   els.btnAddComment.addEventListener('click', async () => {
     const c = state.currentCard; if(!c) return;
     const body = els.cvCommentText.value.trim(); if(!body) return;
@@ -669,6 +868,12 @@ function updateUserBar(){
   // Toggle admin visibility in the new user menu
   const btnAdmin = document.getElementById('btnAdmin');
   if(btnAdmin) { btnAdmin.style.display = (state.user && state.user.is_admin) ? 'block' : 'none'; }
+  // guests only see the boards they were invited to: no groups, no projects of their own
+  const guest = !!(state.user && state.user.is_guest);
+  const btnGroupsPanel = document.getElementById('btnGroupsPanel');
+  if(btnGroupsPanel) btnGroupsPanel.hidden = guest;
+  const btnNewProject = document.getElementById('btnNewProject');
+  if(btnNewProject) btnNewProject.hidden = guest;
   // Update avatar letter in topbar
   const avEl = document.querySelector('.topbar .avatar');
   if(avEl){
@@ -1033,12 +1238,27 @@ function pickColor(current){
   });
 }
 
+const ROLE_RANK = { viewer: 0, member: 1, maintainer: 2, owner: 3 };
+
+// accessSourceLabel explains where a role comes from: "owner", "group X", "project Y"...
+function accessSourceLabel(sources, tr){
+  const src = (sources||[])[0]; if(!src) return '';
+  const k = 'app.access.' + src.kind;
+  const p = {group: src.group_name || '', project: src.project_name || ''};
+  const fb = {owner:'владелец', direct:'напрямую', group:'группа {group}', project:'проект {project}', project_group:'группа {group} в проекте {project}'}[src.kind] || src.kind;
+  const text = tr(k, fb, p);
+  return typeof t==='function' ? text : text.replace('{group}', p.group).replace('{project}', p.project);
+}
+
 function updateBoardHeaderActions(){
   const enabled = !!state.currentBoardId;
-  const btns = [document.getElementById('btnBoardGroups'), els.btnRenameBoard, els.btnDeleteBoard, els.btnNewList];
   const board = state.boards.find(b => b.id === state.currentBoardId) || null;
   const isOwner = !!(state.user && board && board.created_by && state.user.id === board.created_by);
-  for(const b of btns){ if(!b) continue; b.disabled = !enabled || (!isOwner && (b.id==='btnBoardGroups' || b===els.btnRenameBoard || b===els.btnDeleteBoard)); }
+  // my_role comes with /full; until it arrives fall back to ownership
+  const rank = ROLE_RANK[state.myRole || (isOwner ? 'owner' : 'member')] ?? -1;
+  // minimum role per button, mirrors the server permission matrix
+  const need = [[document.getElementById('btnBoardGroups'), 3], [document.getElementById('btnBoardMembers'), 0], [els.btnRenameBoard, 2], [els.btnDeleteBoard, 3], [els.btnNewList, 1]];
+  for(const [b, min] of need){ if(!b) continue; b.disabled = !enabled || rank < min; }
 }
 
 function renderBoardsList(){
@@ -1093,7 +1313,7 @@ async function refreshBoards(){
   }
 }
 
-async function openBoard(id){ state.currentBoardId = id; updateBoardHeaderActions(); await renderBoard(id);
+async function openBoard(id){ state.currentBoardId = id; state.myRole = null; updateBoardHeaderActions(); await renderBoard(id);
   [...els.boards.children].forEach(li => li.classList.toggle('active', parseInt(li.dataset.id,10)===id)); }
 
 let sse;
@@ -1104,13 +1324,20 @@ async function renderBoard(id){
     // Preload board members for assignee select and card badges
     try { const members = await api.boardMembers(full.board.id); state.boardMembers.set(full.board.id, members||[]); } catch(e){ console.warn('board members load failed', e.message); }
     els.boardTitle.textContent = full.board.title;
+    state.myRole = full.my_role || null;
+    document.body.classList.toggle('board-readonly', state.myRole === 'viewer');
+    updateBoardHeaderActions();
     state.lists = full.lists || []; state.cards.clear();
     for(const l of state.lists){ state.cards.set(l.id, (full.cards && full.cards[l.id]) || []); }
     renderLists();
     // SSE subscribe
     if(sse) { sse.close(); sse = null; }
-    sse = new EventSource(`/api/boards/${id}/events`);
+    // resume right after the snapshot; on reconnect EventSource sends Last-Event-ID itself
+    sse = new EventSource(`/api/boards/${id}/events?last_event_id=${full.last_event_id || 0}`);
     sse.onmessage = (e) => { try { onEvent(JSON.parse(e.data)); } catch{} };
+    // the server can't replay what was missed (too old): reload the whole board
+    sse.addEventListener('resync', () => { if(state.currentBoardId === id) renderBoard(id); });
+    loadPresence(id);
   } catch(err){ els.boardTitle.textContent = (typeof t==='function'? t('app.board.load_error') : 'Ошибка загрузки'); alert((typeof t==='function'? (t('app.errors.failed')+': ') : 'Ошибка: ') + err.message); }
 }
 
@@ -1187,6 +1414,29 @@ function onEvent(ev){
       } else if(!state.duplicationInProgress){ renderBoard(state.currentBoardId); }
       break;
     }
+    case 'presence.joined': {
+      const p = ev.payload; if(!p) return;
+      if(!state.presence.has(p.user_id)) state.presence.set(p.user_id, {user_id: p.user_id, name: p.name});
+      renderPresence();
+      break;
+    }
+    case 'presence.left': {
+      state.presence.delete(ev.payload?.user_id); renderPresence();
+      break;
+    }
+    case 'card.doc_op': {
+      collabEvent(ev.payload);
+      break;
+    }
+    case 'card.editing':
+    case 'card.stopped': {
+      const p = ev.payload; if(!p) return;
+      const u = state.presence.get(p.user_id) || {user_id: p.user_id, name: p.name};
+      if(ev.type === 'card.editing'){ u.editing_card_id = p.card_id; if(p.name) u.name = p.name; state.presence.set(p.user_id, u); }
+      else if(u.editing_card_id === p.card_id){ delete u.editing_card_id; }
+      renderPresence();
+      break;
+    }
     case 'comment.created': {
       if(!state.duplicationInProgress){ renderBoard(state.currentBoardId); }
       break;
@@ -1195,6 +1445,14 @@ function onEvent(ev){
       refreshBoards();
       break;
     }
+    case 'board.deleted':
+    case 'access.revoked': {
+      // the board is gone for us: the server closes the stream, open another board
+      if(sse) { sse.close(); sse = null; }
+      state.currentBoardId = null;
+      refreshBoards();
+      break;
+    }
   }
 }
 
@@ -1291,7 +1549,7 @@ function setCardCollapsed(id, val){
 
 function renderCard(c){
   const el = document.createElement('article');
-  el.className = 'card'; el.draggable = true; el.dataset.id = c.id;
+  el.className = 'card'; el.draggable = state.myRole !== 'viewer'; el.dataset.id = c.id;
   // Assignee badge (if known)
   let assigneeHTML = '';
   if(c.assignee_id && state.currentBoardId && state.boardMembers.has(state.currentBoardId)){
@@ -1342,6 +1600,217 @@ function renderCard(c){
   return el;
 }
 
+// Presence: who has the board open and who is editing which card
+async function loadPresence(boardId){
+  try {
+    const list = await api.boardPresence(boardId);
+    if(state.currentBoardId !== boardId) return;
+    state.presence = new Map((list || []).map(p => [p.user_id, p]));
+  } catch { state.presence = new Map(); }
+  renderPresence();
+}
+
+function renderPresence(){
+  const box = document.getElementById('boardPresence'); if(!box) return;
+  box.innerHTML = '';
+  for(const p of state.presence.values()){
+    const av = document.createElement('span');
+    av.className = 'avatar presence-avatar' + (p.editing_card_id ? ' editing' : '');
+    av.textContent = ((p.name || '').trim().charAt(0) || '?').toUpperCase();
+    av.title = p.name || '';
+    box.appendChild(av);
+  }
+  // warn in the open card when someone else edits it too
+  const note = document.getElementById('cvEditing');
+  const c = state.currentCard;
+  if(note){
+    const others = c && els.dlgCardView.open ? [...state.presence.values()].filter(p => p.editing_card_id === c.id && !(state.user && p.user_id === state.user.id)) : [];
+    note.hidden = others.length === 0;
+    const names = others.map(p => p.name).join(', ');
+    note.textContent = !others.length ? '' : (typeof t==='function' ? t('app.dialogs.card.also_editing', {names}) : ('Сейчас редактирует: ' + names));
+  }
+}
+
+// while the card dialog is open the server is told every 30s (the mark lapses after a minute)
+let editingTimer = null;
+function startEditing(cardId){
+  stopEditing();
+  const ping = () => api.setCardEditing(cardId, true).catch(() => {});
+  ping();
+  editingTimer = { cardId, id: setInterval(ping, 30000) };
+}
+function stopEditing(){
+  if(!editingTimer) return;
+  clearInterval(editingTimer.id);
+  api.setCardEditing(editingTimer.cardId, false).catch(() => {});
+  editingTimer = null;
+}
+
+// Collaborative description: the textarea's changes go to the server as ot.js-style
+// operations on the revision we have (positions in UTF-16 units, like JS strings);
+// others' operations come back as card.doc_op events and are merged in. One operation
+// is in flight at a time, typing meanwhile is composed into the next one.
+const ot = {
+  retain(op, n){ if(n <= 0) return; const l = op[op.length-1]; if(typeof l === 'number' && l > 0) op[op.length-1] += n; else op.push(n); },
+  del(op, n){ if(n <= 0) return; const l = op[op.length-1]; if(typeof l === 'number' && l < 0) op[op.length-1] -= n; else op.push(-n); },
+  ins(op, s){
+    if(!s) return; const k = op.length, l = op[k-1];
+    if(typeof l === 'string') op[k-1] += s;
+    else if(typeof l === 'number' && l < 0){ if(typeof op[k-2] === 'string') op[k-2] += s; else { op[k] = l; op[k-1] = s; } }
+    else op.push(s);
+  },
+  apply(op, doc){
+    let i = 0, out = '';
+    for(const c of op){ if(typeof c === 'string') out += c; else if(c > 0){ out += doc.slice(i, i+c); i += c; } else i -= c; }
+    return out;
+  },
+  rest(c, n){ return typeof c === 'string' ? c.slice(n) : (c > 0 ? c - n : c + n); },
+  len(c){ return typeof c === 'string' ? c.length : Math.abs(c); },
+  // a and b were made on the same text; returns [a', b'] with apply(b', apply(a)) === apply(a', apply(b))
+  transform(a, b){
+    const a2 = [], b2 = []; let i = 0, j = 0, x = a[i++], y = b[j++];
+    while(x !== undefined || y !== undefined){
+      if(typeof x === 'string'){ ot.ins(a2, x); ot.retain(b2, x.length); x = a[i++]; continue; }
+      if(typeof y === 'string'){ ot.retain(a2, y.length); ot.ins(b2, y); y = b[j++]; continue; }
+      if(x === undefined || y === undefined) throw new Error('operation length mismatch');
+      const n = Math.min(ot.len(x), ot.len(y));
+      if(x > 0 && y > 0){ ot.retain(a2, n); ot.retain(b2, n); }
+      else if(x < 0 && y > 0) ot.del(a2, n);
+      else if(x > 0 && y < 0) ot.del(b2, n);
+      x = ot.len(x) === n ? a[i++] : ot.rest(x, n);
+      y = ot.len(y) === n ? b[j++] : ot.rest(y, n);
+    }
+    return [a2, b2];
+  },
+  // a then b as one operation
+  compose(a, b){
+    const out = []; let i = 0, j = 0, x = a[i++], y = b[j++];
+    while(x !== undefined || y !== undefined){
+      if(typeof x === 'number' && x < 0){ ot.del(out, -x); x = a[i++]; continue; }
+      if(typeof y === 'string'){ ot.ins(out, y); y = b[j++]; continue; }
+      if(x === undefined || y === undefined) throw new Error('operation length mismatch');
+      const n = Math.min(ot.len(x), ot.len(y));
+      if(typeof x === 'string'){ if(y > 0) ot.ins(out, x.slice(0, n)); }
+      else if(y > 0) ot.retain(out, n); else ot.del(out, n);
+      x = ot.len(x) === n ? a[i++] : ot.rest(x, n);
+      y = ot.len(y) === n ? b[j++] : ot.rest(y, n);
+    }
+    return out;
+  },
+  // one change around the common prefix and suffix
+  diff(from, to){
+    let p = 0; while(p < from.length && p < to.length && from[p] === to[p]) p++;
+    let s = 0; while(s < from.length-p && s < to.length-p && from[from.length-1-s] === to[to.length-1-s]) s++;
+    const op = []; ot.retain(op, p); ot.ins(op, to.slice(p, to.length-s)); ot.del(op, from.length-p-s); ot.retain(op, s);
+    return op;
+  },
+  // where a caret at idx ends up after op
+  index(op, idx){
+    let pos = 0, out = idx;
+    for(const c of op){
+      if(pos > idx) break;
+      if(typeof c === 'string') out += c.length;
+      else if(c > 0) pos += c;
+      else { out -= Math.min(-c, idx - pos); pos -= c; }
+    }
+    return out;
+  },
+};
+
+const collab = { cardId: null, rev: 0, text: '', outstanding: null, buffer: null, ready: false, catchingUp: false, closing: false,
+  clientId: Math.random().toString(36).slice(2) + Date.now().toString(36) };
+
+async function startCollab(c){
+  Object.assign(collab, { cardId: c.id, rev: 0, text: '', outstanding: null, buffer: null, ready: false, catchingUp: false, closing: false });
+  try {
+    const doc = await api.cardDoc(c.id);
+    if(collab.cardId !== c.id) return;
+    collab.rev = doc.rev; collab.text = doc.text || '';
+    // keep anything typed before the document arrived as a first operation
+    const typed = els.cvDescription.value;
+    els.cvDescription.value = collab.text;
+    collab.ready = true;
+    if(typed !== (c.description || '') && typed !== collab.text){ els.cvDescription.value = typed; collabInput(); }
+    renderCvDescriptionPreview(c);
+  } catch(err){ console.warn('collaborative editing unavailable', err.message); collab.cardId = null; }
+}
+
+function stopCollab(){
+  if(!collab.cardId) return;
+  const c = state.currentCard; if(c && c.id === collab.cardId && collab.ready) c.description = collab.text;
+  // unsent typing still goes out; the session ends with its acknowledgement
+  if(collab.outstanding){ collab.closing = true; return; }
+  collab.cardId = null; collab.ready = false;
+}
+
+function collabActive(cardId){ return collab.ready && !collab.closing && collab.cardId === cardId; }
+
+function collabInput(){
+  if(!collab.ready || collab.closing) return;
+  const text = els.cvDescription.value;
+  if(text === collab.text) return;
+  const op = ot.diff(collab.text, text); collab.text = text;
+  if(collab.outstanding) collab.buffer = collab.buffer ? ot.compose(collab.buffer, op) : op;
+  else { collab.outstanding = op; collabSend(); }
+}
+
+async function collabSend(){
+  const cardId = collab.cardId, sent = collab.outstanding;
+  try {
+    await api.cardDocOp(cardId, { rev: collab.rev, op: sent, client_id: collab.clientId });
+    // the acknowledgement comes with the event stream; if that is down, fetch it
+    setTimeout(() => { if(collab.cardId === cardId && collab.outstanding === sent) collabCatchUp(); }, 3000);
+  }
+  catch(err){
+    if(collab.cardId !== cardId) return;
+    console.warn('description operation failed', err.message);
+    // out of sync (or no longer allowed): start over from the server's text
+    const c = state.currentCard; collab.cardId = null; collab.ready = false;
+    if(c && c.id === cardId && els.dlgCardView.open) startCollab(c);
+  }
+}
+
+function collabEvent(p){
+  if(!p || p.card_id !== collab.cardId || !collab.ready || p.rev <= collab.rev) return;
+  if(p.rev > collab.rev + 1){ collabCatchUp(); return; }
+  collabApply(p);
+}
+
+// events can be skipped (e.g. the board reloaded in between); fetch the missing operations
+async function collabCatchUp(){
+  if(collab.catchingUp) return;
+  collab.catchingUp = true;
+  const cardId = collab.cardId;
+  try {
+    const doc = await api.cardDoc(cardId, collab.rev);
+    for(const o of doc.ops || []) if(collab.cardId === cardId && o.rev === collab.rev + 1) collabApply(o);
+  } catch(err){
+    const c = state.currentCard; collab.cardId = null; collab.ready = false;
+    if(c && c.id === cardId && els.dlgCardView.open) startCollab(c);
+  } finally { collab.catchingUp = false; }
+}
+
+function collabApply(o){
+  collab.rev = o.rev;
+  if(o.client_id === collab.clientId && collab.outstanding){
+    // our own operation: the acknowledgement
+    collab.outstanding = collab.buffer; collab.buffer = null;
+    if(collab.outstanding) collabSend();
+    else if(collab.closing){ collab.cardId = null; collab.ready = false; }
+    return;
+  }
+  let op = o.op;
+  if(collab.outstanding) [collab.outstanding, op] = ot.transform(collab.outstanding, op);
+  if(collab.buffer) [collab.buffer, op] = ot.transform(collab.buffer, op);
+  collab.text = ot.apply(op, collab.text);
+  if(collab.closing || !els.dlgCardView.open) return;
+  const ta = els.cvDescription;
+  const start = ot.index(op, ta.selectionStart), end = ot.index(op, ta.selectionEnd);
+  ta.value = collab.text;
+  if(document.activeElement === ta) ta.setSelectionRange(start, end);
+  renderCvDescriptionPreview(state.currentCard || {});
+}
+
 async function openCard(c){
   state.currentCard = c;
   // Assignee select
@@ -1359,6 +1828,9 @@ async function openCard(c){
   // Открываем диалог сразу, чтобы сбой загрузки комментариев не блокировал редактирование
   els.cvComments.innerHTML = '';
   els.dlgCardView.showModal();
+  if(state.myRole !== 'viewer') startEditing(c.id);
+  startCollab(c);
+  renderPresence();
   try {
     await loadComments(c.id);
   } catch(err){